@@ -3,47 +3,131 @@ package client
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/bazelbuild/remote-apis-sdks/go/digest"
 	log "github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
 	bspb "google.golang.org/genproto/googleapis/bytestream"
+	errdetails "google.golang.org/genproto/googleapis/rpc/errdetails"
 )
 
 // WriteBytes uploads a byte slice.
 func (c *Client) WriteBytes(ctx context.Context, name string, data []byte) error {
+	return c.writeChunked(ctx, name, data)
+}
+
+// WriteBytesFromReader uploads exactly size bytes read from r to the named resource, without holding
+// them in memory: they are sent in chunks of at most the client's ChunkMaxSize, the last of which
+// finishes the write. If r ends early or has more than size bytes, the write is abandoned before it
+// is finished. Failed uploads are retried only if r is an io.Seeker, resuming from the data the
+// server committed.
+func (c *Client) WriteBytesFromReader(ctx context.Context, name string, r io.Reader, size int64) error {
+	return c.writeReader(ctx, name, size, "", r)
+}
+
+// writeChunked uploads data to the named resource with writeStream, in chunks that are slices of
+// data, so that it is not copied. Any extra call options are passed to the Write calls.
+func (c *Client) writeChunked(ctx context.Context, name string, data []byte, extra ...grpc.CallOption) error {
+	return c.writeStream(ctx, name, int64(len(data)), &bytesSource{data: data}, true, extra...)
+}
+
+// writeSource provides the data of a write to writeStream.
+type writeSource interface {
+	// rewind prepares the source for an attempt that starts at offset.
+	rewind(offset int64) error
+	// next returns the next n bytes of the data.
+	next(n int64) ([]byte, error)
+	// check is called before the write is finished, so that a write of bad data can be abandoned
+	// before the server commits it.
+	check() error
+}
+
+// bytesSource is a writeSource of a byte slice.
+type bytesSource struct {
+	data   []byte
+	offset int64
+}
+
+func (s *bytesSource) rewind(offset int64) error {
+	s.offset = offset
+	return nil
+}
+
+func (s *bytesSource) next(n int64) ([]byte, error) {
+	chunk := s.data[s.offset : s.offset+n]
+	s.offset += n
+	return chunk, nil
+}
+
+func (s *bytesSource) check() error {
+	return nil
+}
+
+// writeStream uploads size bytes from src to the named resource, in chunks of at most the client's
+// ChunkMaxSize. If a stream fails after sending data, the retry asks the server with
+// QueryWriteStatus how much of the data it committed, and resumes the upload from there rather than
+// from the start. If the server can't tell, the upload starts over. Failed uploads are only retried
+// if retriable is true. Any extra call options are passed to the Write calls.
+func (c *Client) writeStream(ctx context.Context, name string, size int64, src writeSource, retriable bool, extra ...grpc.CallOption) error {
+	chunkSize := int64(c.chunkMaxSize)
 	cancelCtx, cancel := context.WithCancel(ctx)
-	opts := c.rpcOpts()
+	opts := append(c.rpcOpts(), extra...)
 	defer cancel()
+	defer c.pollCommitted(cancelCtx, name, size)()
+	sent := false // Whether a previous attempt sent any data.
 	closure := func() error {
+		var offset int64
+		if sent {
+			var done bool
+			offset, done = c.committedSize(cancelCtx, name, size)
+			if done {
+				return nil
+			}
+			log.V(2).Infof("Resuming write of %s at offset %d", name, offset)
+		}
+		if err := src.rewind(offset); err != nil {
+			return err
+		}
 		// Use lower-level Write in order to not retry twice.
 		stream, err := c.byteStream.Write(cancelCtx, opts...)
 		if err != nil {
 			return err
 		}
-		var offset int64
-		arr := data // Save a local copy that gets altered in the loop.
-		first := true
-		for len(arr) > 0 || first { // Iterate at least once, so we can upload 0-sized data.
-			first = false
-			req := &bspb.WriteRequest{ResourceName: name}
-			if offset > 0 {
-				req.ResourceName = ""
-			}
-			req.WriteOffset = offset
-			chunkSize := int64(c.chunkMaxSize)
-			dataLen := int64(len(arr))
-			if chunkSize > dataLen {
-				chunkSize = dataLen
-			}
-			req.Data = arr[:chunkSize]
-			arr = arr[chunkSize:]
-			if len(arr) == 0 {
+		for first := true; offset < size || first; first = false { // Iterate at least once, so we can upload 0-sized data.
+			n := size - offset
+			if n > chunkSize {
+				n = chunkSize
+			}
+			chunk, err := src.next(n)
+			if err != nil {
+				return err
+			}
+			// The first request of every stream names the resource, including resumed ones.
+			req := &bspb.WriteRequest{WriteOffset: offset, Data: chunk}
+			if first {
+				req.ResourceName = name
+			}
+			offset += n
+			if offset == size {
+				if err := src.check(); err != nil {
+					return err
+				}
 				req.FinishWrite = true
 			}
 			log.V(3).Infof("Sending: resource:%s offset:%d len(data):%d", req.ResourceName, req.WriteOffset, len(req.Data))
-			err := stream.Send(req)
+			err = stream.Send(req)
 			if err == io.EOF {
 				break
 			}
@@ -51,23 +135,174 @@ func (c *Client) WriteBytes(ctx context.Context, name string, data []byte) error
 				log.Error("after regular stream send: ", err)
 				return err
 			}
-			offset += chunkSize
+			sent = sent || n > 0
 		}
 		if _, err := stream.CloseAndRecv(); err != nil {
 			return err
 		}
 		return nil
 	}
+	if !retriable {
+		return closure()
+	}
 	return c.retrier.do(cancelCtx, closure)
 }
 
+// committedSize asks the server how many bytes of an interrupted write of size bytes to the named
+// resource it committed, and whether the write is complete. It returns 0 if the server doesn't know,
+// so that the write starts over.
+func (c *Client) committedSize(ctx context.Context, name string, size int64) (int64, bool) {
+	var resp *bspb.QueryWriteStatusResponse
+	// Use lower-level QueryWriteStatus in order to not retry within a retry.
+	err := c.callWithTimeout(ctx, func(ctx context.Context) (e error) {
+		resp, e = c.byteStream.QueryWriteStatus(ctx, &bspb.QueryWriteStatusRequest{ResourceName: name}, c.rpcOpts()...)
+		return e
+	})
+	if err != nil {
+		log.V(2).Infof("Failed to query the status of the write of %s, restarting it: %v", name, err)
+		return 0, false
+	}
+	if resp.Complete {
+		return size, true
+	}
+	if resp.CommittedSize < 0 || resp.CommittedSize > size {
+		return 0, false
+	}
+	return resp.CommittedSize, false
+}
+
+// pollCommitted reports the progress of a write of size bytes to the named resource to the client's
+// CommitProgress callback, polling the server with QueryWriteStatus until the returned function is
+// called. It does nothing if the client has no CommitProgress callback.
+func (c *Client) pollCommitted(ctx context.Context, name string, size int64) (stop func()) {
+	p := c.commitPoll
+	if p.OnCommit == nil || p.Interval <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := safely(func() error {
+			t := time.NewTicker(p.Interval)
+			defer t.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-t.C:
+				}
+				var resp *bspb.QueryWriteStatusResponse
+				err := c.callWithTimeout(ctx, func(ctx context.Context) (e error) {
+					resp, e = c.byteStream.QueryWriteStatus(ctx, &bspb.QueryWriteStatusRequest{ResourceName: name}, c.rpcOpts()...)
+					return e
+				})
+				if err != nil {
+					// The server may not know the resource until it received the first chunk.
+					log.V(2).Infof("Failed to query the status of the write of %s: %v", name, err)
+					continue
+				}
+				committed := resp.CommittedSize
+				if resp.Complete {
+					committed = size
+				}
+				p.OnCommit(name, committed, size)
+			}
+		})()
+		if err != nil {
+			log.Errorf("Polling the status of the write of %s failed: %v", name, err)
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// writeReader uploads exactly size bytes read from r to the named resource with writeStream. The
+// data is hashed as it is streamed; if r ends early, has extra bytes, or its contents don't match
+// hash (unless hash is empty), the upload is abandoned before it is finished, so that the server
+// doesn't store the blob. Failed uploads are retried only if r is an io.Seeker, by rewinding it to
+// its initial position: the part of the input that the server committed is read again to check its
+// hash, but not sent again.
+func (c *Client) writeReader(ctx context.Context, name string, size int64, hash string, r io.Reader) error {
+	src := &readerSource{r: r, size: size, hash: hash, fn: c.digestFn}
+	canSeek := false
+	if seeker, ok := r.(io.Seeker); ok {
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			src.seeker, src.start, canSeek = seeker, start, true
+		}
+	}
+	return c.writeStream(ctx, name, size, src, canSeek)
+}
+
+// readerSource is a writeSource of size bytes read from a reader, which checks their hash. It can
+// only be rewound if it has a seeker, or to the start of the first attempt.
+type readerSource struct {
+	r      io.Reader
+	seeker io.Seeker // The reader as a seeker, if it can seek.
+	start  int64     // The initial position of the seeker.
+	size   int64
+	hash   string
+	fn     *digest.Function // The function that hash is computed with.
+	h      hash.Hash
+	offset int64
+	buf    []byte
+}
+
+func (s *readerSource) rewind(offset int64) error {
+	if s.seeker != nil {
+		if _, err := s.seeker.Seek(s.start, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind input: %v", err)
+		}
+	}
+	s.h = s.fn.NewHash()
+	s.offset = 0
+	if n, err := io.CopyN(s.h, s.r, offset); err == io.EOF {
+		return fmt.Errorf("input ended after %d bytes, but %d were expected", n, s.size)
+	} else if err != nil {
+		// Wrapping the error to ensure it may never get retried.
+		return fmt.Errorf("failed to read from input: %v", err)
+	}
+	s.offset = offset
+	return nil
+}
+
+func (s *readerSource) next(n int64) ([]byte, error) {
+	if int64(len(s.buf)) < n {
+		s.buf = make([]byte, n)
+	}
+	chunk := s.buf[:n]
+	m, err := io.ReadFull(s.r, chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("input ended after %d bytes, but %d were expected", s.offset+int64(m), s.size)
+	}
+	if err != nil {
+		// Wrapping the error to ensure it may never get retried.
+		return nil, fmt.Errorf("failed to read from input: %v", err)
+	}
+	s.h.Write(chunk)
+	s.offset += n
+	return chunk, nil
+}
+
+func (s *readerSource) check() error {
+	if n, _ := s.r.Read(make([]byte, 1)); n > 0 {
+		return fmt.Errorf("input has more than the %d bytes expected", s.size)
+	}
+	if got := hex.EncodeToString(s.h.Sum(nil)); s.hash != "" && got != s.hash {
+		return fmt.Errorf("input has hash %s, but %s was expected", got, s.hash)
+	}
+	return nil
+}
+
 // ReadBytes fetches a resource's contents into a byte slice.
 //
 // ReadBytes panics with ErrTooLarge if an attempt is made to read a resource with contents too
 // large to fit into a byte array.
 func (c *Client) ReadBytes(ctx context.Context, name string) ([]byte, error) {
 	buf := &bytes.Buffer{}
-	_, err := c.readStreamed(ctx, name, 0, 0, buf)
+	_, err := c.readStreamed(ctx, name, 0, 0, -1, buf)
 	return buf.Bytes(), err
 }
 
@@ -78,16 +313,32 @@ func (c *Client) ReadBytes(ctx context.Context, name string) ([]byte, error) {
 //
 // The number of bytes read is returned.
 func (c *Client) ReadResourceToFile(ctx context.Context, name, fpath string) (int64, error) {
-	return c.readToFile(ctx, c.InstanceName+name, fpath)
+	return c.readToFile(ctx, c.resourceName(strings.TrimPrefix(name, "/")), -1, fpath, nil)
 }
 
-func (c *Client) readToFile(ctx context.Context, name string, fpath string) (int64, error) {
+// readToFile reads a resource into a file, as readStreamed does into a Writer. The data is also
+// hashed by v, if it is not nil.
+func (c *Client) readToFile(ctx context.Context, name string, size int64, fpath string, v *readVerifier) (int64, error) {
 	f, err := os.Create(fpath)
 	if err != nil {
 		return 0, err
 	}
 	defer f.Close()
-	return c.readStreamed(ctx, name, 0, 0, f)
+	return c.readStreamed(ctx, name, 0, 0, size, v.tee(f))
+}
+
+// readToSizedFile reads a resource of a known size into a file, like readToFile, but first sizes
+// the file to the size of the resource and then writes the data into it in place.
+func (c *Client) readToSizedFile(ctx context.Context, name string, size int64, fpath string, v *readVerifier) (int64, error) {
+	f, err := os.Create(fpath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return 0, err
+	}
+	return c.readStreamed(ctx, name, 0, 0, size, v.tee(&offsetWriter{w: f}))
 }
 
 // readStreamed reads from a bytestream and copies the result to the provided Writer, starting
@@ -95,16 +346,24 @@ func (c *Client) readToFile(ctx context.Context, name string, fpath string) (int
 // offset must be non-negative, and an error may be returned if the offset is past the end of the
 // stream. The limit must be non-negative, although offset+limit may exceed the length of the
 // stream.
-func (c *Client) readStreamed(ctx context.Context, name string, offset, limit int64, w io.Writer) (n int64, e error) {
+//
+// If size is not negative, it is the number of bytes the read is expected to return. A stream that
+// ends before then is treated as a transient error (Unavailable), so that the retrier, if any,
+// resumes the read from where it stopped, as it does for streams that fail. A Read that fails with
+// a redirect (see ReadRedirectType) is resumed from the resource it names, provided that it names
+// the same blob, so that a faulty server can't substitute other data. Any extra call options are
+// passed to the Read calls.
+func (c *Client) readStreamed(ctx context.Context, name string, offset, limit, size int64, w io.Writer, extra ...grpc.CallOption) (n int64, e error) {
 	cancelCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	closure := func() error {
+	opts := append(c.rpcOpts(), extra...)
+	attempt := func() error {
 		// Use lower-level Read in order to not retry twice.
 		stream, err := c.byteStream.Read(cancelCtx, &bspb.ReadRequest{
 			ResourceName: name,
 			ReadOffset:   offset + n,
 			ReadLimit:    limit,
-		})
+		}, opts...)
 		if err != nil {
 			return err
 		}
@@ -131,12 +390,157 @@ func (c *Client) readStreamed(ctx context.Context, name string, offset, limit in
 			if limit > 0 {
 				limit -= int64(sz)
 				if limit <= 0 {
-					break
+					return nil
 				}
 			}
 		}
+		if size >= 0 && n < size {
+			return status.Errorf(codes.Unavailable, "read of %s ended after %d bytes, but %d were expected", name, n, size)
+		}
 		return nil
 	}
+	redirects := 0
+	closure := func() error {
+		for {
+			err := attempt()
+			target, ok := redirectTarget(err)
+			if !ok {
+				return err
+			}
+			if redirects == maxReadRedirects {
+				return fmt.Errorf("read of %s was redirected more than %d times", name, maxReadRedirects)
+			}
+			if !sameBlob(name, target) {
+				return fmt.Errorf("read of %s was redirected to %s, which doesn't name the same blob", name, target)
+			}
+			redirects++
+			log.V(1).Infof("Read of %s redirected to %s", name, target)
+			name = target
+		}
+	}
 	e = c.retrier.do(cancelCtx, closure)
 	return n, e
 }
+
+// ReadRedirectType is the resource type of the google.rpc.ResourceInfo detail of an error that
+// redirects a ByteStream Read to another resource. A federated CAS may fail a Read with such an
+// error, e.g. to send reads of large blobs to the shard that stores them; the read is then resumed
+// from the resource named by the detail, at the same offset. The resource must name the same blob,
+// e.g. "shard/blobs/<hash>/<size>" for "instance/blobs/<hash>/<size>"; redirects elsewhere fail the
+// read. At most maxReadRedirects redirects are followed per read.
+const ReadRedirectType = "type.googleapis.com/google.bytestream.ReadRedirect"
+
+// maxReadRedirects bounds the redirects followed by a read, so that a redirect loop fails it.
+const maxReadRedirects = 5
+
+// sameBlob reports whether two read resource names both end with the same
+// "blobs/<hash>/<size>", i.e. name the same blob, possibly of different instances.
+func sameBlob(name, other string) bool {
+	blob := func(n string) string {
+		parts := strings.Split(n, "/")
+		if len(parts) < 3 || parts[len(parts)-3] != "blobs" {
+			return ""
+		}
+		return strings.Join(parts[len(parts)-3:], "/")
+	}
+	b := blob(name)
+	return b != "" && b == blob(other)
+}
+
+// redirectTarget returns the resource that an error redirects a read to, if it is a redirect.
+func redirectTarget(err error) (string, bool) {
+	st, ok := status.FromError(err)
+	if !ok || err == nil {
+		return "", false
+	}
+	for _, d := range st.Details() {
+		if ri, ok := d.(*errdetails.ResourceInfo); ok && ri.ResourceType == ReadRedirectType && ri.ResourceName != "" {
+			return ri.ResourceName, true
+		}
+	}
+	return "", false
+}
+
+// errReaderClosed is returned to the producer of a prefetchBuffer whose reader has been closed.
+var errReaderClosed = errors.New("reader was closed")
+
+// prefetchBuffer is a pipe between a goroutine writing a stream and a reader, which lets the
+// writer get ahead of the reader by at most limit bytes; beyond that, writes block until the reader
+// catches up. The writer calls finish when the stream ends, and the reader calls close to stop
+// reading, which makes pending and further writes fail.
+type prefetchBuffer struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	limit  int
+	err    error // The error to return once buf is drained, set by finish.
+	closed bool
+}
+
+func newPrefetchBuffer(limit int) *prefetchBuffer {
+	if limit < 1 {
+		limit = 1
+	}
+	b := &prefetchBuffer{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *prefetchBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		for b.buf.Len() >= b.limit && !b.closed {
+			b.cond.Wait()
+		}
+		if b.closed {
+			return n, errReaderClosed
+		}
+		m := len(p) - n
+		if free := b.limit - b.buf.Len(); m > free {
+			m = free
+		}
+		b.buf.Write(p[n : n+m])
+		n += m
+		b.cond.Broadcast()
+	}
+	return n, nil
+}
+
+func (b *prefetchBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.buf.Len() == 0 && b.err == nil && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return 0, errReaderClosed
+	}
+	if b.buf.Len() == 0 {
+		return 0, b.err
+	}
+	n, _ := b.buf.Read(p)
+	b.cond.Broadcast()
+	return n, nil
+}
+
+// finish records the end of the stream: io.EOF if err is nil, err otherwise.
+func (b *prefetchBuffer) finish(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+	b.cond.Broadcast()
+}
+
+// close stops the reading, and releases the buffered data.
+func (b *prefetchBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.buf = bytes.Buffer{}
+	b.cond.Broadcast()
+}
@@ -3,98 +3,580 @@ package client
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/bazelbuild/remote-apis-sdks/go/digest"
 	log "github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
 	"github.com/pborman/uuid"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
 	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	gerrors "github.com/pkg/errors"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
 )
 
 // WriteBlobs stores a large number of blobs from a digest-to-blob map. It's intended for use on the
 // result of PackageTree. Unlike with the single-item functions, it first queries the CAS to
-// see which blobs are missing and only uploads those that are.
+// see which blobs are missing and only uploads those that are, unless the input is within the
+// client's DirectUploadThreshold. If the client has RetryWholeOperation set, the whole call is
+// retried on retriable errors. The call, including retries, is bounded by the client's
+// OperationTimeout.
 func (c *Client) WriteBlobs(ctx context.Context, blobs map[digest.Key][]byte) error {
-	if c.casConcurrency <= 0 {
-		return fmt.Errorf("CASConcurrency should be at least 1")
+	dgs := make([]*repb.Digest, 0, len(blobs))
+	for k := range blobs {
+		dgs = append(dgs, digest.FromKey(k))
 	}
-	const (
-		logInterval = 25
-	)
+	_, err := c.writeBlobsFunc(ctx, "WriteBlobs", dgs, blobSource{fetch: func(k digest.Key) ([]byte, error) {
+		return blobs[k], nil
+	}})
+	return err
+}
 
-	var dgs []*repb.Digest
+// WriteBlobsFunc stores blobs like WriteBlobs, but gets the contents of each blob from fetch rather
+// than from a map, so that they don't all need to be held in memory at once. The contents of a
+// batch are fetched by the worker uploading it, right before the upload, and are released when it
+// completes, so that at most CASConcurrency batches of MaxBatchSz bytes, plus the single-chunk
+// writes allowed by SmallWriteConcurrency, are held at any time; a blob too large for a batch is
+// held whole while it is uploaded. fetch may be called concurrently, and again for the same blob if
+// the client has RetryWholeOperation set.
+func (c *Client) WriteBlobsFunc(ctx context.Context, dgs []*repb.Digest, fetch func(digest.Key) ([]byte, error)) error {
+	_, err := c.writeBlobsFunc(ctx, "WriteBlobsFunc", dgs, blobSource{fetch: fetch})
+	return err
+}
+
+// WriteBlobsWithStats stores blobs like WriteBlobs, and also returns statistics of the upload: how
+// many blobs and bytes were transferred, with how many batch and ByteStream requests, and how many
+// blobs were skipped because the CAS already had them. With RetryWholeOperation, the statistics are
+// those of the last attempt.
+func (c *Client) WriteBlobsWithStats(ctx context.Context, blobs map[digest.Key][]byte) (*Stats, error) {
+	dgs := make([]*repb.Digest, 0, len(blobs))
 	for k := range blobs {
 		dgs = append(dgs, digest.FromKey(k))
 	}
+	return c.writeBlobsFunc(ctx, "WriteBlobs", dgs, blobSource{fetch: func(k digest.Key) ([]byte, error) {
+		return blobs[k], nil
+	}})
+}
+
+// blobSource provides the contents of the blobs of an upload. fetch returns the contents of a blob in
+// memory. open, if set, is tried first for a blob uploaded alone with a ByteStream write, and returns
+// a reader of its contents, so that the blob is streamed rather than held in memory, or a nil reader
+// to have it fetched instead.
+type blobSource struct {
+	fetch func(digest.Key) ([]byte, error)
+	open  func(digest.Key) (io.ReadCloser, error)
+}
+
+func (c *Client) writeBlobsFunc(ctx context.Context, op string, dgs []*repb.Digest, src blobSource) (stats *Stats, err error) {
+	err = c.withOpTimeout(ctx, op, func(ctx context.Context) error {
+		if c.retryWholeOp {
+			return c.retrier.do(ctx, func() (e error) {
+				stats, e = c.writeBlobs(ctx, dgs, src)
+				return e
+			})
+		}
+		var e error
+		stats, e = c.writeBlobs(ctx, dgs, src)
+		return e
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
 
-	missing, err := c.MissingBlobs(ctx, dgs)
+func (c *Client) writeBlobs(ctx context.Context, dgs []*repb.Digest, src blobSource) (*Stats, error) {
+	cached := &Stats{}
+	plan, err := c.planUpload(ctx, dgs, nil, cached)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	stats, err := c.executeUploadPlan(ctx, plan, src)
+	if err != nil {
+		return nil, err
+	}
+	stats.PresenceCacheHits, stats.PresenceCacheMisses = cached.PresenceCacheHits, cached.PresenceCacheMisses
+	dgs = digest.FilterDuplicates(dgs)
+	for _, dg := range dgs {
+		stats.LogicalBytes += dg.SizeBytes
+	}
+	if hits := len(dgs) - stats.Blobs; hits > 0 {
+		stats.CacheHits = hits
+	}
+	return stats, nil
+}
+
+// UploadPlan is a plan to upload blobs to the CAS, computed by PlanUpload: the blobs that are
+// missing from the CAS, grouped into the batches to upload them in. A batch of a single blob is
+// uploaded with a ByteStream write. A plan doesn't hold any blob contents, and may be encoded (e.g.
+// as JSON) to be executed later, or by another process, with ExecuteUploadPlan.
+type UploadPlan struct {
+	Batches [][]*repb.Digest
+}
+
+// Stats describes the data transferred by a CAS operation.
+type Stats struct {
+	// Blobs is the number of blobs transferred, and Bytes their total size.
+	Blobs int
+	Bytes int64
+	// Requests is the number of batch and ByteStream requests made, not counting retries. Of those,
+	// BatchRequests were batch requests and StreamRequests ByteStream requests.
+	Requests       int
+	BatchRequests  int
+	StreamRequests int
+	// CacheHits is the number of blobs that weren't transferred because the CAS already had them, or
+	// the client remembered uploading them (see RememberUploads), and LogicalBytes is the total size
+	// of all the blobs of the operation, including those. They are only set by WriteBlobsWithStats,
+	// as ExecuteUploadPlan only sees the blobs to upload.
+	CacheHits    int
+	LogicalBytes int64
+	// PresenceCacheHits and PresenceCacheMisses are the numbers of blobs of the operation that were
+	// and were not found in the client's PresenceCache. They are only set by WriteBlobsWithStats and
+	// MissingBlobsWithStats.
+	PresenceCacheHits   int
+	PresenceCacheMisses int
+}
+
+// PlanUpload computes how WriteBlobs would upload the blobs with the given digests, without
+// uploading anything: it queries the CAS for the missing blobs, unless they are within the client's
+// DirectUploadThreshold, and splits them into batches according to the client's options. Blobs the
+// client remembers uploading (see RememberUploads) are left out.
+func (c *Client) PlanUpload(ctx context.Context, dgs []*repb.Digest) (UploadPlan, error) {
+	return c.planUpload(ctx, dgs, nil, nil)
+}
+
+// PlanGroupedUpload computes an upload plan like PlanUpload, but keeps related blobs together in
+// the batches, for servers that benefit from the locality. groups maps the digests of related blobs
+// to the same group key, e.g. the path of the directory the blobs are in. The blobs of a group are
+// put in consecutive batches, and a group that fits in a single batch is not split; blobs with no
+// group are batched by size, as PlanUpload does.
+func (c *Client) PlanGroupedUpload(ctx context.Context, dgs []*repb.Digest, groups map[digest.Key]string) (UploadPlan, error) {
+	return c.planUpload(ctx, dgs, groups, nil)
+}
+
+// planUpload computes an upload plan like PlanUpload, grouping the blobs if groups is not nil. If
+// stats is not nil, the hits and misses of the client's PresenceCache are recorded there.
+func (c *Client) planUpload(ctx context.Context, dgs []*repb.Digest, groups map[digest.Key]string, stats *Stats) (UploadPlan, error) {
+	for _, dg := range dgs {
+		if err := c.checkBlobSize(dg); err != nil {
+			return UploadPlan{}, err
+		}
+	}
+	dgs = c.uploaded.filter(dgs)
+	dgs, hits, misses := c.present.filter(dgs)
+	if stats != nil {
+		stats.PresenceCacheHits, stats.PresenceCacheMisses = hits, misses
+	}
+	var missing []*repb.Digest
+	if c.uploadDirectly(dgs) {
+		log.V(1).Info("skipping the missing blobs check for a small upload")
+		missing = dgs
+	} else {
+		var err error
+		if missing, err = c.queryMissingBlobs(ctx, dgs); err != nil {
+			return UploadPlan{}, err
+		}
 	}
 	log.V(1).Infof("%d blobs to store", len(missing))
 	var batches [][]*repb.Digest
 	if c.useBatchOps {
-		batches = makeBatches(missing)
+		var small []*repb.Digest
+		for _, dg := range missing {
+			if c.streamThresh > 0 && dg.SizeBytes >= int64(c.streamThresh) {
+				batches = append(batches, []*repb.Digest{dg})
+			} else {
+				small = append(small, dg)
+			}
+		}
+		maxSz := c.maxBatchSz(ctx)
+		if groups != nil {
+			batches = append(batches, makeGroupedBatches(small, groups, maxSz)...)
+		} else {
+			batches = append(batches, makeBatches(small, maxSz)...)
+		}
 	} else {
 		log.V(1).Info("uploading them individually")
 		for i := range missing {
 			batches = append(batches, missing[i:i+1])
 		}
 	}
+	return UploadPlan{Batches: batches}, nil
+}
+
+// ExecuteUploadPlan uploads the blobs of a plan computed by PlanUpload, getting the contents of each
+// blob from fetch as it is about to be uploaded. Up to CASConcurrency batches are uploaded at once,
+// plus, with SmallWriteConcurrency, as many single-chunk Write streams; fetch may be called
+// concurrently. The CAS checks that the contents match their digests. If the client has
+// CollectBatchErrors set, the failure of a batch doesn't stop the upload of the others. Once the
+// context's deadline is too close for another batch to plausibly finish, judging by the time the
+// client's previous upload batches took, no more batches are started, and a *BatchesStoppedError,
+// with the DeadlineExceeded code but never retried, says how many were left.
+func (c *Client) ExecuteUploadPlan(ctx context.Context, plan UploadPlan, fetch func(digest.Key) ([]byte, error)) (*Stats, error) {
+	return c.executeUploadPlan(ctx, plan, blobSource{fetch: fetch})
+}
+
+func (c *Client) executeUploadPlan(ctx context.Context, plan UploadPlan, src blobSource) (*Stats, error) {
+	if c.casConcurrency <= 0 {
+		return nil, fmt.Errorf("CASConcurrency should be at least 1")
+	}
+	const (
+		logInterval = 25
+	)
 
+	var total int64
+	var totalBlobs int
+	for _, batch := range plan.Batches {
+		for _, dg := range batch {
+			if err := c.checkBlobSize(dg); err != nil {
+				return nil, err
+			}
+			total += dg.SizeBytes
+		}
+		totalBlobs += len(batch)
+	}
+	progress := newProgressReporter(c.onProgress, total)
+	batchProgress := newBatchProgressReporter(c.onBatch, BatchUpload, totalBlobs, total)
+	stats := &Stats{}
+	var errs BatchErrors
+	var mu sync.Mutex // Protects stats and errs.
+	sched := c.newBatchScheduler("upload", len(plan.Batches))
+	uploadBatch := func(ctx context.Context, batch []*repb.Digest) error {
+		var sz int64
+		for _, dg := range batch {
+			sz += dg.SizeBytes
+		}
+		streamed := false
+		if len(batch) == 1 && src.open != nil {
+			var err error
+			if streamed, err = c.writeOpened(ctx, batch[0], src.open); err != nil {
+				return err
+			}
+		}
+		if !streamed {
+			bchMap := make(map[digest.Key][]byte)
+			for _, dg := range batch {
+				data, err := src.fetch(digest.ToKey(dg))
+				if err != nil {
+					return gerrors.WithMessage(err, fmt.Sprintf("fetching blob %s", digest.ToString(dg)))
+				}
+				if int64(len(data)) != dg.SizeBytes {
+					return fmt.Errorf("fetched %d bytes for blob %s", len(data), digest.ToString(dg))
+				}
+				bchMap[digest.ToKey(dg)] = data
+			}
+			if len(batch) > 1 {
+				log.V(2).Infof("uploading batch of %d blobs", len(batch))
+				if err := c.BatchWriteBlobs(ctx, bchMap); err != nil {
+					return err
+				}
+			} else if len(batch) == 1 {
+				log.V(2).Info("uploading single blob")
+				_, name, err := c.writeResourceName(batch[0])
+				if err != nil {
+					return err
+				}
+				if err := c.WriteBytes(ctx, name, bchMap[digest.ToKey(batch[0])]); err != nil {
+					return err
+				}
+			}
+		}
+		c.uploaded.add(batch)
+		c.present.add(batch)
+		progress.add(sz)
+		batchProgress.add(len(batch), sz)
+		mu.Lock()
+		stats.Blobs += len(batch)
+		stats.Bytes += sz
+		stats.Requests++
+		if len(batch) > 1 {
+			stats.BatchRequests++
+		} else {
+			stats.StreamRequests++
+		}
+		mu.Unlock()
+		return nil
+	}
 	eg, eCtx := errgroup.WithContext(ctx)
-	todo := make(chan []*repb.Digest, c.casConcurrency)
-	for i := 0; i < int(c.casConcurrency) && i < len(batches); i++ {
+	// upload uploads batches with the given number of workers, as part of eg.
+	upload := func(batches [][]*repb.Digest, workers int) {
 		eg.Go(func() error {
-			for batch := range todo {
-				if len(batch) > 1 {
-					log.V(2).Infof("uploading batch of %d blobs", len(batch))
-					bchMap := make(map[digest.Key][]byte)
-					for _, dg := range batch {
-						bchMap[digest.ToKey(dg)] = blobs[digest.ToKey(dg)]
-					}
-					if err := c.BatchWriteBlobs(eCtx, bchMap); err != nil {
-						return err
-					}
-				} else {
-					log.V(2).Info("uploading single blob")
-					if _, err := c.WriteBlob(eCtx, blobs[digest.ToKey(batch[0])]); err != nil {
-						return err
-					}
+			return forEachConcurrently(eCtx, len(batches), workers, func(ctx context.Context, i int) error {
+				if left := len(batches) - i - 1; left > 0 && left%logInterval == 0 {
+					log.V(1).Infof("%d batches left to store", left)
 				}
-				if eCtx.Err() != nil {
-					return eCtx.Err()
+				if !sched.start(ctx) {
+					return nil
 				}
-			}
-			return nil
+				start := time.Now()
+				err := uploadBatch(ctx, batches[i])
+				sched.done(time.Since(start))
+				if err != nil && c.collectErrs {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+					return nil
+				}
+				return err
+			})
 		})
 	}
 
-	for len(batches) > 0 {
-		select {
-		case todo <- batches[0]:
-			batches = batches[1:]
-			if len(batches)%logInterval == 0 {
-				log.V(1).Infof("%d batches left to store", len(batches))
+	batches, small := plan.Batches, [][]*repb.Digest(nil)
+	if c.smallWrites > 0 {
+		chunkSz := int64(c.chunkMaxSize)
+		batches = nil
+		for _, batch := range plan.Batches {
+			if len(batch) == 1 && batch[0].SizeBytes <= chunkSz {
+				small = append(small, batch)
+			} else {
+				batches = append(batches, batch)
 			}
-		case <-eCtx.Done():
-			close(todo)
-			return eCtx.Err()
 		}
 	}
-	close(todo)
+	upload(batches, int(c.casConcurrency))
+	upload(small, int(c.smallWrites))
 	log.V(1).Info("Waiting for remaining jobs")
-	err = eg.Wait()
+	err := eg.Wait()
 	log.V(1).Info("Done")
-	return err
+	if err != nil {
+		return nil, err
+	}
+	if err := sched.err(); err != nil {
+		if len(errs) == 0 {
+			return nil, err
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	progress.finish()
+	return stats, nil
+}
+
+// writeOpened uploads a blob with a ByteStream write, streaming its contents from the reader open
+// returns for it, which are checked against its digest as they are sent. It returns false without
+// uploading anything if open returns a nil reader.
+func (c *Client) writeOpened(ctx context.Context, dg *repb.Digest, open func(digest.Key) (io.ReadCloser, error)) (bool, error) {
+	r, err := open(digest.ToKey(dg))
+	if err != nil {
+		return false, gerrors.WithMessage(err, fmt.Sprintf("opening blob %s", digest.ToString(dg)))
+	}
+	if r == nil {
+		return false, nil
+	}
+	defer r.Close()
+	log.V(2).Info("streaming single blob")
+	dg, name, err := c.writeResourceName(dg)
+	if err != nil {
+		return false, err
+	}
+	return true, c.writeReader(ctx, name, dg.SizeBytes, dg.Hash, r)
+}
+
+// BatchErrors is returned by WriteBlobs and ExecuteUploadPlan on clients with CollectBatchErrors
+// set, with the errors of all the batches that failed to upload, in no particular order.
+type BatchErrors []error
+
+func (e BatchErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d batches failed to upload: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// GRPCStatus returns a status with the code most common among the errors, errors without a status
+// counting as Unknown, and the message of Error, so that a code can be retrieved with
+// status.FromError and status.Code. Ties go to the lowest code, for a result that doesn't depend
+// on the order of the errors.
+func (e BatchErrors) GRPCStatus() *status.Status {
+	counts := make(map[codes.Code]int)
+	for _, err := range e {
+		counts[status.Code(err)]++
+	}
+	code := codes.Unknown
+	n := 0
+	for c, cn := range counts {
+		if cn > n || (cn == n && c < code) {
+			code, n = c, cn
+		}
+	}
+	return status.New(code, e.Error())
+}
+
+// forEachConcurrently calls fn with each index in [0, n), running up to CASConcurrency calls at
+// once, which must be at least 1. See forEachConcurrently.
+func (c *Client) forEachConcurrently(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	return forEachConcurrently(ctx, n, int(c.casConcurrency), fn)
+}
+
+// forEachConcurrently calls fn with each index in [0, n), in order, from up to workers goroutines at
+// once. The context passed to fn is cancelled once a call fails, after which, as after ctx is done,
+// no more calls are made. Once all the calls have returned, it returns the first error of fn, or
+// else the error of ctx, since some indices may then have been skipped.
+func forEachConcurrently(ctx context.Context, n, workers int, fn func(ctx context.Context, i int) error) error {
+	eg, eCtx := errgroup.WithContext(ctx)
+	todo := make(chan int, workers)
+	for w := 0; w < workers && w < n; w++ {
+		eg.Go(safely(func() error {
+			for i := range todo {
+				if err := eCtx.Err(); err != nil {
+					return err
+				}
+				if err := fn(eCtx, i); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	for i := 0; i < n && eCtx.Err() == nil; i++ {
+		select {
+		case todo <- i:
+		case <-eCtx.Done():
+		}
+	}
+	close(todo)
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// WriteBlobsWithDigest stores blobs like WriteBlobs, and also returns a digest identifying the whole
+// set of blobs, computed like digest.FromDigests from their digests with the client's digest
+// function, for recording what exactly was uploaded. The digest is that of the input set, including
+// the blobs that were already present.
+func (c *Client) WriteBlobsWithDigest(ctx context.Context, blobs map[digest.Key][]byte) (*repb.Digest, error) {
+	if err := c.WriteBlobs(ctx, blobs); err != nil {
+		return nil, err
+	}
+	dgs := make([]*repb.Digest, 0, len(blobs))
+	for k := range blobs {
+		dgs = append(dgs, digest.FromKey(k))
+	}
+	return c.digestFn.FromDigests(dgs), nil
+}
+
+// checkBlobSize returns an error if dg is the digest of a blob larger than the client's MaxBlobSize.
+func (c *Client) checkBlobSize(dg *repb.Digest) error {
+	return c.checkSize(digest.ToString(dg), dg.SizeBytes)
+}
+
+// checkSize returns an error if size, the size of the blob described by name, is larger than the
+// client's MaxBlobSize.
+func (c *Client) checkSize(name string, size int64) error {
+	if c.maxBlobSize > 0 && size > int64(c.maxBlobSize) {
+		return fmt.Errorf("blob %s of %d bytes exceeds the maximum blob size of %d bytes", name, size, c.maxBlobSize)
+	}
+	return nil
+}
+
+// uploadDirectly returns whether WriteBlobs should upload dgs without first checking which are
+// missing, according to the client's DirectUploadThreshold.
+func (c *Client) uploadDirectly(dgs []*repb.Digest) bool {
+	t := c.directUpload
+	if t.MaxBlobs <= 0 || t.MaxBytes <= 0 || len(dgs) > t.MaxBlobs {
+		return false
+	}
+	var total int64
+	for _, dg := range dgs {
+		total += dg.SizeBytes
+	}
+	return total <= t.MaxBytes
+}
+
+// progressInterval is the minimum time between two consecutive calls to an OnProgress callback.
+const progressInterval = 100 * time.Millisecond
+
+// progressReporter aggregates the progress of concurrent uploads and reports it to an OnProgress
+// callback, at most once per progressInterval. It is safe for concurrent use, and a nil callback
+// makes it a no-op.
+type progressReporter struct {
+	fn          OnProgress
+	mu          sync.Mutex
+	done, total int64
+	last        time.Time
+}
+
+func newProgressReporter(fn OnProgress, total int64) *progressReporter {
+	p := &progressReporter{fn: fn, total: total}
+	if fn != nil {
+		p.last = time.Now()
+		fn(0, total)
+	}
+	return p
+}
+
+// add records n more bytes as done, and reports progress if enough time has passed since the last
+// report.
+func (p *progressReporter) add(n int64) {
+	if p.fn == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.fn(p.done, p.total)
+	}
+}
+
+// finish unconditionally reports the final progress.
+func (p *progressReporter) finish() {
+	if p.fn == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fn(p.done, p.total)
+}
+
+// batchProgressReporter aggregates the progress of the concurrent batches of an operation and
+// reports it to an OnBatchProgress callback after each batch. It is safe for concurrent use, and a
+// nil callback makes it a no-op.
+type batchProgressReporter struct {
+	fn OnBatchProgress
+	mu sync.Mutex
+	p  BatchProgress
+}
+
+func newBatchProgressReporter(fn OnBatchProgress, op BatchOp, totalBlobs int, totalBytes int64) *batchProgressReporter {
+	return &batchProgressReporter{fn: fn, p: BatchProgress{Op: op, TotalBlobs: totalBlobs, TotalBytes: totalBytes}}
+}
+
+// add records a batch of the given number of blobs and bytes as done, and reports the progress.
+func (p *batchProgressReporter) add(blobs int, bytes int64) {
+	if p.fn == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.p.Blobs += blobs
+	p.p.Bytes += bytes
+	p.fn(p.p)
 }
 
 // WriteProto marshals and writes a proto.
@@ -106,19 +588,138 @@ func (c *Client) WriteProto(ctx context.Context, msg proto.Message) (*repb.Diges
 	return c.WriteBlob(ctx, bytes)
 }
 
+// WriteProtos marshals a number of protos and stores them in the CAS with WriteBlobs, so that only
+// the missing ones are uploaded and identical messages only once. It returns the digests of the
+// messages, in the same order.
+func (c *Client) WriteProtos(ctx context.Context, msgs []proto.Message) ([]*repb.Digest, error) {
+	dgs := make([]*repb.Digest, len(msgs))
+	blobs := make(map[digest.Key][]byte)
+	for i, msg := range msgs {
+		bytes, err := proto.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		dgs[i] = c.digestFn.FromBlob(bytes)
+		blobs[digest.ToKey(dgs[i])] = bytes
+	}
+	if err := c.WriteBlobs(ctx, blobs); err != nil {
+		return nil, err
+	}
+	return dgs, nil
+}
+
 // WriteBlob uploads a blob to the CAS.
 func (c *Client) WriteBlob(ctx context.Context, blob []byte) (*repb.Digest, error) {
-	dg := digest.FromBlob(blob)
-	name := c.ResourceNameWrite(dg.Hash, dg.SizeBytes)
-	if err := c.WriteBytes(ctx, name, blob); err != nil {
+	dg := c.digestFn.FromBlob(blob)
+	if err := c.checkBlobSize(dg); err != nil {
+		return nil, err
+	}
+	_, name, err := c.writeResourceName(dg)
+	if err != nil {
+		return nil, err
+	}
+	err = c.writeFlights.do(ctx, digest.ToKey(dg), func() error {
+		return c.WriteBytes(ctx, name, blob)
+	})
+	if err != nil {
 		return nil, err
 	}
+	c.present.add([]*repb.Digest{dg})
 	return dg, nil
 }
 
+// UploadIfMissing uploads a blob to the CAS like WriteBlob, unless the CAS already has it: the blob
+// is first looked up with MissingBlobs, through the client's retrier, and is only written if it is
+// missing. This saves re-uploading large blobs that are referenced again and again. It returns the
+// digest of the blob, and whether it was uploaded.
+func (c *Client) UploadIfMissing(ctx context.Context, blob []byte) (*repb.Digest, bool, error) {
+	dg := c.digestFn.FromBlob(blob)
+	if err := c.checkBlobSize(dg); err != nil {
+		return nil, false, err
+	}
+	dgs := c.uploaded.filter([]*repb.Digest{dg})
+	if len(dgs) == 0 {
+		return dg, false, nil
+	}
+	missing, err := c.MissingBlobs(ctx, dgs)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(missing) == 0 {
+		return dg, false, nil
+	}
+	if _, err := c.WriteBlob(ctx, blob); err != nil {
+		return nil, false, err
+	}
+	c.uploaded.add(dgs)
+	return dg, true, nil
+}
+
+// WriteBlobWithMetadata uploads a blob like WriteBlob, and also returns the metadata the server sent
+// with the response. If the upload was retried, the metadata is that of the last attempt.
+func (c *Client) WriteBlobWithMetadata(ctx context.Context, blob []byte) (*repb.Digest, *RPCMetadata, error) {
+	dg := c.digestFn.FromBlob(blob)
+	if err := c.checkBlobSize(dg); err != nil {
+		return nil, nil, err
+	}
+	_, name, err := c.writeResourceName(dg)
+	if err != nil {
+		return nil, nil, err
+	}
+	md := &RPCMetadata{}
+	err = c.writeChunked(ctx, name, blob, grpc.Header(&md.Header), grpc.Trailer(&md.Trailer))
+	if err != nil {
+		return nil, md, err
+	}
+	return dg, md, nil
+}
+
+// WriteBlobReader uploads a blob of known digest to the CAS, streaming exactly dg.SizeBytes bytes
+// from r. It fails without storing the blob if r ends early, has extra bytes, or its contents don't
+// match dg. Failed uploads are only retried if r is an io.Seeker.
+func (c *Client) WriteBlobReader(ctx context.Context, dg *repb.Digest, r io.Reader) error {
+	if err := c.checkBlobSize(dg); err != nil {
+		return err
+	}
+	dg, name, err := c.writeResourceName(dg)
+	if err != nil {
+		return err
+	}
+	return c.writeReader(ctx, name, dg.SizeBytes, dg.Hash, r)
+}
+
+// WriteBlobFromFile uploads the contents of the file at path to the CAS as a blob with digest dg,
+// streaming it from disk a chunk at a time as WriteBlobReader does, so that the file is never held
+// in memory. The contents are checked against dg as they are sent; if dg is nil, it is computed
+// from the file first, which reads it twice, unless the file is larger than the client's
+// MaxBlobSize. Failed uploads are retried, resuming from the data the server committed.
+func (c *Client) WriteBlobFromFile(ctx context.Context, dg *repb.Digest, path string) error {
+	if dg == nil {
+		// Files that are too large are rejected without hashing them.
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if err := c.checkSize(path, fi.Size()); err != nil {
+			return err
+		}
+		if dg, err = c.digestFn.FromFile(path); err != nil {
+			return err
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.WriteBlobReader(ctx, dg, f)
+}
+
 const (
-	// MaxBatchSz is the maximum size of a batch to upload with BatchWriteBlobs. We set it to slightly
-	// below 4 MB, because that is the limit of a message size in gRPC
+	// MaxBatchSz is the maximum size of a batch to upload with BatchWriteBlobs, counting the encoded
+	// entry of each blob, i.e. its contents plus its digest and framing. We set it to slightly below
+	// 4 MB, because that is the limit of a message size in gRPC, leaving room for the rest of the
+	// request.
 	MaxBatchSz = 4*1024*1024 - 1024
 
 	// MaxBatchDigests is a suggested approximate limit based on current RBE implementation.
@@ -127,48 +728,149 @@ const (
 )
 
 // BatchWriteBlobs uploads a number of blobs to the CAS. They must collectively be below the
-// maximum total size for a batch upload, which is about 4 MB (see MaxBatchSz). Digests must be
-// computed in advance by the caller. In case multiple errors occur during the blob upload, the
-// last error will be returned.
+// maximum total size for a batch upload, which is about 4 MB (see MaxBatchSz), or the smaller
+// maximum advertised by the server (see ServerCapabilities), except for blobs that are larger than
+// that on their own, including their per-blob overhead: those are streamed individually with
+// ByteStream writes, after the rest are uploaded in a batch, so that a blob just under the maximum
+// never makes the request exceed the gRPC message size limit. Digests must be computed in advance
+// by the caller. If blobs of the batch fail to upload, a *BatchWriteBlobsError with the error of
+// each of them is returned.
 func (c *Client) BatchWriteBlobs(ctx context.Context, blobs map[digest.Key][]byte) error {
+	return c.batchWriteBlobsExisting(ctx, blobs, nil)
+}
+
+// BatchWriteBlobsWithExisting uploads blobs like BatchWriteBlobs, and also reports which of them the
+// server deduplicated, i.e. found already present and didn't store again, so that callers can tell
+// the bytes actually stored from no-op stores. The result maps each uploaded blob to whether it
+// already existed. Servers signal this with an ALREADY_EXISTS status for the blob in the batch
+// response; blobs with an OK status, and those streamed with ByteStream writes, are reported as
+// stored, so with servers that don't make the distinction, all the blobs are.
+func (c *Client) BatchWriteBlobsWithExisting(ctx context.Context, blobs map[digest.Key][]byte) (map[digest.Key]bool, error) {
+	existed := make(map[digest.Key]bool)
+	if err := c.batchWriteBlobsExisting(ctx, blobs, existed); err != nil {
+		return nil, err
+	}
+	return existed, nil
+}
+
+// batchWriteBlobsExisting implements BatchWriteBlobs, recording in existed, if it is not nil,
+// whether each blob already existed.
+func (c *Client) batchWriteBlobsExisting(ctx context.Context, blobs map[digest.Key][]byte, existed map[digest.Key]bool) error {
+	blobs, orig, err := c.toWireBlobs(blobs)
+	if err != nil {
+		return err
+	}
+	if orig != nil {
+		wireExisted := existed
+		if existed != nil {
+			wireExisted = make(map[digest.Key]bool)
+		}
+		err := c.writeWireBlobs(ctx, blobs, wireExisted)
+		for k, e := range wireExisted {
+			existed[digest.ToKey(fromWire(orig, digest.FromKey(k)))] = e
+		}
+		if bErr, ok := err.(*BatchWriteBlobsError); ok {
+			return &BatchWriteBlobsError{Errors: fromWireErrors(orig, bErr.Errors)}
+		}
+		return err
+	}
+	return c.writeWireBlobs(ctx, blobs, existed)
+}
+
+// writeWireBlobs implements batchWriteBlobsExisting for blobs keyed by wire digests, see toWire.
+func (c *Client) writeWireBlobs(ctx context.Context, blobs map[digest.Key][]byte, existed map[digest.Key]bool) error {
+	maxSz := c.maxBatchSz(ctx)
 	var reqs []*repb.BatchUpdateBlobsRequest_Request
+	var large []*repb.Digest
 	var sz int64
 	for k, b := range blobs {
 		dg := digest.FromKey(k)
-		sz += dg.SizeBytes
+		if err := c.checkBlobSize(dg); err != nil {
+			return err
+		}
+		entrySz := batchWriteEntrySize(dg)
+		if entrySz > maxSz {
+			// These are streamed, so their hashes go in resource names.
+			if err := c.checkHash(dg); err != nil {
+				return err
+			}
+			large = append(large, dg)
+			continue
+		}
+		sz += entrySz
 		reqs = append(reqs, &repb.BatchUpdateBlobsRequest_Request{
 			Digest: dg,
 			Data:   b,
 		})
 	}
-	if sz > MaxBatchSz {
-		return fmt.Errorf("batch update of %d total bytes exceeds maximum of %d", sz, MaxBatchSz)
+	if sz > maxSz {
+		return fmt.Errorf("batch update of %d total bytes, including the per-blob overhead, exceeds maximum of %d", sz, maxSz)
+	}
+	if len(reqs) > MaxBatchDigests {
+		return fmt.Errorf("batch update of %d total blobs exceeds maximum of %d", len(reqs), MaxBatchDigests)
+	}
+	// The blobs come from a map, so they are sorted to make the request deterministic.
+	sort.Slice(reqs, func(i, j int) bool {
+		return digestLess(reqs[i].Digest, reqs[j].Digest)
+	})
+	sort.Slice(large, func(i, j int) bool {
+		return digestLess(large[i], large[j])
+	})
+	if len(reqs) > 0 {
+		if err := c.batchWriteBlobs(ctx, blobs, reqs, existed); err != nil {
+			return err
+		}
+	}
+	for _, dg := range large {
+		log.V(2).Infof("streaming blob %s, too large for a batch", digest.ToString(dg))
+		if err := c.WriteBytes(ctx, c.ResourceNameWrite(dg.Hash, dg.SizeBytes), blobs[digest.ToKey(dg)]); err != nil {
+			return err
+		}
+		if existed != nil {
+			existed[digest.ToKey(dg)] = false
+		}
 	}
-	if len(blobs) > MaxBatchDigests {
-		return fmt.Errorf("batch update of %d total blobs exceeds maximum of %d", len(blobs), MaxBatchDigests)
+	return nil
+}
+
+// digestLess orders digests by size, and digests of equal size by hash.
+func digestLess(a, b *repb.Digest) bool {
+	if a.SizeBytes != b.SizeBytes {
+		return a.SizeBytes < b.SizeBytes
 	}
+	return a.Hash < b.Hash
+}
+
+// batchWriteBlobs uploads the given requests for blobs in a single batch. A blob with an
+// ALREADY_EXISTS status in the response counts as uploaded; if existed is not nil, it is recorded
+// there as having existed, and the other uploaded blobs as not.
+func (c *Client) batchWriteBlobs(ctx context.Context, blobs map[digest.Key][]byte, reqs []*repb.BatchUpdateBlobsRequest_Request, existed map[digest.Key]bool) error {
 	closure := func() error {
 		var resp *repb.BatchUpdateBlobsResponse
 		err := c.callWithTimeout(ctx, func(ctx context.Context) (e error) {
 			resp, e = c.cas.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
 				InstanceName: c.InstanceName,
 				Requests:     reqs,
-			})
+			}, c.rpcOpts()...)
 			return e
 		})
 		if err != nil {
 			return err
 		}
 
-		numErrs, errDg, errMsg := 0, new(repb.Digest), ""
+		errs := make(map[digest.Key]error)
 		var failedReqs []*repb.BatchUpdateBlobsRequest_Request
 		var retriableError error
 		allRetriable := true
 		for _, r := range resp.Responses {
 			st := status.FromProto(r.Status)
-			if st.Code() != codes.OK {
+			if code := st.Code(); code == codes.OK || code == codes.AlreadyExists {
+				if existed != nil {
+					existed[digest.ToKey(r.Digest)] = code == codes.AlreadyExists
+				}
+			} else {
 				e := st.Err()
-				if c.retrier.ShouldRetry(e) {
+				if c.retrier != nil && c.retrier.ShouldRetry(e) {
 					failedReqs = append(failedReqs, &repb.BatchUpdateBlobsRequest_Request{
 						Digest: r.Digest,
 						Data:   blobs[digest.ToKey(r.Digest)],
@@ -177,229 +879,1235 @@ func (c *Client) BatchWriteBlobs(ctx context.Context, blobs map[digest.Key][]byt
 				} else {
 					allRetriable = false
 				}
-				numErrs++
-				errDg = r.Digest
-				errMsg = r.Status.Message
+				errs[digest.ToKey(r.Digest)] = e
 			}
 		}
 		reqs = failedReqs
-		if numErrs > 0 {
+		if len(errs) > 0 {
 			if allRetriable {
 				return retriableError // Retriable errors only, retry the failed requests.
 			}
-			return fmt.Errorf("uploading blobs as part of a batch resulted in %d failures, including blob %s: %s", numErrs, digest.ToString(errDg), errMsg)
+			return &BatchWriteBlobsError{Errors: errs}
+		}
+		return nil
+	}
+	return c.retrier.do(ctx, closure)
+}
+
+// BatchWriteBlobsError is returned by BatchWriteBlobs when some of the blobs of a batch failed to
+// upload.
+type BatchWriteBlobsError struct {
+	// Errors holds the error of each digest that failed to upload.
+	Errors map[digest.Key]error
+}
+
+func (e *BatchWriteBlobsError) Error() string {
+	return fmt.Sprintf("uploading blobs as part of a batch resulted in %d failures: %s", len(e.Errors), formatBlobErrors(e.Errors))
+}
+
+// formatBlobErrors lists the errors of blobs, ordered by digest.
+func formatBlobErrors(errs map[digest.Key]error) string {
+	var keys []digest.Key
+	for k := range errs {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return digestLess(digest.FromKey(keys[i]), digest.FromKey(keys[j])) })
+	msgs := make([]string, len(keys))
+	for i, k := range keys {
+		msgs[i] = fmt.Sprintf("%s: %v", digest.ToString(digest.FromKey(k)), errs[k])
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// makeBatches splits a list of digests into batches of size no more than maxSz, counting the
+// per-blob overhead of each blob (see batchWriteEntrySize).
+//
+// First, we sort all the blobs, then we make each batch by taking the largest available blob and
+// then filling in with as many small blobs as we can fit. This is a naive approach to the knapsack
+// problem, and may have suboptimal results in some cases, but it results in deterministic batches,
+// runs in O(n log n) time, and avoids most of the pathological cases that result from scanning from
+// one end of the list only.
+//
+// The input list is sorted in-place; additionally, any blob bigger than the maximum will be put in
+// a batch of its own and the caller will need to ensure that it is uploaded with Write, not batch
+// operations.
+func makeBatches(dgs []*repb.Digest, maxSz int64) [][]*repb.Digest {
+	return packBatches(dgs, maxSz, batchWriteEntrySize)
+}
+
+// batchWriteEntrySize returns an upper bound on the encoded size of the entry for dg in a
+// BatchUpdateBlobs request.
+func batchWriteEntrySize(dg *repb.Digest) int64 {
+	// A tag and length prefix each for the entry, its digest and its data.
+	const framing = 3 * (1 + binary.MaxVarintLen64)
+	return framing + int64(proto.Size(dg)) + dg.SizeBytes
+}
+
+// makeGroupedBatches splits a list of digests into batches to upload, like makeBatches, but keeps the
+// digests of each group, according to groups, in consecutive batches. A group is only split if it
+// doesn't fit in a batch of its own. Digests with no group are batched by makeBatches.
+func makeGroupedBatches(dgs []*repb.Digest, groups map[digest.Key]string, maxSz int64) [][]*repb.Digest {
+	byGroup := make(map[string][]*repb.Digest)
+	var names []string
+	var ungrouped []*repb.Digest
+	for _, dg := range dgs {
+		name := groups[digest.ToKey(dg)]
+		if name == "" {
+			ungrouped = append(ungrouped, dg)
+			continue
+		}
+		if _, ok := byGroup[name]; !ok {
+			names = append(names, name)
+		}
+		byGroup[name] = append(byGroup[name], dg)
+	}
+	sort.Strings(names)
+
+	var batches [][]*repb.Digest
+	var batch []*repb.Digest
+	var sz int64
+	flush := func() {
+		if len(batch) > 0 {
+			log.V(2).Infof("created batch of %d blobs with total size %d", len(batch), sz)
+			batches = append(batches, batch)
+		}
+		batch, sz = nil, 0
+	}
+	for _, name := range names {
+		group := byGroup[name]
+		sort.Slice(group, func(i, j int) bool {
+			if group[i].SizeBytes != group[j].SizeBytes {
+				return group[i].SizeBytes > group[j].SizeBytes
+			}
+			return group[i].Hash < group[j].Hash
+		})
+		var groupSz int64
+		for _, dg := range group {
+			groupSz += batchWriteEntrySize(dg)
+		}
+		fitsAlone := groupSz <= maxSz && len(group) <= MaxBatchDigests
+		if fitsAlone && (groupSz > maxSz-sz || len(batch)+len(group) > MaxBatchDigests) {
+			flush()
+		}
+		for _, dg := range group {
+			entrySz := batchWriteEntrySize(dg)
+			if entrySz > maxSz-sz || len(batch) == MaxBatchDigests {
+				flush()
+			}
+			batch = append(batch, dg)
+			sz += entrySz
+		}
+	}
+	flush()
+	log.V(1).Infof("%d grouped batches created", len(batches))
+	return append(batches, makeBatches(ungrouped, maxSz)...)
+}
+
+// packBatches implements the batching algorithm of makeBatches, with the given maximum batch size
+// and a function giving the size that each digest contributes to a batch.
+func packBatches(dgs []*repb.Digest, maxSz int64, size func(*repb.Digest) int64) [][]*repb.Digest {
+	var batches [][]*repb.Digest
+	log.V(1).Infof("Batching %d digests", len(dgs))
+	sort.Slice(dgs, func(i, j int) bool {
+		if si, sj := size(dgs[i]), size(dgs[j]); si != sj {
+			return si < sj
+		}
+		// Blobs of equal size are ordered by hash, so that the batches don't depend on the input order.
+		return dgs[i].Hash < dgs[j].Hash
+	})
+	for len(dgs) > 0 {
+		batch := []*repb.Digest{dgs[len(dgs)-1]}
+		dgs = dgs[:len(dgs)-1]
+		sz := size(batch[0])
+		for len(dgs) > 0 && len(batch) < MaxBatchDigests && size(dgs[0]) <= maxSz-sz { // size(dg)+sz possibly overflows so subtract instead.
+			sz += size(dgs[0])
+			batch = append(batch, dgs[0])
+			dgs = dgs[1:]
+		}
+		log.V(2).Infof("created batch of %d blobs with total size %d", len(batch), sz)
+		batches = append(batches, batch)
+	}
+	log.V(1).Infof("%d batches created", len(batches))
+	return batches
+}
+
+// batchReadRespOverhead is the space reserved in a BatchReadBlobs response for anything other than
+// the per-blob entries.
+const batchReadRespOverhead = 1024
+
+// batchReadEntrySize returns an upper bound on the encoded size of the entry for dg in a successful
+// BatchReadBlobs response.
+func batchReadEntrySize(dg *repb.Digest) int64 {
+	// A tag and length prefix each for the entry, its digest and its data, plus an empty OK status
+	// with its own tag and length.
+	const framing = 3*(1+binary.MaxVarintLen64) + 2
+	return framing + int64(proto.Size(dg)) + dg.SizeBytes
+}
+
+// makeReadBatches splits a list of digests into batches to download with BatchReadBlobs. Unlike
+// makeBatches, it bounds the expected size of each response, including the per-blob overhead, by
+// maxSz, see maxReadBatchSz. As with makeBatches, the input list is sorted in-place, and any blob
+// too large to be downloaded in a batch is put in a batch of its own.
+func makeReadBatches(dgs []*repb.Digest, maxSz int64) [][]*repb.Digest {
+	return packBatches(dgs, maxSz, batchReadEntrySize)
+}
+
+// maxReadBatchSz is the maximum total entry size of a batch to download with BatchReadBlobs. It is
+// also bounded by the maximum batch size the server advertises, if any.
+func (c *Client) maxReadBatchSz(ctx context.Context) int64 {
+	sz := int64(c.maxRecvMsgSize) - batchReadRespOverhead
+	if max := c.serverMaxBatchSz(ctx); max > 0 && max < sz {
+		sz = max
+	}
+	return sz
+}
+
+// BatchDownloadBlobs downloads a number of blobs from the CAS. The digests are split into batches
+// for which the BatchReadBlobs responses are expected to fit within the client's maximum receive
+// message size (see MaxRecvMsgSize) and hold at most MaxBatchDigests digests; blobs that are too
+// large to fit in any batch are read individually with ReadBlob. Up to CASConcurrency batches are
+// downloaded at once. Blobs whose entries in a batch response have retriable errors are requested
+// again, without the rest of the batch. Every blob is checked against its digest, and a
+// *DigestMismatchError is returned if one doesn't match.
+func (c *Client) BatchDownloadBlobs(ctx context.Context, dgs []*repb.Digest) (map[digest.Key][]byte, error) {
+	res := make(map[digest.Key][]byte)
+	err := c.BatchDownloadStream(ctx, dgs, func(k digest.Key, data []byte) error {
+		res[k] = data
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// BatchDownloadStream downloads a number of blobs from the CAS like BatchDownloadBlobs, but rather
+// than returning them all at once, it calls fn with each blob as soon as the batch containing it
+// arrives, so that the blobs can be processed without holding all of them in memory. fn is called
+// once for each distinct digest, and never concurrently. If fn returns an error, the download is
+// stopped and the error returned.
+func (c *Client) BatchDownloadStream(ctx context.Context, dgs []*repb.Digest, fn func(digest.Key, []byte) error) error {
+	if c.casConcurrency <= 0 {
+		return fmt.Errorf("CASConcurrency should be at least 1")
+	}
+	dgs, orig, err := c.toWireAll(dgs)
+	if err != nil {
+		return err
+	}
+	if orig != nil {
+		callerFn := fn
+		fn = func(k digest.Key, data []byte) error {
+			return callerFn(digest.ToKey(fromWire(orig, digest.FromKey(k))), data)
+		}
+	}
+	maxSz := c.maxReadBatchSz(ctx)
+	batches := makeReadBatches(digest.FilterDuplicates(dgs), maxSz)
+	var mu sync.Mutex // Serializes the calls to fn.
+	return c.forEachConcurrently(ctx, len(batches), func(ctx context.Context, i int) error {
+		batch := batches[i]
+		got := make(map[digest.Key][]byte)
+		if len(batch) == 1 && batchReadEntrySize(batch[0]) > maxSz {
+			log.V(2).Info("downloading single blob")
+			data, err := c.ReadBlob(ctx, batch[0])
+			if err != nil {
+				return err
+			}
+			got[digest.ToKey(batch[0])] = data
+		} else {
+			log.V(2).Infof("downloading batch of %d blobs", len(batch))
+			if err := c.batchDownload(ctx, batch, got, nil); err != nil {
+				return err
+			}
+		}
+		return callLocked(&mu, got, fn)
+	})
+}
+
+// ReadBlobs downloads a number of blobs from the CAS, as the counterpart of WriteBlobs. As with
+// BatchDownloadBlobs, small blobs are downloaded in batches, blobs too large for a batch are read
+// with ReadBlob, and up to CASConcurrency downloads run at once. Unlike BatchDownloadBlobs, a
+// failure doesn't stop the other downloads: if some blobs can't be read, the blobs that were read
+// are returned along with a *ReadBlobsError holding the error of each digest that failed. As with
+// ReadBlob, every blob is checked against its digest, and one that doesn't match fails with a
+// *DigestMismatchError.
+func (c *Client) ReadBlobs(ctx context.Context, dgs []*repb.Digest) (map[digest.Key][]byte, error) {
+	if c.casConcurrency <= 0 {
+		return nil, fmt.Errorf("CASConcurrency should be at least 1")
+	}
+	dgs, orig, err := c.toWireAll(dgs)
+	if err != nil {
+		return nil, err
+	}
+	maxSz := c.maxReadBatchSz(ctx)
+	batches := makeReadBatches(digest.FilterDuplicates(dgs), maxSz)
+	res := make(map[digest.Key][]byte)
+	errs := make(map[digest.Key]error)
+	var mu sync.Mutex // Protects res and errs.
+	err = c.forEachConcurrently(ctx, len(batches), func(ctx context.Context, i int) error {
+		batch := batches[i]
+		got := make(map[digest.Key][]byte)
+		gotErrs := make(map[digest.Key]error)
+		if len(batch) == 1 && batchReadEntrySize(batch[0]) > maxSz {
+			log.V(2).Info("downloading single blob")
+			if data, err := c.ReadBlob(ctx, batch[0]); err != nil {
+				gotErrs[digest.ToKey(batch[0])] = err
+			} else {
+				got[digest.ToKey(batch[0])] = data
+			}
+		} else {
+			log.V(2).Infof("downloading batch of %d blobs", len(batch))
+			// The errors are recorded in gotErrs.
+			c.batchDownload(ctx, batch, got, gotErrs)
+		}
+		mu.Lock()
+		for k, data := range got {
+			res[k] = data
+		}
+		for k, err := range gotErrs {
+			errs[k] = err
+		}
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if orig != nil {
+		res, errs = fromWireBlobs(orig, res), fromWireErrors(orig, errs)
+	}
+	if len(errs) > 0 {
+		return res, &ReadBlobsError{Errors: errs}
+	}
+	return res, nil
+}
+
+// fromWireBlobs returns blobs keyed by the caller's digests rather than the wire digests, see
+// toWireAll.
+func fromWireBlobs(orig map[digest.Key]*repb.Digest, blobs map[digest.Key][]byte) map[digest.Key][]byte {
+	res := make(map[digest.Key][]byte, len(blobs))
+	for k, data := range blobs {
+		res[digest.ToKey(fromWire(orig, digest.FromKey(k)))] = data
+	}
+	return res
+}
+
+// fromWireErrors returns errs keyed by the caller's digests rather than the wire digests, see
+// toWireAll.
+func fromWireErrors(orig map[digest.Key]*repb.Digest, errs map[digest.Key]error) map[digest.Key]error {
+	res := make(map[digest.Key]error, len(errs))
+	for k, err := range errs {
+		res[digest.ToKey(fromWire(orig, digest.FromKey(k)))] = err
+	}
+	return res
+}
+
+// ReadBlobsError is returned by ReadBlobs when some of the blobs couldn't be read.
+type ReadBlobsError struct {
+	// Errors holds the error of each digest that couldn't be read.
+	Errors map[digest.Key]error
+}
+
+func (e *ReadBlobsError) Error() string {
+	return fmt.Sprintf("%d blobs failed to download: %s", len(e.Errors), formatBlobErrors(e.Errors))
+}
+
+// callLocked calls fn with each of the given blobs while holding mu.
+func callLocked(mu *sync.Mutex, blobs map[digest.Key][]byte, fn func(digest.Key, []byte) error) error {
+	mu.Lock()
+	defer mu.Unlock()
+	for k, data := range blobs {
+		if err := fn(k, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchDownload downloads a single batch of blobs with BatchReadBlobs, storing them in res. Blobs
+// whose entries in the response have retriable errors are requested again, as in batchWriteBlobs.
+// The data of each entry is checked against its digest, and a blob that doesn't match fails with a
+// *DigestMismatchError, which is returned rather than a summary of the batch's failures; entries
+// for blobs that weren't requested are ignored. If errs is not nil, the error of each blob that
+// couldn't be downloaded is recorded there.
+func (c *Client) batchDownload(ctx context.Context, batch []*repb.Digest, res map[digest.Key][]byte, errs map[digest.Key]error) error {
+	opts := append(c.rpcOpts(), grpc.MaxCallRecvMsgSize(int(c.maxRecvMsgSize)))
+	pending := batch
+	closure := func() error {
+		var resp *repb.BatchReadBlobsResponse
+		err := c.callWithTimeout(ctx, func(ctx context.Context) (e error) {
+			resp, e = c.cas.BatchReadBlobs(ctx, &repb.BatchReadBlobsRequest{
+				InstanceName: c.InstanceName,
+				Digests:      pending,
+			}, opts...)
+			return e
+		})
+		if err != nil {
+			return err
+		}
+
+		requested := make(map[digest.Key]bool, len(pending))
+		for _, dg := range pending {
+			requested[digest.ToKey(dg)] = true
+		}
+		numErrs, errDg, errMsg := 0, new(repb.Digest), ""
+		var failed []*repb.Digest
+		var retriableError, mismatch error
+		allRetriable := true
+		for _, r := range resp.Responses {
+			if err := c.digestFn.Validate(r.Digest); err != nil {
+				// Not a status error, so that the malformed response isn't requested again.
+				return fmt.Errorf("BatchReadBlobs response has an entry with an invalid digest: %v", err)
+			}
+			k := digest.ToKey(r.Digest)
+			if !requested[k] {
+				log.V(2).Infof("ignoring blob %s that was not requested in the batch download response", digest.ToString(r.Digest))
+				continue
+			}
+			st := status.FromProto(r.Status)
+			if st.Code() == codes.OK {
+				if got := c.digestFn.FromBlob(r.Data); !digest.Equal(got, r.Digest) {
+					// The data was corrupted, e.g. by a proxy, and isn't requested again.
+					mismatch = &DigestMismatchError{Want: r.Digest, Got: got}
+					if errs != nil {
+						errs[k] = mismatch
+					}
+					allRetriable = false
+					numErrs++
+					continue
+				}
+				res[k] = r.Data
+				if errs != nil {
+					delete(errs, k)
+				}
+				continue
+			}
+			e := st.Err()
+			if errs != nil {
+				errs[k] = e
+			}
+			if c.retrier != nil && c.retrier.ShouldRetry(e) {
+				failed = append(failed, r.Digest)
+				retriableError = e
+			} else {
+				allRetriable = false
+			}
+			numErrs++
+			errDg = r.Digest
+			errMsg = r.Status.Message
+		}
+		pending = failed
+		if mismatch != nil {
+			return mismatch
+		}
+		if numErrs > 0 {
+			if allRetriable {
+				return retriableError // Retriable errors only, retry the failed digests.
+			}
+			return fmt.Errorf("downloading blobs as part of a batch resulted in %d failures, including blob %s: %s", numErrs, digest.ToString(errDg), errMsg)
+		}
+		return nil
+	}
+	err := c.retrier.do(ctx, closure)
+	for _, dg := range batch {
+		k := digest.ToKey(dg)
+		if _, ok := res[k]; ok {
+			continue
+		}
+		if err == nil {
+			err = fmt.Errorf("blob %s was missing from the batch download response", digest.ToString(dg))
+		}
+		if errs == nil {
+			break
+		}
+		if _, ok := errs[k]; !ok {
+			errs[k] = err
+		}
+	}
+	return err
+}
+
+// ReadBlob fetches a blob from the CAS into a byte slice. On 32-bit platforms, blobs of 2 GB or more
+// don't fit in a byte slice and must be read with ReadBlobStreamed or ReadBlobToFile instead.
+//
+// The contents are checked against the digest. If they don't match, a *DigestMismatchError is
+// returned, along with the contents if the client has ReturnDataOnDigestMismatch set.
+func (c *Client) ReadBlob(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	return c.readVerifiedBlob(ctx, d)
+}
+
+// ReadBlobWithMetadata reads a blob like ReadBlob, and also returns the metadata the server sent
+// with the response, e.g. to identify the backend that served it. If the read was retried, the
+// metadata is that of the last attempt.
+func (c *Client) ReadBlobWithMetadata(ctx context.Context, d *repb.Digest) ([]byte, *RPCMetadata, error) {
+	md := &RPCMetadata{}
+	blob, err := c.readVerifiedBlob(ctx, d, grpc.Header(&md.Header), grpc.Trailer(&md.Trailer))
+	return blob, md, err
+}
+
+// RPCMetadata is the metadata returned by the server for an RPC.
+type RPCMetadata struct {
+	// Header is the header metadata of the response.
+	Header metadata.MD
+	// Trailer is the trailer metadata of the response.
+	Trailer metadata.MD
+}
+
+// readVerifiedBlob implements ReadBlob, passing any extra call options to the Read calls.
+func (c *Client) readVerifiedBlob(ctx context.Context, d *repb.Digest, extra ...grpc.CallOption) ([]byte, error) {
+	wd, err := c.toWire(d)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := c.readBlob(ctx, wd.Hash, wd.SizeBytes, 0, 0, extra...)
+	if err != nil {
+		return nil, err
+	}
+	if got := c.digestFn.FromBlob(blob); got.Hash != wd.Hash || got.SizeBytes != wd.SizeBytes {
+		err := &DigestMismatchError{Want: d, Got: got}
+		if c.mismatchData {
+			return blob, err
 		}
+		return nil, err
+	}
+	return blob, nil
+}
+
+// DigestMismatchError is returned when a blob read from the CAS doesn't match the digest it was read
+// by, e.g. because it was corrupted on the way.
+type DigestMismatchError struct {
+	// Want is the digest of the requested blob.
+	Want *repb.Digest
+	// Got is the digest of the data that was received.
+	Got *repb.Digest
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("blob %s was read with digest %s", digest.ToString(e.Want), digest.ToString(e.Got))
+}
+
+// readVerifier hashes the data of a blob as it is read, to check it against the blob's digest, for
+// clients with VerifyReads set. A nil readVerifier checks nothing.
+type readVerifier struct {
+	want *repb.Digest
+	h    hash.Hash
+}
+
+// newReadVerifier returns a readVerifier of the blob with digest d, or nil if the client doesn't
+// have VerifyReads set.
+func (c *Client) newReadVerifier(d *repb.Digest) *readVerifier {
+	if !c.verifyReads {
 		return nil
 	}
-	return c.retrier.do(ctx, closure)
+	return &readVerifier{want: d, h: c.digestFn.NewHash()}
 }
 
-// makeBatches splits a list of digests into batches of size no more than the maximum.
-//
-// First, we sort all the blobs, then we make each batch by taking the largest available blob and
-// then filling in with as many small blobs as we can fit. This is a naive approach to the knapsack
-// problem, and may have suboptimal results in some cases, but it results in deterministic batches,
-// runs in O(n log n) time, and avoids most of the pathological cases that result from scanning from
-// one end of the list only.
-//
-// The input list is sorted in-place; additionally, any blob bigger than the maximum will be put in
-// a batch of its own and the caller will need to ensure that it is uploaded with Write, not batch
-// operations.
-func makeBatches(dgs []*repb.Digest) [][]*repb.Digest {
-	var batches [][]*repb.Digest
-	log.V(1).Infof("Batching %d digests", len(dgs))
-	sort.Slice(dgs, func(i, j int) bool {
-		return dgs[i].SizeBytes < dgs[j].SizeBytes
-	})
-	for len(dgs) > 0 {
-		batch := []*repb.Digest{dgs[len(dgs)-1]}
-		dgs = dgs[:len(dgs)-1]
-		sz := batch[0].SizeBytes
-		for len(dgs) > 0 && len(batch) < MaxBatchDigests && dgs[0].SizeBytes <= MaxBatchSz-sz { // dg.SizeBytes+sz possibly overflows so subtract instead.
-			sz += dgs[0].SizeBytes
-			batch = append(batch, dgs[0])
-			dgs = dgs[1:]
-		}
-		log.V(2).Infof("created batch of %d blobs with total size %d", len(batch), sz)
-		batches = append(batches, batch)
+// tee returns a writer writing to w, and to the hash of v.
+func (v *readVerifier) tee(w io.Writer) io.Writer {
+	if v == nil {
+		return w
 	}
-	log.V(1).Infof("%d batches created", len(batches))
-	return batches
+	return io.MultiWriter(w, v.h)
 }
 
-// ReadBlob fetches a blob from the CAS into a byte slice.
-func (c *Client) ReadBlob(ctx context.Context, d *repb.Digest) ([]byte, error) {
-	return c.readBlob(ctx, d.Hash, d.SizeBytes, 0, 0)
+// check returns a *DigestMismatchError if the n bytes hashed by v don't match the blob's digest.
+func (v *readVerifier) check(n int64) error {
+	if v == nil {
+		return nil
+	}
+	got := &repb.Digest{Hash: hex.EncodeToString(v.h.Sum(nil)), SizeBytes: n}
+	if !strings.EqualFold(got.Hash, v.want.Hash) || got.SizeBytes != v.want.SizeBytes {
+		return &DigestMismatchError{Want: v.want, Got: got}
+	}
+	return nil
 }
 
 // ReadBlobRange fetches a partial blob from the CAS into a byte slice, starting from offset bytes
 // and including at most limit bytes (or no limit if limit==0). The offset must be non-negative and
 // no greater than the size of the entire blob. The limit must not be negative, but offset+limit may
-// be greater than the size of the entire blob.
+// be greater than the size of the entire blob. As with ReadBlob, on 32-bit platforms the range read
+// must be under 2 GB.
 func (c *Client) ReadBlobRange(ctx context.Context, d *repb.Digest, offset, limit int64) ([]byte, error) {
 	return c.readBlob(ctx, d.Hash, d.SizeBytes, offset, limit)
 }
 
-func (c *Client) readBlob(ctx context.Context, hash string, sizeBytes, offset, limit int64) ([]byte, error) {
-	// int might be 32-bit, in which case we could have a blob whose size is representable in int64
-	// but not int32, and thus can't fit in a slice. We can check for this by casting and seeing if
-	// the result is negative, since 32 bits is big enough wrap all out-of-range values of int64 to
-	// negative numbers. If int is 64-bits, the cast is a no-op and so the condition will always fail.
-	if int(sizeBytes) < 0 {
-		return nil, fmt.Errorf("digest size %d is too big to fit in a byte slice", sizeBytes)
-	}
-	if offset > sizeBytes {
-		return nil, fmt.Errorf("offset %d out of range for a blob of size %d", offset, sizeBytes)
-	}
-	if offset < 0 {
-		return nil, fmt.Errorf("offset %d may not be negative", offset)
-	}
-	if limit < 0 {
-		return nil, fmt.Errorf("limit %d may not be negative", limit)
+func (c *Client) readBlob(ctx context.Context, hash string, sizeBytes, offset, limit int64, extra ...grpc.CallOption) ([]byte, error) {
+	if err := checkRange(sizeBytes, offset, limit); err != nil {
+		return nil, err
 	}
 	sz := sizeBytes - offset
 	if limit > 0 && limit < sz {
 		sz = limit
 	}
 	sz += bytes.MinRead // Pad size so bytes.Buffer does not reallocate.
+	// int might be 32-bit, in which case we could have a read whose size is representable in int64
+	// but not int32, and thus can't fit in a slice. We can check for this by casting back and forth
+	// and seeing if the value survived. If int is 64-bits, the casts are no-ops.
+	if int64(int(sz)) != sz {
+		return nil, fmt.Errorf("reading %d bytes of blob %s/%d is too big to fit in a byte slice, use ReadBlobStreamed or ReadBlobToFile instead", sz-bytes.MinRead, hash, sizeBytes)
+	}
 	buf := bytes.NewBuffer(make([]byte, 0, sz))
-	_, err := c.readBlobStreamed(ctx, hash, sizeBytes, offset, limit, buf)
+	_, err := c.readBlobStreamed(ctx, hash, sizeBytes, offset, limit, buf, extra...)
 	return buf.Bytes(), err
 }
 
 // ReadBlobToFile fetches a blob with a provided digest name from the CAS, saving it into a file.
-// It returns the number of bytes read.
+// It returns the number of bytes read. Unlike ReadBlob, it can read blobs of any size on all
+// platforms. If the client has PreallocateFiles set, the file is sized to the blob before the
+// download starts. If it has ResumeDownloads set, a partial download left in the file by an earlier
+// call is completed rather than started over. If it has VerifyReads set and the data doesn't match
+// the digest, the file is removed and a *DigestMismatchError returned.
 func (c *Client) ReadBlobToFile(ctx context.Context, d *repb.Digest, fpath string) (int64, error) {
 	return c.readBlobToFile(ctx, d.Hash, d.SizeBytes, fpath)
 }
 
 func (c *Client) readBlobToFile(ctx context.Context, hash string, sizeBytes int64, fpath string) (int64, error) {
-	n, err := c.readToFile(ctx, c.resourceNameRead(hash, sizeBytes), fpath)
+	if err := c.checkZeroSize(hash, sizeBytes); err != nil {
+		return 0, err
+	}
+	dg, name, err := c.readResourceName(&repb.Digest{Hash: hash, SizeBytes: sizeBytes})
+	if err != nil {
+		return 0, err
+	}
+	if bool(c.resumeReads) && !bool(c.preallocate) {
+		if n, ok, err := c.resumeToFile(ctx, dg, name, fpath); ok || err != nil {
+			return n, err
+		}
+	}
+	read := c.readToFile
+	if c.preallocate {
+		read = c.readToSizedFile
+	}
+	v := c.newReadVerifier(dg)
+	n, err := read(ctx, name, sizeBytes, fpath, v)
 	if err != nil {
 		return n, err
 	}
 	if n != sizeBytes {
 		return n, fmt.Errorf("CAS fetch read %d bytes but %d were expected", n, sizeBytes)
 	}
+	if err := v.check(n); err != nil {
+		if rerr := os.Remove(fpath); rerr != nil {
+			log.Warningf("failed to remove %s, which doesn't match its digest: %v", fpath, rerr)
+		}
+		return n, err
+	}
 	return n, nil
 }
 
-// ReadBlobStreamed fetches a blob with a provided digest from the CAS.
-// It streams into an io.Writer, and returns the number of bytes read.
-func (c *Client) ReadBlobStreamed(ctx context.Context, d *repb.Digest, w io.Writer) (int64, error) {
-	return c.readBlobStreamed(ctx, d.Hash, d.SizeBytes, 0, 0, w)
+// resumeToFile completes the download of the blob with digest dg, read from the named resource,
+// into a file that holds the start of it, as ReadBlobToFile does with ResumeDownloads set. It
+// returns whether the file now holds the blob, along with its size; if it doesn't, the blob needs to
+// be downloaded from the start.
+func (c *Client) resumeToFile(ctx context.Context, dg *repb.Digest, name, fpath string) (int64, bool, error) {
+	fi, err := os.Stat(fpath)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() == 0 || fi.Size() > dg.SizeBytes {
+		return 0, false, nil
+	}
+	have := fi.Size()
+	if have < dg.SizeBytes {
+		log.V(2).Infof("resuming download of %s into %s after %d bytes", digest.ToString(dg), fpath, have)
+		f, err := os.OpenFile(fpath, os.O_WRONLY, 0)
+		if err != nil {
+			return 0, false, err
+		}
+		n, err := c.readStreamed(ctx, name, have, 0, dg.SizeBytes-have, &offsetWriter{w: f, off: have})
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return have + n, false, err
+		}
+	}
+	got, err := c.digestFn.FromFile(fpath)
+	if err != nil {
+		return 0, false, err
+	}
+	if !digest.Equal(got, dg) {
+		log.Warningf("file %s had unexpected contents for %s, downloading it again", fpath, digest.ToString(dg))
+		return 0, false, nil
+	}
+	return dg.SizeBytes, true, nil
+}
+
+// ReadBlobRangeToFileAt fetches a partial blob from the CAS, as ReadBlobRange does, and writes it to
+// the file at fpath starting fileOffset bytes into the file, leaving the rest of the file as it is.
+// The file is created if it doesn't exist. The number of bytes read is returned.
+func (c *Client) ReadBlobRangeToFileAt(ctx context.Context, d *repb.Digest, offset, limit int64, fpath string, fileOffset int64) (int64, error) {
+	if err := checkRange(d.SizeBytes, offset, limit); err != nil {
+		return 0, err
+	}
+	if fileOffset < 0 {
+		return 0, fmt.Errorf("file offset %d may not be negative", fileOffset)
+	}
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.readBlobStreamed(ctx, d.Hash, d.SizeBytes, offset, limit, &offsetWriter{w: f, off: fileOffset})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// offsetWriter writes sequentially to a WriterAt, starting at an offset.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+// checkRange checks that offset and limit describe a valid range of a blob of size sizeBytes.
+func checkRange(sizeBytes, offset, limit int64) error {
+	if offset > sizeBytes {
+		return fmt.Errorf("offset %d out of range for a blob of size %d", offset, sizeBytes)
+	}
+	if offset < 0 {
+		return fmt.Errorf("offset %d may not be negative", offset)
+	}
+	if limit < 0 {
+		return fmt.Errorf("limit %d may not be negative", limit)
+	}
+	return nil
+}
+
+// BlobReader returns a reader of a blob from the CAS, for consumers that process it incrementally.
+// The blob is downloaded in the background, at most the client's ReadAhead bytes ahead of the
+// reader, so that a slow reader holds back the download instead of having the blob buffered in
+// memory. Closing the reader cancels the download. Like ReadBlobStreamed, it can read blobs of any
+// size on all platforms. If the client has VerifyReads set and the data doesn't match the digest,
+// the last Read returns a *DigestMismatchError rather than io.EOF.
+func (c *Client) BlobReader(ctx context.Context, d *repb.Digest) (io.ReadCloser, error) {
+	if err := c.checkZeroSize(d.Hash, d.SizeBytes); err != nil {
+		return nil, err
+	}
+	cancelCtx, cancel := context.WithCancel(ctx)
+	buf := newPrefetchBuffer(int(c.readAhead))
+	go func() {
+		buf.finish(safely(func() error {
+			v := c.newReadVerifier(d)
+			n, err := c.readBlobStreamed(cancelCtx, d.Hash, d.SizeBytes, 0, 0, v.tee(buf))
+			if err != nil {
+				return err
+			}
+			return v.check(n)
+		})())
+	}()
+	return &blobReader{buf: buf, cancel: cancel}, nil
 }
 
-func (c *Client) readBlobStreamed(ctx context.Context, hash string, sizeBytes, offset, limit int64, w io.Writer) (int64, error) {
-	n, err := c.readStreamed(ctx, c.resourceNameRead(hash, sizeBytes), offset, limit, w)
+// blobReader is the reader returned by BlobReader.
+type blobReader struct {
+	buf    *prefetchBuffer
+	cancel context.CancelFunc
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	return r.buf.Read(p)
+}
+
+func (r *blobReader) Close() error {
+	r.cancel()
+	r.buf.close()
+	return nil
+}
+
+// ReadBlobStreamed fetches a blob with a provided digest from the CAS.
+// It streams into an io.Writer, and returns the number of bytes read. Unlike ReadBlob, it can read
+// blobs of any size on all platforms. If the client has VerifyReads set and the data doesn't match
+// the digest, a *DigestMismatchError is returned once it is all written to w.
+func (c *Client) ReadBlobStreamed(ctx context.Context, d *repb.Digest, w io.Writer) (int64, error) {
+	v := c.newReadVerifier(d)
+	n, err := c.readBlobStreamed(ctx, d.Hash, d.SizeBytes, 0, 0, v.tee(w))
 	if err != nil {
 		return n, err
 	}
+	return n, v.check(n)
+}
+
+func (c *Client) readBlobStreamed(ctx context.Context, hash string, sizeBytes, offset, limit int64, w io.Writer, extra ...grpc.CallOption) (int64, error) {
+	if err := c.checkZeroSize(hash, sizeBytes); err != nil {
+		return 0, err
+	}
 	sz := sizeBytes - offset
 	if limit > 0 && limit < sz {
 		sz = limit
 	}
+	_, name, err := c.readResourceName(&repb.Digest{Hash: hash, SizeBytes: sizeBytes})
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.readStreamed(ctx, name, offset, limit, sz, w, extra...)
+	if err != nil {
+		return n, err
+	}
 	if n != sz {
 		return n, fmt.Errorf("CAS fetch read %d bytes but %d were expected", n, sz)
 	}
 	return n, nil
 }
 
+// checkZeroSize rejects a digest of size 0 whose hash is not that of the empty blob. Such a digest
+// can't describe any blob, and is usually a caller bug; reading it could misleadingly succeed.
+func (c *Client) checkZeroSize(hash string, sizeBytes int64) error {
+	if sizeBytes == 0 && hash != c.digestFn.Empty().Hash {
+		return fmt.Errorf("digest %s/0 has size 0 but is not the digest of the empty blob", hash)
+	}
+	return nil
+}
+
 // MissingBlobs queries the CAS to determine if it has the listed blobs. It returns a list of the
-// missing blobs.
+// missing blobs. If the client was configured with CoalesceMissingBlobs, the query may be merged
+// with those of concurrent callers. The call is bounded by the client's OperationTimeout. As in
+// ExecuteUploadPlan, query batches are not started once the deadline is too close for them to
+// finish.
 func (c *Client) MissingBlobs(ctx context.Context, ds []*repb.Digest) ([]*repb.Digest, error) {
-	if c.casConcurrency <= 0 {
-		return nil, fmt.Errorf("CASConcurrency should be at least 1")
+	missing, _, err := c.MissingBlobsWithStats(ctx, ds)
+	return missing, err
+}
+
+// MissingBlobsWithStats queries the CAS for missing blobs like MissingBlobs, and also returns
+// statistics of the query. Only the PresenceCacheHits and PresenceCacheMisses of the Stats are set.
+func (c *Client) MissingBlobsWithStats(ctx context.Context, ds []*repb.Digest) ([]*repb.Digest, *Stats, error) {
+	ds, hits, misses := c.present.filter(ds)
+	missing, err := c.queryMissingBlobs(ctx, ds)
+	if err != nil {
+		return nil, nil, err
 	}
-	var batches [][]*repb.Digest
+	return missing, &Stats{PresenceCacheHits: hits, PresenceCacheMisses: misses}, nil
+}
+
+// queryMissingBlobs queries the CAS for the missing blobs like MissingBlobs, without consulting the
+// client's PresenceCache, and updates the cache with the result.
+func (c *Client) queryMissingBlobs(ctx context.Context, ds []*repb.Digest) ([]*repb.Digest, error) {
+	var missing []*repb.Digest
+	err := c.withOpTimeout(ctx, "MissingBlobs", func(ctx context.Context) (err error) {
+		if c.coalescer != nil {
+			missing, err = c.coalescer.query(ctx, ds)
+		} else {
+			missing, err = c.missingBlobs(ctx, ds)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.present.addPresent(ds, missing)
+	return missing, nil
+}
+
+// BlobPresence queries the CAS to determine if it has the listed blobs, like MissingBlobs. It
+// returns a map from the key of each queried digest to whether the CAS has the blob. Unlike
+// MissingBlobs, it always queries the CAS, rather than trusting the client's PresenceCache.
+func (c *Client) BlobPresence(ctx context.Context, ds []*repb.Digest) (map[digest.Key]bool, error) {
+	missing, err := c.queryMissingBlobs(ctx, ds)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[digest.Key]bool, len(ds))
+	for _, d := range ds {
+		res[digest.ToKey(d)] = true
+	}
+	for _, d := range missing {
+		res[digest.ToKey(d)] = false
+	}
+	return res, nil
+}
+
+// BlobQueryResult is the result of querying the CAS for a blob, see QueryBlobs.
+type BlobQueryResult struct {
+	// Present is whether the CAS has the blob.
+	Present bool
+	// Batch is the index of the FindMissingBlobs request that queried the blob, in the order the
+	// requests were made.
+	Batch int
+}
+
+// QueryBlobs queries the CAS to determine if it has the listed blobs, like BlobPresence, and returns
+// a map from the key of each queried digest to its result, including which FindMissingBlobs batch
+// queried it, e.g. to track down the shard of a misbehaving server. Like BlobPresence, it always
+// queries the CAS for every blob rather than trusting the client's PresenceCache, which it then
+// updates with the results. Unlike MissingBlobs, the query is never merged with those of concurrent
+// callers, so that the batches are the caller's own. The call is bounded by the client's
+// OperationTimeout.
+func (c *Client) QueryBlobs(ctx context.Context, ds []*repb.Digest) (map[digest.Key]BlobQueryResult, error) {
+	res := make(map[digest.Key]BlobQueryResult, len(ds))
+	err := c.withOpTimeout(ctx, "QueryBlobs", func(ctx context.Context) error {
+		return c.findMissingBatches(ctx, ds, func(batch int, queried, missing []*repb.Digest) {
+			for _, d := range queried {
+				res[digest.ToKey(d)] = BlobQueryResult{Present: true, Batch: batch}
+			}
+			for _, d := range missing {
+				res[digest.ToKey(d)] = BlobQueryResult{Present: false, Batch: batch}
+			}
+			c.present.addPresent(queried, missing)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// AuditBlobs checks that the CAS has the listed blobs, for instance to audit blobs that are believed
+// to be present, without uploading anything. It queries the CAS like MissingBlobs, but without
+// trusting the client's PresenceCache, and splits the digests, without duplicates, into those the
+// CAS has and those it is missing, in the order given.
+func (c *Client) AuditBlobs(ctx context.Context, ds []*repb.Digest) (present, missing []*repb.Digest, err error) {
+	ds = digest.FilterDuplicates(ds)
+	missingDgs, err := c.queryMissingBlobs(ctx, ds)
+	if err != nil {
+		return nil, nil, err
+	}
+	isMissing := make(map[digest.Key]bool, len(missingDgs))
+	for _, d := range missingDgs {
+		isMissing[digest.ToKey(d)] = true
+	}
+	for _, d := range ds {
+		if isMissing[digest.ToKey(d)] {
+			missing = append(missing, d)
+		} else {
+			present = append(present, d)
+		}
+	}
+	return present, missing, nil
+}
+
+// maxFindMissingReqSz is the maximum encoded size of a FindMissingBlobs request. It is below the
+// 4 MB maximum message size that gRPC servers accept by default.
+const maxFindMissingReqSz = MaxBatchSz
+
+// findMissingEntrySize returns the encoded size of a field of a FindMissingBlobsRequest whose value
+// has the given size.
+func findMissingEntrySize(sz int) int {
+	return 1 + binary.MaxVarintLen64 + sz
+}
+
+func (c *Client) missingBlobs(ctx context.Context, ds []*repb.Digest) ([]*repb.Digest, error) {
 	var missing []*repb.Digest
+	err := c.findMissingBatches(ctx, ds, func(_ int, _, batchMissing []*repb.Digest) {
+		missing = append(missing, batchMissing...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return missing, nil
+}
+
+// findMissingBatches queries the CAS for the listed blobs in concurrent FindMissingBlobs batches,
+// calling fn with the index of each batch, the digests it queried and those the CAS is missing, as
+// each response arrives. fn is never called concurrently.
+func (c *Client) findMissingBatches(ctx context.Context, ds []*repb.Digest, fn func(batch int, queried, missing []*repb.Digest)) error {
+	if c.casConcurrency <= 0 {
+		return fmt.Errorf("CASConcurrency should be at least 1")
+	}
+	if c.findMissingMax <= 0 {
+		return fmt.Errorf("FindMissingBatchSize should be at least 1")
+	}
+	ds, orig, err := c.toWireAll(ds)
+	if err != nil {
+		return err
+	}
+	type queryBatch struct {
+		index int
+		dgs   []*repb.Digest
+	}
+	var batches []queryBatch
 	var resultMutex sync.Mutex
 	const (
-		logInterval   = 25
-		maxQueryLimit = 10000
+		logInterval = 25
 	)
+	var totalBytes int64
+	for _, dg := range ds {
+		totalBytes += dg.SizeBytes
+	}
+	progress := newBatchProgressReporter(c.onBatch, BatchQuery, len(ds), totalBytes)
+	reqOverhead := int64(findMissingEntrySize(len(c.InstanceName)))
 	for len(ds) > 0 {
-		batchSize := maxQueryLimit
-		if len(ds) < maxQueryLimit {
-			batchSize = len(ds)
+		batchSize, sz := 0, reqOverhead
+		for batchSize < len(ds) && batchSize < int(c.findMissingMax) {
+			entrySz := int64(findMissingEntrySize(proto.Size(ds[batchSize])))
+			if batchSize > 0 && sz+entrySz > maxFindMissingReqSz {
+				break
+			}
+			sz += entrySz
+			batchSize++
 		}
 		batch := ds[0:batchSize]
 		ds = ds[batchSize:]
 		log.V(2).Infof("created query batch of %d blobs", len(batch))
-		batches = append(batches, batch)
+		batches = append(batches, queryBatch{index: len(batches), dgs: batch})
 	}
 	log.V(1).Infof("%d query batches created", len(batches))
 
-	eg, eCtx := errgroup.WithContext(ctx)
-	todo := make(chan []*repb.Digest, c.casConcurrency)
-	for i := 0; i < int(c.casConcurrency) && i < len(batches); i++ {
-		eg.Go(func() error {
-			for batch := range todo {
-				req := &repb.FindMissingBlobsRequest{
-					InstanceName: c.InstanceName,
-					BlobDigests:  batch,
-				}
-				resp, err := c.FindMissingBlobs(eCtx, req)
-				if err != nil {
-					return err
-				}
-				resultMutex.Lock()
-				missing = append(missing, resp.MissingBlobDigests...)
-				resultMutex.Unlock()
-				if eCtx.Err() != nil {
-					return eCtx.Err()
-				}
+	sched := c.newBatchScheduler("MissingBlobs", len(batches))
+	err = c.forEachConcurrently(ctx, len(batches), func(ctx context.Context, i int) error {
+		if left := len(batches) - i - 1; left > 0 && left%logInterval == 0 {
+			log.V(1).Infof("%d missing batches left to query", left)
+		}
+		if !sched.start(ctx) {
+			return nil
+		}
+		batch := batches[i]
+		req := &repb.FindMissingBlobsRequest{
+			InstanceName: c.InstanceName,
+			BlobDigests:  batch.dgs,
+		}
+		start := time.Now()
+		resp, err := c.FindMissingBlobs(ctx, req)
+		sched.done(time.Since(start))
+		if err != nil {
+			log.Warningf("FindMissingBlobs query batch %d of %d digests failed: %v", batch.index, len(batch.dgs), err)
+			return err
+		}
+		queried := make([]*repb.Digest, len(batch.dgs))
+		var sz int64
+		for i, dg := range batch.dgs {
+			queried[i] = fromWire(orig, dg)
+			sz += dg.SizeBytes
+		}
+		missing := make([]*repb.Digest, len(resp.MissingBlobDigests))
+		for i, dg := range resp.MissingBlobDigests {
+			missing[i] = fromWire(orig, dg)
+		}
+		resultMutex.Lock()
+		fn(batch.index, queried, missing)
+		resultMutex.Unlock()
+		progress.add(len(batch.dgs), sz)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return sched.err()
+}
+
+// BlobSizes is a best-effort query for the sizes of blobs known only by their hashes. It probes the
+// server with a ByteStream QueryWriteStatus call on the resource name "<instance>/blobs/<hash>",
+// which has no size, and returns the committed size of each blob reported complete, keyed by hash.
+// Blobs that are not found are omitted from the result.
+//
+// Only some servers support this: others reject the resource name or the call, in which case an
+// error is returned.
+func (c *Client) BlobSizes(ctx context.Context, hashes []string) (map[string]int64, error) {
+	if c.casConcurrency <= 0 {
+		return nil, fmt.Errorf("CASConcurrency should be at least 1")
+	}
+	sizes := make(map[string]int64)
+	var resultMutex sync.Mutex
+	err := c.forEachConcurrently(ctx, len(hashes), func(ctx context.Context, i int) error {
+		resp, err := c.QueryWriteStatus(ctx, &bspb.QueryWriteStatusRequest{
+			ResourceName: c.resourceName("blobs/" + hashes[i]),
+		})
+		if st, _ := status.FromError(err); st.Code() == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !resp.Complete {
+			return nil
+		}
+		resultMutex.Lock()
+		sizes[hashes[i]] = resp.CommittedSize
+		resultMutex.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+func (c *Client) resourceNameRead(hash string, sizeBytes int64) string {
+	return c.resourceName(fmt.Sprintf("blobs/%s/%d", hash, sizeBytes))
+}
+
+// toWire applies the client's UppercaseHashes policy to a digest to send to the server. A digest
+// whose hash has uppercase hex digits is either rejected or lowercased; others are returned as is.
+func (c *Client) toWire(dg *repb.Digest) (*repb.Digest, error) {
+	lower := strings.ToLower(dg.Hash)
+	if lower == dg.Hash {
+		return dg, nil
+	}
+	if c.upperHashes != LowercaseHashes {
+		return nil, status.Errorf(codes.InvalidArgument, "digest %s has a hash with uppercase hex digits, but hashes must be lowercase", digest.ToString(dg))
+	}
+	return &repb.Digest{Hash: lower, SizeBytes: dg.SizeBytes}, nil
+}
+
+// toResource applies toWire to a digest to put in a ByteStream resource name, and checks that its
+// hash is a valid hash of the client's digest function (see DigestFunction). The server would
+// reject a hash computed by another digest function without saying why.
+func (c *Client) toResource(dg *repb.Digest) (*repb.Digest, error) {
+	dg, err := c.toWire(dg)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkHash(dg); err != nil {
+		return nil, err
+	}
+	return dg, nil
+}
+
+// checkHash checks that the hash of a digest is a valid hash of the client's digest function.
+func (c *Client) checkHash(dg *repb.Digest) error {
+	if err := c.digestFn.ValidateHash(dg.Hash); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid digest %s: %v", digest.ToString(dg), err)
+	}
+	return nil
+}
+
+// toWireAll applies toWire to a list of digests. It also returns the digests that were changed,
+// keyed by the digests to send, to map the digests of responses back to the caller's with fromWire.
+func (c *Client) toWireAll(dgs []*repb.Digest) ([]*repb.Digest, map[digest.Key]*repb.Digest, error) {
+	res := dgs
+	var orig map[digest.Key]*repb.Digest
+	for i, dg := range dgs {
+		w, err := c.toWire(dg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if w == dg {
+			continue
+		}
+		if orig == nil {
+			res = append([]*repb.Digest(nil), dgs...)
+			orig = make(map[digest.Key]*repb.Digest)
+		}
+		res[i] = w
+		orig[digest.ToKey(w)] = dg
+	}
+	return res, orig, nil
+}
+
+// fromWire maps a digest of a response back to the digest the caller gave, see toWireAll.
+func fromWire(orig map[digest.Key]*repb.Digest, dg *repb.Digest) *repb.Digest {
+	if o, ok := orig[digest.ToKey(dg)]; ok {
+		return o
+	}
+	return dg
+}
+
+// toWireBlobs applies toWire to the digests of a digest-to-blob map, copying the map only if a
+// digest changes. Like toWireAll, it also returns the digests that were changed.
+func (c *Client) toWireBlobs(blobs map[digest.Key][]byte) (map[digest.Key][]byte, map[digest.Key]*repb.Digest, error) {
+	var res map[digest.Key][]byte
+	var orig map[digest.Key]*repb.Digest
+	for k, b := range blobs {
+		dg := digest.FromKey(k)
+		w, err := c.toWire(dg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if w == dg {
+			continue
+		}
+		if res == nil {
+			res = make(map[digest.Key][]byte, len(blobs))
+			for k, b := range blobs {
+				res[k] = b
 			}
-			return nil
-		})
+			orig = make(map[digest.Key]*repb.Digest)
+		}
+		delete(res, k)
+		res[digest.ToKey(w)] = b
+		orig[digest.ToKey(w)] = dg
 	}
+	if res == nil {
+		return blobs, nil, nil
+	}
+	return res, orig, nil
+}
 
-	for len(batches) > 0 {
-		select {
-		case todo <- batches[0]:
-			batches = batches[1:]
-			if len(batches)%logInterval == 0 {
-				log.V(1).Infof("%d missing batches left to query", len(batches))
-			}
-		case <-eCtx.Done():
-			close(todo)
-			return nil, eCtx.Err()
-		}
+// writeResourceName applies toResource to a digest and returns the resulting digest along with a
+// write resource name for it.
+func (c *Client) writeResourceName(dg *repb.Digest) (*repb.Digest, string, error) {
+	dg, err := c.toResource(dg)
+	if err != nil {
+		return nil, "", err
 	}
-	close(todo)
-	log.V(1).Info("Waiting for remaining query jobs")
-	err := eg.Wait()
-	log.V(1).Info("Done")
-	return missing, err
+	return dg, c.ResourceNameWrite(dg.Hash, dg.SizeBytes), nil
 }
 
-func (c *Client) resourceNameRead(hash string, sizeBytes int64) string {
-	return fmt.Sprintf("%s/blobs/%s/%d", c.InstanceName, hash, sizeBytes)
+// readResourceName applies toResource to a digest and returns the resulting digest along with its
+// read resource name.
+func (c *Client) readResourceName(dg *repb.Digest) (*repb.Digest, string, error) {
+	dg, err := c.toResource(dg)
+	if err != nil {
+		return nil, "", err
+	}
+	return dg, c.resourceNameRead(dg.Hash, dg.SizeBytes), nil
 }
 
 // ResourceNameWrite generates a valid write resource name.
 func (c *Client) ResourceNameWrite(hash string, sizeBytes int64) string {
-	return fmt.Sprintf("%s/uploads/%s/blobs/%s/%d", c.InstanceName, uuid.New(), hash, sizeBytes)
+	return c.resourceName(fmt.Sprintf("uploads/%s/blobs/%s/%d", uuid.New(), hash, sizeBytes))
+}
+
+// resourceName prefixes a resource name with the client's instance name. An empty instance name is
+// omitted along with its separator, giving e.g. "blobs/<hash>/<size>" rather than
+// "/blobs/<hash>/<size>".
+func (c *Client) resourceName(name string) string {
+	if c.InstanceName == "" {
+		return name
+	}
+	return c.InstanceName + "/" + name
 }
 
 // GetDirectoryTree returns the entire directory tree rooted at the given digest (which must target
-// a Directory stored in the CAS).
+// a Directory stored in the CAS). Each page read is subject to the client's RPC timeout and retried
+// from the last page received, while the walk as a whole is only bounded by ctx.
 func (c *Client) GetDirectoryTree(ctx context.Context, d *repb.Digest) (result []*repb.Directory, err error) {
+	return c.WalkDirectoryTree(ctx, d, func([]*repb.Directory) error { return nil })
+}
+
+// ErrStopWalk can be returned by the callback of WalkDirectoryTree to stop the walk early. It is
+// not returned as an error by WalkDirectoryTree.
+var ErrStopWalk = errors.New("stop walking the directory tree")
+
+// WalkDirectoryTree reads the directory tree rooted at the given digest, as GetDirectoryTree does,
+// calling fn with the directories of each page as it is received, e.g. to explore a huge tree
+// interactively. If fn returns ErrStopWalk, the GetTree stream is cancelled and the directories
+// received so far, including those passed to fn, are returned with a nil error. Any other error of
+// fn also stops the walk, and is returned without retrying.
+//
+// A retried stream resumes from the page token of the last page received. If the server rejects
+// that token as invalid, e.g. because it was restarted and forgot it, the walk restarts from the
+// first page, at most maxTreeRestarts times; fn is then called again with the pages it has already
+// seen.
+func (c *Client) WalkDirectoryTree(ctx context.Context, d *repb.Digest, fn func(dirs []*repb.Directory) error) (result []*repb.Directory, err error) {
+	d, err = c.toWire(d)
+	if err != nil {
+		return nil, err
+	}
 	pageTok := ""
 	result = []*repb.Directory{}
-	closure := func() error {
+	var walkErr error
+	attempt := func() error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
 		// Use the low-level GetTree method to avoid retrying twice.
 		stream, err := c.cas.GetTree(ctx, &repb.GetTreeRequest{
 			InstanceName: c.InstanceName,
 			RootDigest:   d,
 			PageToken:    pageTok,
-		})
+		}, c.rpcOpts()...)
 		if err != nil {
 			return err
 		}
 
 		for {
-			resp, err := stream.Recv()
+			var resp *repb.GetTreeResponse
+			err := c.recvWithTimeout(cancel, func() (e error) {
+				resp, e = stream.Recv()
+				return e
+			})
 			if err == io.EOF {
 				break
 			}
@@ -408,18 +2116,122 @@ func (c *Client) GetDirectoryTree(ctx context.Context, d *repb.Digest) (result [
 			}
 			pageTok = resp.NextPageToken
 			result = append(result, resp.Directories...)
+			if walkErr = fn(resp.Directories); walkErr != nil {
+				return nil
+			}
 		}
 		return nil
 	}
+	restarts := 0
+	closure := func() error {
+		for {
+			tok := pageTok
+			err := attempt()
+			if tok == "" || status.Code(err) != codes.InvalidArgument || restarts == maxTreeRestarts {
+				return err
+			}
+			restarts++
+			log.Warningf("GetTree of %s rejected page token %q, restarting from the first page: %v", digest.ToString(d), tok, err)
+			pageTok = ""
+			result = []*repb.Directory{}
+		}
+	}
 	if err := c.retrier.do(ctx, closure); err != nil {
 		return nil, err
 	}
+	if walkErr != nil && walkErr != ErrStopWalk {
+		return nil, walkErr
+	}
 	return result, nil
 }
 
+// maxTreeRestarts bounds the times a walk of a directory tree restarts from the first page after
+// the server rejects its page token.
+const maxTreeRestarts = 3
+
+// GetTreeByDigest returns the directory tree rooted at the given digest, like GetDirectoryTree, but
+// reads the Directory messages from the CAS by their digests rather than with GetTree, e.g. for
+// servers whose GetTree is slow or missing. The tree is read a level at a time, with the
+// directories of each level downloaded in batches, up to CASConcurrency at once. A directory that
+// appears several times in the tree, such as a shared subtree, is read and returned once. Every
+// Directory is checked against its digest, and a tree of more than maxTreeDirectories distinct
+// directories is rejected, so that a misbehaving server can't have the walk go on without end. The
+// root is returned first, followed by the other directories in breadth-first order. An invalid root
+// digest, or a directory with an invalid child digest, is an InvalidArgument error.
+func (c *Client) GetTreeByDigest(ctx context.Context, rootDg *repb.Digest) ([]*repb.Directory, error) {
+	if err := c.digestFn.Validate(rootDg); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid root digest: %v", err)
+	}
+	var res []*repb.Directory
+	seen := map[digest.Key]bool{digest.ToKey(rootDg): true}
+	level := []*repb.Digest{rootDg}
+	for len(level) > 0 {
+		var dgs []*repb.Digest
+		for _, dg := range level {
+			if dg.SizeBytes > 0 {
+				dgs = append(dgs, dg)
+			}
+		}
+		blobs, err := c.BatchDownloadBlobs(ctx, dgs)
+		if _, ok := err.(*DigestMismatchError); ok {
+			return nil, err
+		}
+		if err != nil {
+			return nil, gerrors.WithMessage(err, "reading directories")
+		}
+		var next []*repb.Digest
+		for _, dg := range level {
+			blob := blobs[digest.ToKey(dg)]
+			dir := &repb.Directory{}
+			if err := proto.Unmarshal(blob, dir); err != nil {
+				return nil, fmt.Errorf("invalid Directory %s: %v", digest.ToString(dg), err)
+			}
+			res = append(res, dir)
+			for _, child := range dir.Directories {
+				if err := c.digestFn.Validate(child.Digest); err != nil {
+					return nil, status.Errorf(codes.InvalidArgument, "directory %s has child %q with an invalid digest: %v", digest.ToString(dg), child.Name, err)
+				}
+				if k := digest.ToKey(child.Digest); !seen[k] {
+					seen[k] = true
+					if len(seen) > maxTreeDirectories {
+						return nil, fmt.Errorf("directory tree %s has more than %d directories", digest.ToString(rootDg), maxTreeDirectories)
+					}
+					next = append(next, child.Digest)
+				}
+			}
+		}
+		level = next
+	}
+	return res, nil
+}
+
+// maxTreeDirectories bounds the number of distinct directories read by GetTreeByDigest.
+const maxTreeDirectories = 1 << 20
+
+// recvWithTimeout calls recv, which receives a message from a stream, applying the client's RPC
+// timeout to that single message rather than to the whole stream. If the timeout expires, the
+// stream is cancelled with cancel and a DeadlineExceeded error is returned.
+func (c *Client) recvWithTimeout(cancel context.CancelFunc, recv func() error) error {
+	t := time.AfterFunc(c.rpcTimeout, cancel)
+	err := recv()
+	if !t.Stop() {
+		return status.Errorf(codes.DeadlineExceeded, "no message received on the stream within %v", c.rpcTimeout)
+	}
+	return err
+}
+
 // FlattenActionOutputs collects and flattens all the outputs of an action.
-// It downloads the output directory metadata, if required, but not the leaf file blobs.
+// It downloads the output directory metadata, if required, but not the leaf file blobs. Output
+// directories with the same Tree digest share a single download, and at most CASConcurrency
+// downloads run at once.
 func (c *Client) FlattenActionOutputs(ctx context.Context, ar *repb.ActionResult) (map[string]*Output, error) {
+	outs, _, err := c.flattenActionOutputs(ctx, ar)
+	return outs, err
+}
+
+// flattenActionOutputs is FlattenActionOutputs, also returning the Tree messages of the output
+// directories, keyed by their digests.
+func (c *Client) flattenActionOutputs(ctx context.Context, ar *repb.ActionResult) (map[string]*Output, map[digest.Key]*repb.Tree, error) {
 	outs := make(map[string]*Output)
 	for _, file := range ar.OutputFiles {
 		outs[file.Path] = &Output{
@@ -440,20 +2252,502 @@ func (c *Client) FlattenActionOutputs(ctx context.Context, ar *repb.ActionResult
 			SymlinkTarget: sm.Target,
 		}
 	}
+	// Output directories often have identical contents, so each distinct Tree is read only once.
+	var todo []*repb.OutputDirectory
+	seen := make(map[digest.Key]bool)
 	for _, dir := range ar.OutputDirectories {
-		if blob, err := c.ReadBlob(ctx, dir.TreeDigest); err == nil {
-			tree := &repb.Tree{}
-			if err := proto.Unmarshal(blob, tree); err != nil {
-				return nil, err
+		if k := digest.ToKey(dir.TreeDigest); !seen[k] {
+			seen[k] = true
+			todo = append(todo, dir)
+		}
+	}
+	trees, err := c.readOutputTrees(ctx, todo)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, dir := range ar.OutputDirectories {
+		tree := trees[digest.ToKey(dir.TreeDigest)]
+		dirouts, err := flattenTreeMessage(c.digestFn, tree, dir.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, out := range dirouts {
+			outs[out.Path] = out
+		}
+	}
+	return outs, trees, nil
+}
+
+// readOutputTrees reads the Tree messages of output directories, which must have distinct tree
+// digests, keyed by those digests.
+func (c *Client) readOutputTrees(ctx context.Context, dirs []*repb.OutputDirectory) (map[digest.Key]*repb.Tree, error) {
+	if c.casConcurrency <= 0 {
+		return nil, fmt.Errorf("CASConcurrency should be at least 1")
+	}
+	trees := make(map[digest.Key]*repb.Tree)
+	var mu sync.Mutex
+	err := c.forEachConcurrently(ctx, len(dirs), func(ctx context.Context, i int) error {
+		dir := dirs[i]
+		blob, err := c.ReadBlob(ctx, dir.TreeDigest)
+		if err != nil {
+			return gerrors.WithMessage(err, fmt.Sprintf("reading the tree of output directory %s", dir.Path))
+		}
+		tree := &repb.Tree{}
+		if err := proto.Unmarshal(blob, tree); err != nil {
+			return err
+		}
+		mu.Lock()
+		trees[digest.ToKey(dir.TreeDigest)] = tree
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return trees, nil
+}
+
+// DownloadOutputs downloads the contents of all the output files of an action into memory, keyed by
+// their paths. Output directories are expanded using their Tree messages, as in
+// FlattenActionOutputs, and the file blobs are then fetched concurrently with BatchDownloadBlobs.
+// Every blob is checked against its digest. Output symlinks are not included in the result, so that
+// they can't be mistaken for files holding their targets; use FlattenActionOutputs to list them.
+// The call is bounded by the client's OperationTimeout.
+func (c *Client) DownloadOutputs(ctx context.Context, ar *repb.ActionResult) (map[string][]byte, error) {
+	var res map[string][]byte
+	err := c.withOpTimeout(ctx, "DownloadOutputs", func(ctx context.Context) (err error) {
+		res, err = c.downloadOutputs(ctx, ar)
+		return err
+	})
+	return res, err
+}
+
+func (c *Client) downloadOutputs(ctx context.Context, ar *repb.ActionResult) (map[string][]byte, error) {
+	outs, err := c.FlattenActionOutputs(ctx, ar)
+	if err != nil {
+		return nil, err
+	}
+	var dgs []*repb.Digest
+	for _, out := range outs {
+		if out.SymlinkTarget != "" {
+			continue
+		}
+		if dg := digest.FromKey(out.Digest); dg.SizeBytes > 0 {
+			dgs = append(dgs, dg)
+		}
+	}
+	blobs, err := c.downloadOutputBlobs(ctx, dgs)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string][]byte)
+	for path, out := range outs {
+		if out.SymlinkTarget != "" {
+			continue
+		}
+		if blob, ok := blobs[out.Digest]; ok {
+			res[path] = blob
+		} else {
+			res[path] = []byte{}
+		}
+	}
+	return res, nil
+}
+
+// downloadOutputBlobs downloads the blobs of output files into memory with BatchDownloadBlobs,
+// which checks them against their digests.
+func (c *Client) downloadOutputBlobs(ctx context.Context, dgs []*repb.Digest) (map[digest.Key][]byte, error) {
+	blobs, err := c.BatchDownloadBlobs(ctx, dgs)
+	if err != nil {
+		return nil, gerrors.WithMessage(err, "downloading output files")
+	}
+	return blobs, nil
+}
+
+// StagingPolicy decides where DownloadOutputsStaged puts the contents of each output file: in
+// memory, or, for files too large to hold in memory comfortably, in a temporary file.
+type StagingPolicy struct {
+	// SpillThreshold is the size in bytes above which the contents of a file are written to a
+	// temporary file rather than kept in memory.
+	SpillThreshold int64
+	// Dir is the directory to create the temporary files in. If empty, the default directory for
+	// temporary files is used (see os.TempDir).
+	Dir string
+}
+
+// StagedOutput is the downloaded contents of an output file, as staged by DownloadOutputsStaged.
+type StagedOutput struct {
+	// Data is the contents of the file, if they were kept in memory.
+	Data []byte
+	// Path is the path of the temporary file holding the contents of the file, if they were spilled
+	// to disk, and empty otherwise.
+	Path string
+}
+
+// DownloadOutputsStaged downloads the contents of all the output files of an action like
+// DownloadOutputs, but stages them according to policy: files larger than its SpillThreshold are
+// downloaded into temporary files, with ReadBlobToFile, and the others are downloaded into memory.
+// The result tells where the contents of each file landed, keyed by its path. Files with identical
+// contents share a temporary file, and the caller owns the temporary files, which it should remove
+// when it's done with them; they are removed if the download fails. Every blob is checked against
+// its digest. The call is bounded by the client's OperationTimeout.
+func (c *Client) DownloadOutputsStaged(ctx context.Context, ar *repb.ActionResult, policy StagingPolicy) (map[string]*StagedOutput, error) {
+	var res map[string]*StagedOutput
+	err := c.withOpTimeout(ctx, "DownloadOutputsStaged", func(ctx context.Context) (err error) {
+		res, err = c.downloadOutputsStaged(ctx, ar, policy)
+		return err
+	})
+	return res, err
+}
+
+func (c *Client) downloadOutputsStaged(ctx context.Context, ar *repb.ActionResult, policy StagingPolicy) (map[string]*StagedOutput, error) {
+	outs, err := c.FlattenActionOutputs(ctx, ar)
+	if err != nil {
+		return nil, err
+	}
+	var small, large []*repb.Digest
+	seen := make(map[digest.Key]bool)
+	for _, out := range outs {
+		if out.SymlinkTarget != "" || seen[out.Digest] {
+			continue
+		}
+		seen[out.Digest] = true
+		switch dg := digest.FromKey(out.Digest); {
+		case dg.SizeBytes > policy.SpillThreshold:
+			large = append(large, dg)
+		case dg.SizeBytes > 0:
+			small = append(small, dg)
+		}
+	}
+	blobs, err := c.downloadOutputBlobs(ctx, small)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := c.spillOutputBlobs(ctx, large, policy.Dir)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]*StagedOutput)
+	for path, out := range outs {
+		if out.SymlinkTarget != "" {
+			continue
+		}
+		if p, ok := paths[out.Digest]; ok {
+			res[path] = &StagedOutput{Path: p}
+		} else if blob, ok := blobs[out.Digest]; ok {
+			res[path] = &StagedOutput{Data: blob}
+		} else {
+			res[path] = &StagedOutput{Data: []byte{}}
+		}
+	}
+	return res, nil
+}
+
+// spillOutputBlobs downloads the blobs of output files into new temporary files in dir, up to
+// CASConcurrency at a time, checking them against their digests. It returns the paths of the files,
+// keyed by the digests of their contents. If any download fails, all the files are removed.
+func (c *Client) spillOutputBlobs(ctx context.Context, dgs []*repb.Digest, dir string) (_ map[digest.Key]string, err error) {
+	if c.casConcurrency <= 0 {
+		return nil, fmt.Errorf("CASConcurrency should be at least 1")
+	}
+	paths := make(map[digest.Key]string)
+	var mu sync.Mutex // Protects paths.
+	defer func() {
+		if err != nil {
+			for _, p := range paths {
+				os.Remove(p)
+			}
+		}
+	}()
+	err = c.forEachConcurrently(ctx, len(dgs), func(ctx context.Context, i int) error {
+		dg := dgs[i]
+		f, err := ioutil.TempFile(dir, "output-*")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		mu.Lock()
+		paths[digest.ToKey(dg)] = f.Name()
+		mu.Unlock()
+		if _, err := c.ReadBlobToFile(ctx, dg, f.Name()); err != nil {
+			return gerrors.WithMessage(err, fmt.Sprintf("downloading output file %s", digest.ToString(dg)))
+		}
+		got, err := c.digestFn.FromFile(f.Name())
+		if err != nil {
+			return err
+		}
+		if !digest.Equal(got, dg) {
+			return &DigestMismatchError{Want: dg, Got: got}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// DownloadActionOutputs downloads the outputs of an action into execRoot, where the paths of the
+// outputs are relative to. It creates the output directories and the parent directories of the
+// outputs, writes each output file with its executable bit, and recreates the output symlinks,
+// replacing any files already at their paths. Every directory of the output directories' Trees is
+// created, including empty ones. Outputs at absolute paths or at paths outside execRoot, including
+// paths under a symlink already in execRoot, are rejected before anything is written. Each distinct
+// blob is downloaded once, small blobs in batches and the others with up to CASConcurrency
+// ByteStream reads at once, and checked against its digest; files with identical contents are then
+// copied locally. Files are written to temporary
+// files that are renamed into place once complete, so a failed download leaves no partially
+// written files at the output paths, although the outputs completed before it remain. The returned
+// Stats hold the number and size of the blobs downloaded, in Blobs and Bytes, and the total size of
+// the output files, in LogicalBytes. The call is bounded by the client's OperationTimeout.
+func (c *Client) DownloadActionOutputs(ctx context.Context, ar *repb.ActionResult, execRoot string) (*Stats, error) {
+	var stats *Stats
+	err := c.withOpTimeout(ctx, "DownloadActionOutputs", func(ctx context.Context) (err error) {
+		stats, err = c.downloadActionOutputs(ctx, ar, execRoot)
+		return err
+	})
+	return stats, err
+}
+
+func (c *Client) downloadActionOutputs(ctx context.Context, ar *repb.ActionResult, execRoot string) (*Stats, error) {
+	if c.casConcurrency <= 0 {
+		return nil, fmt.Errorf("CASConcurrency should be at least 1")
+	}
+	outs, trees, err := c.flattenActionOutputs(ctx, ar)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, dir := range ar.OutputDirectories {
+		treeDirs, err := treeDirectories(c.digestFn, trees[digest.ToKey(dir.TreeDigest)], dir.Path)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, treeDirs...)
+	}
+	for _, dir := range dirs {
+		if err := checkOutputPath(dir); err != nil {
+			return nil, err
+		}
+		if err := checkNoSymlinks(execRoot, dir); err != nil {
+			return nil, err
+		}
+	}
+	for _, out := range outs {
+		if err := checkOutputPath(out.Path); err != nil {
+			return nil, err
+		}
+		if err := checkNoSymlinks(execRoot, filepath.Dir(out.Path)); err != nil {
+			return nil, err
+		}
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(execRoot, dir), 0777); err != nil {
+			return nil, err
+		}
+	}
+	stats := &Stats{}
+	byDigest := make(map[digest.Key][]*Output)
+	var symlinks []*Output
+	for _, out := range outs {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(execRoot, out.Path)), 0777); err != nil {
+			return nil, err
+		}
+		if out.SymlinkTarget != "" {
+			symlinks = append(symlinks, out)
+			continue
+		}
+		byDigest[out.Digest] = append(byDigest[out.Digest], out)
+		stats.LogicalBytes += digest.FromKey(out.Digest).SizeBytes
+	}
+	maxSz := c.maxReadBatchSz(ctx)
+	var small, large []*repb.Digest
+	for k, files := range byDigest {
+		// The file downloaded first, which the others are copied from, doesn't depend on map order.
+		sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+		switch dg := digest.FromKey(k); {
+		case dg.SizeBytes == 0:
+			for _, out := range files {
+				if err := writeOutputFile(execRoot, out, func(tmp string) error { return nil }); err != nil {
+					return nil, err
+				}
+			}
+		case batchReadEntrySize(dg) > maxSz:
+			large = append(large, dg)
+		default:
+			small = append(small, dg)
+		}
+	}
+
+	err = c.BatchDownloadStream(ctx, small, func(k digest.Key, data []byte) error {
+		for _, out := range byDigest[k] {
+			if err := writeOutputFile(execRoot, out, func(tmp string) error { return ioutil.WriteFile(tmp, data, 0644) }); err != nil {
+				return err
+			}
+		}
+		stats.Blobs++
+		stats.Bytes += int64(len(data))
+		return nil
+	})
+	if err != nil {
+		return nil, gerrors.WithMessage(err, "downloading output files")
+	}
+
+	var mu sync.Mutex // Protects stats.
+	err = c.forEachConcurrently(ctx, len(large), func(ctx context.Context, i int) error {
+		dg := large[i]
+		files := byDigest[digest.ToKey(dg)]
+		err := writeOutputFile(execRoot, files[0], func(tmp string) error {
+			if _, err := c.ReadBlobToFile(ctx, dg, tmp); err != nil {
+				return err
 			}
-			dirouts, err := FlattenTree(tree, dir.Path)
+			got, err := c.digestFn.FromFile(tmp)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			for _, out := range dirouts {
-				outs[out.Path] = out
+			if !digest.Equal(got, dg) {
+				return &DigestMismatchError{Want: dg, Got: got}
+			}
+			return nil
+		})
+		if err != nil {
+			return gerrors.WithMessage(err, fmt.Sprintf("downloading output file %s", files[0].Path))
+		}
+		src := filepath.Join(execRoot, files[0].Path)
+		for _, out := range files[1:] {
+			if err := writeOutputFile(execRoot, out, func(tmp string) error { return copyFile(src, tmp) }); err != nil {
+				return err
 			}
 		}
+		mu.Lock()
+		stats.Blobs++
+		stats.Bytes += dg.SizeBytes
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, out := range symlinks {
+		path := filepath.Join(execRoot, out.Path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err := os.Symlink(out.SymlinkTarget, path); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// checkOutputPath rejects an output path that is absolute or that, once cleaned, lies outside of the
+// exec root, since writing it would modify files that aren't outputs.
+func checkOutputPath(path string) error {
+	if filepath.IsAbs(path) {
+		return fmt.Errorf("output path %q is absolute", path)
+	}
+	clean := filepath.Clean(path)
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("output path %q is outside the exec root", path)
+	}
+	return nil
+}
+
+// checkNoSymlinks rejects the directory dir under execRoot if it, or any of its parents under
+// execRoot, is a symlink, e.g. an output symlink left by a previous run, since writing outputs
+// through it could modify files outside of the exec root. The directories that don't exist yet are
+// created as real ones.
+func checkNoSymlinks(execRoot, dir string) error {
+	path := execRoot
+	for _, name := range strings.Split(filepath.Clean(dir), string(filepath.Separator)) {
+		if name == "." {
+			continue
+		}
+		path = filepath.Join(path, name)
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("output directory %q is under the symlink %s", dir, path)
+		}
+	}
+	return nil
+}
+
+// writeOutputFile writes the output file out under execRoot, by having write fill a new temporary
+// file next to it, given its path, and then renaming that into place with the output's permissions.
+// The temporary file is removed if anything fails.
+func writeOutputFile(execRoot string, out *Output, write func(tmp string) error) (err error) {
+	path := filepath.Join(execRoot, out.Path)
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Close()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	if err := write(tmp); err != nil {
+		return err
+	}
+	var mode os.FileMode = 0644
+	if out.IsExecutable {
+		mode = 0755
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// copyFile copies the contents of the file src to the file dst, which it truncates.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// GetActionResultOutput returns the standard output and error of an action. Each of them is taken
+// from the inline bytes of the ActionResult if the server inlined it, and otherwise read from the
+// CAS using its digest, checking the contents against it. An output that the action didn't produce
+// is returned as nil. A nil ActionResult is rejected with an InvalidArgument error.
+func (c *Client) GetActionResultOutput(ctx context.Context, ar *repb.ActionResult) (stdout, stderr []byte, err error) {
+	if ar == nil {
+		return nil, nil, status.Error(codes.InvalidArgument, "nil ActionResult")
+	}
+	if stdout, err = c.actionOutput(ctx, ar.StdoutRaw, ar.StdoutDigest); err != nil {
+		return nil, nil, gerrors.WithMessage(err, "reading stdout")
+	}
+	if stderr, err = c.actionOutput(ctx, ar.StderrRaw, ar.StderrDigest); err != nil {
+		return nil, nil, gerrors.WithMessage(err, "reading stderr")
+	}
+	return stdout, stderr, nil
+}
+
+// actionOutput returns the inline bytes of an action output if there are any, or else the blob
+// with the given digest.
+func (c *Client) actionOutput(ctx context.Context, raw []byte, dg *repb.Digest) ([]byte, error) {
+	if len(raw) > 0 || dg.GetSizeBytes() == 0 {
+		return raw, nil
 	}
-	return outs, nil
+	return c.ReadBlob(ctx, dg)
 }
@@ -7,13 +7,17 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/bazelbuild/remote-apis-sdks/go/client"
 	"github.com/bazelbuild/remote-apis-sdks/go/digest"
+	"github.com/golang/protobuf/proto"
 	"github.com/google/go-cmp/cmp"
 	"github.com/pborman/uuid"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
 	regrpc "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
@@ -190,15 +194,23 @@ func (f *fakeWriter) QueryWriteStatus(context.Context, *bspb.QueryWriteStatusReq
 // in a map. It also counts the number of requests to store received, for validating batching logic.
 type fakeCAS struct {
 	// blobs is the list of blobs that are considered present in the CAS.
-	blobs     map[digest.Key][]byte
-	mu        sync.RWMutex
-	batchReqs int
-	writeReqs int
+	blobs           map[digest.Key][]byte
+	mu              sync.RWMutex
+	batchReqs       int
+	batchReadReqs   int
+	readReqs        int
+	writeReqs       int
+	findMissingReqs int
+	// reportExisting makes BatchUpdateBlobs answer ALREADY_EXISTS for the blobs that are present.
+	reportExisting bool
+	// fn is the digest function of the CAS, SHA256 if nil.
+	fn *digest.Function
 }
 
 func (f *fakeCAS) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
-	f.mu.RLock()
-	defer f.mu.RUnlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.findMissingReqs++
 
 	if req.InstanceName != "instance" {
 		return nil, status.Error(codes.InvalidArgument, "test fake expected instance name \"instance\"")
@@ -231,7 +243,7 @@ func (f *fakeCAS) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlo
 
 	var resps []*repb.BatchUpdateBlobsResponse_Response
 	for _, r := range req.Requests {
-		dg := digest.FromBlob(r.Data)
+		dg := f.fn.FromBlob(r.Data)
 		key := digest.ToKey(dg)
 		if key != digest.ToKey(r.Digest) {
 			resps = append(resps, &repb.BatchUpdateBlobsResponse_Response{
@@ -241,23 +253,82 @@ func (f *fakeCAS) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlo
 			})
 			continue
 		}
+		code := codes.OK
+		if _, ok := f.blobs[key]; ok && f.reportExisting {
+			code = codes.AlreadyExists
+		}
 		f.blobs[key] = r.Data
 		resps = append(resps, &repb.BatchUpdateBlobsResponse_Response{
 			Digest: r.Digest,
-			Status: status.New(codes.OK, "").Proto(),
+			Status: status.New(code, "").Proto(),
 		})
 	}
 	return &repb.BatchUpdateBlobsResponse{Responses: resps}, nil
 }
 
 func (f *fakeCAS) BatchReadBlobs(ctx context.Context, req *repb.BatchReadBlobsRequest) (*repb.BatchReadBlobsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "test fake does not implement method")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batchReadReqs++
+
+	if req.InstanceName != "instance" {
+		return nil, status.Error(codes.InvalidArgument, "test fake expected instance name \"instance\"")
+	}
+
+	var resps []*repb.BatchReadBlobsResponse_Response
+	for _, dg := range req.Digests {
+		blob, ok := f.blobs[digest.ToKey(dg)]
+		if !ok {
+			resps = append(resps, &repb.BatchReadBlobsResponse_Response{
+				Digest: dg,
+				Status: status.Newf(codes.NotFound, "blob %s not found", digest.ToString(dg)).Proto(),
+			})
+			continue
+		}
+		resps = append(resps, &repb.BatchReadBlobsResponse_Response{
+			Digest: dg,
+			Data:   blob,
+			Status: status.New(codes.OK, "").Proto(),
+		})
+	}
+	return &repb.BatchReadBlobsResponse{Responses: resps}, nil
 }
 
 func (f *fakeCAS) GetTree(*repb.GetTreeRequest, regrpc.ContentAddressableStorage_GetTreeServer) error {
 	return status.Error(codes.Unimplemented, "test fake does not implement method")
 }
 
+// rootTreeCAS is a fakeCAS whose GetTree returns the root directory alone, in a single page.
+type rootTreeCAS struct {
+	*fakeCAS
+}
+
+func (f *rootTreeCAS) GetTree(req *repb.GetTreeRequest, stream regrpc.ContentAddressableStorage_GetTreeServer) error {
+	f.mu.RLock()
+	blob, ok := f.blobs[digest.ToKey(req.RootDigest)]
+	f.mu.RUnlock()
+	if !ok {
+		return status.Errorf(codes.NotFound, "root directory %s not found", digest.ToString(req.RootDigest))
+	}
+	dir := &repb.Directory{}
+	if err := proto.Unmarshal(blob, dir); err != nil {
+		return status.Errorf(codes.InvalidArgument, "root %s is not a directory: %v", digest.ToString(req.RootDigest), err)
+	}
+	return stream.Send(&repb.GetTreeResponse{Directories: []*repb.Directory{dir}})
+}
+
+// changingCAS is a fakeCAS that calls change whenever FindMissingBlobs is called, e.g. to modify
+// local files between building a tree and uploading it.
+type changingCAS struct {
+	*fakeCAS
+	change func()
+}
+
+func (f *changingCAS) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	f.change()
+	return f.fakeCAS.FindMissingBlobs(ctx, req)
+}
+
 func (f *fakeCAS) Write(stream bsgrpc.ByteStream_WriteServer) (err error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -325,7 +396,7 @@ func (f *fakeCAS) Write(stream bsgrpc.ByteStream_WriteServer) (err error) {
 	}
 
 	f.blobs[digest.ToKey(dg)] = buf.Bytes()
-	recvDg := digest.FromBlob(f.blobs[digest.ToKey(dg)])
+	recvDg := f.fn.FromBlob(f.blobs[digest.ToKey(dg)])
 	if diff := cmp.Diff(dg, recvDg); diff != "" {
 		delete(f.blobs, digest.ToKey(dg))
 		return status.Errorf(codes.InvalidArgument, "mismatched digest with diff:\n%s", diff)
@@ -334,6 +405,9 @@ func (f *fakeCAS) Write(stream bsgrpc.ByteStream_WriteServer) (err error) {
 }
 
 func (f *fakeCAS) Read(req *bspb.ReadRequest, stream bsgrpc.ByteStream_ReadServer) error {
+	f.mu.Lock()
+	f.readReqs++
+	f.mu.Unlock()
 	if req.ReadOffset != 0 || req.ReadLimit != 0 {
 		return status.Error(codes.Unimplemented, "test fake does not implement read_offset or limit")
 	}
@@ -346,7 +420,10 @@ func (f *fakeCAS) Read(req *bspb.ReadRequest, stream bsgrpc.ByteStream_ReadServe
 	if err != nil {
 		return status.Error(codes.InvalidArgument, "test fake expected resource name of the form \"instance/blobs/<hash>/<size>\"")
 	}
-	dg := digest.TestNew(path[2], int64(size))
+	dg, err := f.fn.New(path[2], int64(size))
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "test fake received an invalid digest: %v", err)
+	}
 	blob, ok := f.blobs[digest.ToKey(dg)]
 	if !ok {
 		return status.Errorf(codes.NotFound, "test fake missing blob with digest %s was requested", digest.ToString(dg))
@@ -355,6 +432,319 @@ func (f *fakeCAS) Read(req *bspb.ReadRequest, stream bsgrpc.ByteStream_ReadServe
 	return stream.Send(&bspb.ReadResponse{Data: blob})
 }
 
-func (f *fakeCAS) QueryWriteStatus(context.Context, *bspb.QueryWriteStatusRequest) (*bspb.QueryWriteStatusResponse, error) {
+// QueryWriteStatus reports stored blobs as complete uploads when asked for a resource name of the
+// form "instance/blobs/<hash>", with no size.
+func (f *fakeCAS) QueryWriteStatus(ctx context.Context, req *bspb.QueryWriteStatusRequest) (*bspb.QueryWriteStatusResponse, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	path := strings.Split(req.ResourceName, "/")
+	if len(path) != 3 || path[0] != "instance" || path[1] != "blobs" {
+		return nil, status.Error(codes.InvalidArgument, "test fake expected resource name of the form \"instance/blobs/<hash>\"")
+	}
+	for k := range f.blobs {
+		if dg := digest.FromKey(k); dg.Hash == path[2] {
+			return &bspb.QueryWriteStatusResponse{CommittedSize: dg.SizeBytes, Complete: true}, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "test fake has no blob with hash %s", path[2])
+}
+
+// slowWriteCAS is a fakeCAS whose Write streams, which may run concurrently, take writeDelay to be
+// acknowledged, as if the server was far away. It records the largest number of streams in flight at
+// once.
+type slowWriteCAS struct {
+	*fakeCAS
+	writeDelay  time.Duration
+	inFlight    int32
+	maxInFlight int32
+}
+
+func (f *slowWriteCAS) Write(stream bsgrpc.ByteStream_WriteServer) error {
+	n := atomic.AddInt32(&f.inFlight, 1)
+	defer atomic.AddInt32(&f.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&f.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(&f.maxInFlight, max, n) {
+			break
+		}
+	}
+	buf := new(bytes.Buffer)
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		buf.Write(req.Data)
+		if req.FinishWrite {
+			break
+		}
+	}
+	time.Sleep(f.writeDelay)
+	f.mu.Lock()
+	f.blobs[digest.ToKey(digest.FromBlob(buf.Bytes()))] = buf.Bytes()
+	f.mu.Unlock()
+	return stream.SendAndClose(&bspb.WriteResponse{CommittedSize: int64(buf.Len())})
+}
+
+// slowQueryCAS is a fakeCAS whose FindMissingBlobs calls take queryDelay to be answered.
+type slowQueryCAS struct {
+	*fakeCAS
+	queryDelay time.Duration
+}
+
+func (f *slowQueryCAS) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	time.Sleep(f.queryDelay)
+	return f.fakeCAS.FindMissingBlobs(ctx, req)
+}
+
+// downBatchCAS is a fakeCAS whose BatchUpdateBlobs calls all fail, each with an error naming the
+// first blob of its batch.
+type downBatchCAS struct {
+	*fakeCAS
+}
+
+func (f *downBatchCAS) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
+	return nil, status.Errorf(codes.Internal, "storage for blob %s is down", digest.ToString(req.Requests[0].Digest))
+}
+
+// slowReadCAS is a fakeCAS whose Read streams, which may run concurrently, take readDelay to start
+// sending data. It records the largest number of streams in flight at once.
+type slowReadCAS struct {
+	*fakeCAS
+	readDelay   time.Duration
+	inFlight    int32
+	maxInFlight int32
+}
+
+func (f *slowReadCAS) Read(req *bspb.ReadRequest, stream bsgrpc.ByteStream_ReadServer) error {
+	n := atomic.AddInt32(&f.inFlight, 1)
+	defer atomic.AddInt32(&f.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&f.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(&f.maxInFlight, max, n) {
+			break
+		}
+	}
+	time.Sleep(f.readDelay)
+	return f.fakeCAS.Read(req, stream)
+}
+
+// slowIngestWriter is a ByteStream server that takes chunkDelay to commit each chunk it receives,
+// and reports the number of bytes committed so far with QueryWriteStatus.
+type slowIngestWriter struct {
+	chunkDelay time.Duration
+	committed  int64 // Accessed atomically.
+}
+
+func (f *slowIngestWriter) Write(stream bsgrpc.ByteStream_WriteServer) error {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		time.Sleep(f.chunkDelay)
+		atomic.AddInt64(&f.committed, int64(len(req.Data)))
+		if req.FinishWrite {
+			return stream.SendAndClose(&bspb.WriteResponse{CommittedSize: atomic.LoadInt64(&f.committed)})
+		}
+	}
+}
+
+func (f *slowIngestWriter) QueryWriteStatus(context.Context, *bspb.QueryWriteStatusRequest) (*bspb.QueryWriteStatusResponse, error) {
+	return &bspb.QueryWriteStatusResponse{CommittedSize: atomic.LoadInt64(&f.committed)}, nil
+}
+
+func (f *slowIngestWriter) Read(*bspb.ReadRequest, bsgrpc.ByteStream_ReadServer) error {
+	return status.Error(codes.Unimplemented, "test fake does not implement method")
+}
+
+// metadataCAS is a fakeCAS that sends header and trailer metadata with its ByteStream responses,
+// naming the backend that served them.
+type metadataCAS struct {
+	*fakeCAS
+}
+
+func (f *metadataCAS) Write(stream bsgrpc.ByteStream_WriteServer) error {
+	stream.SetHeader(metadata.Pairs("backend", "writer"))
+	stream.SetTrailer(metadata.Pairs("served-by", "writer"))
+	return f.fakeCAS.Write(stream)
+}
+
+func (f *metadataCAS) Read(req *bspb.ReadRequest, stream bsgrpc.ByteStream_ReadServer) error {
+	stream.SetHeader(metadata.Pairs("backend", "reader"))
+	stream.SetTrailer(metadata.Pairs("served-by", "reader"))
+	return f.fakeCAS.Read(req, stream)
+}
+
+// fakeNoInstanceByteStream is a fake ByteStream server for clients with an empty instance name. It
+// stores written blobs and serves them back, and expects resource names with no instance prefix.
+type fakeNoInstanceByteStream struct {
+	mu sync.Mutex
+	// blobs are the stored blobs, keyed by "<hash>/<size>".
+	blobs map[string][]byte
+}
+
+func (f *fakeNoInstanceByteStream) Write(stream bsgrpc.ByteStream_WriteServer) error {
+	buf := new(bytes.Buffer)
+	var res string
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if res == "" {
+			res = req.ResourceName
+		}
+		buf.Write(req.Data)
+		if req.FinishWrite {
+			break
+		}
+	}
+	path := strings.Split(res, "/")
+	if len(path) != 5 || path[0] != "uploads" || path[2] != "blobs" {
+		return status.Errorf(codes.InvalidArgument, "test fake expected resource name of the form \"uploads/<uuid>/blobs/<hash>/<size>\", got %q", res)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blobs[path[3]+"/"+path[4]] = buf.Bytes()
+	return stream.SendAndClose(&bspb.WriteResponse{CommittedSize: int64(buf.Len())})
+}
+
+func (f *fakeNoInstanceByteStream) Read(req *bspb.ReadRequest, stream bsgrpc.ByteStream_ReadServer) error {
+	path := strings.Split(req.ResourceName, "/")
+	if len(path) != 3 || path[0] != "blobs" {
+		return status.Errorf(codes.InvalidArgument, "test fake expected resource name of the form \"blobs/<hash>/<size>\", got %q", req.ResourceName)
+	}
+	f.mu.Lock()
+	blob, ok := f.blobs[path[1]+"/"+path[2]]
+	f.mu.Unlock()
+	if !ok {
+		return status.Errorf(codes.NotFound, "test fake missing blob %s was requested", req.ResourceName)
+	}
+	return stream.Send(&bspb.ReadResponse{Data: blob})
+}
+
+func (f *fakeNoInstanceByteStream) QueryWriteStatus(context.Context, *bspb.QueryWriteStatusRequest) (*bspb.QueryWriteStatusResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "test fake does not implement method")
+}
+
+// fakeSizedReader implements ByteStream's Read interface, serving a blob of the requested size made
+// of zeros without ever holding it in memory, for testing reads of very large blobs.
+type fakeSizedReader struct {
+	// sent is the number of bytes sent so far, and finished the number of Read calls that returned.
+	// They must be accessed atomically.
+	sent     int64
+	finished int32
+}
+
+func (f *fakeSizedReader) Read(req *bspb.ReadRequest, stream bsgrpc.ByteStream_ReadServer) error {
+	defer atomic.AddInt32(&f.finished, 1)
+	path := strings.Split(req.ResourceName, "/")
+	if len(path) != 4 || path[0] != "instance" || path[1] != "blobs" {
+		return status.Error(codes.InvalidArgument, "test fake expected resource name of the form \"instance/blobs/<hash>/<size>\"")
+	}
+	size, err := strconv.ParseInt(path[3], 10, 64)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "test fake expected resource name of the form \"instance/blobs/<hash>/<size>\"")
+	}
+	chunk := make([]byte, 1024*1024)
+	for left := size - req.ReadOffset; left > 0; left -= int64(len(chunk)) {
+		if left < int64(len(chunk)) {
+			chunk = chunk[:left]
+		}
+		if err := stream.Send(&bspb.ReadResponse{Data: chunk}); err != nil {
+			return err
+		}
+		atomic.AddInt64(&f.sent, int64(len(chunk)))
+	}
+	return nil
+}
+
+func (f *fakeSizedReader) Write(bsgrpc.ByteStream_WriteServer) error {
+	return status.Error(codes.Unimplemented, "test fake does not implement method")
+}
+
+func (f *fakeSizedReader) QueryWriteStatus(context.Context, *bspb.QueryWriteStatusRequest) (*bspb.QueryWriteStatusResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "test fake does not implement method")
 }
+
+// fakeActionCache is a fake action cache that stores the action results it is given in a map.
+type fakeActionCache struct {
+	mu      sync.Mutex
+	results map[digest.Key]*repb.ActionResult
+}
+
+func (f *fakeActionCache) GetActionResult(ctx context.Context, req *repb.GetActionResultRequest) (*repb.ActionResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res, ok := f.results[digest.ToKey(req.ActionDigest)]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "test fake has no result for action %s", digest.ToString(req.ActionDigest))
+	}
+	return res, nil
+}
+
+func (f *fakeActionCache) UpdateActionResult(ctx context.Context, req *repb.UpdateActionResultRequest) (*repb.ActionResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if req.InstanceName != "instance" {
+		return nil, status.Error(codes.InvalidArgument, "test fake expected instance name \"instance\"")
+	}
+	f.results[digest.ToKey(req.ActionDigest)] = req.ActionResult
+	return req.ActionResult, nil
+}
+
+// fakeCapabilities is a Capabilities server advertising a maximum batch size, which can be changed
+// between calls. It counts the calls it receives.
+type fakeCapabilities struct {
+	mu       sync.Mutex
+	maxBatch int64
+	calls    int
+	// started, if not nil, receives a value when a call starts, and the call then waits until
+	// release is closed.
+	started chan struct{}
+	release chan struct{}
+}
+
+func (f *fakeCapabilities) GetCapabilities(ctx context.Context, req *repb.GetCapabilitiesRequest) (*repb.ServerCapabilities, error) {
+	f.mu.Lock()
+	f.calls++
+	started, release := f.started, f.release
+	f.mu.Unlock()
+	if started != nil {
+		started <- struct{}{}
+		<-release
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &repb.ServerCapabilities{
+		CacheCapabilities: &repb.CacheCapabilities{
+			DigestFunction:         []repb.DigestFunction{repb.DigestFunction_SHA256},
+			MaxBatchTotalSizeBytes: f.maxBatch,
+		},
+	}, nil
+}
+
+// batchSizeCAS is a fakeCAS that records the largest total size of the blobs of a BatchUpdateBlobs
+// request it received.
+type batchSizeCAS struct {
+	*fakeCAS
+	maxSz int64
+}
+
+func (f *batchSizeCAS) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
+	var sz int64
+	for _, r := range req.Requests {
+		sz += int64(len(r.Data))
+	}
+	f.mu.Lock()
+	if sz > f.maxSz {
+		f.maxSz = sz
+	}
+	f.mu.Unlock()
+	return f.fakeCAS.BatchUpdateBlobs(ctx, req)
+}
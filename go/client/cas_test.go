@@ -4,9 +4,21 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/bazelbuild/remote-apis-sdks/go/client"
 	"github.com/bazelbuild/remote-apis-sdks/go/digest"
@@ -15,6 +27,8 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/kylelemons/godebug/pretty"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	regrpc "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
@@ -169,7 +183,7 @@ func TestRead(t *testing.T) {
 	}
 }
 
-func TestWrite(t *testing.T) {
+func TestReadBlobDigestMismatch(t *testing.T) {
 	ctx := context.Background()
 	listener, err := net.Listen("tcp", ":0")
 	if err != nil {
@@ -177,57 +191,44 @@ func TestWrite(t *testing.T) {
 	}
 	defer listener.Close()
 	server := grpc.NewServer()
-	fake := &fakeWriter{}
+	want, corrupted := []byte("foo"), []byte("fob")
+	dg := digest.FromBlob(want)
+	fake := &fakeCAS{blobs: map[digest.Key][]byte{digest.ToKey(dg): corrupted}}
 	bsgrpc.RegisterByteStreamServer(server, fake)
 	go server.Serve(listener)
 	defer server.Stop()
-	c, err := client.Dial(ctx, instance, client.DialParams{
-		Service:    listener.Addr().String(),
-		NoSecurity: true,
-	}, client.ChunkMaxSize(20)) // Use small write chunk size for tests.
-	if err != nil {
-		t.Fatalf("Error connecting to server: %v", err)
-	}
-	defer c.Close()
-
-	tests := []struct {
-		name string
-		blob []byte
-	}{
-		{
-			name: "empty blob",
-			blob: []byte{},
-		},
-		{
-			name: "small blob",
-			blob: []byte("this is a pretty small blob comparatively"),
-		},
-		{
-			name: "5MB zero blob",
-			blob: make([]byte, 5*1024*1024),
-		},
-	}
 
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			gotDg, err := c.WriteBlob(ctx, tc.blob)
+	for _, returnData := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ReturnDataOnDigestMismatch=%t", returnData), func(t *testing.T) {
+			c, err := client.Dial(ctx, instance, client.DialParams{
+				Service:    listener.Addr().String(),
+				NoSecurity: true,
+			}, client.ReturnDataOnDigestMismatch(returnData))
 			if err != nil {
-				t.Errorf("c.WriteBlob(ctx, blob) gave error %s, wanted nil", err)
+				t.Fatalf("Error connecting to server: %v", err)
 			}
-			if fake.err != nil {
-				t.Errorf("c.WriteBlob(ctx, blob) caused the server to return error %s (possibly unseen by c)", fake.err)
+			defer c.Close()
+
+			got, err := c.ReadBlob(ctx, dg)
+			mismatch, ok := err.(*client.DigestMismatchError)
+			if !ok {
+				t.Fatalf("c.ReadBlob(ctx, dg) gave error %v, want a *DigestMismatchError", err)
 			}
-			if diff := cmp.Diff(tc.blob, fake.buf, cmp.Comparer(bytes.Equal)); diff != "" {
-				t.Errorf("c.WriteBlob(ctx, blob) had diff on blobs (-sent, +received):\n%s", diff)
+			if !proto.Equal(mismatch.Want, dg) || !proto.Equal(mismatch.Got, digest.FromBlob(corrupted)) {
+				t.Errorf("c.ReadBlob(ctx, dg) gave mismatch of %v and %v, want %v and %v", mismatch.Want, mismatch.Got, dg, digest.FromBlob(corrupted))
 			}
-			if diff := cmp.Diff(digest.FromBlob(tc.blob), gotDg); diff != "" {
-				t.Errorf("c.WriteBlob(ctx, blob) had diff on digest returned (want -> got):\n%s", diff)
+			var wantData []byte
+			if returnData {
+				wantData = corrupted
+			}
+			if !bytes.Equal(got, wantData) {
+				t.Errorf("c.ReadBlob(ctx, dg) returned data %q, want %q", got, wantData)
 			}
 		})
 	}
 }
 
-func TestMissingBlobs(t *testing.T) {
+func TestVerifyReads(t *testing.T) {
 	ctx := context.Background()
 	listener, err := net.Listen("tcp", ":0")
 	if err != nil {
@@ -235,94 +236,89 @@ func TestMissingBlobs(t *testing.T) {
 	}
 	defer listener.Close()
 	server := grpc.NewServer()
-	fake := &fakeCAS{}
-	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	want, corrupted, good := []byte("foo"), []byte("fob"), []byte("bar")
+	dg, goodDg := digest.FromBlob(want), digest.FromBlob(good)
+	fake := &fakeCAS{blobs: map[digest.Key][]byte{digest.ToKey(dg): corrupted, digest.ToKey(goodDg): good}}
+	bsgrpc.RegisterByteStreamServer(server, fake)
 	go server.Serve(listener)
 	defer server.Stop()
-	c, err := client.Dial(ctx, instance, client.DialParams{
-		Service:    listener.Addr().String(),
-		NoSecurity: true,
-	})
+	execRoot, err := ioutil.TempDir("", "VerifyReads")
 	if err != nil {
-		t.Fatalf("Error connecting to server: %v", err)
+		t.Fatalf("failed to make temp dir: %v", err)
 	}
-	defer c.Close()
+	defer os.RemoveAll(execRoot)
+	fpath := filepath.Join(execRoot, "blob")
 
-	tests := []struct {
+	reads := []struct {
 		name string
-		// present is the digests present in the CAS.
-		present []*repb.Digest
-		// input is the digests given to MissingBlobs.
-		input []*repb.Digest
-		// want is the returned list of digests.
-		want []*repb.Digest
+		read func(c *client.Client, dg *repb.Digest) error
 	}{
 		{
-			name:    "none present",
-			present: nil,
-			input: []*repb.Digest{
-				digest.FromBlob([]byte("foo")),
-				digest.FromBlob([]byte("bar")),
-				digest.FromBlob([]byte("baz")),
-			},
-			want: []*repb.Digest{
-				digest.FromBlob([]byte("foo")),
-				digest.FromBlob([]byte("bar")),
-				digest.FromBlob([]byte("baz")),
+			name: "ReadBlobStreamed",
+			read: func(c *client.Client, dg *repb.Digest) error {
+				_, err := c.ReadBlobStreamed(ctx, dg, ioutil.Discard)
+				return err
 			},
 		},
 		{
-			name: "all present",
-			present: []*repb.Digest{
-				digest.FromBlob([]byte("baz")),
-				digest.FromBlob([]byte("foo")),
-				digest.FromBlob([]byte("bar")),
+			name: "ReadBlobToFile",
+			read: func(c *client.Client, dg *repb.Digest) error {
+				_, err := c.ReadBlobToFile(ctx, dg, fpath)
+				return err
 			},
-			input: []*repb.Digest{
-				digest.FromBlob([]byte("foo")),
-				digest.FromBlob([]byte("bar")),
-				digest.FromBlob([]byte("baz")),
-			},
-			want: nil,
 		},
 		{
-			name: "some present",
-			present: []*repb.Digest{
-				digest.FromBlob([]byte("foo")),
-				digest.FromBlob([]byte("bar")),
-			},
-			input: []*repb.Digest{
-				digest.FromBlob([]byte("foo")),
-				digest.FromBlob([]byte("bar")),
-				digest.FromBlob([]byte("baz")),
-			},
-			want: []*repb.Digest{
-				digest.FromBlob([]byte("baz")),
+			name: "BlobReader",
+			read: func(c *client.Client, dg *repb.Digest) error {
+				r, err := c.BlobReader(ctx, dg)
+				if err != nil {
+					return err
+				}
+				defer r.Close()
+				_, err = ioutil.ReadAll(r)
+				return err
 			},
 		},
 	}
-
-	printCfg := &pretty.Config{Compact: true}
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			fake.blobs = make(map[digest.Key][]byte)
-			for _, dg := range tc.present {
-				// We don't care about blob content in this test so just include nil values.
-				fake.blobs[digest.ToKey(dg)] = nil
-			}
-			t.Logf("CAS contains digests %s", printCfg.Sprint(tc.present))
-			got, err := c.MissingBlobs(ctx, tc.input)
-			if err != nil {
-				t.Errorf("c.MissingBlobs(ctx, %s) gave error %s, expected nil", printCfg.Sprint(tc.input), err)
-			}
-			if diff := cmp.Diff(tc.want, got); diff != "" {
-				t.Errorf("c.MissingBlobs(ctx, %s) gave diff (want -> got):\n%s", printCfg.Sprint(tc.input), diff)
-			}
-		})
+	for _, verify := range []bool{false, true} {
+		c, err := client.Dial(ctx, instance, client.DialParams{
+			Service:    listener.Addr().String(),
+			NoSecurity: true,
+		}, client.VerifyReads(verify))
+		if err != nil {
+			t.Fatalf("Error connecting to server: %v", err)
+		}
+		defer c.Close()
+		for _, r := range reads {
+			t.Run(fmt.Sprintf("%s/VerifyReads=%t", r.name, verify), func(t *testing.T) {
+				if err := r.read(c, goodDg); err != nil {
+					t.Errorf("%s of an intact blob gave error %v, want nil", r.name, err)
+				}
+				err := r.read(c, dg)
+				if !verify {
+					if err != nil {
+						t.Errorf("%s of a corrupted blob gave error %v, want nil", r.name, err)
+					}
+					return
+				}
+				mismatch, ok := err.(*client.DigestMismatchError)
+				if !ok {
+					t.Fatalf("%s of a corrupted blob gave error %v, want a *DigestMismatchError", r.name, err)
+				}
+				if !proto.Equal(mismatch.Want, dg) || !proto.Equal(mismatch.Got, digest.FromBlob(corrupted)) {
+					t.Errorf("%s gave mismatch of %v and %v, want %v and %v", r.name, mismatch.Want, mismatch.Got, dg, digest.FromBlob(corrupted))
+				}
+				if r.name == "ReadBlobToFile" {
+					if _, err := os.Stat(fpath); !os.IsNotExist(err) {
+						t.Errorf("os.Stat(%q) gave error %v after a mismatch, want the file to be removed", fpath, err)
+					}
+				}
+			})
+		}
 	}
 }
 
-func TestWriteBlobs(t *testing.T) {
+func TestBlobsWithMetadata(t *testing.T) {
 	ctx := context.Background()
 	listener, err := net.Listen("tcp", ":0")
 	if err != nil {
@@ -330,110 +326,121 @@ func TestWriteBlobs(t *testing.T) {
 	}
 	defer listener.Close()
 	server := grpc.NewServer()
-	fake := &fakeCAS{}
+	fake := &metadataCAS{&fakeCAS{blobs: make(map[digest.Key][]byte)}}
 	bsgrpc.RegisterByteStreamServer(server, fake)
-	regrpc.RegisterContentAddressableStorageServer(server, fake)
 	go server.Serve(listener)
 	defer server.Stop()
 	c, err := client.Dial(ctx, instance, client.DialParams{
 		Service:    listener.Addr().String(),
 		NoSecurity: true,
-	}, client.ChunkMaxSize(20)) // Use small write chunk size for tests.
+	})
 	if err != nil {
 		t.Fatalf("Error connecting to server: %v", err)
 	}
 	defer c.Close()
 
-	var thousandBlobs [][]byte
-	var halfThousandBlobs [][]byte
-	for i := 0; i < 1000; i++ {
-		var buf = new(bytes.Buffer)
-		binary.Write(buf, binary.LittleEndian, i)
-		thousandBlobs = append(thousandBlobs, buf.Bytes())
-		if i%2 == 0 {
-			halfThousandBlobs = append(halfThousandBlobs, buf.Bytes())
+	blob := []byte("foo")
+	dg, md, err := c.WriteBlobWithMetadata(ctx, blob)
+	if err != nil {
+		t.Fatalf("c.WriteBlobWithMetadata(ctx, blob) gave error %v, want nil", err)
+	}
+	if !proto.Equal(dg, digest.FromBlob(blob)) {
+		t.Errorf("c.WriteBlobWithMetadata(ctx, blob) = %v, want %v", dg, digest.FromBlob(blob))
+	}
+	if got := md.Header.Get("backend"); len(got) != 1 || got[0] != "writer" {
+		t.Errorf("c.WriteBlobWithMetadata(ctx, blob) returned backend header %v, want [writer]", got)
+	}
+	if got := md.Trailer.Get("served-by"); len(got) != 1 || got[0] != "writer" {
+		t.Errorf("c.WriteBlobWithMetadata(ctx, blob) returned served-by trailer %v, want [writer]", got)
+	}
+
+	got, md, err := c.ReadBlobWithMetadata(ctx, dg)
+	if err != nil {
+		t.Fatalf("c.ReadBlobWithMetadata(ctx, dg) gave error %v, want nil", err)
+	}
+	if !bytes.Equal(got, blob) {
+		t.Errorf("c.ReadBlobWithMetadata(ctx, dg) = %q, want %q", got, blob)
+	}
+	if got := md.Header.Get("backend"); len(got) != 1 || got[0] != "reader" {
+		t.Errorf("c.ReadBlobWithMetadata(ctx, dg) returned backend header %v, want [reader]", got)
+	}
+	if got := md.Trailer.Get("served-by"); len(got) != 1 || got[0] != "reader" {
+		t.Errorf("c.ReadBlobWithMetadata(ctx, dg) returned served-by trailer %v, want [reader]", got)
+	}
+}
+
+func TestReadBlobToFilePreallocate(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	dir, err := ioutil.TempDir("", "read_to_file_preallocate")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fpath := filepath.Join(dir, "blob")
+	// Record the size of the file when the download starts.
+	var startSize int64
+	interceptor := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if fi, err := os.Stat(fpath); err == nil {
+			startSize = fi.Size()
 		}
+		return handler(srv, ss)
 	}
+	server := grpc.NewServer(grpc.StreamInterceptor(interceptor))
+	fake := &fakeReader{blob: []byte("foobarbaz"), chunks: []int{3, 3, 3}}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	dg := digest.FromBlob(fake.blob)
 
 	tests := []struct {
-		name string
-		// input is the blobs to try to store; they're converted to a file map by the test
-		input [][]byte
-		// present is the blobs already present in the CAS; they're pre-loaded into the fakeCAS object
-		// and the test verifies no attempt was made to upload them.
-		present [][]byte
+		preallocate   client.PreallocateFiles
+		wantStartSize int64
 	}{
-		{
-			name:    "No blobs",
-			input:   nil,
-			present: nil,
-		},
-		{
-			name:    "None present",
-			input:   [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")},
-			present: nil,
-		},
-		{
-			name:    "All present",
-			input:   [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")},
-			present: [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")},
-		},
-		{
-			name:    "Some present",
-			input:   [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")},
-			present: [][]byte{[]byte("bar")},
-		},
-		{
-			name:    "1000 blobs heavy concurrency",
-			input:   thousandBlobs,
-			present: halfThousandBlobs,
-		},
+		{preallocate: false, wantStartSize: 0},
+		{preallocate: true, wantStartSize: dg.SizeBytes},
 	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("PreallocateFiles=%t", tc.preallocate), func(t *testing.T) {
+			c, err := client.Dial(ctx, instance, client.DialParams{
+				Service:    listener.Addr().String(),
+				NoSecurity: true,
+			}, tc.preallocate)
+			if err != nil {
+				t.Fatalf("Error connecting to server: %v", err)
+			}
+			defer c.Close()
+			// A longer existing file is replaced.
+			if err := ioutil.WriteFile(fpath, []byte("0123456789abcdef"), 0644); err != nil {
+				t.Fatalf("failed to write %s: %v", fpath, err)
+			}
 
-	for _, ub := range []client.UseBatchOps{false, true} {
-		t.Run(fmt.Sprintf("UsingBatch:%t", ub), func(t *testing.T) {
-			ub.Apply(c)
-			for _, tc := range tests {
-				t.Run(tc.name, func(t *testing.T) {
-					fake.blobs = make(map[digest.Key][]byte)
-					fake.batchReqs = 0
-					fake.writeReqs = 0
-					for _, blob := range tc.present {
-						// We don't care about blob content in this test so just include nil values.
-						fake.blobs[digest.ToKey(digest.FromBlob(blob))] = nil
-					}
-					input := make(map[digest.Key][]byte)
-					for _, blob := range tc.input {
-						input[digest.ToKey(digest.FromBlob(blob))] = blob
-					}
-
-					err := c.WriteBlobs(ctx, input)
-					if err != nil {
-						t.Fatalf("c.WriteBlobs(ctx, inputs) gave error %s, expected nil", err)
-					}
-
-					for _, blob := range tc.present {
-						dg := digest.FromBlob(blob)
-						if gotBlob := fake.blobs[digest.ToKey(dg)]; gotBlob != nil {
-							t.Errorf("blob %v with digest %s was uploaded even though it was already present in the CAS", blob, digest.ToString(dg))
-						}
-						// Remove this from the input map so we don't iterate it below.
-						delete(input, digest.ToKey(dg))
-					}
-					for dg, blob := range input {
-						if gotBlob, ok := fake.blobs[dg]; !ok {
-							t.Errorf("blob %v with digest %s was not uploaded, expected it to be present in the CAS", blob, digest.ToString(digest.FromKey(dg)))
-						} else if diff := cmp.Diff(blob, gotBlob); diff != "" {
-							t.Errorf("blob %v with digest %s had diff on uploaded blob:\n%s", blob, digest.ToString(digest.FromKey(dg)), diff)
-						}
-					}
-				})
+			n, err := c.ReadBlobToFile(ctx, dg, fpath)
+			if err != nil {
+				t.Fatalf("c.ReadBlobToFile(ctx, %v, path) gave error %v, want nil", dg, err)
+			}
+			if n != dg.SizeBytes {
+				t.Errorf("c.ReadBlobToFile(ctx, %v, path) = %d, want %d", dg, n, dg.SizeBytes)
+			}
+			got, err := ioutil.ReadFile(fpath)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", fpath, err)
+			}
+			if !bytes.Equal(got, fake.blob) {
+				t.Errorf("c.ReadBlobToFile(ctx, %v, path) left file contents %q, want %q", dg, got, fake.blob)
+			}
+			if startSize != tc.wantStartSize {
+				t.Errorf("file had size %d when the download started, want %d", startSize, tc.wantStartSize)
 			}
 		})
 	}
 }
 
-func TestWriteBlobsBatching(t *testing.T) {
+func TestReadBlobRangeToFileAt(t *testing.T) {
 	ctx := context.Background()
 	listener, err := net.Listen("tcp", ":0")
 	if err != nil {
@@ -441,95 +448,3982 @@ func TestWriteBlobsBatching(t *testing.T) {
 	}
 	defer listener.Close()
 	server := grpc.NewServer()
-	fake := &fakeCAS{}
+	fake := &fakeReader{blob: []byte("foobarbaz"), chunks: []int{3, 3, 3}}
 	bsgrpc.RegisterByteStreamServer(server, fake)
-	regrpc.RegisterContentAddressableStorageServer(server, fake)
 	go server.Serve(listener)
 	defer server.Stop()
 	c, err := client.Dial(ctx, instance, client.DialParams{
 		Service:    listener.Addr().String(),
 		NoSecurity: true,
-	}, client.UseBatchOps(true))
+	})
 	if err != nil {
 		t.Fatalf("Error connecting to server: %v", err)
 	}
 	defer c.Close()
+	dir, err := ioutil.TempDir("", "read_to_file_at")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	dg := digest.FromBlob(fake.blob)
 
-	const mb = 1024 * 1024
 	tests := []struct {
-		name      string
-		sizes     []int
-		batchReqs int
-		writeReqs int
+		name       string
+		existing   []byte // If nil, the file doesn't exist.
+		offset     int64
+		limit      int64
+		fileOffset int64
+		want       []byte
+		wantN      int64
 	}{
 		{
-			name:      "single small blob",
-			sizes:     []int{1},
-			batchReqs: 0,
-			writeReqs: 1,
+			name:       "patch middle of file",
+			existing:   []byte("0123456789"),
+			offset:     2,
+			limit:      5,
+			fileOffset: 3,
+			want:       []byte("012obarb89"),
+			wantN:      5,
 		},
 		{
-			name:      "large and small blobs hitting max exactly",
-			sizes:     []int{client.MaxBatchSz - 1, client.MaxBatchSz - 1, client.MaxBatchSz - 1, 1, 1, 1},
-			batchReqs: 3,
-			writeReqs: 0,
+			name:       "extend file",
+			existing:   []byte("0123"),
+			offset:     6,
+			fileOffset: 2,
+			want:       []byte("01baz"),
+			wantN:      3,
 		},
 		{
-			name:      "small batches of big blobs",
-			sizes:     []int{1*mb + 1, 1*mb + 1, 1*mb + 1, 1*mb + 1, 1*mb + 1, 1*mb + 1, 1*mb + 1},
+			name:       "new file",
+			offset:     3,
+			limit:      3,
+			fileOffset: 2,
+			want:       []byte("\x00\x00bar"),
+			wantN:      3,
+		},
+	}
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fpath := filepath.Join(dir, fmt.Sprintf("file%d", i))
+			if tc.existing != nil {
+				if err := ioutil.WriteFile(fpath, tc.existing, 0644); err != nil {
+					t.Fatalf("failed to write %s: %v", fpath, err)
+				}
+			}
+			n, err := c.ReadBlobRangeToFileAt(ctx, dg, tc.offset, tc.limit, fpath, tc.fileOffset)
+			if err != nil {
+				t.Fatalf("c.ReadBlobRangeToFileAt(ctx, dg, %d, %d, fpath, %d) gave error %v, want nil", tc.offset, tc.limit, tc.fileOffset, err)
+			}
+			got, err := ioutil.ReadFile(fpath)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", fpath, err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("c.ReadBlobRangeToFileAt(ctx, dg, %d, %d, fpath, %d) left file contents %q, want %q", tc.offset, tc.limit, tc.fileOffset, got, tc.want)
+			}
+			if n != tc.wantN {
+				t.Errorf("c.ReadBlobRangeToFileAt(ctx, dg, %d, %d, fpath, %d) = %d, want %d", tc.offset, tc.limit, tc.fileOffset, n, tc.wantN)
+			}
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeWriter{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.ChunkMaxSize(client.MinWriteChunkSize)) // Use the smallest write chunk size for tests.
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	tests := []struct {
+		name string
+		blob []byte
+	}{
+		{
+			name: "empty blob",
+			blob: []byte{},
+		},
+		{
+			name: "small blob",
+			blob: []byte("this is a pretty small blob comparatively"),
+		},
+		{
+			name: "blob of one chunk",
+			blob: bytes.Repeat([]byte("a"), client.MinWriteChunkSize),
+		},
+		{
+			name: "blob of 2.5 chunks",
+			blob: bytes.Repeat([]byte("ab"), client.MinWriteChunkSize*5/4),
+		},
+		{
+			name: "5MB zero blob",
+			blob: make([]byte, 5*1024*1024),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			gotDg, err := c.WriteBlob(ctx, tc.blob)
+			if err != nil {
+				t.Errorf("c.WriteBlob(ctx, blob) gave error %s, wanted nil", err)
+			}
+			if fake.err != nil {
+				t.Errorf("c.WriteBlob(ctx, blob) caused the server to return error %s (possibly unseen by c)", fake.err)
+			}
+			if diff := cmp.Diff(tc.blob, fake.buf, cmp.Comparer(bytes.Equal)); diff != "" {
+				t.Errorf("c.WriteBlob(ctx, blob) had diff on blobs (-sent, +received):\n%s", diff)
+			}
+			if diff := cmp.Diff(digest.FromBlob(tc.blob), gotDg); diff != "" {
+				t.Errorf("c.WriteBlob(ctx, blob) had diff on digest returned (want -> got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestUploadIfMissing(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	blob := []byte("a blob that is referenced again and again")
+	wantDg := digest.FromBlob(blob)
+	for i, wantUploaded := range []bool{true, false} {
+		dg, uploaded, err := c.UploadIfMissing(ctx, blob)
+		if err != nil {
+			t.Fatalf("c.UploadIfMissing(ctx, blob) #%d gave error %v, want nil", i, err)
+		}
+		if !proto.Equal(dg, wantDg) || uploaded != wantUploaded {
+			t.Errorf("c.UploadIfMissing(ctx, blob) #%d = (%s, %t), want (%s, %t)", i, digest.ToString(dg), uploaded, digest.ToString(wantDg), wantUploaded)
+		}
+		if got := fake.blobs[digest.ToKey(wantDg)]; !bytes.Equal(got, blob) {
+			t.Errorf("c.UploadIfMissing(ctx, blob) #%d stored %q, want %q", i, got, blob)
+		}
+		if fake.findMissingReqs != i+1 {
+			t.Errorf("c.UploadIfMissing(ctx, blob) #%d made %d FindMissingBlobs calls in total, want %d", i, fake.findMissingReqs, i+1)
+		}
+		if fake.writeReqs != 1 {
+			t.Errorf("c.UploadIfMissing(ctx, blob) #%d made %d Write calls in total, want 1", i, fake.writeReqs)
+		}
+	}
+}
+
+func TestWriteBytesFromReader(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeWriter{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.ChunkMaxSize(client.MinWriteChunkSize)) // Use the smallest write chunk size for tests.
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	// The blob spans several chunks.
+	blob := bytes.Repeat([]byte("this is a pretty small blob comparatively"), client.MinWriteChunkSize/10)
+	dg := digest.FromBlob(blob)
+	name := c.ResourceNameWrite(dg.Hash, dg.SizeBytes)
+	// The reader is not seekable, as from a pipe.
+	if err := c.WriteBytesFromReader(ctx, name, struct{ io.Reader }{bytes.NewReader(blob)}, dg.SizeBytes); err != nil {
+		t.Fatalf("c.WriteBytesFromReader(ctx, %q, r, %d) gave error %v, want nil", name, dg.SizeBytes, err)
+	}
+	if fake.err != nil {
+		t.Errorf("c.WriteBytesFromReader(ctx, %q, r, %d) caused the server to return error %v", name, dg.SizeBytes, fake.err)
+	}
+	if !bytes.Equal(fake.buf, blob) {
+		t.Errorf("c.WriteBytesFromReader(ctx, %q, r, %d) sent %d bytes, want the %d bytes of the blob", name, dg.SizeBytes, len(fake.buf), len(blob))
+	}
+
+	if err := c.WriteBytesFromReader(ctx, name, bytes.NewReader(blob[:len(blob)-10]), dg.SizeBytes); err == nil {
+		t.Errorf("c.WriteBytesFromReader(ctx, %q, r, %d) with a short input gave no error, want error", name, dg.SizeBytes)
+	}
+	cCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := c.WriteBytesFromReader(cCtx, name, bytes.NewReader(blob), dg.SizeBytes); err == nil {
+		t.Errorf("c.WriteBytesFromReader(cCtx, %q, r, %d) with a canceled context gave no error, want error", name, dg.SizeBytes)
+	}
+}
+
+func TestChunkMaxSize(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeWriter{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	blob := bytes.Repeat([]byte("abcdefgh"), (client.MaxWriteChunkSize+client.MaxWriteChunkSize/2)/8)
+	dg := digest.FromBlob(blob)
+	tests := []struct {
+		name      string
+		chunkSize int
+		wantErr   bool
+	}{
+		{name: "default", chunkSize: client.DefaultMaxWriteChunkSize},
+		{name: "minimum", chunkSize: client.MinWriteChunkSize},
+		// The fake rejects chunks of more than 2MB, so larger sizes must be clamped.
+		{name: "clamped", chunkSize: 2 * client.MaxWriteChunkSize},
+		{name: "too small", chunkSize: client.MinWriteChunkSize - 1, wantErr: true},
+		{name: "zero", chunkSize: 0, wantErr: true},
+		{name: "negative", chunkSize: -1, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := client.Dial(ctx, instance, client.DialParams{
+				Service:    listener.Addr().String(),
+				NoSecurity: true,
+			}, client.ChunkMaxSize(tc.chunkSize))
+			if tc.wantErr {
+				if err == nil {
+					c.Close()
+					t.Errorf("client.Dial with ChunkMaxSize(%d) gave no error, want error", tc.chunkSize)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error connecting to server: %v", err)
+			}
+			defer c.Close()
+
+			fake.buf, fake.err = nil, nil
+			name := c.ResourceNameWrite(dg.Hash, dg.SizeBytes)
+			for _, write := range []struct {
+				desc string
+				fn   func() error
+			}{
+				{"c.WriteBytes(ctx, name, blob)", func() error { return c.WriteBytes(ctx, name, blob) }},
+				{"c.WriteBytesFromReader(ctx, name, r, size)", func() error {
+					return c.WriteBytesFromReader(ctx, name, bytes.NewReader(blob), dg.SizeBytes)
+				}},
+			} {
+				if err := write.fn(); err != nil {
+					t.Fatalf("%s with ChunkMaxSize(%d) gave error %v, want nil", write.desc, tc.chunkSize, err)
+				}
+				if fake.err != nil {
+					t.Errorf("%s with ChunkMaxSize(%d) caused the server to return error %v", write.desc, tc.chunkSize, fake.err)
+				}
+				if !bytes.Equal(fake.buf, blob) {
+					t.Errorf("%s with ChunkMaxSize(%d) sent %d bytes, want %d", write.desc, tc.chunkSize, len(fake.buf), len(blob))
+				}
+			}
+		})
+	}
+
+	// Applied to an existing client, sizes above the maximum are clamped and sizes below the minimum
+	// are ignored.
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+	for _, tc := range []struct{ chunkSize, want int }{
+		{chunkSize: 0, want: client.DefaultMaxWriteChunkSize},
+		{chunkSize: 2 * client.MaxWriteChunkSize, want: client.MaxWriteChunkSize},
+		{chunkSize: client.MinWriteChunkSize + 1, want: client.MinWriteChunkSize + 1},
+		{chunkSize: client.MinWriteChunkSize - 1, want: client.MinWriteChunkSize + 1},
+	} {
+		client.ChunkMaxSize(tc.chunkSize).Apply(c)
+		if got := c.Config().ChunkMaxSize; got != tc.want {
+			t.Errorf("ChunkMaxSize(%d).Apply(c) set the chunk size to %d, want %d", tc.chunkSize, got, tc.want)
+		}
+	}
+}
+
+func TestWriteCommitProgress(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &slowIngestWriter{chunkDelay: 20 * time.Millisecond}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	type commit struct {
+		name             string
+		committed, total int64
+	}
+	var mu sync.Mutex
+	var commits []commit
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.ChunkMaxSize(client.MinWriteChunkSize), client.CommitProgress{
+		Interval: 5 * time.Millisecond,
+		OnCommit: func(name string, committed, total int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			commits = append(commits, commit{name, committed, total})
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	// The blob is sent in 5 chunks, which take 100ms to commit.
+	blob := bytes.Repeat([]byte("0123"), 5*client.MinWriteChunkSize/4)
+	name := fmt.Sprintf("instance/uploads/abc/blobs/foo/%d", len(blob))
+	if err := c.WriteBytes(ctx, name, blob); err != nil {
+		t.Fatalf("c.WriteBytes(ctx, %q, blob) gave error %v, want nil", name, err)
+	}
+	mu.Lock()
+	got := append([]commit(nil), commits...)
+	mu.Unlock()
+	if len(got) == 0 {
+		t.Fatalf("c.WriteBytes(ctx, %q, blob) reported no commit progress", name)
+	}
+	var last int64
+	for _, cm := range got {
+		if cm.name != name || cm.total != int64(len(blob)) {
+			t.Errorf("OnCommit(%q, %d, %d) was called, want name %q and total %d", cm.name, cm.committed, cm.total, name, len(blob))
+		}
+		if cm.committed < last || cm.committed > cm.total {
+			t.Errorf("OnCommit(_, %d, %d) was called after reporting %d committed bytes", cm.committed, cm.total, last)
+		}
+		last = cm.committed
+	}
+	// No progress is reported once the write returned.
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(commits) != len(got) {
+		t.Errorf("OnCommit was called %d times after c.WriteBytes returned", len(commits)-len(got))
+	}
+}
+
+func TestUppercaseHashes(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, &rootTreeCAS{fake})
+	go server.Serve(listener)
+	defer server.Stop()
+
+	upper := func(dg *repb.Digest) *repb.Digest {
+		return &repb.Digest{Hash: strings.ToUpper(dg.Hash), SizeBytes: dg.SizeBytes}
+	}
+	present, missing, written := []byte("present"), []byte("missing"), []byte("written")
+	presentDg, missingDg, writtenDg := upper(digest.FromBlob(present)), upper(digest.FromBlob(missing)), upper(digest.FromBlob(written))
+	dir, err := proto.Marshal(&repb.Directory{Files: []*repb.FileNode{{Name: "present", Digest: digest.FromBlob(present)}}})
+	if err != nil {
+		t.Fatalf("proto.Marshal(directory) gave error %v", err)
+	}
+	dirDg := upper(digest.FromBlob(dir))
+
+	t.Run("RejectUppercaseHashes", func(t *testing.T) {
+		c, err := client.Dial(ctx, instance, client.DialParams{
+			Service:    listener.Addr().String(),
+			NoSecurity: true,
+		})
+		if err != nil {
+			t.Fatalf("Error connecting to server: %v", err)
+		}
+		defer c.Close()
+		fake.blobs = map[digest.Key][]byte{digest.ToKey(digest.FromBlob(present)): present}
+
+		checkErr := func(call string, err error) {
+			t.Helper()
+			if st, _ := status.FromError(err); st.Code() != codes.InvalidArgument || !strings.Contains(st.Message(), digest.ToString(presentDg)) {
+				t.Errorf("%s gave error %v, want InvalidArgument naming %s", call, err, digest.ToString(presentDg))
+			}
+		}
+		_, err = c.ReadBlob(ctx, presentDg)
+		checkErr("c.ReadBlob(ctx, uppercase digest)", err)
+		_, err = c.MissingBlobs(ctx, []*repb.Digest{presentDg})
+		checkErr("c.MissingBlobs(ctx, uppercase digests)", err)
+		_, err = c.BatchDownloadBlobs(ctx, []*repb.Digest{presentDg})
+		checkErr("c.BatchDownloadBlobs(ctx, uppercase digests)", err)
+		err = c.BatchWriteBlobs(ctx, map[digest.Key][]byte{digest.ToKey(presentDg): present})
+		checkErr("c.BatchWriteBlobs(ctx, uppercase digests)", err)
+		_, err = c.GetDirectoryTree(ctx, presentDg)
+		checkErr("c.GetDirectoryTree(ctx, uppercase digest)", err)
+	})
+
+	t.Run("LowercaseHashes", func(t *testing.T) {
+		c, err := client.Dial(ctx, instance, client.DialParams{
+			Service:    listener.Addr().String(),
+			NoSecurity: true,
+		}, client.LowercaseHashes)
+		if err != nil {
+			t.Fatalf("Error connecting to server: %v", err)
+		}
+		defer c.Close()
+		fake.blobs = map[digest.Key][]byte{
+			digest.ToKey(digest.FromBlob(present)): present,
+			digest.ToKey(digest.FromBlob(dir)):     dir,
+		}
+
+		if got, err := c.ReadBlob(ctx, presentDg); err != nil || !bytes.Equal(got, present) {
+			t.Errorf("c.ReadBlob(ctx, uppercase digest) = (%q, %v), want (%q, nil)", got, err, present)
+		}
+		gotMissing, err := c.MissingBlobs(ctx, []*repb.Digest{presentDg, missingDg})
+		if err != nil {
+			t.Errorf("c.MissingBlobs(ctx, uppercase digests) gave error %v, want nil", err)
+		} else if diff := cmp.Diff([]*repb.Digest{missingDg}, gotMissing); diff != "" {
+			t.Errorf("c.MissingBlobs(ctx, uppercase digests) gave result diff (-want +got):\n%s", diff)
+		}
+		gotBlobs, err := c.BatchDownloadBlobs(ctx, []*repb.Digest{presentDg})
+		if err != nil {
+			t.Errorf("c.BatchDownloadBlobs(ctx, uppercase digests) gave error %v, want nil", err)
+		} else if diff := cmp.Diff(map[digest.Key][]byte{digest.ToKey(presentDg): present}, gotBlobs); diff != "" {
+			t.Errorf("c.BatchDownloadBlobs(ctx, uppercase digests) gave result diff (-want +got):\n%s", diff)
+		}
+		if err := c.WriteBlobs(ctx, map[digest.Key][]byte{digest.ToKey(writtenDg): written}); err != nil {
+			t.Errorf("c.WriteBlobs(ctx, uppercase digests) gave error %v, want nil", err)
+		}
+		if got := fake.blobs[digest.ToKey(digest.FromBlob(written))]; !bytes.Equal(got, written) {
+			t.Errorf("c.WriteBlobs(ctx, uppercase digests) stored %q under the lowercase digest, want %q", got, written)
+		}
+		// Results are keyed by the caller's digests.
+		existed, err := c.BatchWriteBlobsWithExisting(ctx, map[digest.Key][]byte{digest.ToKey(writtenDg): written})
+		if err != nil {
+			t.Errorf("c.BatchWriteBlobsWithExisting(ctx, uppercase digests) gave error %v, want nil", err)
+		} else if diff := cmp.Diff(map[digest.Key]bool{digest.ToKey(writtenDg): false}, existed); diff != "" {
+			t.Errorf("c.BatchWriteBlobsWithExisting(ctx, uppercase digests) gave result diff (-want +got):\n%s", diff)
+		}
+		err = c.BatchWriteBlobs(ctx, map[digest.Key][]byte{digest.ToKey(writtenDg): []byte("corrupted")})
+		if bErr, ok := err.(*client.BatchWriteBlobsError); !ok {
+			t.Errorf("c.BatchWriteBlobs(ctx, uppercase digest of other data) gave error %v, want a *BatchWriteBlobsError", err)
+		} else if _, ok := bErr.Errors[digest.ToKey(writtenDg)]; !ok || len(bErr.Errors) != 1 {
+			t.Errorf("c.BatchWriteBlobs(ctx, uppercase digest of other data) gave errors %v, want one for %s", bErr.Errors, digest.ToString(writtenDg))
+		}
+		dirs, err := c.GetDirectoryTree(ctx, dirDg)
+		if err != nil {
+			t.Errorf("c.GetDirectoryTree(ctx, uppercase digest) gave error %v, want nil", err)
+		} else if len(dirs) != 1 || len(dirs[0].Files) != 1 || dirs[0].Files[0].Name != "present" {
+			t.Errorf("c.GetDirectoryTree(ctx, uppercase digest) = %v, want the directory holding \"present\"", dirs)
+		}
+	})
+}
+
+func TestHashLength(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+	dir, err := ioutil.TempDir("", "hash_length")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fpath := filepath.Join(dir, "blob")
+
+	blob := []byte("blob")
+	sha256Dg := digest.FromBlob(blob)
+	sha1Dg := &repb.Digest{Hash: "7f48e8ee4a2a4ac8fe9c8a2e2f2cbbd6a4fc6ac6", SizeBytes: int64(len(blob))}
+	calls := []struct {
+		name string
+		call func(dg *repb.Digest) error
+	}{
+		{
+			name: "ReadBlob",
+			call: func(dg *repb.Digest) error {
+				_, err := c.ReadBlob(ctx, dg)
+				return err
+			},
+		},
+		{
+			name: "ReadBlobToFile",
+			call: func(dg *repb.Digest) error {
+				_, err := c.ReadBlobToFile(ctx, dg, fpath)
+				return err
+			},
+		},
+		{
+			name: "WriteBlobReader",
+			call: func(dg *repb.Digest) error {
+				return c.WriteBlobReader(ctx, dg, bytes.NewReader(blob))
+			},
+		},
+	}
+	for _, call := range calls {
+		t.Run(call.name+", SHA256", func(t *testing.T) {
+			fake.blobs = map[digest.Key][]byte{digest.ToKey(sha256Dg): blob}
+			if err := call.call(sha256Dg); err != nil {
+				t.Errorf("%s with a SHA256 hash gave error %v, want nil", call.name, err)
+			}
+		})
+		t.Run(call.name+", SHA1", func(t *testing.T) {
+			fake.blobs = make(map[digest.Key][]byte)
+			fake.readReqs, fake.writeReqs = 0, 0
+			err := call.call(sha1Dg)
+			if st, _ := status.FromError(err); st.Code() != codes.InvalidArgument || !strings.Contains(st.Message(), "SHA1") {
+				t.Errorf("%s with a SHA1 hash gave error %v, want InvalidArgument naming SHA1", call.name, err)
+			}
+			if fake.readReqs != 0 || fake.writeReqs != 0 {
+				t.Errorf("%s with a SHA1 hash made %d Read and %d Write calls, want none", call.name, fake.readReqs, fake.writeReqs)
+			}
+		})
+	}
+}
+
+func TestDigestFunction(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{fn: digest.SHA1, blobs: make(map[digest.Key][]byte)}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	params := client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}
+	if _, err := client.Dial(ctx, instance, params, client.DigestFunction(repb.DigestFunction_UNKNOWN)); err == nil {
+		t.Errorf("Dial with an unsupported DigestFunction gave no error")
+	}
+	c, err := client.Dial(ctx, instance, params, client.DigestFunction(repb.DigestFunction_SHA1))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+	// A client of a SHA256 CAS in the same process keeps using SHA256.
+	other, err := client.Dial(ctx, instance, params)
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer other.Close()
+
+	if got := c.Config().DigestFunction; got != repb.DigestFunction_SHA1 {
+		t.Errorf("c.Config().DigestFunction = %v, want SHA1", got)
+	}
+	if got := other.Config().DigestFunction; got != repb.DigestFunction_SHA256 {
+		t.Errorf("other.Config().DigestFunction = %v, want SHA256", got)
+	}
+	blob := []byte("blob")
+	want := digest.SHA1.FromBlob(blob)
+	dg, err := c.WriteBlob(ctx, blob)
+	if err != nil {
+		t.Fatalf("c.WriteBlob(ctx, blob) gave error %v, want nil", err)
+	}
+	if !digest.Equal(dg, want) {
+		t.Errorf("c.WriteBlob(ctx, blob) = %v, want %v", dg, want)
+	}
+	if got, err := c.ReadBlob(ctx, dg); err != nil || !bytes.Equal(got, blob) {
+		t.Errorf("c.ReadBlob(ctx, %v) = (%q, %v), want (%q, nil)", dg, got, err, blob)
+	}
+	more := []byte("other blob")
+	blobs := map[digest.Key][]byte{digest.ToKey(digest.SHA1.FromBlob(more)): more}
+	if err := c.WriteBlobs(ctx, blobs); err != nil {
+		t.Errorf("c.WriteBlobs(ctx, blobs) gave error %v, want nil", err)
+	}
+	for k := range blobs {
+		if _, ok := fake.blobs[k]; !ok {
+			t.Errorf("c.WriteBlobs(ctx, blobs) didn't store %v", digest.FromKey(k))
+		}
+	}
+	if _, err := other.ReadBlob(ctx, dg); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("other.ReadBlob(ctx, %v) gave error %v, want InvalidArgument", dg, err)
+	}
+	if _, err := client.NewMirrorClient(0, c, other); err == nil {
+		t.Errorf("NewMirrorClient with clients of different digest functions gave no error")
+	}
+}
+
+func TestMissingBlobs(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	tests := []struct {
+		name string
+		// present is the digests present in the CAS.
+		present []*repb.Digest
+		// input is the digests given to MissingBlobs.
+		input []*repb.Digest
+		// want is the returned list of digests.
+		want []*repb.Digest
+	}{
+		{
+			name:    "none present",
+			present: nil,
+			input: []*repb.Digest{
+				digest.FromBlob([]byte("foo")),
+				digest.FromBlob([]byte("bar")),
+				digest.FromBlob([]byte("baz")),
+			},
+			want: []*repb.Digest{
+				digest.FromBlob([]byte("foo")),
+				digest.FromBlob([]byte("bar")),
+				digest.FromBlob([]byte("baz")),
+			},
+		},
+		{
+			name: "all present",
+			present: []*repb.Digest{
+				digest.FromBlob([]byte("baz")),
+				digest.FromBlob([]byte("foo")),
+				digest.FromBlob([]byte("bar")),
+			},
+			input: []*repb.Digest{
+				digest.FromBlob([]byte("foo")),
+				digest.FromBlob([]byte("bar")),
+				digest.FromBlob([]byte("baz")),
+			},
+			want: nil,
+		},
+		{
+			name: "some present",
+			present: []*repb.Digest{
+				digest.FromBlob([]byte("foo")),
+				digest.FromBlob([]byte("bar")),
+			},
+			input: []*repb.Digest{
+				digest.FromBlob([]byte("foo")),
+				digest.FromBlob([]byte("bar")),
+				digest.FromBlob([]byte("baz")),
+			},
+			want: []*repb.Digest{
+				digest.FromBlob([]byte("baz")),
+			},
+		},
+	}
+
+	printCfg := &pretty.Config{Compact: true}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.blobs = make(map[digest.Key][]byte)
+			for _, dg := range tc.present {
+				// We don't care about blob content in this test so just include nil values.
+				fake.blobs[digest.ToKey(dg)] = nil
+			}
+			t.Logf("CAS contains digests %s", printCfg.Sprint(tc.present))
+			got, err := c.MissingBlobs(ctx, tc.input)
+			if err != nil {
+				t.Errorf("c.MissingBlobs(ctx, %s) gave error %s, expected nil", printCfg.Sprint(tc.input), err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("c.MissingBlobs(ctx, %s) gave diff (want -> got):\n%s", printCfg.Sprint(tc.input), diff)
+			}
+		})
+	}
+}
+
+func TestBlobPresence(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	foo, bar, baz := digest.FromBlob([]byte("foo")), digest.FromBlob([]byte("bar")), digest.FromBlob([]byte("baz"))
+	tests := []struct {
+		name string
+		// present is the digests present in the CAS.
+		present []*repb.Digest
+		// input is the digests given to BlobPresence.
+		input []*repb.Digest
+		// want is the returned presence of each digest.
+		want map[digest.Key]bool
+	}{
+		{
+			name:    "none present",
+			present: nil,
+			input:   []*repb.Digest{foo, bar, baz},
+			want:    map[digest.Key]bool{digest.ToKey(foo): false, digest.ToKey(bar): false, digest.ToKey(baz): false},
+		},
+		{
+			name:    "all present",
+			present: []*repb.Digest{baz, foo, bar},
+			input:   []*repb.Digest{foo, bar, baz},
+			want:    map[digest.Key]bool{digest.ToKey(foo): true, digest.ToKey(bar): true, digest.ToKey(baz): true},
+		},
+		{
+			name:    "some present",
+			present: []*repb.Digest{foo, bar},
+			input:   []*repb.Digest{foo, bar, baz, foo},
+			want:    map[digest.Key]bool{digest.ToKey(foo): true, digest.ToKey(bar): true, digest.ToKey(baz): false},
+		},
+		{
+			name:  "no input",
+			input: nil,
+			want:  map[digest.Key]bool{},
+		},
+	}
+
+	printCfg := &pretty.Config{Compact: true}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.blobs = make(map[digest.Key][]byte)
+			for _, dg := range tc.present {
+				fake.blobs[digest.ToKey(dg)] = nil
+			}
+			got, err := c.BlobPresence(ctx, tc.input)
+			if err != nil {
+				t.Errorf("c.BlobPresence(ctx, %s) gave error %s, expected nil", printCfg.Sprint(tc.input), err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("c.BlobPresence(ctx, %s) gave diff (want -> got):\n%s", printCfg.Sprint(tc.input), diff)
+			}
+		})
+	}
+}
+
+func TestQueryBlobs(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.FindMissingBatchSize(2), client.PresenceCache{MaxEntries: 10})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	var dgs []*repb.Digest
+	for i := 0; i < 5; i++ {
+		dgs = append(dgs, digest.FromBlob([]byte(fmt.Sprintf("blob%d", i))))
+	}
+	// Blobs 0, 2 and 3 are present.
+	for _, i := range []int{0, 2, 3} {
+		fake.blobs[digest.ToKey(dgs[i])] = nil
+	}
+	got, err := c.QueryBlobs(ctx, dgs)
+	if err != nil {
+		t.Fatalf("c.QueryBlobs(ctx, digests) gave error %v, want nil", err)
+	}
+	want := map[digest.Key]client.BlobQueryResult{
+		digest.ToKey(dgs[0]): {Present: true, Batch: 0},
+		digest.ToKey(dgs[1]): {Present: false, Batch: 0},
+		digest.ToKey(dgs[2]): {Present: true, Batch: 1},
+		digest.ToKey(dgs[3]): {Present: true, Batch: 1},
+		digest.ToKey(dgs[4]): {Present: false, Batch: 2},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("c.QueryBlobs(ctx, digests) gave diff (-want +got):\n%s", diff)
+	}
+
+	// The present blobs are now in the presence cache, but are queried again all the same.
+	fake.findMissingReqs = 0
+	delete(fake.blobs, digest.ToKey(dgs[2]))
+	got, err = c.QueryBlobs(ctx, dgs)
+	if err != nil {
+		t.Fatalf("c.QueryBlobs(ctx, digests) gave error %v, want nil", err)
+	}
+	want[digest.ToKey(dgs[2])] = client.BlobQueryResult{Present: false, Batch: 1}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("c.QueryBlobs(ctx, digests) after caching gave diff (-want +got):\n%s", diff)
+	}
+	if fake.findMissingReqs != 3 {
+		t.Errorf("c.QueryBlobs(ctx, digests) after caching made %d FindMissingBlobs calls, want 3", fake.findMissingReqs)
+	}
+}
+
+func TestMissingBlobsBatching(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	// The server rejects requests over the default gRPC message size limit of 4 MB.
+	server := grpc.NewServer()
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	// digests returns n digests with hashes of the given length.
+	digests := func(n, hashLen int) []*repb.Digest {
+		var dgs []*repb.Digest
+		for i := 0; i < n; i++ {
+			hash := fmt.Sprintf("%0*d", hashLen, i)
+			dgs = append(dgs, &repb.Digest{Hash: hash, SizeBytes: 1})
+		}
+		return dgs
+	}
+	tests := []struct {
+		name            string
+		opts            []client.Opt
+		input           []*repb.Digest
+		wantFindMissing int
+	}{
+		{
+			name:            "default batch size",
+			input:           digests(25000, 64),
+			wantFindMissing: 3,
+		},
+		{
+			name:            "configured batch size",
+			opts:            []client.Opt{client.FindMissingBatchSize(2)},
+			input:           digests(5, 64),
+			wantFindMissing: 3,
+		},
+		{
+			name:            "requests limited by message size",
+			input:           digests(10000, 600),
+			wantFindMissing: 2,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := client.Dial(ctx, instance, client.DialParams{
+				Service:    listener.Addr().String(),
+				NoSecurity: true,
+			}, tc.opts...)
+			if err != nil {
+				t.Fatalf("Error connecting to server: %v", err)
+			}
+			defer c.Close()
+			fake.findMissingReqs = 0
+
+			got, err := c.MissingBlobs(ctx, tc.input)
+			if err != nil {
+				t.Fatalf("c.MissingBlobs(ctx, input) gave error %v, expected nil", err)
+			}
+			if len(got) != len(tc.input) {
+				t.Errorf("c.MissingBlobs(ctx, input) returned %d digests, want %d", len(got), len(tc.input))
+			}
+			if fake.findMissingReqs != tc.wantFindMissing {
+				t.Errorf("%d FindMissingBlobs requests received, want %d", fake.findMissingReqs, tc.wantFindMissing)
+			}
+		})
+	}
+}
+
+func TestAuditBlobs(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	// The small batches are queried concurrently.
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.FindMissingBatchSize(100))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	var input, wantPresent, wantMissing []*repb.Digest
+	for i := 0; i < 3000; i++ {
+		blob := []byte(fmt.Sprintf("blob %d", i))
+		dg := digest.FromBlob(blob)
+		input = append(input, dg)
+		if i%3 == 0 {
+			fake.blobs[digest.ToKey(dg)] = blob
+			wantPresent = append(wantPresent, dg)
+		} else {
+			wantMissing = append(wantMissing, dg)
+		}
+	}
+	// Duplicates are only reported once.
+	input = append(input, input[:10]...)
+
+	present, missing, err := c.AuditBlobs(ctx, input)
+	if err != nil {
+		t.Fatalf("c.AuditBlobs(ctx, input) gave error %v, want nil", err)
+	}
+	if diff := cmp.Diff(wantPresent, present); diff != "" {
+		t.Errorf("c.AuditBlobs(ctx, input) gave present digests diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(wantMissing, missing); diff != "" {
+		t.Errorf("c.AuditBlobs(ctx, input) gave missing digests diff (-want +got):\n%s", diff)
+	}
+	if fake.findMissingReqs != 30 {
+		t.Errorf("%d FindMissingBlobs requests received, want 30", fake.findMissingReqs)
+	}
+}
+
+func TestWriteBlobs(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.ChunkMaxSize(client.MinWriteChunkSize)) // Use the smallest write chunk size for tests.
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	var thousandBlobs [][]byte
+	var halfThousandBlobs [][]byte
+	for i := 0; i < 1000; i++ {
+		var buf = new(bytes.Buffer)
+		binary.Write(buf, binary.LittleEndian, i)
+		thousandBlobs = append(thousandBlobs, buf.Bytes())
+		if i%2 == 0 {
+			halfThousandBlobs = append(halfThousandBlobs, buf.Bytes())
+		}
+	}
+
+	tests := []struct {
+		name string
+		// input is the blobs to try to store; they're converted to a file map by the test
+		input [][]byte
+		// present is the blobs already present in the CAS; they're pre-loaded into the fakeCAS object
+		// and the test verifies no attempt was made to upload them.
+		present [][]byte
+	}{
+		{
+			name:    "No blobs",
+			input:   nil,
+			present: nil,
+		},
+		{
+			name:    "None present",
+			input:   [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")},
+			present: nil,
+		},
+		{
+			name:    "All present",
+			input:   [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")},
+			present: [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")},
+		},
+		{
+			name:    "Some present",
+			input:   [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")},
+			present: [][]byte{[]byte("bar")},
+		},
+		{
+			name:    "1000 blobs heavy concurrency",
+			input:   thousandBlobs,
+			present: halfThousandBlobs,
+		},
+		{
+			name:    "Blobs of several chunks",
+			input:   [][]byte{bytes.Repeat([]byte("foo"), client.MinWriteChunkSize*5/6), bytes.Repeat([]byte("bar"), client.MinWriteChunkSize)},
+			present: nil,
+		},
+	}
+
+	for _, ub := range []client.UseBatchOps{false, true} {
+		t.Run(fmt.Sprintf("UsingBatch:%t", ub), func(t *testing.T) {
+			ub.Apply(c)
+			for _, tc := range tests {
+				t.Run(tc.name, func(t *testing.T) {
+					fake.blobs = make(map[digest.Key][]byte)
+					fake.batchReqs = 0
+					fake.writeReqs = 0
+					for _, blob := range tc.present {
+						// We don't care about blob content in this test so just include nil values.
+						fake.blobs[digest.ToKey(digest.FromBlob(blob))] = nil
+					}
+					input := make(map[digest.Key][]byte)
+					for _, blob := range tc.input {
+						input[digest.ToKey(digest.FromBlob(blob))] = blob
+					}
+
+					err := c.WriteBlobs(ctx, input)
+					if err != nil {
+						t.Fatalf("c.WriteBlobs(ctx, inputs) gave error %s, expected nil", err)
+					}
+
+					for _, blob := range tc.present {
+						dg := digest.FromBlob(blob)
+						if gotBlob := fake.blobs[digest.ToKey(dg)]; gotBlob != nil {
+							t.Errorf("blob %v with digest %s was uploaded even though it was already present in the CAS", blob, digest.ToString(dg))
+						}
+						// Remove this from the input map so we don't iterate it below.
+						delete(input, digest.ToKey(dg))
+					}
+					for dg, blob := range input {
+						if gotBlob, ok := fake.blobs[dg]; !ok {
+							t.Errorf("blob %v with digest %s was not uploaded, expected it to be present in the CAS", blob, digest.ToString(digest.FromKey(dg)))
+						} else if diff := cmp.Diff(blob, gotBlob); diff != "" {
+							t.Errorf("blob %v with digest %s had diff on uploaded blob:\n%s", blob, digest.ToString(digest.FromKey(dg)), diff)
+						}
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestWriteBlobsBatching(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.UseBatchOps(true))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	const mb = 1024 * 1024
+	tests := []struct {
+		name      string
+		sizes     []int
+		batchReqs int
+		writeReqs int
+		// streamThreshold is applied to the client for this test case.
+		streamThreshold client.StreamThreshold
+	}{
+		{
+			name:      "single small blob",
+			sizes:     []int{1},
+			batchReqs: 0,
+			writeReqs: 1,
+		},
+		{
+			// With their digests and framing, the large blobs don't fit in a batch even on their own.
+			name:      "large and small blobs hitting max exactly",
+			sizes:     []int{client.MaxBatchSz - 1, client.MaxBatchSz - 1, client.MaxBatchSz - 1, 1, 1, 1},
+			batchReqs: 1,
+			writeReqs: 3,
+		},
+		{
+			// The blobs add up to the maximum, but a batch of all of them would exceed the gRPC message
+			// size limit, since each blob adds its own overhead.
+			name:      "blob just under max with small blobs",
+			sizes:     append([]int{client.MaxBatchSz - 2000}, repeatInt(100, 20)...),
+			batchReqs: 2,
+			writeReqs: 0,
+		},
+		{
+			name:      "small batches of big blobs",
+			sizes:     []int{1*mb + 1, 1*mb + 1, 1*mb + 1, 1*mb + 1, 1*mb + 1, 1*mb + 1, 1*mb + 1},
 			batchReqs: 2,
 			writeReqs: 1,
 		},
 		{
-			name:      "batch with blob that's too big",
-			sizes:     []int{5 * mb, 1 * mb, 1 * mb, 1 * mb},
-			batchReqs: 1,
-			writeReqs: 1,
+			name:      "batch with blob that's too big",
+			sizes:     []int{5 * mb, 1 * mb, 1 * mb, 1 * mb},
+			batchReqs: 1,
+			writeReqs: 1,
+		},
+		{
+			name:      "many small blobs",
+			sizes:     []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+			batchReqs: 1,
+			writeReqs: 0,
+		},
+		{
+			name:            "blob above stream threshold",
+			sizes:           []int{1*mb + mb/2, 10 * 1024, 10 * 1024, 10 * 1024},
+			batchReqs:       1,
+			writeReqs:       1,
+			streamThreshold: 1 * mb,
+		},
+		{
+			name:            "blob at stream threshold",
+			sizes:           []int{1 * mb, 1*mb - 1, 10 * 1024},
+			batchReqs:       1,
+			writeReqs:       1,
+			streamThreshold: 1 * mb,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.blobs = make(map[digest.Key][]byte)
+			fake.writeReqs = 0
+			fake.batchReqs = 0
+			tc.streamThreshold.Apply(c)
+			blobs := make(map[digest.Key][]byte)
+			for i, sz := range tc.sizes {
+				blob := make([]byte, int(sz))
+				blob[0] = byte(i) // Ensure blobs are distinct
+				blobs[digest.ToKey(digest.FromBlob(blob))] = blob
+			}
+
+			err := c.WriteBlobs(ctx, blobs)
+			if err != nil {
+				t.Fatalf("c.WriteBlobs(ctx, inputs) gave error %s, expected nil", err)
+			}
+
+			for k, blob := range blobs {
+				dg := digest.FromKey(k)
+				if gotBlob, ok := fake.blobs[k]; !ok {
+					t.Errorf("blob of size %d with digest %s was not uploaded, expected it to be present in the CAS", dg.SizeBytes, digest.ToString(dg))
+				} else if diff := cmp.Diff(blob, gotBlob, cmp.Comparer(bytes.Equal)); diff != "" {
+					t.Errorf("blob of size %d with digest %s had diff on uploaded blob:\n%s", dg.SizeBytes, digest.ToString(dg), diff)
+				}
+			}
+			if fake.batchReqs != tc.batchReqs {
+				t.Errorf("%d requests were made to BatchUpdateBlobs, wanted %d", fake.batchReqs, tc.batchReqs)
+			}
+			if fake.writeReqs != tc.writeReqs {
+				t.Errorf("%d requests were made to Write, wanted %d", fake.writeReqs, tc.writeReqs)
+			}
+		})
+	}
+}
+
+// repeatInt returns a slice of n copies of v.
+func repeatInt(v, n int) []int {
+	res := make([]int, n)
+	for i := range res {
+		res[i] = v
+	}
+	return res
+}
+
+func TestFlattenActionOutputs(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.UseBatchOps(true))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	fooDigest := digest.TestNew("1001", 1)
+	barDigest := digest.TestNew("1002", 2)
+	dirB := &repb.Directory{
+		Files: []*repb.FileNode{
+			{Name: "foo", Digest: fooDigest, IsExecutable: true},
+		},
+	}
+	bDigest := digest.TestFromProto(dirB)
+	dirA := &repb.Directory{
+		Directories: []*repb.DirectoryNode{
+			{Name: "b", Digest: bDigest},
+		},
+		Files: []*repb.FileNode{
+			{Name: "bar", Digest: barDigest},
+		},
+	}
+	aDigest := digest.TestFromProto(dirA)
+	root := &repb.Directory{
+		Directories: []*repb.DirectoryNode{
+			{Name: "a", Digest: aDigest},
+			{Name: "b", Digest: bDigest},
+		},
+	}
+	tree := &repb.Tree{
+		Root:     root,
+		Children: []*repb.Directory{dirA, dirB},
+	}
+	treeBlob, err := proto.Marshal(tree)
+	if err != nil {
+		t.Errorf("failed marshalling Tree: %s", err)
+	}
+	treeDigest := digest.FromBlob(treeBlob)
+	treeA := &repb.Tree{
+		Root:     dirA,
+		Children: []*repb.Directory{dirB},
+	}
+	treeABlob, err := proto.Marshal(treeA)
+	if err != nil {
+		t.Errorf("failed marshalling Tree: %s", err)
+	}
+	treeADigest := digest.FromBlob(treeABlob)
+	fake.blobs = make(map[digest.Key][]byte)
+	fake.blobs[digest.ToKey(treeDigest)] = treeBlob
+	fake.blobs[digest.ToKey(treeADigest)] = treeABlob
+	ar := &repb.ActionResult{
+		OutputFiles: []*repb.OutputFile{
+			&repb.OutputFile{Path: "foo", Digest: fooDigest}},
+		OutputFileSymlinks: []*repb.OutputSymlink{
+			&repb.OutputSymlink{Path: "x/bar", Target: "../dir/a/bar"}},
+		OutputDirectorySymlinks: []*repb.OutputSymlink{
+			&repb.OutputSymlink{Path: "x/a", Target: "../dir/a"}},
+		OutputDirectories: []*repb.OutputDirectory{
+			&repb.OutputDirectory{Path: "dir", TreeDigest: treeDigest},
+			&repb.OutputDirectory{Path: "dir2", TreeDigest: treeADigest},
+		},
+	}
+	outputs, err := c.FlattenActionOutputs(ctx, ar)
+	if err != nil {
+		t.Errorf("error in FlattenActionOutputs: %s", err)
+	}
+	wantOutputs := map[string]*client.Output{
+		"dir/a/b/foo": &client.Output{Digest: digest.ToKey(fooDigest), IsExecutable: true},
+		"dir/a/bar":   &client.Output{Digest: digest.ToKey(barDigest)},
+		"dir/b/foo":   &client.Output{Digest: digest.ToKey(fooDigest), IsExecutable: true},
+		"dir2/b/foo":  &client.Output{Digest: digest.ToKey(fooDigest), IsExecutable: true},
+		"dir2/bar":    &client.Output{Digest: digest.ToKey(barDigest)},
+		"foo":         &client.Output{Digest: digest.ToKey(fooDigest)},
+		"x/a":         &client.Output{SymlinkTarget: "../dir/a"},
+		"x/bar":       &client.Output{SymlinkTarget: "../dir/a/bar"},
+	}
+	if len(outputs) != len(wantOutputs) {
+		t.Errorf("FlattenActionOutputs gave wrong number of outputs: want %d, got %d", len(wantOutputs), len(outputs))
+	}
+	for path, wantOut := range wantOutputs {
+		got, ok := outputs[path]
+		if !ok {
+			t.Errorf("expected output %s is missing", path)
+		}
+		if got.Path != path {
+			t.Errorf("FlattenActionOutputs keyed %s output with %s path", got.Path, path)
+		}
+		if wantOut.Digest != got.Digest {
+			t.Errorf("FlattenActionOutputs gave digest diff on %s: want %v, got: %v", path, wantOut.Digest, got.Digest)
+		}
+		if wantOut.IsExecutable != got.IsExecutable {
+			t.Errorf("FlattenActionOutputs gave IsExecutable diff on %s: want %v, got: %v", path, wantOut.IsExecutable, got.IsExecutable)
+		}
+		if wantOut.SymlinkTarget != got.SymlinkTarget {
+			t.Errorf("FlattenActionOutputs gave symlink target diff on %s: want %s, got: %s", path, wantOut.SymlinkTarget, got.SymlinkTarget)
+		}
+	}
+}
+
+func TestFlattenActionOutputsSharedTree(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	fooDigest := digest.TestNew("1001", 1)
+	tree := &repb.Tree{Root: &repb.Directory{Files: []*repb.FileNode{{Name: "foo", Digest: fooDigest}}}}
+	treeBlob, err := proto.Marshal(tree)
+	if err != nil {
+		t.Fatalf("failed marshalling Tree: %s", err)
+	}
+	treeDigest := digest.FromBlob(treeBlob)
+	fake.blobs = map[digest.Key][]byte{digest.ToKey(treeDigest): treeBlob}
+	ar := &repb.ActionResult{
+		OutputDirectories: []*repb.OutputDirectory{
+			{Path: "dir1", TreeDigest: treeDigest},
+			{Path: "dir2", TreeDigest: treeDigest},
+		},
+	}
+	outputs, err := c.FlattenActionOutputs(ctx, ar)
+	if err != nil {
+		t.Fatalf("c.FlattenActionOutputs(ctx, ar) gave error %v, want nil", err)
+	}
+	for _, path := range []string{"dir1/foo", "dir2/foo"} {
+		if out, ok := outputs[path]; !ok || out.Digest != digest.ToKey(fooDigest) {
+			t.Errorf("c.FlattenActionOutputs(ctx, ar) gave output %v for %s, want digest %v", out, path, fooDigest)
+		}
+	}
+	if fake.readReqs != 1 {
+		t.Errorf("%d Read requests received, want 1", fake.readReqs)
+	}
+}
+
+func TestFlattenActionOutputsConcurrency(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &slowReadCAS{fakeCAS: &fakeCAS{}, readDelay: 10 * time.Millisecond}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	const concurrency = 5
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.CASConcurrency(concurrency))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	fooDigest := digest.TestNew("1001", 1)
+	fake.blobs = make(map[digest.Key][]byte)
+	ar := &repb.ActionResult{}
+	for i := 0; i < 200; i++ {
+		tree := &repb.Tree{Root: &repb.Directory{Files: []*repb.FileNode{{Name: fmt.Sprintf("foo%d", i), Digest: fooDigest}}}}
+		treeBlob, err := proto.Marshal(tree)
+		if err != nil {
+			t.Fatalf("failed marshalling Tree: %s", err)
+		}
+		treeDigest := digest.FromBlob(treeBlob)
+		fake.blobs[digest.ToKey(treeDigest)] = treeBlob
+		ar.OutputDirectories = append(ar.OutputDirectories, &repb.OutputDirectory{Path: fmt.Sprintf("dir%d", i), TreeDigest: treeDigest})
+	}
+	outputs, err := c.FlattenActionOutputs(ctx, ar)
+	if err != nil {
+		t.Fatalf("c.FlattenActionOutputs(ctx, ar) gave error %v, want nil", err)
+	}
+	for i := 0; i < 200; i++ {
+		path := fmt.Sprintf("dir%d/foo%d", i, i)
+		if out, ok := outputs[path]; !ok || out.Digest != digest.ToKey(fooDigest) {
+			t.Errorf("c.FlattenActionOutputs(ctx, ar) gave output %v for %s, want digest %v", out, path, fooDigest)
+		}
+	}
+	if fake.maxInFlight > concurrency {
+		t.Errorf("%d Read streams were in flight at once, want at most %d", fake.maxInFlight, concurrency)
+	}
+	if fake.maxInFlight < 2 {
+		t.Errorf("%d Read streams were in flight at once, want the trees to be read concurrently", fake.maxInFlight)
+	}
+}
+
+func TestWriteBlobsProgress(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	type call struct{ done, total int64 }
+	var calls []call
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.OnProgress(func(done, total int64) {
+		calls = append(calls, call{done, total})
+	}))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	present := []byte("present")
+	fake.blobs = map[digest.Key][]byte{digest.ToKey(digest.FromBlob(present)): present}
+	blobs := map[digest.Key][]byte{digest.ToKey(digest.FromBlob(present)): present}
+	var total int64
+	for i := 0; i < 100; i++ {
+		blob := []byte(fmt.Sprintf("blob %d", i))
+		blobs[digest.ToKey(digest.FromBlob(blob))] = blob
+		total += int64(len(blob))
+	}
+
+	if err := c.WriteBlobs(ctx, blobs); err != nil {
+		t.Fatalf("c.WriteBlobs(ctx, blobs) gave error %s, expected nil", err)
+	}
+	if len(calls) < 2 {
+		t.Fatalf("OnProgress was called %d times, want at least 2", len(calls))
+	}
+	if want := (call{0, total}); calls[0] != want {
+		t.Errorf("first OnProgress call = %v, want %v", calls[0], want)
+	}
+	if want := (call{total, total}); calls[len(calls)-1] != want {
+		t.Errorf("last OnProgress call = %v, want %v", calls[len(calls)-1], want)
+	}
+	for i := 1; i < len(calls); i++ {
+		if calls[i].done < calls[i-1].done {
+			t.Errorf("OnProgress went backwards: %v after %v", calls[i], calls[i-1])
+		}
+	}
+}
+
+func TestWriteBlobsWithStats(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	present := []byte("present")
+	large := make([]byte, client.MaxBatchSz+1)
+	fake.blobs = map[digest.Key][]byte{digest.ToKey(digest.FromBlob(present)): present}
+	blobs := make(map[digest.Key][]byte)
+	for _, blob := range [][]byte{present, []byte("foo"), []byte("bar"), large} {
+		blobs[digest.ToKey(digest.FromBlob(blob))] = blob
+	}
+
+	stats, err := c.WriteBlobsWithStats(ctx, blobs)
+	if err != nil {
+		t.Fatalf("c.WriteBlobsWithStats(ctx, blobs) gave error %v, want nil", err)
+	}
+	// The small blobs are uploaded in a batch, and the large one is streamed.
+	want := &client.Stats{
+		Blobs:          3,
+		Bytes:          int64(6 + len(large)),
+		Requests:       2,
+		BatchRequests:  1,
+		StreamRequests: 1,
+		CacheHits:      1,
+		LogicalBytes:   int64(6 + len(large) + len(present)),
+	}
+	if diff := cmp.Diff(want, stats); diff != "" {
+		t.Errorf("c.WriteBlobsWithStats(ctx, blobs) gave stats diff (-want +got):\n%s", diff)
+	}
+
+	// Once everything is present, nothing is transferred.
+	stats, err = c.WriteBlobsWithStats(ctx, blobs)
+	if err != nil {
+		t.Fatalf("c.WriteBlobsWithStats(ctx, blobs) gave error %v, want nil", err)
+	}
+	want = &client.Stats{CacheHits: 4, LogicalBytes: want.LogicalBytes}
+	if diff := cmp.Diff(want, stats); diff != "" {
+		t.Errorf("c.WriteBlobsWithStats(ctx, blobs) with all blobs present gave stats diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestBatchProgress(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	var mu sync.Mutex
+	calls := make(map[client.BatchOp][]client.BatchProgress)
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.FindMissingBatchSize(10), client.OnBatchProgress(func(p client.BatchProgress) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[p.Op] = append(calls[p.Op], p)
+	}))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	present := []byte("present")
+	fake.blobs = map[digest.Key][]byte{digest.ToKey(digest.FromBlob(present)): present}
+	blobs := map[digest.Key][]byte{digest.ToKey(digest.FromBlob(present)): present}
+	var missingBytes int64
+	for i := 0; i < 100; i++ {
+		blob := []byte(fmt.Sprintf("blob %d", i))
+		blobs[digest.ToKey(digest.FromBlob(blob))] = blob
+		missingBytes += int64(len(blob))
+	}
+	allBytes := missingBytes + int64(len(present))
+
+	if err := c.WriteBlobs(ctx, blobs); err != nil {
+		t.Fatalf("c.WriteBlobs(ctx, blobs) gave error %s, expected nil", err)
+	}
+	wantLast := map[client.BatchOp]client.BatchProgress{
+		client.BatchQuery:  {Op: client.BatchQuery, Blobs: 101, TotalBlobs: 101, Bytes: allBytes, TotalBytes: allBytes},
+		client.BatchUpload: {Op: client.BatchUpload, Blobs: 100, TotalBlobs: 100, Bytes: missingBytes, TotalBytes: missingBytes},
+	}
+	for op, want := range wantLast {
+		got := calls[op]
+		if len(got) == 0 {
+			t.Errorf("OnBatchProgress was not called for op %d", op)
+			continue
+		}
+		if got[len(got)-1] != want {
+			t.Errorf("last OnBatchProgress call for op %d = %+v, want %+v", op, got[len(got)-1], want)
+		}
+		for i := 1; i < len(got); i++ {
+			if got[i].Blobs <= got[i-1].Blobs || got[i].Bytes <= got[i-1].Bytes {
+				t.Errorf("OnBatchProgress didn't advance: %+v after %+v", got[i], got[i-1])
+			}
+		}
+	}
+	// The 101 digests are queried in batches of 10.
+	if n := len(calls[client.BatchQuery]); n != 11 {
+		t.Errorf("OnBatchProgress was called %d times for the query, want 11", n)
+	}
+}
+
+func TestBatchDownloadBlobs(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	const maxRecv = 1024 * 1024
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.MaxRecvMsgSize(maxRecv))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	tests := []struct {
+		name string
+		// sizes are the sizes of the blobs to download.
+		sizes []int
+		// wantBatchReads is the number of BatchReadBlobs requests expected.
+		wantBatchReads int
+	}{
+		{
+			name:           "fits in one response",
+			sizes:          []int{100000, 200000, 300000},
+			wantBatchReads: 1,
+		},
+		{
+			name:           "total overflows receive size",
+			sizes:          []int{300000, 300000, 300000, 300000, 300000},
+			wantBatchReads: 2,
+		},
+		{
+			name:           "response overhead overflows receive size",
+			sizes:          []int{maxRecv / 2, maxRecv/2 - 1024},
+			wantBatchReads: 2,
+		},
+		{
+			name:           "blob larger than receive size",
+			sizes:          []int{2 * maxRecv, 10, 20},
+			wantBatchReads: 1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.blobs = make(map[digest.Key][]byte)
+			fake.batchReadReqs = 0
+			var dgs []*repb.Digest
+			want := make(map[digest.Key][]byte)
+			for i, sz := range tc.sizes {
+				blob := bytes.Repeat([]byte{byte(i)}, sz)
+				dg := digest.FromBlob(blob)
+				fake.blobs[digest.ToKey(dg)] = blob
+				want[digest.ToKey(dg)] = blob
+				dgs = append(dgs, dg)
+			}
+
+			got, err := c.BatchDownloadBlobs(ctx, dgs)
+			if err != nil {
+				t.Fatalf("c.BatchDownloadBlobs(ctx, dgs) gave error %v, expected nil", err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("c.BatchDownloadBlobs(ctx, dgs) gave diff (-want +got):\n%s", diff)
+			}
+			if fake.batchReadReqs != tc.wantBatchReads {
+				t.Errorf("%d BatchReadBlobs requests received, want %d", fake.batchReadReqs, tc.wantBatchReads)
+			}
+		})
+	}
+}
+
+func TestReadBlobs(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	const maxRecv = 64 * 1024
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.MaxRecvMsgSize(maxRecv), client.CASConcurrency(2))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	want := make(map[digest.Key][]byte)
+	var dgs []*repb.Digest
+	for i, sz := range []int{10, 20, 2 * maxRecv} {
+		blob := bytes.Repeat([]byte{byte(i)}, sz)
+		dg := digest.FromBlob(blob)
+		fake.blobs[digest.ToKey(dg)] = blob
+		want[digest.ToKey(dg)] = blob
+		dgs = append(dgs, dg)
+	}
+	got, err := c.ReadBlobs(ctx, dgs)
+	if err != nil {
+		t.Fatalf("c.ReadBlobs(ctx, dgs) gave error %v, want nil", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("c.ReadBlobs(ctx, dgs) gave diff (-want +got):\n%s", diff)
+	}
+	if fake.batchReadReqs != 1 || fake.readReqs != 1 {
+		t.Errorf("c.ReadBlobs(ctx, dgs) made %d BatchReadBlobs and %d Read requests, want 1 and 1", fake.batchReadReqs, fake.readReqs)
+	}
+
+	// Missing blobs, both batched and streamed, are reported without stopping the other downloads.
+	missingSmall := digest.FromBlob([]byte("missing"))
+	missingLarge := digest.FromBlob(bytes.Repeat([]byte("m"), 2*maxRecv))
+	got, err = c.ReadBlobs(ctx, append(dgs, missingSmall, missingLarge))
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("c.ReadBlobs(ctx, dgs) with missing blobs gave diff (-want +got):\n%s", diff)
+	}
+	rbErr, ok := err.(*client.ReadBlobsError)
+	if !ok {
+		t.Fatalf("c.ReadBlobs(ctx, dgs) with missing blobs gave error %v, want a *ReadBlobsError", err)
+	}
+	for _, dg := range []*repb.Digest{missingSmall, missingLarge} {
+		if st, _ := status.FromError(rbErr.Errors[digest.ToKey(dg)]); st.Code() != codes.NotFound {
+			t.Errorf("c.ReadBlobs(ctx, dgs) gave error %v for %s, want NotFound", rbErr.Errors[digest.ToKey(dg)], digest.ToString(dg))
+		}
+	}
+	if len(rbErr.Errors) != 2 {
+		t.Errorf("c.ReadBlobs(ctx, dgs) gave errors for %d blobs, want 2", len(rbErr.Errors))
+	}
+}
+
+// nilDigestCAS is a fakeCAS whose BatchReadBlobs responses are malformed: they have no digests.
+type nilDigestCAS struct {
+	*fakeCAS
+}
+
+func (f *nilDigestCAS) BatchReadBlobs(ctx context.Context, req *repb.BatchReadBlobsRequest) (*repb.BatchReadBlobsResponse, error) {
+	resp, err := f.fakeCAS.BatchReadBlobs(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range resp.Responses {
+		r.Digest = nil
+	}
+	return resp, nil
+}
+
+func TestBatchDownloadBlobsMalformedResponse(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	blob := []byte("foo")
+	dg := digest.FromBlob(blob)
+	fake := &nilDigestCAS{&fakeCAS{blobs: map[digest.Key][]byte{digest.ToKey(dg): blob}}}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.RetryTransient())
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	_, err = c.BatchDownloadBlobs(ctx, []*repb.Digest{dg})
+	if err == nil || !strings.Contains(err.Error(), "invalid digest") {
+		t.Errorf("c.BatchDownloadBlobs(ctx, dgs) of a malformed response gave error %v, want an error about the invalid digest", err)
+	}
+	// A malformed response isn't requested again.
+	if fake.batchReadReqs != 1 {
+		t.Errorf("c.BatchDownloadBlobs(ctx, dgs) of a malformed response made %d BatchReadBlobs calls, want 1", fake.batchReadReqs)
+	}
+}
+
+// corruptBatchCAS is a fakeCAS whose BatchReadBlobs responses are corrupted: the data of the blob
+// with digest corrupt is altered, and an entry for a blob that wasn't requested is added.
+type corruptBatchCAS struct {
+	*fakeCAS
+	corrupt *repb.Digest
+}
+
+func (f *corruptBatchCAS) BatchReadBlobs(ctx context.Context, req *repb.BatchReadBlobsRequest) (*repb.BatchReadBlobsResponse, error) {
+	resp, err := f.fakeCAS.BatchReadBlobs(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range resp.Responses {
+		if proto.Equal(r.Digest, f.corrupt) {
+			r.Data = append([]byte("X"), r.Data[1:]...)
+		}
+	}
+	extra := []byte("not requested")
+	resp.Responses = append(resp.Responses, &repb.BatchReadBlobsResponse_Response{Digest: digest.FromBlob(extra), Data: extra})
+	return resp, nil
+}
+
+func TestBatchDownloadCorruptResponse(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	foo, bar := []byte("foo"), []byte("bar")
+	fooDg, barDg := digest.FromBlob(foo), digest.FromBlob(bar)
+	fake := &corruptBatchCAS{
+		fakeCAS: &fakeCAS{blobs: map[digest.Key][]byte{digest.ToKey(fooDg): foo, digest.ToKey(barDg): bar}},
+		corrupt: barDg,
+	}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.RetryTransient())
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.BatchDownloadBlobs(ctx, []*repb.Digest{fooDg, barDg}); !isDigestMismatch(err, barDg) {
+		t.Errorf("c.BatchDownloadBlobs(ctx, dgs) of a corrupted blob gave error %v, want a *DigestMismatchError for %s", err, digest.ToString(barDg))
+	}
+
+	fake.batchReadReqs = 0
+	got, err := c.ReadBlobs(ctx, []*repb.Digest{fooDg, barDg})
+	rbErr, ok := err.(*client.ReadBlobsError)
+	if !ok {
+		t.Fatalf("c.ReadBlobs(ctx, dgs) of a corrupted blob gave error %v, want a *ReadBlobsError", err)
+	}
+	if len(rbErr.Errors) != 1 || !isDigestMismatch(rbErr.Errors[digest.ToKey(barDg)], barDg) {
+		t.Errorf("c.ReadBlobs(ctx, dgs) of a corrupted blob gave errors %v, want a *DigestMismatchError for %s only", rbErr.Errors, digest.ToString(barDg))
+	}
+	// The verified blob is returned, and the blob that wasn't requested is ignored.
+	want := map[digest.Key][]byte{digest.ToKey(fooDg): foo}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("c.ReadBlobs(ctx, dgs) of a corrupted blob gave diff (-want +got):\n%s", diff)
+	}
+	// Corrupted data isn't requested again.
+	if fake.batchReadReqs != 1 {
+		t.Errorf("c.ReadBlobs(ctx, dgs) of a corrupted blob made %d BatchReadBlobs calls, want 1", fake.batchReadReqs)
+	}
+}
+
+// isDigestMismatch returns whether err is a *DigestMismatchError for the blob with digest want.
+func isDigestMismatch(err error, want *repb.Digest) bool {
+	e, ok := err.(*client.DigestMismatchError)
+	return ok && proto.Equal(e.Want, want)
+}
+
+func TestBatchDownloadStream(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	const maxRecv = 1024 * 1024
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.MaxRecvMsgSize(maxRecv), client.CASConcurrency(4))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	var dgs []*repb.Digest
+	want := make(map[digest.Key][]byte)
+	for i := 0; i < 10; i++ {
+		blob := bytes.Repeat([]byte{byte(i)}, 300000)
+		dg := digest.FromBlob(blob)
+		fake.blobs[digest.ToKey(dg)] = blob
+		want[digest.ToKey(dg)] = blob
+		dgs = append(dgs, dg, dg)
+	}
+
+	got := make(map[digest.Key][]byte)
+	var calls, inFlight int32
+	err = c.BatchDownloadStream(ctx, dgs, func(k digest.Key, data []byte) error {
+		if atomic.AddInt32(&inFlight, 1) != 1 {
+			t.Error("BatchDownloadStream called the callback concurrently")
+		}
+		defer atomic.AddInt32(&inFlight, -1)
+		calls++
+		got[k] = data
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("c.BatchDownloadStream(ctx, dgs, fn) gave error %v, expected nil", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("c.BatchDownloadStream(ctx, dgs, fn) gave diff (-want +got):\n%s", diff)
+	}
+	if int(calls) != len(want) {
+		t.Errorf("c.BatchDownloadStream(ctx, dgs, fn) called fn %d times, want %d", calls, len(want))
+	}
+
+	errStop := errors.New("stop")
+	err = c.BatchDownloadStream(ctx, dgs, func(digest.Key, []byte) error { return errStop })
+	if err != errStop {
+		t.Errorf("c.BatchDownloadStream(ctx, dgs, fn) with a failing fn gave error %v, want %v", err, errStop)
+	}
+}
+
+func TestEmptyInstanceName(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeNoInstanceByteStream{blobs: make(map[string][]byte)}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	c, err := client.Dial(ctx, "", client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	blob := []byte("no instance")
+	dg, err := c.WriteBlob(ctx, blob)
+	if err != nil {
+		t.Fatalf("c.WriteBlob(ctx, blob) gave error %v, expected nil", err)
+	}
+	got, err := c.ReadBlob(ctx, dg)
+	if err != nil {
+		t.Fatalf("c.ReadBlob(ctx, %v) gave error %v, expected nil", dg, err)
+	}
+	if !bytes.Equal(got, blob) {
+		t.Errorf("c.ReadBlob(ctx, %v) = %q, want %q", dg, got, blob)
+	}
+
+	dir, err := ioutil.TempDir("", "empty_instance")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blob")
+	name := fmt.Sprintf("/blobs/%s/%d", dg.Hash, dg.SizeBytes)
+	if _, err := c.ReadResourceToFile(ctx, name, path); err != nil {
+		t.Fatalf("c.ReadResourceToFile(ctx, %q, path) gave error %v, expected nil", name, err)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read back file: %v", err)
+	}
+	if !bytes.Equal(contents, blob) {
+		t.Errorf("c.ReadResourceToFile(ctx, %q, path) wrote %q, want %q", name, contents, blob)
+	}
+}
+
+func TestBlobSizes(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	foo, bar, baz := []byte("foo"), []byte("barbar"), []byte("baz")
+	for _, blob := range [][]byte{foo, bar} {
+		fake.blobs[digest.ToKey(digest.FromBlob(blob))] = blob
+	}
+	hashes := []string{digest.FromBlob(foo).Hash, digest.FromBlob(bar).Hash, digest.FromBlob(baz).Hash}
+	got, err := c.BlobSizes(ctx, hashes)
+	if err != nil {
+		t.Fatalf("c.BlobSizes(ctx, %v) gave error %v, expected nil", hashes, err)
+	}
+	want := map[string]int64{
+		digest.FromBlob(foo).Hash: int64(len(foo)),
+		digest.FromBlob(bar).Hash: int64(len(bar)),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("c.BlobSizes(ctx, %v) gave diff (-want +got):\n%s", hashes, diff)
+	}
+}
+
+func TestReadZeroSizeMismatch(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeReader{blob: []byte("foobar"), chunks: []int{6}}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	dir, err := ioutil.TempDir("", "zero_size")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dg := &repb.Digest{Hash: digest.FromBlob(fake.blob).Hash, SizeBytes: 0}
+	if _, err := c.ReadBlob(ctx, dg); err == nil {
+		t.Errorf("c.ReadBlob(ctx, %v) gave nil error, want an error for the zero size", dg)
+	}
+	if _, err := c.ReadBlobStreamed(ctx, dg, new(bytes.Buffer)); err == nil {
+		t.Errorf("c.ReadBlobStreamed(ctx, %v, w) gave nil error, want an error for the zero size", dg)
+	}
+	if _, err := c.ReadBlobToFile(ctx, dg, filepath.Join(dir, "blob")); err == nil {
+		t.Errorf("c.ReadBlobToFile(ctx, %v, path) gave nil error, want an error for the zero size", dg)
+	}
+}
+
+func TestWriteProtos(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	fooDir := &repb.Directory{Files: []*repb.FileNode{{Name: "foo", Digest: digest.FromBlob([]byte("foo"))}}}
+	barDir := &repb.Directory{Files: []*repb.FileNode{{Name: "bar", Digest: digest.FromBlob([]byte("bar"))}}}
+	msgs := []proto.Message{fooDir, barDir, proto.Clone(fooDir), &repb.Directory{}}
+	got, err := c.WriteProtos(ctx, msgs)
+	if err != nil {
+		t.Fatalf("c.WriteProtos(ctx, msgs) gave error %v, expected nil", err)
+	}
+	var want []*repb.Digest
+	for _, msg := range msgs {
+		want = append(want, digest.TestFromProto(msg))
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("c.WriteProtos(ctx, msgs) gave diff (-want +got):\n%s", diff)
+	}
+	if len(fake.blobs) != 3 {
+		t.Errorf("c.WriteProtos(ctx, msgs) stored %d blobs, want 3", len(fake.blobs))
+	}
+	for _, dg := range want {
+		if _, ok := fake.blobs[digest.ToKey(dg)]; !ok {
+			t.Errorf("c.WriteProtos(ctx, msgs) did not store blob %s", digest.ToString(dg))
+		}
+	}
+}
+
+// largeBlobTestsEnv is the environment variable that, when set to a non-empty value, enables the
+// tests that stream multi-gigabyte blobs. They take too long to run by default.
+const largeBlobTestsEnv = "RUN_LARGE_BLOB_TESTS"
+
+func TestReadLargeBlobRange(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeSizedReader{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+	dir, err := ioutil.TempDir("", "large_blob_range")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The blob and the offset of the range are bigger than the largest int32, but only the end of the
+	// blob is sent.
+	const size, offset = 1<<32 + 12345, 1 << 32
+	dg := digest.TestNew("a", size)
+	got, err := c.ReadBlobRange(ctx, dg, offset, 0)
+	if err != nil {
+		t.Errorf("c.ReadBlobRange(ctx, %v, %d, 0) gave error %v, want nil", dg, int64(offset), err)
+	}
+	if len(got) != size-offset {
+		t.Errorf("c.ReadBlobRange(ctx, %v, %d, 0) read %d bytes, want %d", dg, int64(offset), len(got), size-offset)
+	}
+	fpath := filepath.Join(dir, "blob")
+	n, err := c.ReadBlobRangeToFileAt(ctx, dg, offset, 0, fpath, 0)
+	if err != nil {
+		t.Errorf("c.ReadBlobRangeToFileAt(ctx, %v, %d, 0, %q, 0) gave error %v, want nil", dg, int64(offset), fpath, err)
+	}
+	if n != size-offset {
+		t.Errorf("c.ReadBlobRangeToFileAt(ctx, %v, %d, 0, %q, 0) = %d, want %d", dg, int64(offset), fpath, n, size-offset)
+	}
+	if sent := atomic.LoadInt64(&fake.sent); sent != 2*(size-offset) {
+		t.Errorf("the server sent %d bytes, want %d", sent, 2*(size-offset))
+	}
+}
+
+func TestReadLargeBlobStreamed(t *testing.T) {
+	if os.Getenv(largeBlobTestsEnv) == "" {
+		t.Skipf("skipping streaming a multi-gigabyte blob, set %s to run it", largeBlobTestsEnv)
+	}
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	bsgrpc.RegisterByteStreamServer(server, &fakeSizedReader{})
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	// Bigger than the largest int32, so it couldn't be held in a byte slice on 32-bit platforms.
+	const size = 1<<31 + 12345
+	dg := digest.TestNew("a", size)
+	n, err := c.ReadBlobStreamed(ctx, dg, ioutil.Discard)
+	if err != nil {
+		t.Errorf("c.ReadBlobStreamed(ctx, %v, w) gave error %v, want nil", dg, err)
+	}
+	if n != size {
+		t.Errorf("c.ReadBlobStreamed(ctx, %v, w) = %d, want %d", dg, n, int64(size))
+	}
+	n, err = c.ReadBlobToFile(ctx, dg, os.DevNull)
+	if err != nil {
+		t.Errorf("c.ReadBlobToFile(ctx, %v, %q) gave error %v, want nil", dg, os.DevNull, err)
+	}
+	if n != size {
+		t.Errorf("c.ReadBlobToFile(ctx, %v, %q) = %d, want %d", dg, os.DevNull, n, int64(size))
+	}
+}
+
+func TestWriteBlobReader(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.ChunkMaxSize(client.MinWriteChunkSize))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	// The blob spans several chunks, and so does mismatched, which differs in its last byte.
+	blob := bytes.Repeat([]byte("foobarbaz"), client.MinWriteChunkSize/3)
+	mismatched := append(append([]byte(nil), blob[:len(blob)-1]...), 'x')
+	dg := digest.FromBlob(blob)
+	tests := []struct {
+		name    string
+		dg      *repb.Digest
+		input   []byte
+		wantErr bool
+	}{
+		{
+			name:  "exact size",
+			dg:    dg,
+			input: blob,
+		},
+		{
+			name:  "empty blob",
+			dg:    digest.Empty,
+			input: []byte{},
+		},
+		{
+			name:    "input too short",
+			dg:      dg,
+			input:   blob[:len(blob)-2],
+			wantErr: true,
+		},
+		{
+			name:    "input too long",
+			dg:      dg,
+			input:   append(blob, 'x'),
+			wantErr: true,
+		},
+		{
+			name:    "hash mismatch",
+			dg:      dg,
+			input:   mismatched,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		for _, seekable := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s, seekable=%t", tc.name, seekable), func(t *testing.T) {
+				fake.blobs = make(map[digest.Key][]byte)
+				var r io.Reader = bytes.NewReader(tc.input)
+				if !seekable {
+					r = struct{ io.Reader }{r}
+				}
+				err := c.WriteBlobReader(ctx, tc.dg, r)
+				if gotErr := err != nil; gotErr != tc.wantErr {
+					t.Fatalf("c.WriteBlobReader(ctx, %v, r) gave error %v, want error: %v", tc.dg, err, tc.wantErr)
+				}
+				got, ok := fake.blobs[digest.ToKey(tc.dg)]
+				if tc.wantErr {
+					if ok {
+						t.Errorf("c.WriteBlobReader(ctx, %v, r) failed but stored %d bytes", tc.dg, len(got))
+					}
+					return
+				}
+				if !ok || !bytes.Equal(got, tc.input) {
+					t.Errorf("c.WriteBlobReader(ctx, %v, r) stored %d bytes (present: %t), want the %d bytes of the input", tc.dg, len(got), ok, len(tc.input))
+				}
+			})
+		}
+	}
+}
+
+func TestWriteBlobFromFile(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.ChunkMaxSize(client.MinWriteChunkSize))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	dir, err := ioutil.TempDir("", "write_blob_from_file")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// The blob spans several chunks.
+	blob := bytes.Repeat([]byte("foobarbaz"), client.MinWriteChunkSize/3)
+	path := filepath.Join(dir, "blob")
+	if err := ioutil.WriteFile(path, blob, 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	dg := digest.FromBlob(blob)
+
+	tests := []struct {
+		name    string
+		dg      *repb.Digest
+		path    string
+		wantErr bool
+	}{
+		{name: "given digest", dg: dg, path: path},
+		{name: "computed digest", path: path},
+		{name: "wrong digest", dg: digest.FromBlob(blob[1:]), path: path, wantErr: true},
+		{name: "missing file", dg: dg, path: filepath.Join(dir, "missing"), wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.blobs = make(map[digest.Key][]byte)
+			err := c.WriteBlobFromFile(ctx, tc.dg, tc.path)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("c.WriteBlobFromFile(ctx, %v, %s) gave error %v, want error: %v", tc.dg, tc.path, err, tc.wantErr)
+			}
+			if tc.wantErr {
+				if len(fake.blobs) > 0 {
+					t.Errorf("c.WriteBlobFromFile(ctx, %v, %s) failed but stored blobs", tc.dg, tc.path)
+				}
+				return
+			}
+			if got, ok := fake.blobs[digest.ToKey(dg)]; !ok || !bytes.Equal(got, blob) {
+				t.Errorf("c.WriteBlobFromFile(ctx, %v, %s) stored %d bytes (present: %t), want the %d bytes of the file", tc.dg, tc.path, len(got), ok, len(blob))
+			}
+		})
+	}
+}
+
+func TestDownloadOutputs(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	foo, bar := []byte("foo"), []byte("bar")
+	fooDigest, barDigest := digest.FromBlob(foo), digest.FromBlob(bar)
+	dirA := &repb.Directory{
+		Files: []*repb.FileNode{
+			{Name: "bar", Digest: barDigest},
+			{Name: "empty", Digest: digest.Empty},
+		},
+		Symlinks: []*repb.SymlinkNode{{Name: "link", Target: "bar"}},
+	}
+	root := &repb.Directory{
+		Directories: []*repb.DirectoryNode{{Name: "a", Digest: digest.TestFromProto(dirA)}},
+		Files:       []*repb.FileNode{{Name: "foo", Digest: fooDigest}},
+	}
+	treeBlob, err := proto.Marshal(&repb.Tree{Root: root, Children: []*repb.Directory{dirA}})
+	if err != nil {
+		t.Fatalf("failed marshalling Tree: %s", err)
+	}
+	treeDigest := digest.FromBlob(treeBlob)
+	ar := &repb.ActionResult{
+		OutputFiles: []*repb.OutputFile{{Path: "out/foo", Digest: fooDigest}},
+		OutputFileSymlinks: []*repb.OutputSymlink{
+			{Path: "out/link", Target: "foo"}},
+		OutputDirectories: []*repb.OutputDirectory{
+			{Path: "dir", TreeDigest: treeDigest},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		blobs   map[digest.Key][]byte
+		want    map[string][]byte
+		wantErr bool
+	}{
+		{
+			name: "all present",
+			blobs: map[digest.Key][]byte{
+				digest.ToKey(fooDigest):  foo,
+				digest.ToKey(barDigest):  bar,
+				digest.ToKey(treeDigest): treeBlob,
+			},
+			want: map[string][]byte{
+				"out/foo":     foo,
+				"dir/foo":     foo,
+				"dir/a/bar":   bar,
+				"dir/a/empty": {},
+			},
+		},
+		{
+			name: "file missing",
+			blobs: map[digest.Key][]byte{
+				digest.ToKey(fooDigest):  foo,
+				digest.ToKey(treeDigest): treeBlob,
+			},
+			wantErr: true,
+		},
+		{
+			name: "tree missing",
+			blobs: map[digest.Key][]byte{
+				digest.ToKey(fooDigest): foo,
+				digest.ToKey(barDigest): bar,
+			},
+			wantErr: true,
+		},
+		{
+			name: "corrupt file",
+			blobs: map[digest.Key][]byte{
+				digest.ToKey(fooDigest):  []byte("fob"),
+				digest.ToKey(barDigest):  bar,
+				digest.ToKey(treeDigest): treeBlob,
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.blobs = tc.blobs
+			got, err := c.DownloadOutputs(ctx, ar)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("c.DownloadOutputs(ctx, ar) gave error %v, want error: %t", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("c.DownloadOutputs(ctx, ar) gave diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDownloadActionOutputs(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	// Blobs over about 3 KB are read with ByteStream rather than in batches.
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.MaxRecvMsgSize(4096))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	foo, large := []byte("foo"), bytes.Repeat([]byte("l"), 5000)
+	fooDigest, largeDigest := digest.FromBlob(foo), digest.FromBlob(large)
+	emptyDir := &repb.Directory{}
+	dirB := &repb.Directory{
+		Directories: []*repb.DirectoryNode{{Name: "c", Digest: digest.TestFromProto(emptyDir)}},
+	}
+	dirA := &repb.Directory{
+		Directories: []*repb.DirectoryNode{{Name: "b", Digest: digest.TestFromProto(dirB)}},
+		Files: []*repb.FileNode{
+			{Name: "large", Digest: largeDigest, IsExecutable: true},
+			{Name: "empty", Digest: digest.Empty},
+		},
+		Symlinks: []*repb.SymlinkNode{{Name: "link", Target: "large"}},
+	}
+	root := &repb.Directory{
+		Directories: []*repb.DirectoryNode{{Name: "a", Digest: digest.TestFromProto(dirA)}},
+		Files:       []*repb.FileNode{{Name: "foo", Digest: fooDigest}},
+	}
+	treeBlob, err := proto.Marshal(&repb.Tree{Root: root, Children: []*repb.Directory{dirA, dirB, emptyDir}})
+	if err != nil {
+		t.Fatalf("failed marshalling Tree: %s", err)
+	}
+	treeDigest := digest.FromBlob(treeBlob)
+	emptyTree, err := proto.Marshal(&repb.Tree{Root: &repb.Directory{}})
+	if err != nil {
+		t.Fatalf("failed marshalling Tree: %s", err)
+	}
+	ar := &repb.ActionResult{
+		OutputFiles: []*repb.OutputFile{
+			{Path: "out/foo", Digest: fooDigest, IsExecutable: true},
+			{Path: "out/large", Digest: largeDigest},
+		},
+		OutputFileSymlinks: []*repb.OutputSymlink{{Path: "out/link", Target: "foo"}},
+		OutputDirectories: []*repb.OutputDirectory{
+			{Path: "dir", TreeDigest: treeDigest},
+			{Path: "emptydir", TreeDigest: digest.FromBlob(emptyTree)},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		blobs map[digest.Key][]byte
+		// want describes the files under execRoot by path: their contents, followed by "*" for
+		// executables, or "-> target" for symlinks, or "/" for directories.
+		want      map[string]string
+		wantStats *client.Stats
+		wantErr   bool
+	}{
+		{
+			name: "all present",
+			blobs: map[digest.Key][]byte{
+				digest.ToKey(fooDigest):                  foo,
+				digest.ToKey(largeDigest):                large,
+				digest.ToKey(treeDigest):                 treeBlob,
+				digest.ToKey(digest.FromBlob(emptyTree)): emptyTree,
+			},
+			want: map[string]string{
+				"out":         "/",
+				"out/foo":     "foo*",
+				"out/large":   string(large),
+				"out/link":    "-> foo",
+				"dir":         "/",
+				"dir/foo":     "foo",
+				"dir/a":       "/",
+				"dir/a/large": string(large) + "*",
+				"dir/a/empty": "",
+				"dir/a/link":  "-> large",
+				"dir/a/b":     "/",
+				"dir/a/b/c":   "/",
+				"emptydir":    "/",
+			},
+			wantStats: &client.Stats{Blobs: 2, Bytes: 5003, LogicalBytes: 10006},
+		},
+		{
+			name: "large file missing",
+			blobs: map[digest.Key][]byte{
+				digest.ToKey(fooDigest):                  foo,
+				digest.ToKey(treeDigest):                 treeBlob,
+				digest.ToKey(digest.FromBlob(emptyTree)): emptyTree,
+			},
+			wantErr: true,
+		},
+		{
+			name: "corrupt large file",
+			blobs: map[digest.Key][]byte{
+				digest.ToKey(fooDigest):                  foo,
+				digest.ToKey(largeDigest):                bytes.Repeat([]byte("m"), 5000),
+				digest.ToKey(treeDigest):                 treeBlob,
+				digest.ToKey(digest.FromBlob(emptyTree)): emptyTree,
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			execRoot, err := ioutil.TempDir("", "DownloadActionOutputs")
+			if err != nil {
+				t.Fatalf("failed to make temp dir: %v", err)
+			}
+			defer os.RemoveAll(execRoot)
+			fake.blobs = tc.blobs
+			stats, err := c.DownloadActionOutputs(ctx, ar, execRoot)
+			got := make(map[string]string)
+			walkErr := filepath.Walk(execRoot, func(path string, info os.FileInfo, err error) error {
+				if err != nil || path == execRoot {
+					return err
+				}
+				rel, err := filepath.Rel(execRoot, path)
+				if err != nil {
+					return err
+				}
+				rel = filepath.ToSlash(rel)
+				switch {
+				case info.Mode()&os.ModeSymlink != 0:
+					target, err := os.Readlink(path)
+					if err != nil {
+						return err
+					}
+					got[rel] = "-> " + target
+				case info.IsDir():
+					got[rel] = "/"
+				default:
+					blob, err := ioutil.ReadFile(path)
+					if err != nil {
+						return err
+					}
+					got[rel] = string(blob)
+					if info.Mode()&0100 != 0 {
+						got[rel] += "*"
+					}
+				}
+				return nil
+			})
+			if walkErr != nil {
+				t.Fatalf("failed to list %s: %v", execRoot, walkErr)
+			}
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("c.DownloadActionOutputs(ctx, ar, execRoot) gave no error, want error")
+				}
+				for path, contents := range got {
+					if strings.Contains(path, ".tmp-") || (strings.HasSuffix(path, "large") && contents != "") {
+						t.Errorf("c.DownloadActionOutputs(ctx, ar, execRoot) left partial file %s", path)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("c.DownloadActionOutputs(ctx, ar, execRoot) gave error %v, want nil", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("c.DownloadActionOutputs(ctx, ar, execRoot) wrote files with diff (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantStats, stats); diff != "" {
+				t.Errorf("c.DownloadActionOutputs(ctx, ar, execRoot) gave stats diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	fake.blobs = map[digest.Key][]byte{
+		digest.ToKey(fooDigest):                  foo,
+		digest.ToKey(digest.FromBlob(emptyTree)): emptyTree,
+	}
+	escaping := map[string]*repb.ActionResult{
+		"absolute file":      {OutputFiles: []*repb.OutputFile{{Path: "/abs/foo", Digest: fooDigest}}},
+		"escaping file":      {OutputFiles: []*repb.OutputFile{{Path: "out/../../foo", Digest: fooDigest}}},
+		"escaping symlink":   {OutputFileSymlinks: []*repb.OutputSymlink{{Path: "../link", Target: "foo"}}},
+		"escaping directory": {OutputDirectories: []*repb.OutputDirectory{{Path: "..", TreeDigest: digest.FromBlob(emptyTree)}}},
+	}
+	for name, ar := range escaping {
+		t.Run(name, func(t *testing.T) {
+			parent, err := ioutil.TempDir("", "DownloadActionOutputs")
+			if err != nil {
+				t.Fatalf("failed to make temp dir: %v", err)
+			}
+			defer os.RemoveAll(parent)
+			execRoot := filepath.Join(parent, "root")
+			if err := os.Mkdir(execRoot, 0777); err != nil {
+				t.Fatalf("failed to make exec root: %v", err)
+			}
+			if _, err := c.DownloadActionOutputs(ctx, ar, execRoot); err == nil {
+				t.Errorf("c.DownloadActionOutputs(ctx, %v, execRoot) gave no error, want error", ar)
+			}
+			for _, dir := range []string{parent, execRoot} {
+				infos, err := ioutil.ReadDir(dir)
+				if err != nil {
+					t.Fatalf("failed to list %s: %v", dir, err)
+				}
+				if want := map[string]int{parent: 1, execRoot: 0}[dir]; len(infos) != want {
+					t.Errorf("c.DownloadActionOutputs(ctx, %v, execRoot) left %d entries in %s, want %d", ar, len(infos), dir, want)
+				}
+			}
+		})
+	}
+
+	// A symlink left under the exec root, e.g. by a previous run, mustn't let outputs be written
+	// outside of it.
+	throughSymlink := map[string]*repb.ActionResult{
+		"file":      {OutputFiles: []*repb.OutputFile{{Path: "out/foo", Digest: fooDigest}}},
+		"nested":    {OutputFiles: []*repb.OutputFile{{Path: "out/sub/foo", Digest: fooDigest}}},
+		"directory": {OutputDirectories: []*repb.OutputDirectory{{Path: "out/dir", TreeDigest: digest.FromBlob(emptyTree)}}},
+	}
+	for name, ar := range throughSymlink {
+		t.Run("through symlink "+name, func(t *testing.T) {
+			parent, err := ioutil.TempDir("", "DownloadActionOutputs")
+			if err != nil {
+				t.Fatalf("failed to make temp dir: %v", err)
+			}
+			defer os.RemoveAll(parent)
+			execRoot, outside := filepath.Join(parent, "root"), filepath.Join(parent, "outside")
+			for _, dir := range []string{execRoot, outside} {
+				if err := os.Mkdir(dir, 0777); err != nil {
+					t.Fatalf("failed to make %s: %v", dir, err)
+				}
+			}
+			if err := os.Symlink(outside, filepath.Join(execRoot, "out")); err != nil {
+				t.Fatalf("failed to make symlink: %v", err)
+			}
+			if _, err := c.DownloadActionOutputs(ctx, ar, execRoot); err == nil {
+				t.Errorf("c.DownloadActionOutputs(ctx, %v, execRoot) gave no error, want error", ar)
+			}
+			infos, err := ioutil.ReadDir(outside)
+			if err != nil {
+				t.Fatalf("failed to list %s: %v", outside, err)
+			}
+			if len(infos) != 0 {
+				t.Errorf("c.DownloadActionOutputs(ctx, %v, execRoot) left %d entries outside of the exec root, want 0", ar, len(infos))
+			}
+		})
+	}
+}
+
+func TestDownloadOutputsStaged(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	small, large := []byte("small"), bytes.Repeat([]byte("large"), 10)
+	smallDigest, largeDigest := digest.FromBlob(small), digest.FromBlob(large)
+	root := &repb.Directory{Files: []*repb.FileNode{{Name: "large", Digest: largeDigest}}}
+	treeBlob, err := proto.Marshal(&repb.Tree{Root: root})
+	if err != nil {
+		t.Fatalf("failed marshalling Tree: %s", err)
+	}
+	treeDigest := digest.FromBlob(treeBlob)
+	ar := &repb.ActionResult{
+		OutputFiles: []*repb.OutputFile{
+			{Path: "out/small", Digest: smallDigest},
+			{Path: "out/large", Digest: largeDigest},
+			{Path: "out/empty", Digest: digest.Empty},
+		},
+		OutputDirectories: []*repb.OutputDirectory{{Path: "dir", TreeDigest: treeDigest}},
+	}
+	policy := client.StagingPolicy{SpillThreshold: int64(len(small))}
+
+	tests := []struct {
+		name  string
+		blobs map[digest.Key][]byte
+		// want maps the paths of the outputs to their contents, and wantSpilled lists those that are
+		// expected in temporary files.
+		want        map[string][]byte
+		wantSpilled []string
+		wantErr     bool
+	}{
+		{
+			name: "all present",
+			blobs: map[digest.Key][]byte{
+				digest.ToKey(smallDigest): small,
+				digest.ToKey(largeDigest): large,
+				digest.ToKey(treeDigest):  treeBlob,
+			},
+			want: map[string][]byte{
+				"out/small": small,
+				"out/large": large,
+				"out/empty": {},
+				"dir/large": large,
+			},
+			wantSpilled: []string{"dir/large", "out/large"},
+		},
+		{
+			name: "corrupt large file",
+			blobs: map[digest.Key][]byte{
+				digest.ToKey(smallDigest): small,
+				digest.ToKey(largeDigest): bytes.Repeat([]byte("LARGE"), 10),
+				digest.ToKey(treeDigest):  treeBlob,
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "staged")
+			if err != nil {
+				t.Fatalf("failed to make temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			policy.Dir = dir
+			fake.blobs = tc.blobs
+
+			got, err := c.DownloadOutputsStaged(ctx, ar, policy)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("c.DownloadOutputsStaged(ctx, ar, policy) gave error %v, want error: %t", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				// The temporary files of a failed download are removed.
+				if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 0 {
+					t.Errorf("c.DownloadOutputsStaged(ctx, ar, policy) left %d files in %s, want none (err: %v)", len(files), dir, err)
+				}
+				return
+			}
+			contents := make(map[string][]byte)
+			var spilled []string
+			for path, out := range got {
+				contents[path] = out.Data
+				if out.Path == "" {
+					continue
+				}
+				if filepath.Dir(out.Path) != dir {
+					t.Errorf("output %s was staged in %s, want a file in %s", path, out.Path, dir)
+				}
+				spilled = append(spilled, path)
+				if contents[path], err = ioutil.ReadFile(out.Path); err != nil {
+					t.Fatalf("failed to read %s: %v", out.Path, err)
+				}
+			}
+			if diff := cmp.Diff(tc.want, contents); diff != "" {
+				t.Errorf("c.DownloadOutputsStaged(ctx, ar, policy) gave contents diff (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantSpilled, spilled, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+				t.Errorf("c.DownloadOutputsStaged(ctx, ar, policy) spilled outputs diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGetActionResultOutput(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	out, errOut := []byte("out"), []byte("err")
+	outDg, errDg := digest.FromBlob(out), digest.FromBlob(errOut)
+	fake.blobs = map[digest.Key][]byte{
+		digest.ToKey(outDg): out,
+		digest.ToKey(errDg): errOut,
+	}
+	missingDg := digest.FromBlob([]byte("missing"))
+
+	tests := []struct {
+		name       string
+		ar         *repb.ActionResult
+		wantStdout []byte
+		wantStderr []byte
+		wantErr    bool
+	}{
+		{
+			name:       "inline",
+			ar:         &repb.ActionResult{StdoutRaw: out, StderrRaw: errOut},
+			wantStdout: out,
+			wantStderr: errOut,
+		},
+		{
+			name:       "digests",
+			ar:         &repb.ActionResult{StdoutDigest: outDg, StderrDigest: errDg},
+			wantStdout: out,
+			wantStderr: errOut,
+		},
+		{
+			name:       "inline and digest",
+			ar:         &repb.ActionResult{StdoutRaw: out, StderrDigest: errDg},
+			wantStdout: out,
+			wantStderr: errOut,
+		},
+		{
+			name: "no output",
+			ar:   &repb.ActionResult{StderrDigest: digest.Empty},
+		},
+		{
+			name:    "missing blob",
+			ar:      &repb.ActionResult{StdoutRaw: out, StderrDigest: missingDg},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stdout, stderr, err := c.GetActionResultOutput(ctx, tc.ar)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("c.GetActionResultOutput(ctx, ar) gave error %v, want error: %t", err, tc.wantErr)
+			}
+			if !bytes.Equal(stdout, tc.wantStdout) || !bytes.Equal(stderr, tc.wantStderr) {
+				t.Errorf("c.GetActionResultOutput(ctx, ar) = (%q, %q), want (%q, %q)", stdout, stderr, tc.wantStdout, tc.wantStderr)
+			}
+		})
+	}
+	if _, _, err := c.GetActionResultOutput(ctx, nil); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("c.GetActionResultOutput(ctx, nil) gave error %v, want InvalidArgument", err)
+	}
+}
+
+func TestWriteBlobsDirectUpload(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.DirectUploadThreshold{MaxBlobs: 3, MaxBytes: 10})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	tests := []struct {
+		name            string
+		input           [][]byte
+		wantFindMissing int
+	}{
+		{
+			name:            "tiny input",
+			input:           [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")},
+			wantFindMissing: 0,
+		},
+		{
+			name:            "too many blobs",
+			input:           [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")},
+			wantFindMissing: 1,
+		},
+		{
+			name:            "too many bytes",
+			input:           [][]byte{[]byte("foobar"), []byte("bazqux")},
+			wantFindMissing: 1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.blobs = make(map[digest.Key][]byte)
+			fake.findMissingReqs = 0
+			input := make(map[digest.Key][]byte)
+			for _, blob := range tc.input {
+				input[digest.ToKey(digest.FromBlob(blob))] = blob
+			}
+			if err := c.WriteBlobs(ctx, input); err != nil {
+				t.Fatalf("c.WriteBlobs(ctx, input) gave error %v, expected nil", err)
+			}
+			if fake.findMissingReqs != tc.wantFindMissing {
+				t.Errorf("%d FindMissingBlobs requests received, want %d", fake.findMissingReqs, tc.wantFindMissing)
+			}
+			if diff := cmp.Diff(input, fake.blobs); diff != "" {
+				t.Errorf("c.WriteBlobs(ctx, input) stored different blobs (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWriteBlobsFuncMemory(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	// resident is the number of bytes fetched for upload that the server hasn't stored yet, and peak
+	// its largest value.
+	var mu sync.Mutex
+	var resident, peak int64
+	stored := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		r, ok := req.(*repb.BatchUpdateBlobsRequest)
+		if !ok {
+			return handler(ctx, req)
+		}
+		time.Sleep(10 * time.Millisecond)
+		resp, err := handler(ctx, req)
+		mu.Lock()
+		for _, e := range r.Requests {
+			resident -= e.Digest.SizeBytes
+		}
+		mu.Unlock()
+		return resp, err
+	}
+	server := grpc.NewServer(grpc.UnaryInterceptor(stored))
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	const concurrency = 2
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.CASConcurrency(concurrency))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	// The blobs are generated from their index when fetched, 7 to a batch.
+	const n, size = 63, 512 * 1024
+	gen := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, size)
+	}
+	index := make(map[digest.Key]int)
+	var dgs []*repb.Digest
+	for i := 0; i < n; i++ {
+		dg := digest.FromBlob(gen(i))
+		index[digest.ToKey(dg)] = i
+		dgs = append(dgs, dg)
+	}
+	fetch := func(k digest.Key) ([]byte, error) {
+		i, ok := index[k]
+		if !ok {
+			return nil, fmt.Errorf("unexpected blob %v", k)
+		}
+		mu.Lock()
+		resident += size
+		if resident > peak {
+			peak = resident
+		}
+		mu.Unlock()
+		return gen(i), nil
+	}
+	if err := c.WriteBlobsFunc(ctx, dgs, fetch); err != nil {
+		t.Fatalf("c.WriteBlobsFunc(ctx, dgs, fetch) gave error %v, want nil", err)
+	}
+	if len(fake.blobs) != n {
+		t.Errorf("c.WriteBlobsFunc(ctx, dgs, fetch) stored %d blobs, want %d", len(fake.blobs), n)
+	}
+	if max := int64(concurrency * client.MaxBatchSz); peak > max {
+		t.Errorf("c.WriteBlobsFunc(ctx, dgs, fetch) held up to %d fetched bytes, want at most %d", peak, max)
+	}
+}
+
+func TestWriteBlobsCollectBatchErrors(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &downBatchCAS{fakeCAS: &fakeCAS{}}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	// Two blobs fit in a batch, so the blobs are uploaded in 3 batches.
+	input := make(map[digest.Key][]byte)
+	for i := 0; i < 6; i++ {
+		blob := make([]byte, 3*1024*1024/2)
+		blob[0] = byte(i)
+		input[digest.ToKey(digest.FromBlob(blob))] = blob
+	}
+	tests := []struct {
+		name       string
+		opts       []client.Opt
+		wantErrors int
+	}{
+		{
+			name: "first error",
+		},
+		{
+			name:       "all errors",
+			opts:       []client.Opt{client.CollectBatchErrors(true)},
+			wantErrors: 3,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := client.Dial(ctx, instance, client.DialParams{
+				Service:    listener.Addr().String(),
+				NoSecurity: true,
+			}, tc.opts...)
+			if err != nil {
+				t.Fatalf("Error connecting to server: %v", err)
+			}
+			defer c.Close()
+
+			err = c.WriteBlobs(ctx, input)
+			if err == nil {
+				t.Fatal("c.WriteBlobs(ctx, input) gave nil error, want an error")
+			}
+			errs, ok := err.(client.BatchErrors)
+			if tc.wantErrors == 0 {
+				if ok {
+					t.Errorf("c.WriteBlobs(ctx, input) gave BatchErrors %v, want a single error", err)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("c.WriteBlobs(ctx, input) gave error %v, want BatchErrors", err)
+			}
+			if len(errs) != tc.wantErrors {
+				t.Errorf("c.WriteBlobs(ctx, input) gave %d errors, want %d: %v", len(errs), tc.wantErrors, err)
+			}
+			for _, e := range errs {
+				if status.Code(e) != codes.Internal {
+					t.Errorf("c.WriteBlobs(ctx, input) gave batch error %v, want code %v", e, codes.Internal)
+				}
+			}
+			if status.Code(err) != codes.Internal {
+				t.Errorf("status.Code(c.WriteBlobs(ctx, input)) = %v, want %v", status.Code(err), codes.Internal)
+			}
+		})
+	}
+}
+
+func TestBatchErrorsGRPCStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		errs client.BatchErrors
+		want codes.Code
+	}{
+		{
+			name: "single",
+			errs: client.BatchErrors{status.Error(codes.NotFound, "missing")},
+			want: codes.NotFound,
+		},
+		{
+			name: "most common",
+			errs: client.BatchErrors{
+				status.Error(codes.Internal, "a"),
+				status.Error(codes.Unavailable, "b"),
+				status.Error(codes.Unavailable, "c"),
+			},
+			want: codes.Unavailable,
+		},
+		{
+			name: "tie",
+			errs: client.BatchErrors{status.Error(codes.Unavailable, "a"), status.Error(codes.Internal, "b")},
+			want: codes.Internal,
+		},
+		{
+			name: "without status",
+			errs: client.BatchErrors{errors.New("a"), errors.New("b"), status.Error(codes.Internal, "c")},
+			want: codes.Unknown,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			st, ok := status.FromError(tc.errs)
+			if !ok {
+				t.Fatalf("status.FromError(%v) failed", tc.errs)
+			}
+			if st.Code() != tc.want || st.Message() != tc.errs.Error() {
+				t.Errorf("status.FromError(%v) = %v, want code %v and the message of Error", tc.errs, st, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriteBlobsSmallWriteConcurrency(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &slowWriteCAS{fakeCAS: &fakeCAS{}, writeDelay: 10 * time.Millisecond}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	input := make(map[digest.Key][]byte)
+	for i := 0; i < 200; i++ {
+		blob := []byte(fmt.Sprintf("blob %d", i))
+		input[digest.ToKey(digest.FromBlob(blob))] = blob
+	}
+	tests := []struct {
+		name            string
+		opts            []client.Opt
+		wantMaxInFlight int32
+	}{
+		{
+			name:            "CASConcurrency only",
+			opts:            []client.Opt{client.UseBatchOps(false), client.CASConcurrency(10)},
+			wantMaxInFlight: 10,
+		},
+		{
+			name:            "SmallWriteConcurrency",
+			opts:            []client.Opt{client.UseBatchOps(false), client.CASConcurrency(10), client.SmallWriteConcurrency(100)},
+			wantMaxInFlight: 100,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := client.Dial(ctx, instance, client.DialParams{
+				Service:    listener.Addr().String(),
+				NoSecurity: true,
+			}, tc.opts...)
+			if err != nil {
+				t.Fatalf("Error connecting to server: %v", err)
+			}
+			defer c.Close()
+			fake.blobs = make(map[digest.Key][]byte)
+			fake.maxInFlight = 0
+
+			start := time.Now()
+			if err := c.WriteBlobs(ctx, input); err != nil {
+				t.Fatalf("c.WriteBlobs(ctx, input) gave error %v, expected nil", err)
+			}
+			t.Logf("uploaded %d blobs in %v", len(input), time.Since(start))
+			if diff := cmp.Diff(input, fake.blobs); diff != "" {
+				t.Errorf("c.WriteBlobs(ctx, input) stored different blobs (-want +got):\n%s", diff)
+			}
+			if fake.maxInFlight > tc.wantMaxInFlight {
+				t.Errorf("%d Write streams were in flight at once, want at most %d", fake.maxInFlight, tc.wantMaxInFlight)
+			}
+			if fake.maxInFlight <= 10 && tc.wantMaxInFlight > 10 {
+				t.Errorf("%d Write streams were in flight at once, want more than CASConcurrency", fake.maxInFlight)
+			}
+		})
+	}
+}
+
+func TestBatchWriteBlobsLargeBlob(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	input := make(map[digest.Key][]byte)
+	for _, blob := range [][]byte{bytes.Repeat([]byte{1}, 5*1024*1024), []byte("foo"), []byte("bar"), []byte("baz")} {
+		input[digest.ToKey(digest.FromBlob(blob))] = blob
+	}
+	if err := c.BatchWriteBlobs(ctx, input); err != nil {
+		t.Fatalf("c.BatchWriteBlobs(ctx, input) gave error %v, expected nil", err)
+	}
+	if diff := cmp.Diff(input, fake.blobs); diff != "" {
+		t.Errorf("c.BatchWriteBlobs(ctx, input) stored different blobs (-want +got):\n%s", diff)
+	}
+	if fake.batchReqs != 1 || fake.writeReqs != 1 {
+		t.Errorf("c.BatchWriteBlobs(ctx, input) sent %d BatchUpdateBlobs and %d Write requests, want 1 and 1", fake.batchReqs, fake.writeReqs)
+	}
+}
+
+func TestBatchWriteBlobsWithExisting(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	foo, bar := []byte("foo"), []byte("bar")
+	fooKey, barKey := digest.ToKey(digest.FromBlob(foo)), digest.ToKey(digest.FromBlob(bar))
+	input := map[digest.Key][]byte{fooKey: foo, barKey: bar}
+	tests := []struct {
+		name           string
+		reportExisting bool
+		want           map[digest.Key]bool
+	}{
+		{
+			name:           "server reports existing blobs",
+			reportExisting: true,
+			want:           map[digest.Key]bool{fooKey: true, barKey: false},
+		},
+		{
+			name: "server doesn't distinguish",
+			want: map[digest.Key]bool{fooKey: false, barKey: false},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.blobs = map[digest.Key][]byte{fooKey: foo}
+			fake.reportExisting = tc.reportExisting
+			got, err := c.BatchWriteBlobsWithExisting(ctx, input)
+			if err != nil {
+				t.Fatalf("c.BatchWriteBlobsWithExisting(ctx, input) gave error %v, want nil", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("c.BatchWriteBlobsWithExisting(ctx, input) gave diff (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(input, fake.blobs); diff != "" {
+				t.Errorf("c.BatchWriteBlobsWithExisting(ctx, input) stored different blobs (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMaxBlobSize(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.MaxBlobSize(10))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	dir, err := ioutil.TempDir("", "max_blob_size")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	small, large := []byte("small"), []byte("a blob that is too large")
+	smallDg := digest.FromBlob(small)
+	tests := []struct {
+		name  string
+		write func(blob []byte) error
+	}{
+		{
+			name: "WriteBlob",
+			write: func(blob []byte) error {
+				_, err := c.WriteBlob(ctx, blob)
+				return err
+			},
+		},
+		{
+			name: "WriteBlobReader",
+			write: func(blob []byte) error {
+				return c.WriteBlobReader(ctx, digest.FromBlob(blob), bytes.NewReader(blob))
+			},
+		},
+		{
+			name: "WriteBlobs",
+			write: func(blob []byte) error {
+				return c.WriteBlobs(ctx, map[digest.Key][]byte{digest.ToKey(smallDg): small, digest.ToKey(digest.FromBlob(blob)): blob})
+			},
+		},
+		{
+			name: "BatchWriteBlobs",
+			write: func(blob []byte) error {
+				return c.BatchWriteBlobs(ctx, map[digest.Key][]byte{digest.ToKey(smallDg): small, digest.ToKey(digest.FromBlob(blob)): blob})
+			},
+		},
+		{
+			name: "WriteBlobFromFile",
+			write: func(blob []byte) error {
+				path := filepath.Join(dir, fmt.Sprintf("blob_%d", len(blob)))
+				if err := ioutil.WriteFile(path, blob, 0644); err != nil {
+					t.Fatalf("Error writing %s: %v", path, err)
+				}
+				return c.WriteBlobFromFile(ctx, nil, path)
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.blobs = make(map[digest.Key][]byte)
+			fake.batchReqs, fake.writeReqs, fake.findMissingReqs = 0, 0, 0
+			err := tc.write(large)
+			if err == nil || !strings.Contains(err.Error(), "exceeds the maximum blob size of 10 bytes") {
+				t.Errorf("writing a blob of %d bytes gave error %v, want one about the maximum blob size", len(large), err)
+			}
+			if n := fake.batchReqs + fake.writeReqs + fake.findMissingReqs; n != 0 {
+				t.Errorf("writing a blob of %d bytes made %d requests, want none", len(large), n)
+			}
+
+			if err := tc.write(small); err != nil {
+				t.Fatalf("writing a blob of %d bytes gave error %v, want nil", len(small), err)
+			}
+			if _, ok := fake.blobs[digest.ToKey(smallDg)]; !ok {
+				t.Errorf("blob of %d bytes was not stored", len(small))
+			}
+		})
+	}
+}
+
+func TestWriteBlobsRememberUploads(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.RememberUploads(true))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	fooBar := map[digest.Key][]byte{
+		digest.ToKey(digest.FromBlob([]byte("foo"))): []byte("foo"),
+		digest.ToKey(digest.FromBlob([]byte("bar"))): []byte("bar"),
+	}
+	fake.blobs = make(map[digest.Key][]byte)
+	if err := c.WriteBlobs(ctx, fooBar); err != nil {
+		t.Fatalf("c.WriteBlobs(ctx, fooBar) gave error %v, expected nil", err)
+	}
+	if fake.findMissingReqs != 1 || fake.batchReqs != 1 {
+		t.Errorf("first upload sent %d FindMissingBlobs and %d BatchUpdateBlobs requests, want 1 and 1", fake.findMissingReqs, fake.batchReqs)
+	}
+
+	// Uploading the same blobs again sends nothing, even after the server lost them.
+	fake.blobs = make(map[digest.Key][]byte)
+	fake.findMissingReqs, fake.batchReqs = 0, 0
+	if err := c.WriteBlobs(ctx, fooBar); err != nil {
+		t.Fatalf("c.WriteBlobs(ctx, fooBar) gave error %v, expected nil", err)
+	}
+	if fake.findMissingReqs != 0 || fake.batchReqs != 0 || fake.writeReqs != 0 {
+		t.Errorf("second upload sent %d FindMissingBlobs, %d BatchUpdateBlobs and %d Write requests, want none", fake.findMissingReqs, fake.batchReqs, fake.writeReqs)
+	}
+
+	// Only the blob not uploaded before is checked and uploaded.
+	bazBlob := []byte("baz")
+	bazKey := digest.ToKey(digest.FromBlob(bazBlob))
+	input := map[digest.Key][]byte{bazKey: bazBlob}
+	for k, blob := range fooBar {
+		input[k] = blob
+	}
+	if err := c.WriteBlobs(ctx, input); err != nil {
+		t.Fatalf("c.WriteBlobs(ctx, input) gave error %v, expected nil", err)
+	}
+	if fake.findMissingReqs != 1 {
+		t.Errorf("%d FindMissingBlobs requests received, want 1", fake.findMissingReqs)
+	}
+	if diff := cmp.Diff(map[digest.Key][]byte{bazKey: bazBlob}, fake.blobs); diff != "" {
+		t.Errorf("c.WriteBlobs(ctx, input) stored different blobs (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteBlobsWithDigest(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	foo, bar := []byte("foo"), []byte("bar")
+	fake := &fakeCAS{blobs: map[digest.Key][]byte{digest.ToKey(digest.FromBlob(foo)): foo}}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	blobs := map[digest.Key][]byte{
+		digest.ToKey(digest.FromBlob(foo)): foo,
+		digest.ToKey(digest.FromBlob(bar)): bar,
+	}
+	got, err := c.WriteBlobsWithDigest(ctx, blobs)
+	if err != nil {
+		t.Fatalf("c.WriteBlobsWithDigest(ctx, blobs) gave error %v, want nil", err)
+	}
+	// The already present blob is part of the set.
+	want := digest.FromDigests([]*repb.Digest{digest.FromBlob(bar), digest.FromBlob(foo)})
+	if !digest.Equal(got, want) {
+		t.Errorf("c.WriteBlobsWithDigest(ctx, blobs) = %v, want %v", got, want)
+	}
+	if _, ok := fake.blobs[digest.ToKey(digest.FromBlob(bar))]; !ok {
+		t.Errorf("c.WriteBlobsWithDigest(ctx, blobs) did not upload the missing blob")
+	}
+}
+
+func TestBlobReader(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeSizedReader{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	const readAhead = 1024 * 1024
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.ReadAhead(readAhead))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	t.Run("full read", func(t *testing.T) {
+		const size = 3*1024*1024 + 123
+		dg := digest.TestNew("a", size)
+		r, err := c.BlobReader(ctx, dg)
+		if err != nil {
+			t.Fatalf("c.BlobReader(ctx, %v) gave error %v, want nil", dg, err)
+		}
+		defer r.Close()
+		n, err := io.Copy(ioutil.Discard, r)
+		if err != nil {
+			t.Errorf("reading from c.BlobReader(ctx, %v) gave error %v, want nil", dg, err)
+		}
+		if n != size {
+			t.Errorf("read %d bytes from c.BlobReader(ctx, %v), want %d", n, dg, int64(size))
+		}
+	})
+
+	t.Run("slow reader", func(t *testing.T) {
+		atomic.StoreInt64(&fake.sent, 0)
+		atomic.StoreInt32(&fake.finished, 0)
+		// Larger than what gRPC's flow control windows may buffer, so that only the read-ahead bound
+		// keeps the download from running to completion.
+		const size = 256 * 1024 * 1024
+		dg := digest.TestNew("a", size)
+		r, err := c.BlobReader(ctx, dg)
+		if err != nil {
+			t.Fatalf("c.BlobReader(ctx, %v) gave error %v, want nil", dg, err)
+		}
+		if _, err := io.ReadFull(r, make([]byte, readAhead)); err != nil {
+			t.Fatalf("reading from c.BlobReader(ctx, %v) gave error %v, want nil", dg, err)
+		}
+		time.Sleep(500 * time.Millisecond)
+		if sent := atomic.LoadInt64(&fake.sent); sent > size/4 {
+			t.Errorf("the server sent %d bytes while only %d were read, want at most %d", sent, readAhead, size/4)
+		}
+		r.Close()
+		for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&fake.finished) == 0; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("the server's Read did not end after the reader was closed")
+			}
+		}
+	})
+}
+
+func TestExecuteUploadPlan(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.StreamThreshold(1000))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	foo, bar, baz, large := []byte("foo"), []byte("bar"), []byte("baz"), bytes.Repeat([]byte("l"), 1000)
+	blobs := make(map[digest.Key][]byte)
+	var dgs []*repb.Digest
+	for _, blob := range [][]byte{foo, bar, baz, large} {
+		dg := digest.FromBlob(blob)
+		blobs[digest.ToKey(dg)] = blob
+		dgs = append(dgs, dg)
+	}
+	fake.blobs = map[digest.Key][]byte{digest.ToKey(digest.FromBlob(foo)): foo}
+
+	plan, err := c.PlanUpload(ctx, dgs)
+	if err != nil {
+		t.Fatalf("c.PlanUpload(ctx, dgs) gave error %v, want nil", err)
+	}
+	if len(fake.blobs) != 1 {
+		t.Errorf("c.PlanUpload(ctx, dgs) uploaded %d blobs, want none", len(fake.blobs)-1)
+	}
+	// The plan can be stored and executed elsewhere.
+	enc, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatalf("json.Marshal(plan) gave error %v", err)
+	}
+	var decoded client.UploadPlan
+	if err := json.Unmarshal(enc, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal(%s) gave error %v", enc, err)
+	}
+
+	var mu sync.Mutex
+	var fetched []digest.Key
+	stats, err := c.ExecuteUploadPlan(ctx, decoded, func(k digest.Key) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetched = append(fetched, k)
+		return blobs[k], nil
+	})
+	if err != nil {
+		t.Fatalf("c.ExecuteUploadPlan(ctx, plan, fetch) gave error %v, want nil", err)
+	}
+	if diff := cmp.Diff(blobs, fake.blobs); diff != "" {
+		t.Errorf("c.ExecuteUploadPlan(ctx, plan, fetch) stored different blobs (-want +got):\n%s", diff)
+	}
+	// The already present blob is not fetched, and the large blob is streamed separately.
+	want := &client.Stats{Blobs: 3, Bytes: 1006, Requests: 2, BatchRequests: 1, StreamRequests: 1}
+	if diff := cmp.Diff(want, stats); diff != "" {
+		t.Errorf("c.ExecuteUploadPlan(ctx, plan, fetch) gave stats diff (-want +got):\n%s", diff)
+	}
+	if len(fetched) != 3 {
+		t.Errorf("c.ExecuteUploadPlan(ctx, plan, fetch) fetched %d blobs, want 3", len(fetched))
+	}
+
+	_, err = c.ExecuteUploadPlan(ctx, decoded, func(k digest.Key) ([]byte, error) {
+		return nil, fmt.Errorf("no such blob")
+	})
+	if err == nil {
+		t.Errorf("c.ExecuteUploadPlan(ctx, plan, fetch) with failing fetch gave nil error, want error")
+	}
+}
+
+func TestExecuteUploadPlanPanic(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	blob := []byte("blob")
+	dg := digest.FromBlob(blob)
+	plan := client.UploadPlan{Batches: [][]*repb.Digest{{dg}}}
+	// The fetch runs in a worker goroutine, where a panic would crash the process if it wasn't
+	// recovered.
+	_, err = c.ExecuteUploadPlan(ctx, plan, func(k digest.Key) ([]byte, error) {
+		var blobs map[digest.Key][]byte
+		blobs[k] = blob
+		return blob, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "panic") {
+		t.Errorf("c.ExecuteUploadPlan(ctx, plan, fetch) with a panicking fetch gave error %v, want a panic error", err)
+	}
+	if len(fake.blobs) != 0 {
+		t.Errorf("c.ExecuteUploadPlan(ctx, plan, fetch) with a panicking fetch stored %d blobs, want none", len(fake.blobs))
+	}
+	// The client keeps working.
+	if _, err := c.ExecuteUploadPlan(ctx, plan, func(digest.Key) ([]byte, error) { return blob, nil }); err != nil {
+		t.Errorf("c.ExecuteUploadPlan(ctx, plan, fetch) after a panic gave error %v, want nil", err)
+	}
+	if got, ok := fake.blobs[digest.ToKey(dg)]; !ok || !bytes.Equal(got, blob) {
+		t.Errorf("c.ExecuteUploadPlan(ctx, plan, fetch) after a panic stored %q (present: %t), want %q", got, ok, blob)
+	}
+}
+
+func TestBatchesDeterministic(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	// The server records the digests of each BatchUpdateBlobs request, in order.
+	var mu sync.Mutex
+	var batchReqs [][]*repb.Digest
+	record := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if r, ok := req.(*repb.BatchUpdateBlobsRequest); ok {
+			var dgs []*repb.Digest
+			for _, e := range r.Requests {
+				dgs = append(dgs, e.Digest)
+			}
+			mu.Lock()
+			batchReqs = append(batchReqs, dgs)
+			mu.Unlock()
+		}
+		return handler(ctx, req)
+	}
+	server := grpc.NewServer(grpc.UnaryInterceptor(record))
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.UseBatchOps(true))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	// Many blobs of the same size, which take several batches.
+	blobs := make(map[digest.Key][]byte)
+	var dgs []*repb.Digest
+	for i := 0; i < 5000; i++ {
+		blob := make([]byte, 2000)
+		binary.LittleEndian.PutUint32(blob, uint32(i))
+		dg := digest.FromBlob(blob)
+		blobs[digest.ToKey(dg)] = blob
+		dgs = append(dgs, dg)
+	}
+
+	var first client.UploadPlan
+	for seed := int64(0); seed < 5; seed++ {
+		shuffled := append([]*repb.Digest(nil), dgs...)
+		rand.New(rand.NewSource(seed)).Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		plan, err := c.PlanUpload(ctx, shuffled)
+		if err != nil {
+			t.Fatalf("c.PlanUpload(ctx, dgs) gave error %v, want nil", err)
+		}
+		if len(plan.Batches) < 2 {
+			t.Fatalf("c.PlanUpload(ctx, dgs) gave %d batches, want several", len(plan.Batches))
+		}
+		if seed == 0 {
+			first = plan
+		} else if diff := cmp.Diff(first, plan); diff != "" {
+			t.Errorf("c.PlanUpload(ctx, dgs) with shuffled digests gave plan diff (-first +got):\n%s", diff)
+		}
+	}
+
+	small := make(map[digest.Key][]byte)
+	for _, dg := range dgs[:100] {
+		small[digest.ToKey(dg)] = blobs[digest.ToKey(dg)]
+	}
+	for i := 0; i < 5; i++ {
+		fake.blobs = make(map[digest.Key][]byte)
+		if err := c.BatchWriteBlobs(ctx, small); err != nil {
+			t.Fatalf("c.BatchWriteBlobs(ctx, blobs) gave error %v, want nil", err)
+		}
+	}
+	if len(batchReqs) != 5 {
+		t.Fatalf("%d BatchUpdateBlobs requests received, want 5", len(batchReqs))
+	}
+	for _, got := range batchReqs[1:] {
+		if diff := cmp.Diff(batchReqs[0], got); diff != "" {
+			t.Errorf("c.BatchWriteBlobs(ctx, blobs) sent requests with digests diff (-first +got):\n%s", diff)
+		}
+	}
+}
+
+func TestPlanGroupedUpload(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.UseBatchOps(true))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	const mb = 1024 * 1024
+	tests := []struct {
+		name   string
+		sizes  []int
+		groups []string
+		// batches lists the indices of the blobs in each batch of the plan.
+		batches [][]int
+	}{
+		{
+			name:    "groups kept together",
+			sizes:   []int{2 * mb, 2 * mb, 1 * mb, 1 * mb},
+			groups:  []string{"a", "b", "a", "b"},
+			batches: [][]int{{0, 2}, {1, 3}},
+		},
+		{
+			name:    "small groups share a batch",
+			sizes:   []int{1, 2, 3},
+			groups:  []string{"c", "b", "a"},
+			batches: [][]int{{0, 1, 2}},
 		},
 		{
-			name:      "many small blobs",
-			sizes:     []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
-			batchReqs: 1,
-			writeReqs: 0,
+			name:    "group larger than a batch",
+			sizes:   []int{3 * mb / 2, 3 * mb / 2, 3 * mb / 2, 1 * mb},
+			groups:  []string{"a", "a", "a", "b"},
+			batches: [][]int{{0, 1}, {2, 3}},
+		},
+		{
+			name:    "ungrouped blobs batched by size",
+			sizes:   []int{1 * mb, 1, 2},
+			groups:  []string{"a", "", ""},
+			batches: [][]int{{0}, {1, 2}},
 		},
 	}
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			fake.blobs = make(map[digest.Key][]byte)
-			fake.writeReqs = 0
-			fake.batchReqs = 0
-			blobs := make(map[digest.Key][]byte)
+			var dgs []*repb.Digest
+			index := make(map[digest.Key]int)
+			groups := make(map[digest.Key]string)
 			for i, sz := range tc.sizes {
-				blob := make([]byte, int(sz))
+				blob := make([]byte, sz)
 				blob[0] = byte(i) // Ensure blobs are distinct
-				blobs[digest.ToKey(digest.FromBlob(blob))] = blob
+				dg := digest.FromBlob(blob)
+				dgs = append(dgs, dg)
+				index[digest.ToKey(dg)] = i
+				if tc.groups[i] != "" {
+					groups[digest.ToKey(dg)] = tc.groups[i]
+				}
 			}
 
-			err := c.WriteBlobs(ctx, blobs)
+			plan, err := c.PlanGroupedUpload(ctx, dgs, groups)
 			if err != nil {
-				t.Fatalf("c.WriteBlobs(ctx, inputs) gave error %s, expected nil", err)
+				t.Fatalf("c.PlanGroupedUpload(ctx, dgs, groups) gave error %v, want nil", err)
 			}
-
-			for k, blob := range blobs {
-				dg := digest.FromKey(k)
-				if gotBlob, ok := fake.blobs[k]; !ok {
-					t.Errorf("blob of size %d with digest %s was not uploaded, expected it to be present in the CAS", dg.SizeBytes, digest.ToString(dg))
-				} else if diff := cmp.Diff(blob, gotBlob, cmp.Comparer(bytes.Equal)); diff != "" {
-					t.Errorf("blob of size %d with digest %s had diff on uploaded blob:\n%s", dg.SizeBytes, digest.ToString(dg), diff)
+			var got [][]int
+			for _, batch := range plan.Batches {
+				var idx []int
+				for _, dg := range batch {
+					idx = append(idx, index[digest.ToKey(dg)])
 				}
+				sort.Ints(idx)
+				got = append(got, idx)
 			}
-			if fake.batchReqs != tc.batchReqs {
-				t.Errorf("%d requests were made to BatchUpdateBlobs, wanted %d", fake.batchReqs, tc.batchReqs)
-			}
-			if fake.writeReqs != tc.writeReqs {
-				t.Errorf("%d requests were made to Write, wanted %d", fake.writeReqs, tc.writeReqs)
+			if diff := cmp.Diff(tc.batches, got); diff != "" {
+				t.Errorf("c.PlanGroupedUpload(ctx, dgs, groups) gave batches diff (-want +got):\n%s", diff)
 			}
 		})
 	}
 }
 
-func TestFlattenActionOutputs(t *testing.T) {
+func TestServerMaxBatchSize(t *testing.T) {
 	ctx := context.Background()
 	listener, err := net.Listen("tcp", ":0")
 	if err != nil {
@@ -537,109 +4431,295 @@ func TestFlattenActionOutputs(t *testing.T) {
 	}
 	defer listener.Close()
 	server := grpc.NewServer()
-	fake := &fakeCAS{}
-	bsgrpc.RegisterByteStreamServer(server, fake)
+	fake := &batchSizeCAS{fakeCAS: &fakeCAS{blobs: make(map[digest.Key][]byte)}}
+	caps := &fakeCapabilities{maxBatch: 1000}
 	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterCapabilitiesServer(server, caps)
 	go server.Serve(listener)
 	defer server.Stop()
 	c, err := client.Dial(ctx, instance, client.DialParams{
 		Service:    listener.Addr().String(),
 		NoSecurity: true,
-	}, client.UseBatchOps(true))
+	})
 	if err != nil {
 		t.Fatalf("Error connecting to server: %v", err)
 	}
 	defer c.Close()
 
-	fooDigest := digest.TestNew("1001", 1)
-	barDigest := digest.TestNew("1002", 2)
-	dirB := &repb.Directory{
-		Files: []*repb.FileNode{
-			{Name: "foo", Digest: fooDigest, IsExecutable: true},
-		},
+	writeBlobs := func(prefix string) {
+		t.Helper()
+		fake.batchReqs, fake.maxSz = 0, 0
+		blobs := make(map[digest.Key][]byte)
+		for i := 0; i < 20; i++ {
+			blob := []byte(fmt.Sprintf("%s %d %s", prefix, i, strings.Repeat("x", 100)))
+			blobs[digest.ToKey(digest.FromBlob(blob))] = blob
+		}
+		if err := c.WriteBlobs(ctx, blobs); err != nil {
+			t.Fatalf("c.WriteBlobs(ctx, blobs) gave error %v, expected nil", err)
+		}
 	}
-	bDigest := digest.TestFromProto(dirB)
-	dirA := &repb.Directory{
-		Directories: []*repb.DirectoryNode{
-			{Name: "b", Digest: bDigest},
-		},
-		Files: []*repb.FileNode{
-			{Name: "bar", Digest: barDigest},
-		},
+
+	if got := c.Config().MaxBatchSize; got != client.MaxBatchSz {
+		t.Errorf("c.Config().MaxBatchSize = %d before the capabilities were fetched, want %d", got, client.MaxBatchSz)
 	}
-	aDigest := digest.TestFromProto(dirA)
-	root := &repb.Directory{
-		Directories: []*repb.DirectoryNode{
-			{Name: "a", Digest: aDigest},
-			{Name: "b", Digest: bDigest},
-		},
+	writeBlobs("a")
+	if got := c.Config().MaxBatchSize; got != 1000 {
+		t.Errorf("c.Config().MaxBatchSize = %d, want the 1000 advertised by the server", got)
 	}
-	tree := &repb.Tree{
-		Root:     root,
-		Children: []*repb.Directory{dirA, dirB},
+	if fake.batchReqs < 2 || fake.maxSz > 1000 {
+		t.Errorf("c.WriteBlobs(ctx, blobs) made %d batch requests of at most %d bytes, want several of at most 1000 bytes", fake.batchReqs, fake.maxSz)
 	}
-	treeBlob, err := proto.Marshal(tree)
-	if err != nil {
-		t.Errorf("failed marshalling Tree: %s", err)
+	writeBlobs("b")
+	if caps.calls != 1 {
+		t.Errorf("the client got the server capabilities %d times, want 1", caps.calls)
 	}
-	treeDigest := digest.FromBlob(treeBlob)
-	treeA := &repb.Tree{
-		Root:     dirA,
-		Children: []*repb.Directory{dirB},
+
+	// With no maximum advertised, the client's own maximum is used.
+	caps.maxBatch = 0
+	if _, err := c.RefreshCapabilities(ctx); err != nil {
+		t.Fatalf("c.RefreshCapabilities(ctx) gave error %v, expected nil", err)
 	}
-	treeABlob, err := proto.Marshal(treeA)
-	if err != nil {
-		t.Errorf("failed marshalling Tree: %s", err)
+	writeBlobs("c")
+	if fake.batchReqs != 1 {
+		t.Errorf("c.WriteBlobs(ctx, blobs) made %d batch requests, want 1", fake.batchReqs)
 	}
-	treeADigest := digest.FromBlob(treeABlob)
-	fake.blobs = make(map[digest.Key][]byte)
-	fake.blobs[digest.ToKey(treeDigest)] = treeBlob
-	fake.blobs[digest.ToKey(treeADigest)] = treeABlob
-	ar := &repb.ActionResult{
-		OutputFiles: []*repb.OutputFile{
-			&repb.OutputFile{Path: "foo", Digest: fooDigest}},
-		OutputFileSymlinks: []*repb.OutputSymlink{
-			&repb.OutputSymlink{Path: "x/bar", Target: "../dir/a/bar"}},
-		OutputDirectorySymlinks: []*repb.OutputSymlink{
-			&repb.OutputSymlink{Path: "x/a", Target: "../dir/a"}},
-		OutputDirectories: []*repb.OutputDirectory{
-			&repb.OutputDirectory{Path: "dir", TreeDigest: treeDigest},
-			&repb.OutputDirectory{Path: "dir2", TreeDigest: treeADigest},
-		},
+	if caps.calls != 2 {
+		t.Errorf("the client got the server capabilities %d times, want 2", caps.calls)
 	}
-	outputs, err := c.FlattenActionOutputs(ctx, ar)
-	if err != nil {
-		t.Errorf("error in FlattenActionOutputs: %s", err)
+	if got := c.Config().MaxBatchSize; got != client.MaxBatchSz {
+		t.Errorf("c.Config().MaxBatchSize = %d with no maximum advertised, want %d", got, client.MaxBatchSz)
 	}
-	wantOutputs := map[string]*client.Output{
-		"dir/a/b/foo": &client.Output{Digest: digest.ToKey(fooDigest), IsExecutable: true},
-		"dir/a/bar":   &client.Output{Digest: digest.ToKey(barDigest)},
-		"dir/b/foo":   &client.Output{Digest: digest.ToKey(fooDigest), IsExecutable: true},
-		"dir2/b/foo":  &client.Output{Digest: digest.ToKey(fooDigest), IsExecutable: true},
-		"dir2/bar":    &client.Output{Digest: digest.ToKey(barDigest)},
-		"foo":         &client.Output{Digest: digest.ToKey(fooDigest)},
-		"x/a":         &client.Output{SymlinkTarget: "../dir/a"},
-		"x/bar":       &client.Output{SymlinkTarget: "../dir/a/bar"},
+
+	// While a fetch is in flight, other callers wait for it, but can give up, and the cached
+	// capabilities remain readable.
+	caps.mu.Lock()
+	caps.started, caps.release = make(chan struct{}), make(chan struct{})
+	caps.mu.Unlock()
+	refreshed := make(chan error)
+	go func() {
+		_, err := c.RefreshCapabilities(ctx)
+		refreshed <- err
+	}()
+	<-caps.started
+	if got := c.Config().MaxBatchSize; got != client.MaxBatchSz {
+		t.Errorf("c.Config().MaxBatchSize = %d during a refresh, want %d", got, client.MaxBatchSz)
 	}
-	if len(outputs) != len(wantOutputs) {
-		t.Errorf("FlattenActionOutputs gave wrong number of outputs: want %d, got %d", len(wantOutputs), len(outputs))
+	shortCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.ServerCapabilities(shortCtx); err != context.DeadlineExceeded {
+		t.Errorf("c.ServerCapabilities(ctx) during a refresh gave error %v, want %v", err, context.DeadlineExceeded)
 	}
-	for path, wantOut := range wantOutputs {
-		got, ok := outputs[path]
-		if !ok {
-			t.Errorf("expected output %s is missing", path)
-		}
-		if got.Path != path {
-			t.Errorf("FlattenActionOutputs keyed %s output with %s path", got.Path, path)
-		}
-		if wantOut.Digest != got.Digest {
-			t.Errorf("FlattenActionOutputs gave digest diff on %s: want %v, got: %v", path, wantOut.Digest, got.Digest)
+	close(caps.release)
+	if err := <-refreshed; err != nil {
+		t.Errorf("c.RefreshCapabilities(ctx) gave error %v, want nil", err)
+	}
+	if caps.calls != 3 {
+		t.Errorf("the client got the server capabilities %d times, want 3", caps.calls)
+	}
+}
+
+func TestGetTreeByDigest(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	put := func(dir *repb.Directory) *repb.Digest {
+		blob, err := proto.Marshal(dir)
+		if err != nil {
+			t.Fatalf("proto.Marshal(%v) gave error %v", dir, err)
 		}
-		if wantOut.IsExecutable != got.IsExecutable {
-			t.Errorf("FlattenActionOutputs gave IsExecutable diff on %s: want %v, got: %v", path, wantOut.IsExecutable, got.IsExecutable)
+		dg := digest.FromBlob(blob)
+		fake.blobs[digest.ToKey(dg)] = blob
+		return dg
+	}
+	leaf := &repb.Directory{Files: []*repb.FileNode{{Name: "f", Digest: digest.FromBlob([]byte("f"))}}}
+	leafDg := put(leaf)
+	empty := &repb.Directory{}
+	emptyDg := digest.Empty
+	// a and b share the leaf subtree, which should be read and returned once.
+	a := &repb.Directory{Directories: []*repb.DirectoryNode{{Name: "leaf", Digest: leafDg}, {Name: "empty", Digest: emptyDg}}}
+	b := &repb.Directory{Directories: []*repb.DirectoryNode{{Name: "leaf", Digest: leafDg}}}
+	root := &repb.Directory{Directories: []*repb.DirectoryNode{{Name: "a", Digest: put(a)}, {Name: "b", Digest: put(b)}}}
+	rootDg := put(root)
+
+	got, err := c.GetTreeByDigest(ctx, rootDg)
+	if err != nil {
+		t.Fatalf("c.GetTreeByDigest(ctx, %s) gave error %v, want nil", digest.ToString(rootDg), err)
+	}
+	want := []*repb.Directory{root, a, b, leaf, empty}
+	if len(got) != len(want) {
+		t.Fatalf("c.GetTreeByDigest(ctx, %s) gave %d directories, want %d", digest.ToString(rootDg), len(got), len(want))
+	}
+	for i := range want {
+		if !proto.Equal(got[i], want[i]) {
+			t.Errorf("c.GetTreeByDigest(ctx, %s)[%d] = %v, want %v", digest.ToString(rootDg), i, got[i], want[i])
 		}
-		if wantOut.SymlinkTarget != got.SymlinkTarget {
-			t.Errorf("FlattenActionOutputs gave symlink target diff on %s: want %s, got: %s", path, wantOut.SymlinkTarget, got.SymlinkTarget)
+	}
+
+	missing := &repb.Directory{Directories: []*repb.DirectoryNode{{Name: "gone", Digest: digest.TestNew("a", 10)}}}
+	missingDg := put(missing)
+	if _, err := c.GetTreeByDigest(ctx, missingDg); err == nil {
+		t.Errorf("c.GetTreeByDigest(ctx, %s) with a missing directory gave no error, want error", digest.ToString(missingDg))
+	}
+
+	corruptDg := digest.FromBlob([]byte("corrupt"))
+	fake.blobs[digest.ToKey(corruptDg)] = []byte("corrupX")
+	corrupt := &repb.Directory{Directories: []*repb.DirectoryNode{{Name: "bad", Digest: corruptDg}}}
+	corruptRootDg := put(corrupt)
+	_, err = c.GetTreeByDigest(ctx, corruptRootDg)
+	if _, ok := err.(*client.DigestMismatchError); !ok {
+		t.Errorf("c.GetTreeByDigest(ctx, %s) with a corrupted directory gave error %v, want a DigestMismatchError", digest.ToString(corruptRootDg), err)
+	}
+
+	if _, err := c.GetTreeByDigest(ctx, nil); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("c.GetTreeByDigest(ctx, nil) gave error %v, want InvalidArgument", err)
+	}
+	invalid := map[string]*repb.Digest{
+		"nil digest":    nil,
+		"invalid hash":  {Hash: "xyz", SizeBytes: 1},
+		"negative size": {Hash: leafDg.Hash, SizeBytes: -1},
+	}
+	for name, dg := range invalid {
+		dir := &repb.Directory{Directories: []*repb.DirectoryNode{{Name: "leaf", Digest: leafDg}, {Name: "bad", Digest: dg}}}
+		dirDg := put(dir)
+		if _, err := c.GetTreeByDigest(ctx, dirDg); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("c.GetTreeByDigest(ctx, %s) with a child with a %s gave error %v, want InvalidArgument", digest.ToString(dirDg), name, err)
 		}
 	}
 }
+
+func TestBatchesStopNearDeadline(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	const delay = 100 * time.Millisecond
+	fake := &slowQueryCAS{fakeCAS: &fakeCAS{blobs: make(map[digest.Key][]byte)}, queryDelay: delay}
+	writer := &slowWriteCAS{fakeCAS: fake.fakeCAS, writeDelay: delay}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	bsgrpc.RegisterByteStreamServer(server, writer)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	const numBatches = 10
+	blobs := make(map[digest.Key][]byte)
+	var dgs []*repb.Digest
+	for i := 0; i < numBatches; i++ {
+		blob := []byte(fmt.Sprintf("blob %d", i))
+		dg := digest.FromBlob(blob)
+		blobs[digest.ToKey(dg)] = blob
+		dgs = append(dgs, dg)
+	}
+	// Each batch takes delay, and only one runs at a time, so two batches finish before the deadline
+	// and the third is not started.
+	const timeout = 5 * delay / 2
+	const wantDone = 2
+	wantMsg := fmt.Sprintf("%d of %d batches left", numBatches-wantDone, numBatches)
+	tests := []struct {
+		name string
+		opts []client.Opt
+		run  func(ctx context.Context, c *client.Client) error
+		done func() int
+	}{
+		{
+			name: "MissingBlobs",
+			opts: []client.Opt{client.FindMissingBatchSize(1)},
+			run: func(ctx context.Context, c *client.Client) error {
+				_, err := c.MissingBlobs(ctx, dgs)
+				return err
+			},
+			done: func() int { return fake.findMissingReqs },
+		},
+		{
+			name: "WriteBlobs",
+			opts: []client.Opt{client.UseBatchOps(false)},
+			run: func(ctx context.Context, c *client.Client) error {
+				// Skip the initial query, which takes delay too.
+				fake.queryDelay = 0
+				defer func() { fake.queryDelay = delay }()
+				return c.WriteBlobs(ctx, blobs)
+			},
+			done: func() int {
+				fake.mu.Lock()
+				defer fake.mu.Unlock()
+				return len(fake.blobs)
+			},
+		},
+		{
+			// A retry would run into the same deadline, so the stopped upload is not retried.
+			name: "WriteBlobs retrying the whole operation",
+			opts: []client.Opt{client.UseBatchOps(false), client.RetryTransient(), client.RetryWholeOperation(true)},
+			run: func(ctx context.Context, c *client.Client) error {
+				fake.queryDelay = 0
+				defer func() { fake.queryDelay = delay }()
+				return c.WriteBlobs(ctx, blobs)
+			},
+			done: func() int {
+				fake.mu.Lock()
+				defer fake.mu.Unlock()
+				return len(fake.blobs)
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.mu.Lock()
+			fake.blobs = make(map[digest.Key][]byte)
+			fake.findMissingReqs = 0
+			fake.mu.Unlock()
+			c, err := client.Dial(ctx, instance, client.DialParams{
+				Service:    listener.Addr().String(),
+				NoSecurity: true,
+			}, append(tc.opts, client.CASConcurrency(1))...)
+			if err != nil {
+				t.Fatalf("Error connecting to server: %v", err)
+			}
+			defer c.Close()
+
+			tCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			err = tc.run(tCtx, c)
+			if st, _ := status.FromError(err); st.Code() != codes.DeadlineExceeded || !strings.Contains(st.Message(), wantMsg) {
+				t.Errorf("%s gave error %v, want DeadlineExceeded error with %q", tc.name, err, wantMsg)
+			}
+			if _, ok := err.(*client.BatchesStoppedError); !ok {
+				t.Errorf("%s gave error of type %T, want *client.BatchesStoppedError", tc.name, err)
+			}
+			if got := tc.done(); got != wantDone {
+				t.Errorf("%s completed %d batches, want %d", tc.name, got, wantDone)
+			}
+
+			// The client remembers how long batches take, so a later call with less time left than
+			// that doesn't start any.
+			tCtx, cancel = context.WithTimeout(ctx, delay/2)
+			defer cancel()
+			if err := tc.run(tCtx, c); status.Code(err) != codes.DeadlineExceeded {
+				t.Errorf("%s with less time left than a batch takes gave error %v, want DeadlineExceeded", tc.name, err)
+			}
+			if got := tc.done(); got != wantDone {
+				t.Errorf("%s with less time left than a batch takes completed %d batches in all, want %d", tc.name, got, wantDone)
+			}
+		})
+	}
+}
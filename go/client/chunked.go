@@ -0,0 +1,145 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/digest"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// WriteChunked splits the contents of r into chunks of chunkSize bytes, the last of which may be
+// shorter, and stores each chunk in the CAS as its own blob. It then stores a manifest blob listing
+// the digests of the chunks in order, from which ReadChunked reassembles the contents, and returns
+// the digests of the manifest and of the chunks.
+//
+// The manifest has one line per chunk, holding its digest in the canonical hash/size form of
+// digest.ToString. Chunks are uploaded with WriteBlobs as they are read, so that only missing ones
+// are sent, and at most CASConcurrency chunks are held in memory at a time. The manifest is only
+// stored after all the chunks are.
+func (c *Client) WriteChunked(ctx context.Context, r io.Reader, chunkSize int64) (manifestDigest *repb.Digest, chunkDigests []*repb.Digest, err error) {
+	if chunkSize <= 0 {
+		return nil, nil, fmt.Errorf("chunk size must be positive, got %d", chunkSize)
+	}
+	var manifest bytes.Buffer
+	// The pending chunks are read into a single buffer, reused once they are uploaded. It starts
+	// at the size of the pending chunks, or of the input if that is known and smaller, but at most
+	// MaxWriteChunkSize for inputs of unknown length, and grows as needed.
+	limit := int64(MaxWriteChunkSize)
+	if l, ok := r.(interface{ Len() int }); ok {
+		limit = int64(l.Len())
+	}
+	bufSize := limit
+	if conc := int64(c.casConcurrency); conc > 0 && chunkSize <= limit/conc {
+		bufSize = chunkSize * conc
+	}
+	buf := make([]byte, 0, bufSize)
+	pending := make(map[digest.Key][]byte)
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		if err := c.WriteBlobs(ctx, pending); err != nil {
+			return err
+		}
+		pending = make(map[digest.Key][]byte)
+		buf = buf[:0]
+		return nil
+	}
+	for {
+		start := len(buf)
+		var eof bool
+		var err error
+		if buf, eof, err = readChunk(r, buf, chunkSize); err != nil {
+			return nil, nil, fmt.Errorf("failed to read chunk %d: %v", len(chunkDigests), err)
+		}
+		if len(buf) == start {
+			break
+		}
+		chunk := buf[start:len(buf):len(buf)]
+		dg := c.digestFn.FromBlob(chunk)
+		chunkDigests = append(chunkDigests, dg)
+		manifest.WriteString(digest.ToString(dg))
+		manifest.WriteByte('\n')
+		pending[digest.ToKey(dg)] = chunk
+		if len(pending) >= int(c.casConcurrency) {
+			if err := flush(); err != nil {
+				return nil, nil, err
+			}
+		}
+		if eof {
+			break
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, nil, err
+	}
+	manifestDigest = c.digestFn.FromBlob(manifest.Bytes())
+	if err := c.WriteBlobs(ctx, map[digest.Key][]byte{digest.ToKey(manifestDigest): manifest.Bytes()}); err != nil {
+		return nil, nil, err
+	}
+	return manifestDigest, chunkDigests, nil
+}
+
+// readChunk appends up to n bytes read from r to buf, growing it only as the data arrives, and
+// reports whether r ended first.
+func readChunk(r io.Reader, buf []byte, n int64) ([]byte, bool, error) {
+	end := int64(len(buf)) + n
+	for int64(len(buf)) < end {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		free := buf[len(buf):cap(buf)]
+		if left := end - int64(len(buf)); int64(len(free)) > left {
+			free = free[:left]
+		}
+		m, err := r.Read(free)
+		buf = buf[:len(buf)+m]
+		if err == io.EOF {
+			return buf, true, nil
+		}
+		if err != nil {
+			return buf, false, err
+		}
+	}
+	return buf, false, nil
+}
+
+// ReadChunked reads a manifest stored by WriteChunked from the CAS, and writes the chunks it lists
+// to w in order, returning the number of bytes written. Each chunk is checked against its digest as
+// it is read.
+func (c *Client) ReadChunked(ctx context.Context, manifestDigest *repb.Digest, w io.Writer) (int64, error) {
+	var manifest []byte
+	if manifestDigest.SizeBytes > 0 {
+		var err error
+		if manifest, err = c.ReadBlob(ctx, manifestDigest); err != nil {
+			return 0, err
+		}
+	}
+	var dgs []*repb.Digest
+	s := bufio.NewScanner(bytes.NewReader(manifest))
+	for s.Scan() {
+		dg, err := c.digestFn.FromString(s.Text())
+		if err != nil {
+			return 0, fmt.Errorf("invalid chunk manifest %s: %v", digest.ToString(manifestDigest), err)
+		}
+		dgs = append(dgs, dg)
+	}
+	var n int64
+	for _, dg := range dgs {
+		chunk, err := c.ReadBlob(ctx, dg)
+		if err != nil {
+			return n, err
+		}
+		nw, err := w.Write(chunk)
+		n += int64(nw)
+		if err != nil {
+			return n, fmt.Errorf("failed to write to output stream: %v", err)
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,140 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/digest"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+
+	regrpc "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bsgrpc "google.golang.org/genproto/googleapis/bytestream"
+)
+
+func TestWriteChunked(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.CASConcurrency(2))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	tests := []struct {
+		name      string
+		data      []byte
+		chunkSize int64
+		// unknownLen has the input read a byte at a time, by a reader that doesn't report its length.
+		unknownLen bool
+		wantChunks []string
+	}{
+		{
+			name:      "empty",
+			data:      nil,
+			chunkSize: 4,
+		},
+		{
+			name:       "short last chunk",
+			data:       []byte("abcdabcdefg"),
+			chunkSize:  4,
+			wantChunks: []string{"abcd", "abcd", "efg"},
+		},
+		{
+			name:       "whole chunks",
+			data:       []byte("abcdefghijkl"),
+			chunkSize:  4,
+			wantChunks: []string{"abcd", "efgh", "ijkl"},
+		},
+		{
+			name:       "single chunk",
+			data:       []byte("abc"),
+			chunkSize:  4,
+			wantChunks: []string{"abc"},
+		},
+		{
+			name:       "unknown length",
+			data:       []byte("abcdabcdefg"),
+			chunkSize:  4,
+			unknownLen: true,
+			wantChunks: []string{"abcd", "abcd", "efg"},
+		},
+		{
+			// The buffer is sized by the input rather than the chunk size.
+			name:       "huge chunk size",
+			data:       []byte("abc"),
+			chunkSize:  1 << 40,
+			wantChunks: []string{"abc"},
+		},
+		{
+			name:       "huge chunk size, unknown length",
+			data:       []byte("abc"),
+			chunkSize:  1 << 40,
+			unknownLen: true,
+			wantChunks: []string{"abc"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var r io.Reader = bytes.NewReader(tc.data)
+			if tc.unknownLen {
+				r = iotest.OneByteReader(r)
+			}
+			manifestDg, chunkDgs, err := c.WriteChunked(ctx, r, tc.chunkSize)
+			if err != nil {
+				t.Fatalf("c.WriteChunked(ctx, r, %d) gave error %v, want nil", tc.chunkSize, err)
+			}
+			var wantDgs []*repb.Digest
+			for _, chunk := range tc.wantChunks {
+				dg := digest.FromBlob([]byte(chunk))
+				wantDgs = append(wantDgs, dg)
+				if got, ok := fake.blobs[digest.ToKey(dg)]; !ok || string(got) != chunk {
+					t.Errorf("chunk %q was not stored in the CAS", chunk)
+				}
+			}
+			if diff := cmp.Diff(digestStrings(wantDgs), digestStrings(chunkDgs)); diff != "" {
+				t.Errorf("c.WriteChunked(ctx, r, %d) gave chunk digests diff (-want +got):\n%s", tc.chunkSize, diff)
+			}
+
+			var got bytes.Buffer
+			n, err := c.ReadChunked(ctx, manifestDg, &got)
+			if err != nil {
+				t.Fatalf("c.ReadChunked(ctx, %s, w) gave error %v, want nil", digest.ToString(manifestDg), err)
+			}
+			if n != int64(len(tc.data)) || !bytes.Equal(got.Bytes(), tc.data) {
+				t.Errorf("c.ReadChunked(ctx, %s, w) wrote %d bytes %q, want %d bytes %q", digest.ToString(manifestDg), n, got.Bytes(), len(tc.data), tc.data)
+			}
+		})
+	}
+
+	if _, _, err := c.WriteChunked(ctx, bytes.NewReader([]byte("abc")), 0); err == nil {
+		t.Errorf("c.WriteChunked(ctx, r, 0) gave no error, want error")
+	}
+}
+
+func digestStrings(dgs []*repb.Digest) []string {
+	var s []string
+	for _, dg := range dgs {
+		s = append(s, digest.ToString(dg))
+	}
+	return s
+}
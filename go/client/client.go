@@ -7,10 +7,13 @@ import (
 	"io"
 	"net/http"
 	"os/user"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bazelbuild/remote-apis-sdks/go/actas"
+	"github.com/bazelbuild/remote-apis-sdks/go/digest"
 	"github.com/bazelbuild/remote-apis-sdks/go/retry"
 	log "github.com/golang/glog"
 
@@ -19,6 +22,7 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/oauth"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/status"
 
 	regrpc "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
@@ -34,6 +38,26 @@ const (
 	// DefaultMaxWriteChunkSize is the default max chunk size for ByteStream.Write RPCs.
 	DefaultMaxWriteChunkSize = 1024 * 1024
 
+	// MaxWriteChunkSize is the largest chunk size used for ByteStream.Write RPCs. Larger
+	// ChunkMaxSize values are clamped to it, since servers may reject larger messages.
+	MaxWriteChunkSize = 2 * 1024 * 1024
+
+	// MinWriteChunkSize is the smallest ChunkMaxSize that a client accepts. Smaller chunks would
+	// make writes take a round trip for every few bytes.
+	MinWriteChunkSize = 4 * 1024
+
+	// DefaultMaxRecvMsgSize is the default maximum size of a message received by the client. It
+	// matches the gRPC default.
+	DefaultMaxRecvMsgSize = 4 * 1024 * 1024
+
+	// DefaultFindMissingBatchSize is the default maximum number of digests queried in a single
+	// FindMissingBlobs request.
+	DefaultFindMissingBatchSize = 10000
+
+	// DefaultReadAhead is the default maximum amount of data a BlobReader downloads ahead of its
+	// reader.
+	DefaultReadAhead = 4 * 1024 * 1024
+
 	scopes      = "https://www.googleapis.com/auth/cloud-platform"
 	authority   = "test-server"
 	localPrefix = "localhost"
@@ -50,20 +74,54 @@ const (
 // concurrent use.
 type Client struct {
 	// InstanceName is the instance name for the targeted remote execution instance; e.g. for Google
-	// RBE: "projects/<foo>/instances/default_instance".
-	InstanceName   string
-	actionCache    regrpc.ActionCacheClient
-	byteStream     bsgrpc.ByteStreamClient
-	cas            regrpc.ContentAddressableStorageClient
-	execution      regrpc.ExecutionClient
-	capabilities   regrpc.CapabilitiesClient
-	operations     opgrpc.OperationsClient
-	retrier        *Retrier
-	chunkMaxSize   ChunkMaxSize
-	useBatchOps    UseBatchOps
-	casConcurrency CASConcurrency
-	rpcTimeout     time.Duration
-	creds          credentials.PerRPCCredentials
+	// RBE: "projects/<foo>/instances/default_instance". It may be empty for servers that do not use
+	// instance names.
+	InstanceName    string
+	actionCache     regrpc.ActionCacheClient
+	byteStream      bsgrpc.ByteStreamClient
+	cas             regrpc.ContentAddressableStorageClient
+	execution       regrpc.ExecutionClient
+	capabilities    regrpc.CapabilitiesClient
+	operations      opgrpc.OperationsClient
+	retrier         *Retrier
+	digestFn        *digest.Function
+	digestFnErr     error
+	chunkMaxSize    ChunkMaxSize
+	chunkMaxSizeErr error
+	useBatchOps     UseBatchOps
+	casConcurrency  CASConcurrency
+	maxRecvMsgSize  MaxRecvMsgSize
+	streamThresh    StreamThreshold
+	directUpload    DirectUploadThreshold
+	retryWholeOp    RetryWholeOperation
+	readAhead       ReadAhead
+	uploaded        *uploadedSet
+	smallWrites     SmallWriteConcurrency
+	mismatchData    ReturnDataOnDigestMismatch
+	verifyReads     VerifyReads
+	collectErrs     CollectBatchErrors
+	preallocate     PreallocateFiles
+	resumeReads     ResumeDownloads
+	upperHashes     UppercaseHashes
+	invocationID    InvocationID
+	findMissingMax  FindMissingBatchSize
+	maxBlobSize     MaxBlobSize
+	rpcRate         RPCsPerSecond
+	rpcTimeout      time.Duration
+	opTimeout       time.Duration
+	creds           credentials.PerRPCCredentials
+	onProgress      OnProgress
+	onBatch         OnBatchProgress
+	commitPoll      CommitProgress
+	coalescer       *missingBlobsCoalescer
+	writeFlights    *writeFlights
+	present         *presenceCache
+	batchTimes      *batchTimes
+	capsMu          sync.Mutex
+	capsFetched     bool
+	caps            *repb.ServerCapabilities
+	capsErr         error
+	capsFetch       chan struct{} // Closed when the fetch of the capabilities in flight, if any, is done.
 	// Used to close the underlying connection.
 	io.Closer
 }
@@ -73,12 +131,43 @@ type Opt interface {
 	Apply(*Client)
 }
 
-// ChunkMaxSize is maximum chunk size to use in Bytestream wrappers.
+// ChunkMaxSize is maximum chunk size to use in Bytestream wrappers. Each ByteStream write holds a
+// buffer of up to this size for as long as it runs, so the memory used by uploads grows with it,
+// times the number of concurrent writes (see CASConcurrency and SmallWriteConcurrency). In
+// exchange, larger chunks take fewer round trips to send a blob, which helps on high-latency links.
+// Values above MaxWriteChunkSize are clamped to it, and values below MinWriteChunkSize make Dial and
+// NewClient fail. The default is DefaultMaxWriteChunkSize.
 type ChunkMaxSize int
 
-// Apply sets the client's maximal chunk size s.
+// Apply sets the client's maximal chunk size s, clamped to MaxWriteChunkSize. A size below
+// MinWriteChunkSize is ignored by a client that already exists.
 func (s ChunkMaxSize) Apply(c *Client) {
-	c.chunkMaxSize = s
+	if s < MinWriteChunkSize {
+		c.chunkMaxSizeErr = fmt.Errorf("ChunkMaxSize should be at least %d, got %d", MinWriteChunkSize, s)
+		return
+	}
+	if s > MaxWriteChunkSize {
+		s = MaxWriteChunkSize
+	}
+	c.chunkMaxSize, c.chunkMaxSizeErr = s, nil
+}
+
+// DigestFunction is the digest function that the client computes digests with and validates
+// digests against, e.g. SHA1 for a CAS that uses it. The default is SHA256, and SHA1 and MD5 are
+// also supported; other functions make Dial and NewClient fail. Digests passed to the client must
+// be computed with the same function, e.g. with the digest.Function it names (see
+// digest.FunctionFor).
+type DigestFunction repb.DigestFunction
+
+// Apply sets the client's digest function. An unsupported function is ignored by a client that
+// already exists.
+func (f DigestFunction) Apply(c *Client) {
+	fn, err := digest.FunctionFor(repb.DigestFunction(f))
+	if err != nil {
+		c.digestFnErr = err
+		return
+	}
+	c.digestFn, c.digestFnErr = fn, nil
 }
 
 // UseBatchOps can be set to true to use batch CAS operations when uploading multiple blobs, or
@@ -100,6 +189,315 @@ func (cy CASConcurrency) Apply(c *Client) {
 	c.casConcurrency = cy
 }
 
+// FindMissingBatchSize is the maximum number of digests that MissingBlobs queries in a single
+// FindMissingBlobs request. Requests are also kept under the default gRPC message size limit of
+// servers, whatever the number of digests. The default is DefaultFindMissingBatchSize.
+type FindMissingBatchSize int
+
+// Apply sets the client's maximal FindMissingBlobs batch size s.
+func (s FindMissingBatchSize) Apply(c *Client) {
+	c.findMissingMax = s
+}
+
+// MaxBlobSize is the size in bytes of the largest blob that the client uploads. Uploads that include
+// a larger blob, e.g. a runaway log file, fail with a descriptive error before anything is
+// transferred, rather than filling the CAS. Zero, the default, means no limit.
+type MaxBlobSize int64
+
+// Apply sets the client's maximum blob size.
+func (s MaxBlobSize) Apply(c *Client) {
+	c.maxBlobSize = s
+}
+
+// MaxRecvMsgSize is the maximum size of a message the client will accept in a batch download
+// response. BatchDownloadBlobs splits its requests so that each response is expected to fit within
+// it. It should not exceed the maximum message size the server will send.
+type MaxRecvMsgSize int
+
+// Apply sets the client's maximal receive message size s.
+func (s MaxRecvMsgSize) Apply(c *Client) {
+	c.maxRecvMsgSize = s
+}
+
+// StreamThreshold is the size in bytes at or above which WriteBlobs uploads a blob on its own with a
+// ByteStream write, even if it would fit in a batch. It is useful for servers that handle large
+// batch entries poorly. Zero, the default, leaves the choice to batching alone.
+type StreamThreshold int64
+
+// Apply sets the client's stream threshold.
+func (s StreamThreshold) Apply(c *Client) {
+	c.streamThresh = s
+}
+
+// DirectUploadThreshold sets the limits under which WriteBlobs skips the FindMissingBlobs query and
+// uploads all of its input directly. For a handful of small blobs, the extra round trip can cost more
+// than uploading blobs that are already present, which batch uploads deduplicate on the server
+// anyway. The query is skipped only if the input has at most MaxBlobs blobs and at most MaxBytes
+// bytes in total. The zero value, the default, always queries.
+type DirectUploadThreshold struct {
+	MaxBlobs int
+	MaxBytes int64
+}
+
+// Apply sets the client's direct upload threshold.
+func (t DirectUploadThreshold) Apply(c *Client) {
+	c.directUpload = t
+}
+
+// RetryWholeOperation can be set to true to retry a failed WriteBlobs call as a whole with the
+// client's Retrier, starting again from the check for missing blobs, which is safe because the
+// upload is idempotent. Each attempt still retries its individual RPCs, so a blob may be sent up to
+// the product of the two numbers of attempts; a Retrier with few attempts is advisable.
+type RetryWholeOperation bool
+
+// Apply sets the RetryWholeOperation flag on a client.
+func (r RetryWholeOperation) Apply(c *Client) {
+	c.retryWholeOp = r
+}
+
+// ReadAhead is the maximum number of bytes a BlobReader downloads ahead of what has been read from
+// it.
+type ReadAhead int
+
+// Apply sets the client's read-ahead size.
+func (r ReadAhead) Apply(c *Client) {
+	c.readAhead = r
+}
+
+// SmallWriteConcurrency is the number of ByteStream Write streams for blobs that fit in a single
+// chunk (see ChunkMaxSize) that an upload may have in flight at once, on top of the CASConcurrency
+// requests for the other blobs and batches. Uploads of many tiny blobs without batch operations
+// (see UseBatchOps) spend most of their time waiting for each stream to be acknowledged rather than
+// sending data, so they benefit from a much higher concurrency than the larger requests: with a fake
+// CAS that takes 10ms to acknowledge each stream, 200 tiny blobs are uploaded about 6 times faster
+// with a SmallWriteConcurrency of 100 than with a CASConcurrency of 10 alone. If 0 (the default),
+// those streams share the CASConcurrency limit with the other requests.
+type SmallWriteConcurrency int
+
+// Apply sets the SmallWriteConcurrency on a client.
+func (cy SmallWriteConcurrency) Apply(c *Client) {
+	c.smallWrites = cy
+}
+
+// ReturnDataOnDigestMismatch can be set to true to have ReadBlob return the data it read along with
+// the *DigestMismatchError when the data doesn't match the requested digest, so that it can be
+// inspected, e.g. to debug a proxy that corrupts blobs. By default, the data is discarded.
+type ReturnDataOnDigestMismatch bool
+
+// Apply sets the ReturnDataOnDigestMismatch flag on a client.
+func (r ReturnDataOnDigestMismatch) Apply(c *Client) {
+	c.mismatchData = r
+}
+
+// VerifyReads can be set to true to have ReadBlobStreamed, ReadBlobToFile and BlobReader hash the
+// data of a blob as it is read and check it against the blob's digest, returning a
+// *DigestMismatchError if it doesn't match, e.g. because a proxy corrupted it. ReadBlob always checks
+// the data; partial reads such as ReadBlobRange can't be checked. By default, the other reads only
+// check the amount of data read, to save the cost of hashing it.
+type VerifyReads bool
+
+// Apply sets the VerifyReads flag on a client.
+func (v VerifyReads) Apply(c *Client) {
+	c.verifyReads = v
+}
+
+// CollectBatchErrors can be set to true to have WriteBlobs and ExecuteUploadPlan keep uploading the
+// other batches when a batch fails, and return the errors of all the failed batches together as a
+// BatchErrors. By default, the first failure cancels the other uploads and is the only one returned.
+type CollectBatchErrors bool
+
+// Apply sets the CollectBatchErrors flag on a client.
+func (e CollectBatchErrors) Apply(c *Client) {
+	c.collectErrs = e
+}
+
+// PreallocateFiles can be set to true to have ReadBlobToFile size the file to the size of the blob
+// before downloading it, and then write the blob into it in place. The file then has its final
+// size from the start, so that it can be memory mapped, or filled concurrently with
+// ReadBlobRangeToFileAt, without being grown as it is written.
+type PreallocateFiles bool
+
+// Apply sets the PreallocateFiles flag on a client.
+func (p PreallocateFiles) Apply(c *Client) {
+	c.preallocate = p
+}
+
+// ResumeDownloads can be set to true to have ReadBlobToFile resume the download of a blob into a
+// file that an earlier, interrupted download of the same blob left partially written, reading only
+// the rest of the blob from the CAS; a file that already holds the whole blob isn't downloaded
+// again. The resulting file is checked against the digest of the blob, and downloaded again from
+// the start if it doesn't match, e.g. because the file held other data. Files sized by
+// PreallocateFiles can't be resumed, as their size doesn't tell how much was written.
+type ResumeDownloads bool
+
+// Apply sets the ResumeDownloads flag on a client.
+func (r ResumeDownloads) Apply(c *Client) {
+	c.resumeReads = r
+}
+
+// UppercaseHashes is how the client handles digests of blobs whose hashes have uppercase hex
+// digits, e.g. when they come from external sources. The API requires lowercase hex, and servers
+// don't find blobs by such digests, which otherwise fail with confusing NOT_FOUND errors.
+type UppercaseHashes int
+
+const (
+	// RejectUppercaseHashes fails calls given such digests with an InvalidArgument error naming the
+	// digest. It is the default.
+	RejectUppercaseHashes UppercaseHashes = iota
+	// LowercaseHashes lowercases the hashes before sending them to the server. Results are still
+	// keyed by the digests the caller gave.
+	LowercaseHashes
+)
+
+// Apply sets the client's handling of uppercase hashes.
+func (u UppercaseHashes) Apply(c *Client) {
+	c.upperHashes = u
+}
+
+// RememberUploads can be set to true to have the client remember the blobs it has uploaded with
+// WriteBlobs or ExecuteUploadPlan, and leave them out of later uploads without querying the CAS for
+// them. It suits long-lived clients of a CAS that doesn't evict blobs soon after they are written.
+type RememberUploads bool
+
+// Apply sets the RememberUploads flag on a client.
+func (r RememberUploads) Apply(c *Client) {
+	if !r {
+		c.uploaded = nil
+		return
+	}
+	c.uploaded = &uploadedSet{keys: make(map[digest.Key]bool)}
+}
+
+// uploadedSet is the set of blobs uploaded by a client, with RememberUploads. It is safe for
+// concurrent use, and a nil set is empty.
+type uploadedSet struct {
+	mu   sync.RWMutex
+	keys map[digest.Key]bool
+}
+
+// add records that the blobs with the given digests were uploaded.
+func (s *uploadedSet) add(dgs []*repb.Digest) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, dg := range dgs {
+		s.keys[digest.ToKey(dg)] = true
+	}
+}
+
+// filter returns the digests of dgs that were not uploaded.
+func (s *uploadedSet) filter(dgs []*repb.Digest) []*repb.Digest {
+	if s == nil {
+		return dgs
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var res []*repb.Digest
+	for _, dg := range dgs {
+		if !s.keys[digest.ToKey(dg)] {
+			res = append(res, dg)
+		}
+	}
+	return res
+}
+
+// CoalesceMissingBlobs is the length of a window in which concurrent MissingBlobs calls are merged
+// into shared FindMissingBlobs RPCs, trading a little latency for fewer, larger queries when many
+// goroutines check overlapping digests. Only calls whose contexts carry the same outgoing metadata,
+// e.g. from ContextWithMetadata or ContextWithInvocationID, are merged, and the shared RPCs carry
+// that metadata. The shared RPCs run until the latest deadline of the callers' contexts, or without
+// a deadline if one of them has none; callers stop waiting when their own context is done. Zero,
+// the default, disables coalescing.
+type CoalesceMissingBlobs time.Duration
+
+// Apply sets the MissingBlobs coalescing window on a client.
+func (w CoalesceMissingBlobs) Apply(c *Client) {
+	if w <= 0 {
+		c.coalescer = nil
+		return
+	}
+	c.coalescer = &missingBlobsCoalescer{c: c, window: time.Duration(w)}
+}
+
+// CoalesceWrites can be set to true to have concurrent WriteBlob calls for the same blob share a
+// single ByteStream write, e.g. when several goroutines upload the same shared input. The callers
+// joining a write in progress get its result; if the caller making it gives up because its context
+// is done, they try again themselves. Writes are only shared while they are in progress.
+type CoalesceWrites bool
+
+// Apply sets the CoalesceWrites flag on a client.
+func (s CoalesceWrites) Apply(c *Client) {
+	if !s {
+		c.writeFlights = nil
+		return
+	}
+	c.writeFlights = &writeFlights{inFlight: make(map[digest.Key]*writeFlight)}
+}
+
+// OnProgress is a callback reporting the aggregate progress of a WriteBlobs call, in bytes. total is
+// the number of bytes that were found to be missing from the CAS, and done is the number of those
+// bytes that were uploaded so far. It is called once at the start and once at the end of a
+// successful upload, and at most once every 100 ms in between. Calls for an upload are never
+// concurrent, but those for concurrent uploads may be. See OnBatchProgress for the progress of each
+// batch, in blobs as well as bytes.
+type OnProgress func(done, total int64)
+
+// Apply sets the client's upload progress callback.
+func (p OnProgress) Apply(c *Client) {
+	c.onProgress = p
+}
+
+// BatchOp is the kind of batched CAS work whose progress is reported to an OnBatchProgress callback.
+type BatchOp int
+
+const (
+	// BatchQuery is querying the CAS for missing blobs, as done by MissingBlobs and WriteBlobs.
+	BatchQuery BatchOp = iota
+	// BatchUpload is uploading blobs, as done by WriteBlobs, WriteBlobsFunc and ExecuteUploadPlan.
+	BatchUpload
+)
+
+// BatchProgress is the progress of a batched CAS operation.
+type BatchProgress struct {
+	Op BatchOp
+	// Blobs is the number of blobs processed so far, and Bytes their total size. TotalBlobs and
+	// TotalBytes are those of the whole operation; for uploads, they only count the blobs that were
+	// found to be missing.
+	Blobs, TotalBlobs int
+	Bytes, TotalBytes int64
+}
+
+// OnBatchProgress is a callback reporting the progress of uploads and missing blob queries, in
+// blobs as well as bytes. Unlike OnProgress, it is called after each batch completes, and also
+// covers MissingBlobs, whose queries of many digests are split into batches too. Calls for an
+// operation are never concurrent, but those for concurrent operations may be. Coalesced
+// MissingBlobs calls (see CoalesceMissingBlobs) report the progress of their shared query.
+type OnBatchProgress func(BatchProgress)
+
+// Apply sets the client's batch progress callback.
+func (p OnBatchProgress) Apply(c *Client) {
+	c.onBatch = p
+}
+
+// CommitProgress has the client poll the server with QueryWriteStatus during long ByteStream writes,
+// such as those of WriteBytes and WriteBlob, to report how much of the data the server has
+// committed, which can lag behind what was sent when the server is the bottleneck.
+type CommitProgress struct {
+	// Interval is the time between two polls. Writes that take less time are not polled.
+	Interval time.Duration
+	// OnCommit is called with the name of the resource being written, the number of bytes the server
+	// committed, and the size of the write, after each successful poll. Calls for a write are never
+	// concurrent, and none are made after the write returns.
+	OnCommit func(name string, committed, total int64)
+}
+
+// Apply sets the client's commit progress callback.
+func (p CommitProgress) Apply(c *Client) {
+	c.commitPoll = p
+}
+
 // PerRPCCreds sets per-call options that will be set on all RPCs to the underlying connection.
 type PerRPCCreds struct {
 	Creds credentials.PerRPCCredentials
@@ -110,6 +508,44 @@ func (p *PerRPCCreds) Apply(c *Client) {
 	c.creds = p.Creds
 }
 
+// InvocationID is an Opt that tags every RPC of the client with an invocation ID, in the
+// InvocationIDHeader metadata, so that the server can attribute the traffic to an invocation, e.g.
+// for accounting. To tag only some calls, use ContextWithInvocationID instead; the two shouldn't be
+// combined, as the server would receive both IDs.
+type InvocationID string
+
+// Apply sets the invocation ID of a client.
+func (id InvocationID) Apply(c *Client) {
+	c.invocationID = id
+}
+
+// invocationIDCreds adds the InvocationIDHeader metadata to the per-RPC credentials creds, if any.
+// It is how InvocationID attaches the header to every call, since call options can't add metadata
+// otherwise.
+type invocationIDCreds struct {
+	id    string
+	creds credentials.PerRPCCredentials
+}
+
+func (ic *invocationIDCreds) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	md := make(map[string]string)
+	if ic.creds != nil {
+		var err error
+		if md, err = ic.creds.GetRequestMetadata(ctx, uri...); err != nil {
+			return nil, err
+		}
+	}
+	res := map[string]string{InvocationIDHeader: ic.id}
+	for k, v := range md {
+		res[k] = v
+	}
+	return res, nil
+}
+
+func (ic *invocationIDCreds) RequireTransportSecurity() bool {
+	return ic.creds != nil && ic.creds.RequireTransportSecurity()
+}
+
 func getImpersonatedRPCCreds(ctx context.Context, actAs string, cred credentials.PerRPCCredentials) credentials.PerRPCCredentials {
 	// Wrap in a ReuseTokenSource to cache valid tokens in memory (i.e., non-nil, with a non-expired
 	// access token).
@@ -159,6 +595,41 @@ type DialParams struct {
 	// on individual calls. This overrides ActAsAccount, UseApplicationDefault, and UseComputeEngine.
 	// This is not the same as NoSecurity, as transport credentials will still be set.
 	TransportCredsOnly bool
+
+	// RecordFile, if set, is a file to which all CAS and ByteStream requests and responses on the
+	// connection are recorded, for debugging. The recording can be served back with a Replayer.
+	RecordFile string
+
+	// KeepaliveTime, if set, is the time after which the client pings the server if it has seen no
+	// activity on the connection, so that the connection isn't closed by proxies while it is idle,
+	// e.g. during long pauses between the chunks of a streamed upload. Servers may close connections
+	// that ping too often.
+	KeepaliveTime time.Duration
+
+	// KeepaliveTimeout is how long the client waits for a reply to a keepalive ping before closing the
+	// connection. If zero, gRPC's default is used. It is ignored if KeepaliveTime is not set.
+	KeepaliveTimeout time.Duration
+
+	// KeepalivePermitWithoutStream is true if keepalive pings should also be sent when there are no
+	// active RPCs on the connection. It is ignored if KeepaliveTime is not set.
+	KeepalivePermitWithoutStream bool
+
+	// ReconnectAfterUnavailable, if positive, is the number of consecutive calls failing with
+	// UNAVAILABLE after which a new connection to the service is established and used for the next
+	// calls. It lets the client recover when a backend restart leaves the connection in a bad state.
+	ReconnectAfterUnavailable int
+
+	// CASConnections, if greater than 1, is the number of connections to the service that the CAS
+	// and ByteStream calls are spread over, round-robin, e.g. so that the concurrent requests of
+	// large uploads aren't limited by the concurrent streams that a single HTTP/2 connection allows.
+	// Other calls are all sent on the same connection.
+	CASConnections int
+
+	// UnaryInterceptors and StreamInterceptors are applied to all calls on the connection, e.g. to
+	// add tracing spans or refresh auth tokens. The first interceptor of each list is the outermost
+	// one; they all run before the interceptors installed by the other parameters.
+	UnaryInterceptors  []grpc.UnaryClientInterceptor
+	StreamInterceptors []grpc.StreamClientInterceptor
 }
 
 // DialRaw dials a remote execution service and returns the grpc connection that is established.
@@ -198,10 +669,73 @@ func DialRaw(ctx context.Context, params DialParams) (*grpc.ClientConn, error) {
 		opts = append(opts, grpc.WithTransportCredentials(tlsCreds))
 	}
 
+	if params.KeepaliveTime > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                params.KeepaliveTime,
+			Timeout:             params.KeepaliveTimeout,
+			PermitWithoutStream: params.KeepalivePermitWithoutStream,
+		}))
+	}
+
+	unary := append([]grpc.UnaryClientInterceptor(nil), params.UnaryInterceptors...)
+	stream := append([]grpc.StreamClientInterceptor(nil), params.StreamInterceptors...)
+	if params.RecordFile != "" {
+		rec, err := newRecorder(params.RecordFile)
+		if err != nil {
+			return nil, err
+		}
+		unary, stream = append(unary, rec.unary), append(stream, rec.stream)
+	}
+	var pool *connPool
+	if params.CASConnections > 1 {
+		// The other connections have their own reconnectors, but share the interceptors of this one.
+		p := params
+		p.RecordFile, p.CASConnections = "", 0
+		p.UnaryInterceptors, p.StreamInterceptors = nil, nil
+		pool = &connPool{}
+		for i := 1; i < params.CASConnections; i++ {
+			conn, err := DialRaw(ctx, p)
+			if err != nil {
+				pool.close()
+				return nil, err
+			}
+			pool.conns = append(pool.conns, conn)
+		}
+		unary, stream = append(unary, pool.unary), append(stream, pool.stream)
+	}
+	var rc *reconnector
+	if params.ReconnectAfterUnavailable > 0 {
+		// The new connections only carry the calls; the interceptors of this one still apply. They are
+		// dialed with their own context, as ctx may be done by the time they are needed.
+		p := params
+		p.RecordFile, p.ReconnectAfterUnavailable = "", 0
+		p.UnaryInterceptors, p.StreamInterceptors = nil, nil
+		rc = &reconnector{
+			dial:      func(ctx context.Context) (*grpc.ClientConn, error) { return DialRaw(ctx, p) },
+			threshold: params.ReconnectAfterUnavailable,
+		}
+		unary, stream = append(unary, rc.unary), append(stream, rc.stream)
+	}
+	if len(unary) > 0 {
+		opts = append(opts, grpc.WithUnaryInterceptor(chainUnary(unary)))
+	}
+	if len(stream) > 0 {
+		opts = append(opts, grpc.WithStreamInterceptor(chainStream(stream)))
+	}
+
 	conn, err := grpc.Dial(params.Service, opts...)
 	if err != nil {
+		if pool != nil {
+			pool.close()
+		}
 		return nil, fmt.Errorf("couldn't dial gRPC %q: %v", params.Service, err)
 	}
+	if rc != nil {
+		go rc.closeWith(conn)
+	}
+	if pool != nil {
+		go pool.closeWith(conn)
+	}
 	return conn, nil
 }
 
@@ -212,14 +746,16 @@ func Dial(ctx context.Context, instanceName string, params DialParams, opts ...O
 	if err != nil {
 		return nil, err
 	}
-	return NewClient(conn, instanceName, opts...)
+	c, err := NewClient(conn, instanceName, opts...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
 }
 
 // NewClient creates a client from an existing gRPC connection.
 func NewClient(conn *grpc.ClientConn, instanceName string, opts ...Opt) (*Client, error) {
-	if instanceName == "" {
-		return nil, fmt.Errorf("instance needs to be specified")
-	}
 	log.Infof("Connecting to remote execution instance %s", instanceName)
 	client := &Client{
 		InstanceName:   instanceName,
@@ -231,18 +767,125 @@ func NewClient(conn *grpc.ClientConn, instanceName string, opts ...Opt) (*Client
 		operations:     opgrpc.NewOperationsClient(conn),
 		rpcTimeout:     time.Minute,
 		Closer:         conn,
+		digestFn:       digest.SHA256,
 		chunkMaxSize:   DefaultMaxWriteChunkSize,
 		useBatchOps:    true,
 		casConcurrency: 10,
+		maxRecvMsgSize: DefaultMaxRecvMsgSize,
+		readAhead:      DefaultReadAhead,
+		findMissingMax: DefaultFindMissingBatchSize,
+		batchTimes:     newBatchTimes(),
 	}
 	for _, o := range opts {
 		o.Apply(client)
 	}
+	if client.digestFnErr != nil {
+		return nil, client.digestFnErr
+	}
+	if client.chunkMaxSizeErr != nil {
+		return nil, client.chunkMaxSizeErr
+	}
 	return client, nil
 }
 
+// ClientConfig is a snapshot of the effective configuration of a Client, after defaults and
+// options are applied, meant for logging and bug reports.
+type ClientConfig struct {
+	InstanceName               string
+	DigestFunction             repb.DigestFunction
+	ChunkMaxSize               int
+	UseBatchOps                bool
+	MaxBatchSize               int64
+	CASConcurrency             int
+	FindMissingBatchSize       int
+	MaxBlobSize                int64
+	SmallWriteConcurrency      int
+	MaxRecvMsgSize             int
+	StreamThreshold            int64
+	DirectUpload               DirectUploadThreshold
+	ReadAhead                  int
+	RPCTimeout                 time.Duration
+	RPCsPerSecond              float64
+	OperationTimeout           time.Duration
+	Retries                    bool
+	RetryWholeOperation        bool
+	RememberUploads            bool
+	ReturnDataOnDigestMismatch bool
+	VerifyReads                bool
+	CollectBatchErrors         bool
+	PreallocateFiles           bool
+	ResumeDownloads            bool
+	UppercaseHashes            UppercaseHashes
+	CoalesceMissingBlobs       time.Duration
+	CoalesceWrites             bool
+	PresenceCacheSize          int
+	PresenceCacheTTL           time.Duration
+	PerRPCCredentials          bool
+	CommitProgressInterval     time.Duration
+	InvocationID               string
+}
+
+// cachedMaxBatchSz returns the maximum size of a batch to upload like maxBatchSz, but only from the
+// cached capabilities of the server, without fetching them.
+func (c *Client) cachedMaxBatchSz() int64 {
+	c.capsMu.Lock()
+	defer c.capsMu.Unlock()
+	if !c.capsFetched || c.capsErr != nil {
+		return MaxBatchSz
+	}
+	return negotiatedBatchSz(c.caps.GetCacheCapabilities().GetMaxBatchTotalSizeBytes())
+}
+
+// Config returns the effective configuration of the client. MaxBatchSize is the maximum size
+// negotiated with the server once its capabilities have been fetched, see ServerCapabilities, and
+// MaxBatchSz before then.
+func (c *Client) Config() ClientConfig {
+	cfg := ClientConfig{
+		InstanceName:               c.InstanceName,
+		DigestFunction:             c.digestFn.Value(),
+		ChunkMaxSize:               int(c.chunkMaxSize),
+		UseBatchOps:                bool(c.useBatchOps),
+		MaxBatchSize:               c.cachedMaxBatchSz(),
+		CASConcurrency:             int(c.casConcurrency),
+		FindMissingBatchSize:       int(c.findMissingMax),
+		MaxBlobSize:                int64(c.maxBlobSize),
+		SmallWriteConcurrency:      int(c.smallWrites),
+		MaxRecvMsgSize:             int(c.maxRecvMsgSize),
+		StreamThreshold:            int64(c.streamThresh),
+		DirectUpload:               c.directUpload,
+		ReadAhead:                  int(c.readAhead),
+		RPCTimeout:                 c.rpcTimeout,
+		RPCsPerSecond:              float64(c.rpcRate),
+		OperationTimeout:           c.opTimeout,
+		Retries:                    c.retrier != nil,
+		RetryWholeOperation:        bool(c.retryWholeOp),
+		RememberUploads:            c.uploaded != nil,
+		ReturnDataOnDigestMismatch: bool(c.mismatchData),
+		VerifyReads:                bool(c.verifyReads),
+		CollectBatchErrors:         bool(c.collectErrs),
+		PreallocateFiles:           bool(c.preallocate),
+		ResumeDownloads:            bool(c.resumeReads),
+		UppercaseHashes:            c.upperHashes,
+		CoalesceWrites:             c.writeFlights != nil,
+		PerRPCCredentials:          c.creds != nil,
+		InvocationID:               string(c.invocationID),
+	}
+	if c.coalescer != nil {
+		cfg.CoalesceMissingBlobs = c.coalescer.window
+	}
+	if c.present != nil {
+		cfg.PresenceCacheSize, cfg.PresenceCacheTTL = c.present.maxEntries, c.present.ttl
+	}
+	if c.commitPoll.OnCommit != nil {
+		cfg.CommitProgressInterval = c.commitPoll.Interval
+	}
+	return cfg
+}
+
 // RPCTimeout is a Opt that sets the per-RPC deadline.
-// NOTE that the deadline is only applied to non-streaming calls.
+// For non-streaming calls, the deadline applies to the whole call. For the GetTree streams of
+// GetDirectoryTree and WalkDirectoryTree, it applies to the wait for each page instead, so that long
+// trees aren't cut short while stalled streams still fail; other streams are not bounded by it.
 // The default timeout value is 1 minute.
 type RPCTimeout time.Duration
 
@@ -251,11 +894,62 @@ func (d RPCTimeout) Apply(c *Client) {
 	c.rpcTimeout = time.Duration(d)
 }
 
+// OperationTimeout is an Opt that sets an overall deadline for a call to WriteBlobs, MissingBlobs
+// or DownloadOutputs, covering all the RPCs and retries it makes. Unlike RPCTimeout, it bounds
+// operations that are slow without any single RPC hanging. A call that runs out of time fails with
+// an *OperationTimeoutError. By default, there is no overall deadline.
+type OperationTimeout time.Duration
+
+// Apply applies the timeout to a Client.
+func (d OperationTimeout) Apply(c *Client) {
+	c.opTimeout = time.Duration(d)
+}
+
+// OperationTimeoutError is the error of a call that didn't complete within the client's
+// OperationTimeout. Running out of a per-RPC timeout instead gives a DeadlineExceeded status.
+type OperationTimeoutError struct {
+	// Op is the name of the call that timed out, e.g. "WriteBlobs".
+	Op string
+	// Timeout is the client's OperationTimeout.
+	Timeout time.Duration
+	// Err is the error the call returned when it ran out of time.
+	Err error
+}
+
+func (e *OperationTimeoutError) Error() string {
+	return fmt.Sprintf("%s did not complete within the operation timeout of %v: %v", e.Op, e.Timeout, e.Err)
+}
+
+// Unwrap returns the error the call returned when it ran out of time.
+func (e *OperationTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// withOpTimeout calls f with a context bounded by the client's OperationTimeout, if it has one. If
+// f fails because that deadline passed, the error is returned as an *OperationTimeoutError.
+func (c *Client) withOpTimeout(ctx context.Context, op string, f func(ctx context.Context) error) error {
+	if c.opTimeout <= 0 {
+		return f(ctx)
+	}
+	childCtx, cancel := context.WithTimeout(ctx, c.opTimeout)
+	defer cancel()
+	err := f(childCtx)
+	// Deadlines of the caller's context are left to the caller.
+	if err != nil && childCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return &OperationTimeoutError{Op: op, Timeout: c.opTimeout, Err: err}
+	}
+	return err
+}
+
 func (c *Client) rpcOpts() []grpc.CallOption {
-	if c.creds == nil {
+	creds := c.creds
+	if c.invocationID != "" {
+		creds = &invocationIDCreds{id: string(c.invocationID), creds: c.creds}
+	}
+	if creds == nil {
 		return nil
 	}
-	return []grpc.CallOption{grpc.PerRPCCredentials(c.creds)}
+	return []grpc.CallOption{grpc.PerRPCCredentials(creds)}
 }
 
 func (c *Client) callWithTimeout(ctx context.Context, f func(ctx context.Context) error) error {
@@ -268,6 +962,20 @@ func (c *Client) callWithTimeout(ctx context.Context, f func(ctx context.Context
 	return e
 }
 
+// safely returns a function that calls f, but returns an error with the stack trace if f panics,
+// rather than crashing the process. It is meant for the goroutines that the client starts, so that
+// malformed inputs or server responses degrade to an error.
+func safely(f func() error) func() error {
+	return func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+			}
+		}()
+		return f()
+	}
+}
+
 // Retrier applied to all client requests.
 type Retrier struct {
 	Backoff     retry.BackoffPolicy
@@ -286,7 +994,52 @@ func (r *Retrier) do(ctx context.Context, f func() error) error {
 	if r == nil {
 		return f()
 	}
-	return retry.WithPolicy(ctx, r.ShouldRetry, r.Backoff, f)
+	attempts := 0
+	var lastErr error
+	// An operation that stopped starting batches near the deadline would only run into it again.
+	shouldRetry := func(err error) bool {
+		return !batchesStopped(err) && r.ShouldRetry(err)
+	}
+	err := retry.WithPolicy(ctx, shouldRetry, r.Backoff, func() error {
+		attempts++
+		lastErr = f()
+		return lastErr
+	})
+	// WithPolicy gives up on a retriable error only once the retry budget is exhausted, or when the
+	// context is done.
+	if err != nil && ctx.Err() == nil && shouldRetry(lastErr) {
+		return &RetryBudgetExhaustedError{Attempts: attempts, Err: lastErr}
+	}
+	return err
+}
+
+// RetryBudgetExhaustedError is returned by client methods that still failed with a retriable error
+// after exhausting the retries of the client's Retrier, as opposed to failing with a non-retriable
+// error. The error of the last attempt is available through Unwrap, and its gRPC status code is
+// preserved.
+type RetryBudgetExhaustedError struct {
+	// Attempts is the number of attempts that were made.
+	Attempts int
+	// Err is the error returned by the last attempt.
+	Err error
+}
+
+func (e *RetryBudgetExhaustedError) Error() string {
+	return fmt.Sprintf("retry budget exhausted (%d attempts): %v", e.Attempts, e.Err)
+}
+
+// Unwrap returns the error of the last attempt.
+func (e *RetryBudgetExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+// GRPCStatus returns the status of the last attempt, with its message annotated, so that the status
+// code can be retrieved with status.FromError and status.Code.
+func (e *RetryBudgetExhaustedError) GRPCStatus() *status.Status {
+	st, _ := status.FromError(e.Err)
+	spb := st.Proto()
+	spb.Message = fmt.Sprintf("retry budget exhausted (%d attempts): %s", e.Attempts, spb.Message)
+	return status.FromProto(spb)
 }
 
 // RetryTransient is a default retry policy for transient status codes.
@@ -487,6 +1240,100 @@ func (c *Client) GetCapabilities(ctx context.Context, req *repb.GetCapabilitiesR
 	return res, nil
 }
 
+// ServerCapabilities returns the capabilities of the server, which the client fetches with
+// GetCapabilities the first time they are needed and then caches, along with any error, until
+// RefreshCapabilities is called. The client uses them to keep its batches within the maximum batch
+// size the server advertises, when it is smaller than MaxBatchSz; if they can't be fetched, MaxBatchSz
+// is used. The client logs a warning if the server doesn't list its digest function, see
+// DigestFunction.
+func (c *Client) ServerCapabilities(ctx context.Context) (*repb.ServerCapabilities, error) {
+	return c.capabilitiesCached(ctx, false)
+}
+
+// RefreshCapabilities fetches the capabilities of the server again, replacing those cached by
+// ServerCapabilities, and returns them.
+func (c *Client) RefreshCapabilities(ctx context.Context) (*repb.ServerCapabilities, error) {
+	return c.capabilitiesCached(ctx, true)
+}
+
+// capabilitiesCached returns the cached capabilities of the server, fetching them if they aren't
+// cached or refresh is true. Callers that find a fetch in flight wait for it rather than starting
+// another, and the RPC is made without holding c.capsMu, so that waiters can give up when their
+// context is done. An error is not cached if the context of the fetch is done, as it says nothing
+// about the server.
+func (c *Client) capabilitiesCached(ctx context.Context, refresh bool) (*repb.ServerCapabilities, error) {
+	c.capsMu.Lock()
+	for c.capsFetch != nil {
+		wait := c.capsFetch
+		c.capsMu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c.capsMu.Lock()
+	}
+	if c.capsFetched && !refresh {
+		defer c.capsMu.Unlock()
+		return c.caps, c.capsErr
+	}
+	done := make(chan struct{})
+	c.capsFetch = done
+	c.capsMu.Unlock()
+
+	caps, err := c.GetCapabilities(ctx, &repb.GetCapabilitiesRequest{InstanceName: c.InstanceName})
+	cache := err == nil || ctx.Err() == nil
+	c.capsMu.Lock()
+	if cache {
+		c.caps, c.capsErr, c.capsFetched = caps, err, true
+	}
+	c.capsFetch = nil
+	close(done)
+	c.capsMu.Unlock()
+	if !cache {
+		return nil, err
+	}
+	if err != nil {
+		log.Warningf("failed to get the server capabilities: %v", err)
+		return nil, err
+	}
+	if fns := caps.GetCacheCapabilities().GetDigestFunction(); len(fns) > 0 {
+		supported := false
+		for _, fn := range fns {
+			supported = supported || fn == c.digestFn.Value()
+		}
+		if !supported {
+			log.Warningf("the server supports the digest functions %v, but not %v, which the client uses", fns, c.digestFn)
+		}
+	}
+	return caps, nil
+}
+
+// serverMaxBatchSz returns the maximum total size of the blobs of a batch that the server advertises,
+// or 0 if it doesn't advertise any, or its capabilities can't be fetched.
+func (c *Client) serverMaxBatchSz(ctx context.Context) int64 {
+	caps, err := c.ServerCapabilities(ctx)
+	if err != nil {
+		return 0
+	}
+	return caps.GetCacheCapabilities().GetMaxBatchTotalSizeBytes()
+}
+
+// maxBatchSz returns the maximum size of a batch to upload with BatchUpdateBlobs: MaxBatchSz, or the
+// maximum advertised by the server if it is smaller.
+func (c *Client) maxBatchSz(ctx context.Context) int64 {
+	return negotiatedBatchSz(c.serverMaxBatchSz(ctx))
+}
+
+// negotiatedBatchSz returns MaxBatchSz, or the maximum batch size advertised by the server, max, if
+// it is positive and smaller.
+func negotiatedBatchSz(max int64) int64 {
+	if max > 0 && max < MaxBatchSz {
+		return max
+	}
+	return MaxBatchSz
+}
+
 // GetOperation wraps the underlying call with specific client options.
 func (c *Client) GetOperation(ctx context.Context, req *oppb.GetOperationRequest) (res *oppb.Operation, err error) {
 	opts := c.rpcOpts()
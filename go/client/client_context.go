@@ -16,11 +16,18 @@ import (
 const (
 	// The headers key of our RequestMetadata.
 	remoteHeadersKey = "build.bazel.remote.execution.v2.requestmetadata-bin"
+
+	// InvocationIDHeader is the gRPC metadata key of the invocation ID set with InvocationID or
+	// ContextWithInvocationID. It is separate from the tool invocation ID of the RequestMetadata, and
+	// is meant for servers that attribute traffic to invocations, e.g. for billing or rate limiting.
+	InvocationIDHeader = "x-invocation-id"
 )
 
 // ContextWithMetadata attaches metadata to the passed-in context, returning a new
 // context. This function should be called in every test method after a context is created. It uses
-// the already created context to generate a new one containing the metadata header.
+// the already created context to generate a new one containing the metadata header. Other outgoing
+// metadata of the context, e.g. tracing headers, is kept, but a RequestMetadata header that it
+// already has is replaced.
 func ContextWithMetadata(ctx context.Context, toolName, actionID, invocationID string) (context.Context, error) {
 	if actionID == "" {
 		actionID = uuid.New()
@@ -45,6 +52,14 @@ func ContextWithMetadata(ctx context.Context, toolName, actionID, invocationID s
 
 	// metadata package converts the binary buffer to a base64 string, so no need to encode before
 	// sending.
-	mdPair := metadata.Pairs(remoteHeadersKey, string(buf))
-	return metadata.NewOutgoingContext(ctx, mdPair), nil
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	md.Set(remoteHeadersKey, string(buf))
+	return metadata.NewOutgoingContext(ctx, md), nil
+}
+
+// ContextWithInvocationID returns a context that tags the RPCs made with it with the given
+// invocation ID, in the InvocationIDHeader metadata, keeping the metadata already attached to ctx.
+func ContextWithInvocationID(ctx context.Context, invocationID string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, InvocationIDHeader, invocationID)
 }
@@ -0,0 +1,319 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/digest"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bsgrpc "google.golang.org/genproto/googleapis/bytestream"
+)
+
+func TestConfig(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	params := client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}
+	defaults := client.ClientConfig{
+		InstanceName:         instance,
+		DigestFunction:       repb.DigestFunction_SHA256,
+		ChunkMaxSize:         client.DefaultMaxWriteChunkSize,
+		UseBatchOps:          true,
+		MaxBatchSize:         client.MaxBatchSz,
+		CASConcurrency:       10,
+		FindMissingBatchSize: client.DefaultFindMissingBatchSize,
+		MaxRecvMsgSize:       client.DefaultMaxRecvMsgSize,
+		ReadAhead:            client.DefaultReadAhead,
+		RPCTimeout:           time.Minute,
+	}
+	configured := defaults
+	configured.ChunkMaxSize = 8192
+	configured.UseBatchOps = false
+	configured.CASConcurrency = 3
+	configured.DirectUpload = client.DirectUploadThreshold{MaxBlobs: 2, MaxBytes: 100}
+	configured.RPCTimeout = time.Second
+	configured.OperationTimeout = time.Hour
+	configured.Retries = true
+	configured.RememberUploads = true
+	configured.CollectBatchErrors = true
+	configured.PreallocateFiles = true
+	configured.ResumeDownloads = true
+	configured.CommitProgressInterval = time.Second
+	configured.UppercaseHashes = client.LowercaseHashes
+	configured.CoalesceMissingBlobs = 10 * time.Millisecond
+	configured.CoalesceWrites = true
+	configured.VerifyReads = true
+	configured.PresenceCacheSize = 1000
+	configured.PresenceCacheTTL = time.Minute
+	configured.MaxBlobSize = 1 << 30
+	configured.RPCsPerSecond = 500
+
+	tests := []struct {
+		name string
+		opts []client.Opt
+		want client.ClientConfig
+	}{
+		{
+			name: "defaults",
+			want: defaults,
+		},
+		{
+			name: "options",
+			opts: []client.Opt{
+				client.ChunkMaxSize(8192),
+				client.UseBatchOps(false),
+				client.CASConcurrency(3),
+				client.DirectUploadThreshold{MaxBlobs: 2, MaxBytes: 100},
+				client.RPCTimeout(time.Second),
+				client.OperationTimeout(time.Hour),
+				client.RetryTransient(),
+				client.RememberUploads(true),
+				client.CollectBatchErrors(true),
+				client.PreallocateFiles(true),
+				client.ResumeDownloads(true),
+				client.CommitProgress{Interval: time.Second, OnCommit: func(string, int64, int64) {}},
+				client.LowercaseHashes,
+				client.CoalesceMissingBlobs(10 * time.Millisecond),
+				client.CoalesceWrites(true),
+				client.VerifyReads(true),
+				client.PresenceCache{MaxEntries: 1000, TTL: time.Minute},
+				client.MaxBlobSize(1 << 30),
+				client.RPCsPerSecond(500),
+			},
+			want: configured,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := client.Dial(ctx, instance, params, tc.opts...)
+			if err != nil {
+				t.Fatalf("Error connecting to server: %v", err)
+			}
+			defer c.Close()
+			if diff := cmp.Diff(tc.want, c.Config()); diff != "" {
+				t.Errorf("c.Config() gave diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// headerRecorder records the values of a metadata header received by a server, by method.
+type headerRecorder struct {
+	header string
+	mu     sync.Mutex
+	values map[string][]string
+}
+
+func (r *headerRecorder) record(ctx context.Context, method string) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values[method] = append(r.values[method], md.Get(r.header)...)
+}
+
+func (r *headerRecorder) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	r.record(ctx, info.FullMethod)
+	return handler(ctx, req)
+}
+
+func (r *headerRecorder) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	r.record(ss.Context(), info.FullMethod)
+	return handler(srv, ss)
+}
+
+func TestInvocationID(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	rec := &headerRecorder{header: client.InvocationIDHeader}
+	server := grpc.NewServer(grpc.UnaryInterceptor(rec.unary), grpc.StreamInterceptor(rec.stream))
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	repb.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	input := make(map[digest.Key][]byte)
+	for _, blob := range [][]byte{[]byte("foo"), []byte("bar"), bytes.Repeat([]byte{1}, 5*1024*1024)} {
+		input[digest.ToKey(digest.FromBlob(blob))] = blob
+	}
+	tests := []struct {
+		name string
+		opts []client.Opt
+		ctx  context.Context
+	}{
+		{
+			name: "option",
+			opts: []client.Opt{client.InvocationID("invocation")},
+			ctx:  context.Background(),
+		},
+		{
+			name: "context",
+			ctx:  client.ContextWithInvocationID(context.Background(), "invocation"),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := client.Dial(tc.ctx, instance, client.DialParams{
+				Service:    listener.Addr().String(),
+				NoSecurity: true,
+			}, tc.opts...)
+			if err != nil {
+				t.Fatalf("Error connecting to server: %v", err)
+			}
+			defer c.Close()
+			fake.blobs = make(map[digest.Key][]byte)
+			rec.values = make(map[string][]string)
+
+			if err := c.WriteBlobs(tc.ctx, input); err != nil {
+				t.Fatalf("c.WriteBlobs(ctx, input) gave error %v, expected nil", err)
+			}
+			want := map[string][]string{
+				"/build.bazel.remote.execution.v2.ContentAddressableStorage/FindMissingBlobs": {"invocation"},
+				"/build.bazel.remote.execution.v2.ContentAddressableStorage/BatchUpdateBlobs": {"invocation"},
+				"/google.bytestream.ByteStream/Write":                                         {"invocation"},
+			}
+			if diff := cmp.Diff(want, rec.values); diff != "" {
+				t.Errorf("server received invocation IDs with diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCallerMetadata(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	var mu sync.Mutex
+	var got metadata.MD
+	server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		mu.Lock()
+		got, _ = metadata.FromIncomingContext(ctx)
+		mu.Unlock()
+		return handler(ctx, req)
+	}))
+	fake := &fakeCAS{}
+	repb.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "traceparent", "trace")
+	ctx, err = client.ContextWithMetadata(ctx, "tool", "action", "invocation")
+	if err != nil {
+		t.Fatalf("client.ContextWithMetadata(ctx, ...) gave error %v, want nil", err)
+	}
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.InvocationID("id"))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.MissingBlobs(ctx, []*repb.Digest{digest.FromBlob([]byte("foo"))}); err != nil {
+		t.Fatalf("c.MissingBlobs(ctx, ...) gave error %v, want nil", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if v := got.Get("traceparent"); len(v) != 1 || v[0] != "trace" {
+		t.Errorf("server received traceparent %v, want [trace]", v)
+	}
+	if v := got.Get(client.InvocationIDHeader); len(v) != 1 || v[0] != "id" {
+		t.Errorf("server received %s %v, want [id]", client.InvocationIDHeader, v)
+	}
+	v := got.Get("build.bazel.remote.execution.v2.requestmetadata-bin")
+	if len(v) != 1 {
+		t.Fatalf("server received %d RequestMetadata headers, want 1", len(v))
+	}
+	meta := &repb.RequestMetadata{}
+	if err := proto.Unmarshal([]byte(v[0]), meta); err != nil {
+		t.Fatalf("failed to unmarshal RequestMetadata: %v", err)
+	}
+	if meta.ActionId != "action" || meta.ToolInvocationId != "invocation" {
+		t.Errorf("server received RequestMetadata %v, want action ID %q and tool invocation ID %q", meta, "action", "invocation")
+	}
+}
+
+func TestDialInterceptors(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	repb.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	var mu sync.Mutex
+	var calls []string
+	record := func(name, method string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, name+" "+method)
+	}
+	unary := func(name string) grpc.UnaryClientInterceptor {
+		return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			record(name, method)
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+	}
+	stream := func(name string) grpc.StreamClientInterceptor {
+		return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			record(name, method)
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+	}
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:            listener.Addr().String(),
+		NoSecurity:         true,
+		UnaryInterceptors:  []grpc.UnaryClientInterceptor{unary("outer"), unary("inner")},
+		StreamInterceptors: []grpc.StreamClientInterceptor{stream("stream")},
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	blob := []byte("blob")
+	dg := digest.FromBlob(blob)
+	fake.blobs = map[digest.Key][]byte{digest.ToKey(dg): blob}
+	if _, err := c.MissingBlobs(ctx, []*repb.Digest{dg}); err != nil {
+		t.Fatalf("c.MissingBlobs(ctx, digests) gave error %v, want nil", err)
+	}
+	if _, err := c.ReadBlob(ctx, dg); err != nil {
+		t.Fatalf("c.ReadBlob(ctx, digest) gave error %v, want nil", err)
+	}
+	want := []string{
+		"outer /build.bazel.remote.execution.v2.ContentAddressableStorage/FindMissingBlobs",
+		"inner /build.bazel.remote.execution.v2.ContentAddressableStorage/FindMissingBlobs",
+		"stream /google.bytestream.ByteStream/Read",
+	}
+	if diff := cmp.Diff(want, calls); diff != "" {
+		t.Errorf("interceptors saw calls with diff (-want +got):\n%s", diff)
+	}
+}
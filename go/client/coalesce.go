@@ -0,0 +1,196 @@
+package client
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/digest"
+	log "github.com/golang/glog"
+	"google.golang.org/grpc/metadata"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// missingBlobsCoalescer merges the MissingBlobs queries of concurrent callers arriving within a
+// time window into a single query. Only callers whose contexts carry the same outgoing metadata are
+// merged, so that each query is sent with its callers' metadata.
+type missingBlobsCoalescer struct {
+	c      *Client
+	window time.Duration
+
+	mu sync.Mutex
+	// pending holds the queries currently collecting digests, by the key of their metadata.
+	pending map[string]*coalescedQuery
+}
+
+// coalescedQuery is a set of digests queried together on behalf of several callers.
+type coalescedQuery struct {
+	md  metadata.MD
+	dgs map[digest.Key]bool
+	// deadline is the latest deadline of the callers, unless one of them has none, in which case
+	// unbounded is set.
+	deadline  time.Time
+	unbounded bool
+	// done is closed once missing and err are set.
+	done    chan struct{}
+	missing map[digest.Key]bool
+	err     error
+}
+
+// mdKey returns a key identifying the outgoing metadata md, regardless of the order of its keys.
+func mdKey(md metadata.MD) string {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		for _, v := range md[k] {
+			b.WriteByte(0)
+			b.WriteString(v)
+		}
+		b.WriteByte(1)
+	}
+	return b.String()
+}
+
+// query adds ds to the pending query of callers with the same outgoing metadata as ctx, starting a
+// new one if needed, and waits for its result.
+func (m *missingBlobsCoalescer) query(ctx context.Context, ds []*repb.Digest) ([]*repb.Digest, error) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	key := mdKey(md)
+	m.mu.Lock()
+	q := m.pending[key]
+	if q == nil {
+		q = &coalescedQuery{md: md.Copy(), dgs: make(map[digest.Key]bool), done: make(chan struct{})}
+		if m.pending == nil {
+			m.pending = make(map[string]*coalescedQuery)
+		}
+		m.pending[key] = q
+		time.AfterFunc(m.window, func() { m.run(key, q) })
+	}
+	for _, dg := range ds {
+		q.dgs[digest.ToKey(dg)] = true
+	}
+	if deadline, ok := ctx.Deadline(); !ok {
+		q.unbounded = true
+	} else if deadline.After(q.deadline) {
+		q.deadline = deadline
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if q.err != nil {
+		return nil, q.err
+	}
+	var missing []*repb.Digest
+	seen := make(map[digest.Key]bool)
+	for _, dg := range ds {
+		k := digest.ToKey(dg)
+		if q.missing[k] && !seen[k] {
+			seen[k] = true
+			missing = append(missing, dg)
+		}
+	}
+	return missing, nil
+}
+
+// run closes q, pending under key, to new digests and queries the CAS for them, with the metadata
+// of its callers and until the latest of their deadlines.
+func (m *missingBlobsCoalescer) run(key string, q *coalescedQuery) {
+	m.mu.Lock()
+	if m.pending[key] == q {
+		delete(m.pending, key)
+	}
+	m.mu.Unlock()
+
+	var dgs []*repb.Digest
+	for k := range q.dgs {
+		dgs = append(dgs, digest.FromKey(k))
+	}
+	ctx := metadata.NewOutgoingContext(context.Background(), q.md)
+	if !q.unbounded {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, q.deadline)
+		defer cancel()
+	}
+	log.V(2).Infof("querying %d coalesced digests", len(dgs))
+	missing, err := m.c.missingBlobs(ctx, dgs)
+	q.missing = make(map[digest.Key]bool)
+	for _, dg := range missing {
+		q.missing[digest.ToKey(dg)] = true
+	}
+	q.err = err
+	close(q.done)
+}
+
+// writeFlights collapses concurrent uploads of the same blob into a single write, see
+// CoalesceWrites.
+type writeFlights struct {
+	mu sync.Mutex
+	// inFlight holds the writes in progress, by digest. Entries are removed when the write ends.
+	inFlight map[digest.Key]*writeFlight
+}
+
+// writeFlight is a write of a blob shared by concurrent callers.
+type writeFlight struct {
+	// done is closed once err and canceled are set.
+	done chan struct{}
+	err  error
+	// canceled is whether the write failed because the context of the caller making it was done.
+	canceled bool
+}
+
+// do runs write to upload the blob with key k, unless an upload of it is already in flight, in
+// which case it waits for that upload and returns its result. If the caller making the shared upload
+// gives up on it, the callers waiting for it try again, as their own contexts allow. A nil
+// writeFlights runs write directly.
+func (f *writeFlights) do(ctx context.Context, k digest.Key, write func() error) error {
+	if f == nil {
+		return write()
+	}
+	for {
+		f.mu.Lock()
+		w, ok := f.inFlight[k]
+		if !ok {
+			w = &writeFlight{done: make(chan struct{})}
+			f.inFlight[k] = w
+			f.mu.Unlock()
+			return f.run(ctx, k, w, write)
+		}
+		f.mu.Unlock()
+		log.V(2).Infof("waiting for the upload of %s in flight", digest.ToString(digest.FromKey(k)))
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if !w.canceled {
+			return w.err
+		}
+	}
+}
+
+// run makes the write w of the blob with key k, and removes it from the writes in flight.
+func (f *writeFlights) run(ctx context.Context, k digest.Key, w *writeFlight, write func() error) error {
+	// A panicking write leaves err unset and canceled true, so that the waiters try again.
+	w.canceled = true
+	defer func() {
+		f.mu.Lock()
+		delete(f.inFlight, k)
+		f.mu.Unlock()
+		close(w.done)
+	}()
+	w.err = write()
+	w.canceled = w.err != nil && ctx.Err() != nil
+	return w.err
+}
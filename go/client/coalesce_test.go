@@ -0,0 +1,247 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/digest"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	regrpc "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bsgrpc "google.golang.org/genproto/googleapis/bytestream"
+)
+
+func TestCoalesceMissingBlobs(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.CoalesceMissingBlobs(200*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	// Blobs with even indices are present. Each caller queries an overlapping window of blobs.
+	var dgs []*repb.Digest
+	for i := 0; i < 20; i++ {
+		blob := []byte(fmt.Sprintf("blob %d", i))
+		dgs = append(dgs, digest.FromBlob(blob))
+		if i%2 == 0 {
+			fake.blobs[digest.ToKey(dgs[i])] = blob
+		}
+	}
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make([]error, callers)
+	got := make([][]*repb.Digest, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			got[i], errs[i] = c.MissingBlobs(ctx, dgs[i:i+10])
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < callers; i++ {
+		if errs[i] != nil {
+			t.Errorf("c.MissingBlobs(ctx, dgs[%d:%d]) gave error %v, expected nil", i, i+10, errs[i])
+			continue
+		}
+		var want []*repb.Digest
+		for j := i; j < i+10; j++ {
+			if j%2 == 1 {
+				want = append(want, dgs[j])
+			}
+		}
+		if diff := cmp.Diff(want, got[i], cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("c.MissingBlobs(ctx, dgs[%d:%d]) gave diff (-want +got):\n%s", i, i+10, diff)
+		}
+	}
+	if fake.findMissingReqs != 1 {
+		t.Errorf("%d FindMissingBlobs requests were made, want 1", fake.findMissingReqs)
+	}
+}
+
+// invocationsCAS is a fakeCAS that records the invocation ID header of each FindMissingBlobs call,
+// and the time left before its deadline.
+type invocationsCAS struct {
+	*fakeCAS
+	mu          sync.Mutex
+	invocations []string
+	timeLeft    []time.Duration
+}
+
+func (f *invocationsCAS) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	deadline, _ := ctx.Deadline()
+	f.mu.Lock()
+	f.invocations = append(f.invocations, strings.Join(md.Get(client.InvocationIDHeader), ","))
+	f.timeLeft = append(f.timeLeft, time.Until(deadline))
+	f.mu.Unlock()
+	return f.fakeCAS.FindMissingBlobs(ctx, req)
+}
+
+func TestCoalesceMissingBlobsMetadata(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &invocationsCAS{fakeCAS: &fakeCAS{blobs: make(map[digest.Key][]byte)}}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.CoalesceMissingBlobs(200*time.Millisecond), client.RPCTimeout(time.Hour))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	// The callers of invocation "a" have deadlines, so their shared query runs until the later one.
+	// One caller of invocation "b" has none, so theirs is only bound by the RPC timeout.
+	callers := []struct {
+		invocation string
+		timeout    time.Duration
+	}{
+		{"a", time.Minute},
+		{"a", 2 * time.Minute},
+		{"b", time.Minute},
+		{"b", 0},
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(callers))
+	for i, cl := range callers {
+		wg.Add(1)
+		go func(i int, invocation string, timeout time.Duration) {
+			defer wg.Done()
+			cCtx := client.ContextWithInvocationID(ctx, invocation)
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				cCtx, cancel = context.WithTimeout(cCtx, timeout)
+				defer cancel()
+			}
+			_, errs[i] = c.MissingBlobs(cCtx, []*repb.Digest{digest.FromBlob([]byte(fmt.Sprintf("blob %d", i)))})
+		}(i, cl.invocation, cl.timeout)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("c.MissingBlobs(ctx, digests) of caller %d gave error %v, want nil", i, err)
+		}
+	}
+
+	got := make(map[string]time.Duration)
+	for i, inv := range fake.invocations {
+		got[inv] = fake.timeLeft[i]
+	}
+	if left, ok := got["a"]; !ok || left <= time.Minute || left > 2*time.Minute {
+		t.Errorf("FindMissingBlobs call of invocation \"a\" had %v before its deadline, want between 1 and 2 minutes", left)
+	}
+	if left, ok := got["b"]; !ok || left <= 2*time.Minute {
+		t.Errorf("FindMissingBlobs call of invocation \"b\" had %v before its deadline, want the RPC timeout of an hour", left)
+	}
+	if len(fake.invocations) != 2 {
+		t.Errorf("%d FindMissingBlobs requests were made, want 2", len(fake.invocations))
+	}
+}
+
+// blockingWriteCAS is a fakeCAS whose Write streams wait for release to be closed before storing
+// their blob. It counts the Write streams it receives.
+type blockingWriteCAS struct {
+	*fakeCAS
+	release chan struct{}
+	writes  int32
+}
+
+func (f *blockingWriteCAS) Write(stream bsgrpc.ByteStream_WriteServer) error {
+	atomic.AddInt32(&f.writes, 1)
+	<-f.release
+	return f.fakeCAS.Write(stream)
+}
+
+func TestCoalesceWrites(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &blockingWriteCAS{fakeCAS: &fakeCAS{blobs: make(map[digest.Key][]byte)}, release: make(chan struct{})}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.CoalesceWrites(true))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	blob := []byte("shared input")
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = c.WriteBlob(ctx, blob)
+		}(i)
+	}
+	// Give all the callers time to join the write in flight before it completes.
+	time.Sleep(100 * time.Millisecond)
+	close(fake.release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("c.WriteBlob(ctx, blob) of caller %d gave error %v, expected nil", i, err)
+		}
+	}
+	if got := atomic.LoadInt32(&fake.writes); got != 1 {
+		t.Errorf("%d Write streams were made, want 1", got)
+	}
+	if got := fake.blobs[digest.ToKey(digest.FromBlob(blob))]; string(got) != string(blob) {
+		t.Errorf("blob stored in the CAS is %q, want %q", got, blob)
+	}
+
+	// Completed writes are not shared.
+	if _, err := c.WriteBlob(ctx, blob); err != nil {
+		t.Errorf("c.WriteBlob(ctx, blob) gave error %v, expected nil", err)
+	}
+	if got := atomic.LoadInt32(&fake.writes); got != 2 {
+		t.Errorf("%d Write streams were made after a later write, want 2", got)
+	}
+}
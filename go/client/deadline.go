@@ -0,0 +1,145 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// batchTimeWeight is the weight of the latest batch in the moving average of batch times kept by a
+// batchTimes.
+const batchTimeWeight = 0.25
+
+// batchTimes keeps exponentially weighted moving averages of the time the batches of a client's
+// operations take, by operation, so that each call of an operation starts from the estimate of the
+// previous ones. It is safe for concurrent use.
+type batchTimes struct {
+	mu  sync.Mutex
+	avg map[string]time.Duration
+}
+
+func newBatchTimes() *batchTimes {
+	return &batchTimes{avg: make(map[string]time.Duration)}
+}
+
+// get returns the average time a batch of op takes, or 0 if none finished yet.
+func (t *batchTimes) get(op string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.avg[op]
+}
+
+// add records that a batch of op took d to finish.
+func (t *batchTimes) add(op string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	avg, ok := t.avg[op]
+	if !ok || avg == 0 {
+		t.avg[op] = d
+		return
+	}
+	t.avg[op] = avg + time.Duration(batchTimeWeight*float64(d-avg))
+}
+
+// batchScheduler stops the batches of a concurrent operation, such as the uploads of WriteBlobs or
+// the queries of MissingBlobs, from being started once the context's deadline is too close for a
+// batch to plausibly finish, so that the operation fails with an error saying how many batches were
+// left rather than with whichever batches the deadline happens to cut short. It judges by the
+// client's moving average of the time the operation's batches take; until a batch finishes, or if
+// the context has no deadline, every batch is started. It is safe for concurrent use.
+type batchScheduler struct {
+	op    string
+	total int
+	times *batchTimes
+
+	mu        sync.Mutex
+	stopped   bool
+	left      int
+	remaining time.Duration // The time left before the deadline when scheduling stopped.
+	batchTime time.Duration // The average batch time when scheduling stopped.
+}
+
+func (c *Client) newBatchScheduler(op string, total int) *batchScheduler {
+	return &batchScheduler{op: op, total: total, times: c.batchTimes}
+}
+
+// start reports whether a batch should be started under ctx. If not, scheduling stops, and the batch
+// is counted as left.
+func (s *batchScheduler) start(ctx context.Context) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if avg := s.times.get(s.op); !s.stopped && avg > 0 {
+		if deadline, ok := ctx.Deadline(); ok {
+			if remaining := time.Until(deadline); remaining < avg {
+				log.V(1).Infof("%s: %v left before the deadline, but a batch takes about %v; not starting more batches", s.op, remaining, avg)
+				s.stopped, s.remaining, s.batchTime = true, remaining, avg
+			}
+		}
+	}
+	if s.stopped {
+		s.left++
+	}
+	return !s.stopped
+}
+
+// done records that a batch took d to finish.
+func (s *batchScheduler) done(d time.Duration) {
+	s.times.add(s.op, d)
+}
+
+// err returns a *BatchesStoppedError saying how many batches were left if scheduling stopped, and
+// nil otherwise.
+func (s *batchScheduler) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		return nil
+	}
+	return &BatchesStoppedError{Op: s.op, Left: s.left, Total: s.total, Remaining: s.remaining, BatchTime: s.batchTime}
+}
+
+// BatchesStoppedError is returned by operations that stopped starting batches because the context's
+// deadline was too close for another batch to finish, see ExecuteUploadPlan and MissingBlobs. Its
+// gRPC status code is DeadlineExceeded, but the client's Retrier never retries it, since a retry
+// would run into the same deadline.
+type BatchesStoppedError struct {
+	// Op names the operation, and Left and Total are the numbers of its batches that were not
+	// started and of all its batches.
+	Op    string
+	Left  int
+	Total int
+	// Remaining is the time that was left before the deadline, and BatchTime the time a batch was
+	// expected to take, when the operation stopped starting batches.
+	Remaining time.Duration
+	BatchTime time.Duration
+}
+
+func (e *BatchesStoppedError) Error() string {
+	return fmt.Sprintf("%s stopped with %d of %d batches left: %v remained before the context deadline, but a batch takes about %v", e.Op, e.Left, e.Total, e.Remaining.Round(time.Millisecond), e.BatchTime.Round(time.Millisecond))
+}
+
+// GRPCStatus returns a DeadlineExceeded status with the error's message, so that the status code
+// can be retrieved with status.FromError and status.Code.
+func (e *BatchesStoppedError) GRPCStatus() *status.Status {
+	return status.New(codes.DeadlineExceeded, e.Error())
+}
+
+// batchesStopped reports whether err is, or for BatchErrors includes, a *BatchesStoppedError.
+func batchesStopped(err error) bool {
+	switch e := err.(type) {
+	case *BatchesStoppedError:
+		return true
+	case BatchErrors:
+		for _, err := range e {
+			if batchesStopped(err) {
+				return true
+			}
+		}
+	}
+	return false
+}
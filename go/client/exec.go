@@ -3,6 +3,7 @@ package client
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"sort"
 	"time"
@@ -44,6 +45,10 @@ type Action struct {
 	OutputDirs []string
 	// Docker image is a docker:// URL to the docker image in which execution will take place.
 	DockerImage string
+	// Platform contains additional platform properties, such as the OS or the worker pool, which
+	// determine where the action runs. The DockerImage is sent as the container-image property, which
+	// therefore may only be set here if DockerImage is empty.
+	Platform map[string]string
 	// Timeout is the maximum execution time for the action. Note that it's not an overall timeout on
 	// the process, since there may be additional time for transferring files, waiting for a worker to
 	// become available, or other overhead.
@@ -112,6 +117,24 @@ func (c *Client) checkActionCache(ctx context.Context, acDg *repb.Digest) (*repb
 	}
 }
 
+// WriteActionResult stores the blobs referenced by an action result in the CAS with WriteBlobs and
+// then, only if all of them were stored, records the result in the action cache for the action. If
+// any upload fails, the action cache is left untouched, so that it never refers to missing blobs.
+func (c *Client) WriteActionResult(ctx context.Context, actionDigest *repb.Digest, ar *repb.ActionResult, referencedBlobs map[digest.Key][]byte) error {
+	if err := c.WriteBlobs(ctx, referencedBlobs); err != nil {
+		return gerrors.WithMessage(err, "uploading action result blobs to the CAS")
+	}
+	_, err := c.UpdateActionResult(ctx, &repb.UpdateActionResultRequest{
+		InstanceName: c.InstanceName,
+		ActionDigest: actionDigest,
+		ActionResult: ar,
+	})
+	if err != nil {
+		return gerrors.WithMessage(err, "updating the action cache")
+	}
+	return nil
+}
+
 func (c *Client) executeJob(ctx context.Context, skipCache bool, acDg *repb.Digest) (*repb.ActionResult, error) {
 	execReq := &repb.ExecuteRequest{
 		InstanceName:    c.InstanceName,
@@ -145,7 +168,11 @@ func (c *Client) executeJob(ctx context.Context, skipCache bool, acDg *repb.Dige
 // PrepAction returns the digest of the Action and a (possibly nil) pointer to an ActionResult
 // representing the result of the cache check, if any.
 func (c *Client) PrepAction(ctx context.Context, ac *Action) (*repb.Digest, *repb.ActionResult, error) {
-	comDg, err := c.WriteProto(ctx, buildCommand(ac))
+	cmd, err := buildCommand(ac)
+	if err != nil {
+		return nil, nil, err
+	}
+	comDg, err := c.WriteProto(ctx, cmd)
 	if err != nil {
 		return nil, nil, gerrors.WithMessage(err, "storing Command proto")
 	}
@@ -165,7 +192,7 @@ func (c *Client) PrepAction(ctx context.Context, ac *Action) (*repb.Digest, *rep
 	if err != nil {
 		return nil, nil, gerrors.WithMessage(err, "marshalling Action proto")
 	}
-	acDg := digest.FromBlob(acBlob)
+	acDg := c.digestFn.FromBlob(acBlob)
 
 	// If the result is cacheable, check if it's already in the cache.
 	if !ac.DoNotCache || !ac.SkipCache {
@@ -187,17 +214,26 @@ func (c *Client) PrepAction(ctx context.Context, ac *Action) (*repb.Digest, *rep
 	return acDg, nil, nil
 }
 
-func buildCommand(ac *Action) *repb.Command {
+func buildCommand(ac *Action) (*repb.Command, error) {
 	cmd := &repb.Command{
 		Arguments: ac.Args,
 		// Do not use OutputFiles and OutputDirs directly from the Action, as we need to sort them which
 		// implies modification.
 		OutputFiles:       make([]string, len(ac.OutputFiles)),
 		OutputDirectories: make([]string, len(ac.OutputDirs)),
-		Platform: &repb.Platform{
-			Properties: []*repb.Platform_Property{{Name: containerImagePropertyName, Value: ac.DockerImage}},
-		},
+		Platform:          &repb.Platform{},
+	}
+	if _, ok := ac.Platform[containerImagePropertyName]; !ok || ac.DockerImage != "" {
+		if ok {
+			return nil, fmt.Errorf("the %s platform property may not be set along with a DockerImage", containerImagePropertyName)
+		}
+		cmd.Platform.Properties = append(cmd.Platform.Properties, &repb.Platform_Property{Name: containerImagePropertyName, Value: ac.DockerImage})
+	}
+	for name, val := range ac.Platform {
+		cmd.Platform.Properties = append(cmd.Platform.Properties, &repb.Platform_Property{Name: name, Value: val})
 	}
+	// The properties must be sorted by name for the Command, and thus the Action, to be canonical.
+	sort.Slice(cmd.Platform.Properties, func(i, j int) bool { return cmd.Platform.Properties[i].Name < cmd.Platform.Properties[j].Name })
 	copy(cmd.OutputFiles, ac.OutputFiles)
 	copy(cmd.OutputDirectories, ac.OutputDirs)
 	sort.Strings(cmd.OutputFiles)
@@ -206,7 +242,7 @@ func buildCommand(ac *Action) *repb.Command {
 		cmd.EnvironmentVariables = append(cmd.EnvironmentVariables, &repb.Command_EnvironmentVariable{Name: name, Value: val})
 	}
 	sort.Slice(cmd.EnvironmentVariables, func(i, j int) bool { return cmd.EnvironmentVariables[i].Name < cmd.EnvironmentVariables[j].Name })
-	return cmd
+	return cmd, nil
 }
 
 // ExecuteAndWait calls Execute on the underlying client and WaitExecution if necessary. It returns
@@ -1,12 +1,21 @@
 package client_test
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"testing"
 
 	"github.com/bazelbuild/remote-apis-sdks/go/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/digest"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
 
+	regrpc "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bsgrpc "google.golang.org/genproto/googleapis/bytestream"
 	oppb "google.golang.org/genproto/googleapis/longrunning"
 	spb "google.golang.org/genproto/googleapis/rpc/status"
 )
@@ -67,3 +76,167 @@ func TestOperationStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteActionResult(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	cas := &fakeCAS{}
+	ac := &fakeActionCache{}
+	bsgrpc.RegisterByteStreamServer(server, cas)
+	regrpc.RegisterContentAddressableStorageServer(server, cas)
+	regrpc.RegisterActionCacheServer(server, ac)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	stdout, out := []byte("stdout"), []byte("output")
+	acDg := digest.TestNew("a", 1)
+	ar := &repb.ActionResult{
+		OutputFiles:  []*repb.OutputFile{{Path: "out", Digest: digest.FromBlob(out)}},
+		StdoutDigest: digest.FromBlob(stdout),
+	}
+	tests := []struct {
+		name    string
+		blobs   map[digest.Key][]byte
+		wantErr bool
+	}{
+		{
+			name: "all uploaded",
+			blobs: map[digest.Key][]byte{
+				digest.ToKey(digest.FromBlob(stdout)): stdout,
+				digest.ToKey(digest.FromBlob(out)):    out,
+			},
+		},
+		{
+			name: "upload fails",
+			blobs: map[digest.Key][]byte{
+				digest.ToKey(digest.FromBlob(stdout)): stdout,
+				// The digest doesn't match the contents, so the fake rejects it.
+				digest.ToKey(digest.FromBlob(out)): []byte("not the output"),
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cas.blobs = make(map[digest.Key][]byte)
+			ac.results = make(map[digest.Key]*repb.ActionResult)
+			err := c.WriteActionResult(ctx, acDg, ar, tc.blobs)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("c.WriteActionResult(ctx, ...) gave error %v, want error: %v", err, tc.wantErr)
+			}
+			got, ok := ac.results[digest.ToKey(acDg)]
+			if tc.wantErr {
+				if ok {
+					t.Errorf("c.WriteActionResult(ctx, ...) failed but stored action result %v", got)
+				}
+				return
+			}
+			if diff := cmp.Diff(ar, got); diff != "" {
+				t.Errorf("c.WriteActionResult(ctx, ...) stored diff (-want +got):\n%s", diff)
+			}
+			for k := range tc.blobs {
+				if _, ok := cas.blobs[k]; !ok {
+					t.Errorf("c.WriteActionResult(ctx, ...) did not upload blob %v", k)
+				}
+			}
+		})
+	}
+}
+
+func TestPrepActionPlatform(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	cas := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	ac := &fakeActionCache{results: make(map[digest.Key]*repb.ActionResult)}
+	bsgrpc.RegisterByteStreamServer(server, cas)
+	regrpc.RegisterContentAddressableStorageServer(server, cas)
+	regrpc.RegisterActionCacheServer(server, ac)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	// readCommand returns the Command of an action uploaded to the fake CAS.
+	readCommand := func(acDg *repb.Digest) *repb.Command {
+		t.Helper()
+		action := &repb.Action{}
+		if err := proto.Unmarshal(cas.blobs[digest.ToKey(acDg)], action); err != nil {
+			t.Fatalf("failed to unmarshal Action: %v", err)
+		}
+		cmd := &repb.Command{}
+		if err := proto.Unmarshal(cas.blobs[digest.ToKey(action.CommandDigest)], cmd); err != nil {
+			t.Fatalf("failed to unmarshal Command: %v", err)
+		}
+		return cmd
+	}
+
+	platform := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		platform[fmt.Sprintf("key%02d", i)] = fmt.Sprintf("value%d", i)
+	}
+	var firstDg *repb.Digest
+	// Map iteration order is random, so a few tries are likely to iterate the properties in
+	// different orders.
+	for i := 0; i < 5; i++ {
+		acDg, _, err := c.PrepAction(ctx, &client.Action{Args: []string{"run"}, DockerImage: "docker://image", Platform: platform})
+		if err != nil {
+			t.Fatalf("c.PrepAction(ctx, ...) gave error %v, expected nil", err)
+		}
+		if firstDg == nil {
+			firstDg = acDg
+		} else if !digest.Equal(acDg, firstDg) {
+			t.Errorf("c.PrepAction(ctx, ...) gave action digest %v, previously %v", acDg, firstDg)
+		}
+	}
+	props := readCommand(firstDg).Platform.Properties
+	if len(props) != 21 {
+		t.Fatalf("Command has %d platform properties, want 21", len(props))
+	}
+	if props[0].Name != "container-image" || props[0].Value != "docker://image" {
+		t.Errorf("first platform property is %v, want container-image: docker://image", props[0])
+	}
+	for i := 1; i < len(props); i++ {
+		if props[i-1].Name >= props[i].Name {
+			t.Errorf("platform properties are not sorted: %q before %q", props[i-1].Name, props[i].Name)
+		}
+	}
+
+	acDg, _, err := c.PrepAction(ctx, &client.Action{Args: []string{"run"}, Platform: map[string]string{"container-image": "docker://other"}})
+	if err != nil {
+		t.Fatalf("c.PrepAction(ctx, ...) with container-image property gave error %v, expected nil", err)
+	}
+	want := []*repb.Platform_Property{{Name: "container-image", Value: "docker://other"}}
+	if diff := cmp.Diff(want, readCommand(acDg).Platform.Properties); diff != "" {
+		t.Errorf("c.PrepAction(ctx, ...) with container-image property gave diff (-want +got):\n%s", diff)
+	}
+
+	_, _, err = c.PrepAction(ctx, &client.Action{Args: []string{"run"}, DockerImage: "docker://image", Platform: map[string]string{"container-image": "docker://other"}})
+	if err == nil {
+		t.Errorf("c.PrepAction(ctx, ...) with both DockerImage and container-image property gave nil error, want error")
+	}
+}
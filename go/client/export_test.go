@@ -0,0 +1,12 @@
+package client
+
+// This file exposes internals of the package to its tests.
+
+// SetAfterHashHook sets a function called with the path of each file hashed by a tree build that
+// checks for changes, between hashing the file and checking it. It returns a function restoring the
+// previous hook.
+func SetAfterHashHook(f func(path string)) (restore func()) {
+	old := afterHash
+	afterHash = f
+	return func() { afterHash = old }
+}
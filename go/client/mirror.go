@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/digest"
+	log "github.com/golang/glog"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// MirrorClient uploads blobs to several CAS backends at once, e.g. a primary and a secondary CAS for
+// disaster recovery. Writes are fanned out concurrently to all the backends and succeed when at
+// least a quorum of them succeed; reads are served by the first backend that returns the blob.
+//
+// A MirrorClient must be constructed with NewMirrorClient. It is safe for concurrent use provided
+// its Clients are.
+type MirrorClient struct {
+	clients []*Client
+	quorum  int
+}
+
+// NewMirrorClient creates a MirrorClient writing to all of the given clients. A write succeeds when
+// it succeeds on at least quorum of them; if quorum is 0, it must succeed on all of them. Reads try
+// the clients in the order given. The clients must use the same digest function, as blobs are
+// addressed by the same digests on all of them.
+func NewMirrorClient(quorum int, clients ...*Client) (*MirrorClient, error) {
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("at least one client needs to be specified")
+	}
+	for _, c := range clients[1:] {
+		if c.digestFn != clients[0].digestFn {
+			return nil, fmt.Errorf("the clients use different digest functions, %v and %v", clients[0].digestFn, c.digestFn)
+		}
+	}
+	if quorum < 0 || quorum > len(clients) {
+		return nil, fmt.Errorf("quorum %d is not between 0 and the number of clients, %d", quorum, len(clients))
+	}
+	if quorum == 0 {
+		quorum = len(clients)
+	}
+	return &MirrorClient{clients: clients, quorum: quorum}, nil
+}
+
+// WriteBlob uploads a blob to the CAS of every backend.
+func (m *MirrorClient) WriteBlob(ctx context.Context, blob []byte) (*repb.Digest, error) {
+	err := m.fanOut(ctx, func(ctx context.Context, c *Client) error {
+		_, err := c.WriteBlob(ctx, blob)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m.clients[0].digestFn.FromBlob(blob), nil
+}
+
+// WriteBlobs stores a number of blobs in the CAS of every backend, as Client.WriteBlobs does for a
+// single one.
+func (m *MirrorClient) WriteBlobs(ctx context.Context, blobs map[digest.Key][]byte) error {
+	return m.fanOut(ctx, func(ctx context.Context, c *Client) error {
+		return c.WriteBlobs(ctx, blobs)
+	})
+}
+
+// ReadBlob fetches a blob from the first backend that can serve it, trying the backends in order.
+// If none can, the error from the last one is returned.
+func (m *MirrorClient) ReadBlob(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	var err error
+	for i, c := range m.clients {
+		var blob []byte
+		if blob, err = c.ReadBlob(ctx, d); err == nil {
+			return blob, nil
+		}
+		log.V(1).Infof("reading blob %s from backend %d failed: %v", digest.ToString(d), i, err)
+	}
+	return nil, err
+}
+
+// fanOut runs f concurrently against every backend and returns nil if at least a quorum of the calls
+// succeeded. All the calls are waited for, even once a quorum has been reached.
+func (m *MirrorClient) fanOut(ctx context.Context, f func(context.Context, *Client) error) error {
+	errs := make([]error, len(m.clients))
+	var wg sync.WaitGroup
+	for i, c := range m.clients {
+		wg.Add(1)
+		go func(i int, c *Client) {
+			defer wg.Done()
+			errs[i] = safely(func() error { return f(ctx, c) })()
+		}(i, c)
+	}
+	wg.Wait()
+
+	numErrs, firstErr := 0, error(nil)
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		log.Warningf("write to backend %d failed: %v", i, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+		numErrs++
+	}
+	if len(m.clients)-numErrs < m.quorum {
+		return fmt.Errorf("write failed on %d of %d backends, %d successes needed, first error: %v", numErrs, len(m.clients), m.quorum, firstErr)
+	}
+	return nil
+}
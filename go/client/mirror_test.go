@@ -0,0 +1,157 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/digest"
+	"google.golang.org/grpc"
+
+	regrpc "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bsgrpc "google.golang.org/genproto/googleapis/bytestream"
+)
+
+// mirrorBackend starts a server for a mirrored CAS and returns a client connected to it. If fake is
+// nil, the server implements no services and all calls to it fail.
+func mirrorBackend(t *testing.T, fake *fakeCAS) (c *client.Client, cleanup func()) {
+	t.Helper()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	server := grpc.NewServer()
+	if fake != nil {
+		bsgrpc.RegisterByteStreamServer(server, fake)
+		regrpc.RegisterContentAddressableStorageServer(server, fake)
+	}
+	go server.Serve(listener)
+	c, err = client.Dial(context.Background(), instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	return c, func() {
+		c.Close()
+		server.Stop()
+		listener.Close()
+	}
+}
+
+func TestMirrorWrite(t *testing.T) {
+	ctx := context.Background()
+	blob := []byte("mirrored")
+	tests := []struct {
+		name string
+		// broken is whether each backend fails all calls.
+		broken  []bool
+		quorum  int
+		wantErr bool
+	}{
+		{
+			name:   "all succeed",
+			broken: []bool{false, false},
+		},
+		{
+			name:    "one fails, all needed",
+			broken:  []bool{false, true},
+			wantErr: true,
+		},
+		{
+			name:   "one fails, quorum reached",
+			broken: []bool{true, false, false},
+			quorum: 2,
+		},
+		{
+			name:    "two fail, quorum missed",
+			broken:  []bool{true, false, true},
+			quorum:  2,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var clients []*client.Client
+			var fakes []*fakeCAS
+			for _, broken := range tc.broken {
+				var fake *fakeCAS
+				if !broken {
+					fake = &fakeCAS{blobs: make(map[digest.Key][]byte)}
+				}
+				c, cleanup := mirrorBackend(t, fake)
+				defer cleanup()
+				clients = append(clients, c)
+				fakes = append(fakes, fake)
+			}
+			m, err := client.NewMirrorClient(tc.quorum, clients...)
+			if err != nil {
+				t.Fatalf("client.NewMirrorClient(%d, ...) gave error %v, expected nil", tc.quorum, err)
+			}
+
+			for _, write := range []struct {
+				name string
+				f    func() error
+			}{
+				{"WriteBlob", func() error { _, err := m.WriteBlob(ctx, blob); return err }},
+				{"WriteBlobs", func() error {
+					return m.WriteBlobs(ctx, map[digest.Key][]byte{digest.ToKey(digest.FromBlob(blob)): blob})
+				}},
+			} {
+				for _, fake := range fakes {
+					if fake != nil {
+						fake.blobs = make(map[digest.Key][]byte)
+					}
+				}
+				err := write.f()
+				if gotErr := err != nil; gotErr != tc.wantErr {
+					t.Errorf("m.%s(ctx, ...) gave error %v, want error: %v", write.name, err, tc.wantErr)
+				}
+				for i, fake := range fakes {
+					if fake == nil {
+						continue
+					}
+					if _, ok := fake.blobs[digest.ToKey(digest.FromBlob(blob))]; !ok {
+						t.Errorf("m.%s(ctx, ...) did not store the blob on working backend %d", write.name, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMirrorReadBlob(t *testing.T) {
+	ctx := context.Background()
+	blob := []byte("mirrored")
+	dg := digest.FromBlob(blob)
+
+	broken, cleanup := mirrorBackend(t, nil)
+	defer cleanup()
+	empty, cleanup := mirrorBackend(t, &fakeCAS{blobs: make(map[digest.Key][]byte)})
+	defer cleanup()
+	full, cleanup := mirrorBackend(t, &fakeCAS{blobs: map[digest.Key][]byte{digest.ToKey(dg): blob}})
+	defer cleanup()
+
+	m, err := client.NewMirrorClient(0, broken, empty, full)
+	if err != nil {
+		t.Fatalf("client.NewMirrorClient(0, ...) gave error %v, expected nil", err)
+	}
+	got, err := m.ReadBlob(ctx, dg)
+	if err != nil {
+		t.Fatalf("m.ReadBlob(ctx, %v) gave error %v, expected nil", dg, err)
+	}
+	if string(got) != string(blob) {
+		t.Errorf("m.ReadBlob(ctx, %v) = %q, want %q", dg, got, blob)
+	}
+
+	m, err = client.NewMirrorClient(0, broken, empty)
+	if err != nil {
+		t.Fatalf("client.NewMirrorClient(0, ...) gave error %v, expected nil", err)
+	}
+	if _, err := m.ReadBlob(ctx, dg); err == nil {
+		t.Errorf("m.ReadBlob(ctx, %v) gave nil error, expected one as no backend has the blob", dg)
+	}
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+)
+
+// pooledMethodPrefixes are the prefixes of the names of the methods whose calls a connPool spreads
+// over its connections.
+var pooledMethodPrefixes = []string{casService, byteStreamService}
+
+// connPool spreads the CAS and ByteStream calls made on a dialed connection round-robin over it and
+// other connections to the same service, see DialParams.CASConnections, so that concurrent uploads
+// and downloads aren't limited by the streams of a single connection. It is installed as an
+// interceptor of the dialed connection; other calls stay on that connection.
+type connPool struct {
+	// conns are the connections other than the dialed one.
+	conns []*grpc.ClientConn
+	next  uint32
+}
+
+// conn returns the connection to send a call of the given method on, or nil to keep it on the
+// dialed connection.
+func (p *connPool) conn(method string) *grpc.ClientConn {
+	pooled := false
+	for _, prefix := range pooledMethodPrefixes {
+		if strings.HasPrefix(method, prefix) {
+			pooled = true
+		}
+	}
+	if !pooled {
+		return nil
+	}
+	i := int(atomic.AddUint32(&p.next, 1) % uint32(len(p.conns)+1))
+	if i == len(p.conns) {
+		return nil
+	}
+	return p.conns[i]
+}
+
+// close closes the connections of the pool other than the dialed one.
+func (p *connPool) close() {
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+}
+
+// closeWith closes the connections of the pool once the dialed connection cc is closed.
+func (p *connPool) closeWith(cc *grpc.ClientConn) {
+	waitForShutdown(cc)
+	p.close()
+}
+
+func (p *connPool) unary(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if conn := p.conn(method); conn != nil {
+		return conn.Invoke(ctx, method, req, reply, opts...)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func (p *connPool) stream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if conn := p.conn(method); conn != nil {
+		return conn.NewStream(ctx, desc, method, opts...)
+	}
+	return streamer(ctx, desc, cc, method, opts...)
+}
@@ -0,0 +1,159 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/digest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+
+	regrpc "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bsgrpc "google.golang.org/genproto/googleapis/bytestream"
+)
+
+// peerRecorder records the client addresses that a server receives the calls of each method from.
+type peerRecorder struct {
+	mu    sync.Mutex
+	peers map[string]map[string]bool
+}
+
+func (r *peerRecorder) record(ctx context.Context, method string) {
+	p, _ := peer.FromContext(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.peers[method] == nil {
+		r.peers[method] = make(map[string]bool)
+	}
+	r.peers[method][p.Addr.String()] = true
+}
+
+func (r *peerRecorder) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	r.record(ctx, info.FullMethod)
+	return handler(ctx, req)
+}
+
+func (r *peerRecorder) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	r.record(ss.Context(), info.FullMethod)
+	return handler(srv, ss)
+}
+
+// emptyCapabilities is a Capabilities server that reports no capabilities.
+type emptyCapabilities struct{}
+
+func (emptyCapabilities) GetCapabilities(ctx context.Context, req *repb.GetCapabilitiesRequest) (*repb.ServerCapabilities, error) {
+	return &repb.ServerCapabilities{}, nil
+}
+
+func TestCASConnections(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	rec := &peerRecorder{}
+	server := grpc.NewServer(grpc.UnaryInterceptor(rec.unary), grpc.StreamInterceptor(rec.stream))
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	regrpc.RegisterCapabilitiesServer(server, emptyCapabilities{})
+	go server.Serve(listener)
+	defer server.Stop()
+
+	for _, conns := range []int{0, 1, 3} {
+		t.Run(fmt.Sprintf("CASConnections=%d", conns), func(t *testing.T) {
+			c, err := client.Dial(ctx, instance, client.DialParams{
+				Service:        listener.Addr().String(),
+				NoSecurity:     true,
+				CASConnections: conns,
+			})
+			if err != nil {
+				t.Fatalf("Error connecting to server: %v", err)
+			}
+			defer c.Close()
+			rec.peers = make(map[string]map[string]bool)
+
+			for i := 0; i < 6; i++ {
+				if _, err := c.MissingBlobs(ctx, []*repb.Digest{digest.TestNew("a", 1)}); err != nil {
+					t.Fatalf("c.MissingBlobs(ctx, digests) gave error %v, want nil", err)
+				}
+				if _, err := c.WriteBlob(ctx, []byte(fmt.Sprintf("blob%d", i))); err != nil {
+					t.Fatalf("c.WriteBlob(ctx, blob) gave error %v, want nil", err)
+				}
+				if _, err := c.GetCapabilities(ctx, &repb.GetCapabilitiesRequest{}); err != nil {
+					t.Fatalf("c.GetCapabilities(ctx, req) gave error %v, want nil", err)
+				}
+			}
+			want := conns
+			if want < 1 {
+				want = 1
+			}
+			wantPeers := map[string]int{
+				"/build.bazel.remote.execution.v2.ContentAddressableStorage/FindMissingBlobs": want,
+				"/google.bytestream.ByteStream/Write":                                         want,
+				"/build.bazel.remote.execution.v2.Capabilities/GetCapabilities":               1,
+			}
+			for method, n := range wantPeers {
+				if got := len(rec.peers[method]); got != n {
+					t.Errorf("calls of %s came from %d connections, want %d", method, got, n)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkWriteBlobsConnections measures the throughput of uploads spread over pools of
+// connections of different sizes, against a local server.
+func BenchmarkWriteBlobsConnections(b *testing.B) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		b.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	const numBlobs, blobSize = 64, 512 * 1024
+	blobs := make(map[digest.Key][]byte)
+	for i := 0; i < numBlobs; i++ {
+		blob := make([]byte, blobSize)
+		blob[0], blob[1] = byte(i), byte(i>>8)
+		blobs[digest.ToKey(digest.FromBlob(blob))] = blob
+	}
+	for _, conns := range []int{1, 4} {
+		b.Run(fmt.Sprintf("CASConnections=%d", conns), func(b *testing.B) {
+			c, err := client.Dial(ctx, instance, client.DialParams{
+				Service:        listener.Addr().String(),
+				NoSecurity:     true,
+				CASConnections: conns,
+			}, client.CASConcurrency(16))
+			if err != nil {
+				b.Fatalf("Error connecting to server: %v", err)
+			}
+			defer c.Close()
+			b.SetBytes(numBlobs * blobSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				fake.mu.Lock()
+				fake.blobs = make(map[digest.Key][]byte)
+				fake.mu.Unlock()
+				b.StartTimer()
+				if err := c.WriteBlobs(ctx, blobs); err != nil {
+					b.Fatalf("c.WriteBlobs(ctx, blobs) gave error %v, want nil", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/digest"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// PresenceCache is an Opt that has the client remember, in a bounded in-memory cache, the blobs that
+// the CAS recently reported as present to MissingBlobs, or that the client recently uploaded, so that
+// MissingBlobs and uploads skip querying the CAS for them. The cache holds up to MaxEntries digests,
+// evicting the least recently used ones first; an entry expires TTL after it was added, since the CAS
+// may evict blobs, or never if TTL is not positive. By default, or if MaxEntries is not positive,
+// there is no cache. The cache hits and misses of uploads and queries are reported in their Stats,
+// see WriteBlobsWithStats and MissingBlobsWithStats. AuditBlobs, BlobPresence and QueryBlobs always
+// query the CAS, and drop the blobs it is missing from the cache.
+//
+// Unlike RememberUploads, the cache is bounded, and also remembers blobs uploaded by others.
+type PresenceCache struct {
+	MaxEntries int
+	TTL        time.Duration
+}
+
+// Apply sets the presence cache of a client.
+func (p PresenceCache) Apply(c *Client) {
+	if p.MaxEntries <= 0 {
+		c.present = nil
+		return
+	}
+	c.present = &presenceCache{
+		maxEntries: p.MaxEntries,
+		ttl:        p.TTL,
+		entries:    make(map[digest.Key]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// presenceCache is an LRU cache of the blobs known to be present in the CAS, see PresenceCache. It is
+// safe for concurrent use, and a nil cache is always empty.
+type presenceCache struct {
+	maxEntries int
+	ttl        time.Duration
+
+	mu      sync.Mutex
+	entries map[digest.Key]*list.Element
+	// lru holds the presenceEntries of the cache, most recently used first.
+	lru *list.List
+}
+
+type presenceEntry struct {
+	key   digest.Key
+	added time.Time
+}
+
+// filter returns the digests of dgs that are not in the cache, and the numbers of digests that were
+// and were not in it.
+func (p *presenceCache) filter(dgs []*repb.Digest) (res []*repb.Digest, hits, misses int) {
+	if p == nil {
+		return dgs, 0, 0
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, dg := range dgs {
+		if p.get(digest.ToKey(dg), now) {
+			hits++
+		} else {
+			misses++
+			res = append(res, dg)
+		}
+	}
+	return res, hits, misses
+}
+
+// get returns whether the blob with key k is in the cache at time now, marking it as used if so and
+// dropping it if it expired. p.mu must be held.
+func (p *presenceCache) get(k digest.Key, now time.Time) bool {
+	e, ok := p.entries[k]
+	if !ok {
+		return false
+	}
+	if p.ttl > 0 && now.Sub(e.Value.(*presenceEntry).added) >= p.ttl {
+		p.lru.Remove(e)
+		delete(p.entries, k)
+		return false
+	}
+	p.lru.MoveToFront(e)
+	return true
+}
+
+// add records that the blobs with the given digests are present, evicting the least recently used
+// blobs if the cache is full.
+func (p *presenceCache) add(dgs []*repb.Digest) {
+	if p == nil {
+		return
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, dg := range dgs {
+		k := digest.ToKey(dg)
+		if e, ok := p.entries[k]; ok {
+			e.Value.(*presenceEntry).added = now
+			p.lru.MoveToFront(e)
+			continue
+		}
+		p.entries[k] = p.lru.PushFront(&presenceEntry{key: k, added: now})
+		if p.lru.Len() > p.maxEntries {
+			oldest := p.lru.Back()
+			p.lru.Remove(oldest)
+			delete(p.entries, oldest.Value.(*presenceEntry).key)
+		}
+	}
+}
+
+// addPresent records that the blobs with the given digests, other than the missing ones, are
+// present, and forgets the missing ones.
+func (p *presenceCache) addPresent(dgs, missing []*repb.Digest) {
+	if p == nil {
+		return
+	}
+	isMissing := make(map[digest.Key]bool, len(missing))
+	for _, dg := range missing {
+		isMissing[digest.ToKey(dg)] = true
+	}
+	var present []*repb.Digest
+	for _, dg := range dgs {
+		if !isMissing[digest.ToKey(dg)] {
+			present = append(present, dg)
+		}
+	}
+	p.remove(missing)
+	p.add(present)
+}
+
+// remove drops the blobs with the given digests from the cache.
+func (p *presenceCache) remove(dgs []*repb.Digest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, dg := range dgs {
+		k := digest.ToKey(dg)
+		if e, ok := p.entries[k]; ok {
+			p.lru.Remove(e)
+			delete(p.entries, k)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/digest"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+
+	regrpc "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bsgrpc "google.golang.org/genproto/googleapis/bytestream"
+)
+
+func TestPresenceCache(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	const ttl = 200 * time.Millisecond
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.PresenceCache{MaxEntries: 3, TTL: ttl})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	var dgs []*repb.Digest
+	for i := 0; i < 4; i++ {
+		blob := []byte(fmt.Sprintf("blob %d", i))
+		dgs = append(dgs, digest.FromBlob(blob))
+		if i != 3 {
+			fake.blobs[digest.ToKey(dgs[i])] = blob
+		}
+	}
+	// missingBlobs checks the result of MissingBlobsWithStats, whose cache misses are the digests
+	// that weren't hits.
+	missingBlobs := func(dgs []*repb.Digest, want []*repb.Digest, wantReqs, wantHits int) {
+		t.Helper()
+		fake.findMissingReqs = 0
+		got, stats, err := c.MissingBlobsWithStats(ctx, dgs)
+		if err != nil {
+			t.Fatalf("c.MissingBlobsWithStats(ctx, dgs) gave error %v, expected nil", err)
+		}
+		if diff := cmp.Diff(digestStrings(want), digestStrings(got)); diff != "" {
+			t.Errorf("c.MissingBlobsWithStats(ctx, dgs) gave diff (-want +got):\n%s", diff)
+		}
+		if fake.findMissingReqs != wantReqs {
+			t.Errorf("c.MissingBlobsWithStats(ctx, dgs) made %d FindMissingBlobs requests, want %d", fake.findMissingReqs, wantReqs)
+		}
+		if stats.PresenceCacheHits != wantHits || stats.PresenceCacheMisses != len(dgs)-wantHits {
+			t.Errorf("c.MissingBlobsWithStats(ctx, dgs) gave %d presence cache hits and %d misses, want %d and %d", stats.PresenceCacheHits, stats.PresenceCacheMisses, wantHits, len(dgs)-wantHits)
+		}
+	}
+
+	// Present blobs are cached, missing ones are not.
+	missingBlobs(dgs, dgs[3:], 1, 0)
+	missingBlobs(dgs[:3], nil, 0, 3)
+	missingBlobs(dgs[3:], dgs[3:], 1, 0)
+
+	// Uploaded blobs are cached, evicting the least recently used blob, 0.
+	missingBlobs(dgs[1:3], nil, 0, 2)
+	stats, err := c.WriteBlobsWithStats(ctx, map[digest.Key][]byte{digest.ToKey(dgs[3]): []byte("blob 3")})
+	if err != nil {
+		t.Fatalf("c.WriteBlobsWithStats(ctx, blobs) gave error %v, expected nil", err)
+	}
+	if stats.PresenceCacheHits != 0 || stats.PresenceCacheMisses != 1 {
+		t.Errorf("c.WriteBlobsWithStats(ctx, blobs) gave %d presence cache hits and %d misses, want 0 and 1", stats.PresenceCacheHits, stats.PresenceCacheMisses)
+	}
+	missingBlobs(dgs[1:], nil, 0, 3)
+	missingBlobs(dgs[:1], nil, 1, 0)
+
+	stats, err = c.WriteBlobsWithStats(ctx, map[digest.Key][]byte{digest.ToKey(dgs[0]): []byte("blob 0"), digest.ToKey(dgs[3]): []byte("blob 3")})
+	if err != nil {
+		t.Fatalf("c.WriteBlobsWithStats(ctx, blobs) gave error %v, expected nil", err)
+	}
+	if stats.PresenceCacheHits != 2 || stats.PresenceCacheMisses != 0 {
+		t.Errorf("c.WriteBlobsWithStats(ctx, blobs) gave %d presence cache hits and %d misses, want 2 and 0", stats.PresenceCacheHits, stats.PresenceCacheMisses)
+	}
+
+	// Audits query the CAS even for cached blobs, and drop the blobs it lost from the cache.
+	delete(fake.blobs, digest.ToKey(dgs[1]))
+	fake.findMissingReqs = 0
+	present, missing, err := c.AuditBlobs(ctx, dgs[1:3])
+	if err != nil {
+		t.Fatalf("c.AuditBlobs(ctx, dgs) gave error %v, expected nil", err)
+	}
+	if diff := cmp.Diff(digestStrings(dgs[2:3]), digestStrings(present)); diff != "" {
+		t.Errorf("c.AuditBlobs(ctx, dgs) gave present diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(digestStrings(dgs[1:2]), digestStrings(missing)); diff != "" {
+		t.Errorf("c.AuditBlobs(ctx, dgs) gave missing diff (-want +got):\n%s", diff)
+	}
+	if fake.findMissingReqs != 1 {
+		t.Errorf("c.AuditBlobs(ctx, dgs) made %d FindMissingBlobs requests, want 1", fake.findMissingReqs)
+	}
+	fake.findMissingReqs = 0
+	presence, err := c.BlobPresence(ctx, dgs[2:3])
+	if err != nil {
+		t.Fatalf("c.BlobPresence(ctx, dgs) gave error %v, expected nil", err)
+	}
+	if !presence[digest.ToKey(dgs[2])] || fake.findMissingReqs != 1 {
+		t.Errorf("c.BlobPresence(ctx, dgs) = %v with %d FindMissingBlobs requests, want the blob present with 1 request", presence, fake.findMissingReqs)
+	}
+	missingBlobs(dgs[1:3], dgs[1:2], 1, 1)
+	fake.blobs[digest.ToKey(dgs[1])] = []byte("blob 1")
+
+	// Entries expire.
+	time.Sleep(ttl)
+	missingBlobs(dgs[:3], nil, 1, 0)
+}
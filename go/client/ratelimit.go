@@ -0,0 +1,145 @@
+package client
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+
+	regrpc "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bsgrpc "google.golang.org/genproto/googleapis/bytestream"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+)
+
+// RPCsPerSecond is an Opt that limits the rate of the client's CAS calls: BatchUpdateBlobs,
+// BatchReadBlobs, FindMissingBlobs and GetTree, and the ByteStream Read, Write and QueryWriteStatus
+// calls, each stream counting as one call. The limit is shared by all the goroutines using the
+// client, including the workers of WriteBlobs and MissingBlobs, so that the client stays under a
+// server's quota rather than retrying its RESOURCE_EXHAUSTED errors. Calls over the limit wait for
+// their turn, or until their context is done; bursts of up to a second's worth of calls are
+// allowed. By default, or if it is not positive, calls are not limited.
+type RPCsPerSecond float64
+
+// Apply sets the rate limit of the client's CAS calls.
+func (r RPCsPerSecond) Apply(c *Client) {
+	if l, ok := c.cas.(*limitedCAS); ok {
+		c.cas = l.ContentAddressableStorageClient
+	}
+	if l, ok := c.byteStream.(*limitedByteStream); ok {
+		c.byteStream = l.ByteStreamClient
+	}
+	c.rpcRate = r
+	if r <= 0 {
+		return
+	}
+	l := newRateLimiter(float64(r))
+	c.cas = &limitedCAS{ContentAddressableStorageClient: c.cas, l: l}
+	c.byteStream = &limitedByteStream{ByteStreamClient: c.byteStream, l: l}
+}
+
+// rateLimiter is a token bucket holding up to a second's worth of tokens, and at least one, which
+// are added at a constant rate.
+type rateLimiter struct {
+	rate, burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	burst := math.Max(1, rate)
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait takes a token, waiting until one is available. If ctx is done first, the token is given back
+// and the context's error returned.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	// The token is reserved right away, possibly taking the bucket below zero, so that waiting calls
+	// are served in order.
+	l.tokens--
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// limitedCAS is a CAS client whose calls are limited by a rateLimiter.
+type limitedCAS struct {
+	regrpc.ContentAddressableStorageClient
+	l *rateLimiter
+}
+
+func (c *limitedCAS) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest, opts ...grpc.CallOption) (*repb.FindMissingBlobsResponse, error) {
+	if err := c.l.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.ContentAddressableStorageClient.FindMissingBlobs(ctx, req, opts...)
+}
+
+func (c *limitedCAS) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlobsRequest, opts ...grpc.CallOption) (*repb.BatchUpdateBlobsResponse, error) {
+	if err := c.l.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.ContentAddressableStorageClient.BatchUpdateBlobs(ctx, req, opts...)
+}
+
+func (c *limitedCAS) BatchReadBlobs(ctx context.Context, req *repb.BatchReadBlobsRequest, opts ...grpc.CallOption) (*repb.BatchReadBlobsResponse, error) {
+	if err := c.l.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.ContentAddressableStorageClient.BatchReadBlobs(ctx, req, opts...)
+}
+
+func (c *limitedCAS) GetTree(ctx context.Context, req *repb.GetTreeRequest, opts ...grpc.CallOption) (regrpc.ContentAddressableStorage_GetTreeClient, error) {
+	if err := c.l.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.ContentAddressableStorageClient.GetTree(ctx, req, opts...)
+}
+
+// limitedByteStream is a ByteStream client whose calls are limited by a rateLimiter.
+type limitedByteStream struct {
+	bsgrpc.ByteStreamClient
+	l *rateLimiter
+}
+
+func (b *limitedByteStream) Read(ctx context.Context, req *bspb.ReadRequest, opts ...grpc.CallOption) (bsgrpc.ByteStream_ReadClient, error) {
+	if err := b.l.wait(ctx); err != nil {
+		return nil, err
+	}
+	return b.ByteStreamClient.Read(ctx, req, opts...)
+}
+
+func (b *limitedByteStream) Write(ctx context.Context, opts ...grpc.CallOption) (bsgrpc.ByteStream_WriteClient, error) {
+	if err := b.l.wait(ctx); err != nil {
+		return nil, err
+	}
+	return b.ByteStreamClient.Write(ctx, opts...)
+}
+
+func (b *limitedByteStream) QueryWriteStatus(ctx context.Context, req *bspb.QueryWriteStatusRequest, opts ...grpc.CallOption) (*bspb.QueryWriteStatusResponse, error) {
+	if err := b.l.wait(ctx); err != nil {
+		return nil, err
+	}
+	return b.ByteStreamClient.QueryWriteStatus(ctx, req, opts...)
+}
@@ -0,0 +1,70 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/digest"
+	"google.golang.org/grpc"
+
+	regrpc "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bsgrpc "google.golang.org/genproto/googleapis/bytestream"
+)
+
+func TestRPCsPerSecond(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	const rate = 20
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.RPCsPerSecond(rate), client.FindMissingBatchSize(1))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	// A burst of rate calls goes through at once, and the next rate/2 take half a second, even
+	// though they are spread over concurrent workers.
+	var dgs []*repb.Digest
+	for i := 0; i < rate+rate/2; i++ {
+		dgs = append(dgs, digest.FromBlob([]byte(fmt.Sprintf("blob %d", i))))
+	}
+	start := time.Now()
+	if _, err := c.MissingBlobs(ctx, dgs); err != nil {
+		t.Fatalf("c.MissingBlobs(ctx, digests) gave error %v, want nil", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("%d FindMissingBlobs calls took %v, want at least 400ms at %d calls per second", len(dgs), elapsed, rate)
+	}
+	if fake.findMissingReqs != len(dgs) {
+		t.Errorf("%d FindMissingBlobs calls were made, want %d", fake.findMissingReqs, len(dgs))
+	}
+
+	// The bucket is now empty, and a call waiting for its turn gives up when its context is done.
+	tCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := c.WriteBlob(tCtx, []byte("blob")); err == nil {
+		t.Errorf("c.WriteBlob(ctx, blob) with no calls left before its deadline gave no error, want error")
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("c.WriteBlob(ctx, blob) took %v, want it to give up at its 10ms deadline", elapsed)
+	}
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+// redialTimeout bounds the dialing of a replacement connection by a reconnector.
+const redialTimeout = time.Minute
+
+// reconnector replaces the connection that the calls of a dialed connection are sent on after a
+// number of consecutive calls fail with UNAVAILABLE, see DialParams.ReconnectAfterUnavailable. It is
+// installed as an interceptor of the dialed connection, which is used until the first replacement.
+type reconnector struct {
+	// dial dials a new connection to the service.
+	dial      func(ctx context.Context) (*grpc.ClientConn, error)
+	threshold int
+	mu        sync.Mutex
+	// current is the connection replacing the dialed one, or nil if there was no replacement yet.
+	current  *grpc.ClientConn
+	failures int
+	closed   bool
+	// dialing is true while a replacement connection is being dialed, outside of mu.
+	dialing bool
+}
+
+// conn returns the connection to send a call made on the dialed connection cc on.
+func (r *reconnector) conn(cc *grpc.ClientConn) *grpc.ClientConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current != nil {
+		return r.current
+	}
+	return cc
+}
+
+// observe records the outcome of a call that was sent on conn, and replaces the connection if it
+// was the last of threshold consecutive calls to fail with UNAVAILABLE. Calls on a connection that
+// was already replaced are ignored. The replacement is dialed without holding mu, and at most one
+// is dialed at a time.
+func (r *reconnector) observe(cc, conn *grpc.ClientConn, err error) {
+	r.mu.Lock()
+	cur := r.current
+	if cur == nil {
+		cur = cc
+	}
+	if conn != cur {
+		r.mu.Unlock()
+		return
+	}
+	if status.Code(err) != codes.Unavailable {
+		r.failures = 0
+		r.mu.Unlock()
+		return
+	}
+	r.failures++
+	if r.failures < r.threshold || r.closed || r.dialing {
+		r.mu.Unlock()
+		return
+	}
+	log.Warningf("Reconnecting after %d consecutive calls failed with UNAVAILABLE", r.failures)
+	r.dialing = true
+	r.mu.Unlock()
+
+	// The calls made meanwhile aren't blocked by the dial, and keep going to the current connection.
+	ctx, cancel := context.WithTimeout(context.Background(), redialTimeout)
+	next, err := r.dial(ctx)
+	cancel()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dialing = false
+	if err != nil {
+		// The next failure tries again.
+		log.Warningf("Failed to reconnect: %v", err)
+		return
+	}
+	if r.closed {
+		next.Close()
+		return
+	}
+	// Calls still in flight on the replaced connection fail with CANCELLED, and may be retried.
+	if r.current != nil {
+		r.current.Close()
+	}
+	r.current, r.failures = next, 0
+}
+
+// closeWith closes the replacement connection, if any, once the dialed connection cc is closed.
+func (r *reconnector) closeWith(cc *grpc.ClientConn) {
+	waitForShutdown(cc)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.current != nil {
+		r.current.Close()
+	}
+}
+
+// waitForShutdown waits until the connection cc is closed.
+func waitForShutdown(cc *grpc.ClientConn) {
+	for s := cc.GetState(); s != connectivity.Shutdown; s = cc.GetState() {
+		cc.WaitForStateChange(context.Background(), s)
+	}
+}
+
+func (r *reconnector) unary(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	conn := r.conn(cc)
+	err := invoker(ctx, method, req, reply, conn, opts...)
+	r.observe(cc, conn, err)
+	return err
+}
+
+func (r *reconnector) stream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	conn := r.conn(cc)
+	s, err := streamer(ctx, desc, conn, method, opts...)
+	if err != nil {
+		r.observe(cc, conn, err)
+		return nil, err
+	}
+	return &reconnectStream{ClientStream: s, observe: func(err error) { r.observe(cc, conn, err) }}, nil
+}
+
+// reconnectStream is a stream that reports the outcome of each message received to a reconnector.
+type reconnectStream struct {
+	grpc.ClientStream
+	observe func(error)
+}
+
+func (s *reconnectStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == io.EOF {
+		s.observe(nil)
+	} else {
+		s.observe(err)
+	}
+	return err
+}
+
+// chainUnary combines unary interceptors into one, the first one being the outermost, as a
+// connection accepts a single interceptor.
+func chainUnary(ints []grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		chained := invoker
+		for i := len(ints) - 1; i >= 0; i-- {
+			in, next := ints[i], chained
+			chained = func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				return in(ctx, method, req, reply, cc, next, opts...)
+			}
+		}
+		return chained(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// chainStream combines stream interceptors into one, as chainUnary does for unary ones.
+func chainStream(ints []grpc.StreamClientInterceptor) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		chained := streamer
+		for i := len(ints) - 1; i >= 0; i-- {
+			in, next := ints[i], chained
+			chained = func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				return in(ctx, desc, cc, method, next, opts...)
+			}
+		}
+		return chained(ctx, desc, cc, method, opts...)
+	}
+}
@@ -0,0 +1,111 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/digest"
+	"github.com/bazelbuild/remote-apis-sdks/go/retry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	regrpc "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// badConnCAS is a CAS whose FindMissingBlobs calls fail with UNAVAILABLE on the first connection
+// made to it, as if that connection was left in a bad state, and succeed on any other connection.
+type badConnCAS struct {
+	*fakeCAS
+	mu      sync.Mutex
+	badConn string
+	failed  int
+}
+
+func (f *badConnCAS) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Internal, "test fake found no peer for the call")
+	}
+	f.mu.Lock()
+	if f.badConn == "" {
+		f.badConn = p.Addr.String()
+	}
+	bad := p.Addr.String() == f.badConn
+	if bad {
+		f.failed++
+	}
+	f.mu.Unlock()
+	if bad {
+		return nil, status.Error(codes.Unavailable, "connection in a bad state")
+	}
+	return f.fakeCAS.FindMissingBlobs(ctx, req)
+}
+
+func TestReconnectAfterUnavailable(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &badConnCAS{fakeCAS: &fakeCAS{}}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	retrier := &client.Retrier{
+		Backoff:     retry.ExponentialBackoff(time.Millisecond, time.Millisecond, retry.Attempts(6)),
+		ShouldRetry: retry.Always,
+	}
+	dgs := []*repb.Digest{digest.TestNew("a", 1)}
+
+	tests := []struct {
+		name           string
+		reconnectAfter int
+		// cancelDial cancels the context passed to Dial once it returns, which mustn't prevent
+		// reconnecting.
+		cancelDial bool
+		wantErr    bool
+		wantFailed int
+	}{
+		{name: "Disabled", reconnectAfter: 0, wantErr: true, wantFailed: 6},
+		{name: "Enabled", reconnectAfter: 3, wantErr: false, wantFailed: 3},
+		{name: "DialContextCancelled", reconnectAfter: 3, cancelDial: true, wantErr: false, wantFailed: 3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.mu.Lock()
+			fake.badConn, fake.failed = "", 0
+			fake.mu.Unlock()
+			dialCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			c, err := client.Dial(dialCtx, instance, client.DialParams{
+				Service:                   listener.Addr().String(),
+				NoSecurity:                true,
+				ReconnectAfterUnavailable: tc.reconnectAfter,
+			}, retrier)
+			if err != nil {
+				t.Fatalf("Error connecting to server: %v", err)
+			}
+			defer c.Close()
+			if tc.cancelDial {
+				cancel()
+			}
+
+			_, err = c.MissingBlobs(ctx, dgs)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("c.MissingBlobs(ctx, digests) gave error %v, want error: %t", err, tc.wantErr)
+			}
+			if fake.failed != tc.wantFailed {
+				t.Errorf("%d calls failed with UNAVAILABLE, want %d", fake.failed, tc.wantFailed)
+			}
+		})
+	}
+}
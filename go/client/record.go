@@ -0,0 +1,370 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	regrpc "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bsgrpc "google.golang.org/genproto/googleapis/bytestream"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+)
+
+// Full names of the services whose traffic is recorded when DialParams.RecordFile is set, and spread
+// over several connections when DialParams.CASConnections is.
+const (
+	casService        = "/build.bazel.remote.execution.v2.ContentAddressableStorage/"
+	byteStreamService = "/google.bytestream.ByteStream/"
+)
+
+// recordedCall is a single recorded RPC, with its serialized request and response messages in the
+// order they were sent and received, and its final status. A recording file holds one JSON-encoded
+// recordedCall per line, in the order in which the calls completed.
+type recordedCall struct {
+	Method    string
+	Requests  [][]byte `json:",omitempty"`
+	Responses [][]byte `json:",omitempty"`
+	Code      uint32   `json:",omitempty"`
+	Message   string   `json:",omitempty"`
+}
+
+func (rc *recordedCall) setErr(err error) {
+	st, _ := status.FromError(err)
+	rc.Code = uint32(st.Code())
+	rc.Message = st.Message()
+}
+
+func (rc *recordedCall) err() error {
+	return status.Error(codes.Code(rc.Code), rc.Message)
+}
+
+func marshalRecorded(m interface{}) []byte {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return nil
+	}
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		log.Warningf("failed to marshal recorded message: %v", err)
+	}
+	return b
+}
+
+// recorder records the CAS and ByteStream traffic of a connection to a file.
+type recorder struct {
+	path string
+	mu   sync.Mutex
+}
+
+// newRecorder creates a recorder writing to the given file, truncating it.
+func newRecorder(path string) (*recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create recording file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("couldn't create recording file: %v", err)
+	}
+	return &recorder{path: path}, nil
+}
+
+func isRecorded(method string) bool {
+	return strings.HasPrefix(method, casService) || strings.HasPrefix(method, byteStreamService)
+}
+
+// write appends a call to the recording file. The file is only held open while writing, so that
+// the recording is complete at all times without needing to be closed.
+func (r *recorder) write(rc *recordedCall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Warningf("failed to record call to %s: %v", rc.Method, err)
+		return
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(rc); err != nil {
+		log.Warningf("failed to record call to %s: %v", rc.Method, err)
+	}
+}
+
+func (r *recorder) unary(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if !isRecorded(method) {
+		return err
+	}
+	rc := &recordedCall{Method: method, Requests: [][]byte{marshalRecorded(req)}}
+	if err == nil {
+		rc.Responses = [][]byte{marshalRecorded(reply)}
+	}
+	rc.setErr(err)
+	r.write(rc)
+	return err
+}
+
+func (r *recorder) stream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if !isRecorded(method) {
+		return cs, err
+	}
+	rc := &recordedCall{Method: method}
+	if err != nil {
+		rc.setErr(err)
+		r.write(rc)
+		return nil, err
+	}
+	return &recordingStream{ClientStream: cs, r: r, rc: rc, serverStreams: desc.ServerStreams}, nil
+}
+
+// recordingStream is a client stream that records the messages sent and received on it. The call is
+// recorded once the stream completes; streams abandoned by the caller are not recorded.
+type recordingStream struct {
+	grpc.ClientStream
+	r             *recorder
+	serverStreams bool
+
+	mu   sync.Mutex
+	rc   *recordedCall
+	done bool
+}
+
+func (s *recordingStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err == nil {
+		s.mu.Lock()
+		s.rc.Requests = append(s.rc.Requests, marshalRecorded(m))
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *recordingStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return err
+	}
+	switch {
+	case err == nil:
+		s.rc.Responses = append(s.rc.Responses, marshalRecorded(m))
+		if s.serverStreams {
+			return nil
+		}
+		// Client-streaming calls complete with their single response.
+	case err == io.EOF:
+	default:
+		s.rc.setErr(err)
+	}
+	s.done = true
+	s.r.write(s.rc)
+	return err
+}
+
+// Replayer is a fake CAS and ByteStream server that serves the calls recorded by a client dialed with
+// DialParams.RecordFile, for deterministic debugging of server-specific behaviour. Each recorded call
+// is replayed at most once. Incoming calls are matched to the recording by method and request
+// content; when there is no exact match (e.g. because the requests depend on map iteration order or
+// contain random upload IDs), the earliest unreplayed call to the same method is used instead.
+type Replayer struct {
+	mu       sync.Mutex
+	calls    []*recordedCall
+	replayed []bool
+}
+
+// NewReplayer loads a recording from the given file.
+func NewReplayer(path string) (*Replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &Replayer{}
+	dec := json.NewDecoder(f)
+	for {
+		rc := new(recordedCall)
+		if err := dec.Decode(rc); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("couldn't parse recording %s: %v", path, err)
+		}
+		r.calls = append(r.calls, rc)
+	}
+	r.replayed = make([]bool, len(r.calls))
+	return r, nil
+}
+
+// Register registers the Replayer as the CAS and ByteStream service of a server.
+func (r *Replayer) Register(s *grpc.Server) {
+	regrpc.RegisterContentAddressableStorageServer(s, r)
+	bsgrpc.RegisterByteStreamServer(s, r)
+}
+
+// take finds the recorded call to replay for the given call, and marks it as replayed.
+func (r *Replayer) take(method string, reqs ...proto.Message) (*recordedCall, error) {
+	var raw [][]byte
+	for _, req := range reqs {
+		raw = append(raw, marshalRecorded(req))
+	}
+	matches := func(rc *recordedCall) bool {
+		if len(rc.Requests) != len(raw) {
+			return false
+		}
+		for i := range raw {
+			if !bytes.Equal(rc.Requests[i], raw[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	found := -1
+	for i, rc := range r.calls {
+		if r.replayed[i] || rc.Method != method {
+			continue
+		}
+		if matches(rc) {
+			found = i
+			break
+		}
+		if found < 0 {
+			found = i
+		}
+	}
+	if found < 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "no unreplayed call to %s left in the recording", method)
+	}
+	r.replayed[found] = true
+	return r.calls[found], nil
+}
+
+// replayUnary replays a recorded unary call into resp.
+func (r *Replayer) replayUnary(method string, req, resp proto.Message) error {
+	rc, err := r.take(method, req)
+	if err != nil {
+		return err
+	}
+	if rc.Code != uint32(codes.OK) {
+		return rc.err()
+	}
+	if len(rc.Responses) != 1 {
+		return status.Errorf(codes.Internal, "recorded call to %s has %d responses, expected 1", method, len(rc.Responses))
+	}
+	return proto.Unmarshal(rc.Responses[0], resp)
+}
+
+// FindMissingBlobs replays a recorded FindMissingBlobs call.
+func (r *Replayer) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	resp := new(repb.FindMissingBlobsResponse)
+	if err := r.replayUnary(casService+"FindMissingBlobs", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// BatchUpdateBlobs replays a recorded BatchUpdateBlobs call.
+func (r *Replayer) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
+	resp := new(repb.BatchUpdateBlobsResponse)
+	if err := r.replayUnary(casService+"BatchUpdateBlobs", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// BatchReadBlobs replays a recorded BatchReadBlobs call.
+func (r *Replayer) BatchReadBlobs(ctx context.Context, req *repb.BatchReadBlobsRequest) (*repb.BatchReadBlobsResponse, error) {
+	resp := new(repb.BatchReadBlobsResponse)
+	if err := r.replayUnary(casService+"BatchReadBlobs", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// GetTree replays a recorded GetTree call.
+func (r *Replayer) GetTree(req *repb.GetTreeRequest, stream regrpc.ContentAddressableStorage_GetTreeServer) error {
+	rc, err := r.take(casService+"GetTree", req)
+	if err != nil {
+		return err
+	}
+	for _, b := range rc.Responses {
+		resp := new(repb.GetTreeResponse)
+		if err := proto.Unmarshal(b, resp); err != nil {
+			return err
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	return rc.err()
+}
+
+// Read replays a recorded ByteStream Read call.
+func (r *Replayer) Read(req *bspb.ReadRequest, stream bsgrpc.ByteStream_ReadServer) error {
+	rc, err := r.take(byteStreamService+"Read", req)
+	if err != nil {
+		return err
+	}
+	for _, b := range rc.Responses {
+		resp := new(bspb.ReadResponse)
+		if err := proto.Unmarshal(b, resp); err != nil {
+			return err
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	return rc.err()
+}
+
+// Write replays a recorded ByteStream Write call, once all the client's requests are received.
+func (r *Replayer) Write(stream bsgrpc.ByteStream_WriteServer) error {
+	var reqs []proto.Message
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		reqs = append(reqs, req)
+	}
+	rc, err := r.take(byteStreamService+"Write", reqs...)
+	if err != nil {
+		return err
+	}
+	if rc.Code != uint32(codes.OK) {
+		return rc.err()
+	}
+	if len(rc.Responses) != 1 {
+		return status.Errorf(codes.Internal, "recorded Write call has %d responses, expected 1", len(rc.Responses))
+	}
+	resp := new(bspb.WriteResponse)
+	if err := proto.Unmarshal(rc.Responses[0], resp); err != nil {
+		return err
+	}
+	return stream.SendAndClose(resp)
+}
+
+// QueryWriteStatus replays a recorded QueryWriteStatus call.
+func (r *Replayer) QueryWriteStatus(ctx context.Context, req *bspb.QueryWriteStatusRequest) (*bspb.QueryWriteStatusResponse, error) {
+	resp := new(bspb.QueryWriteStatusResponse)
+	if err := r.replayUnary(byteStreamService+"QueryWriteStatus", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
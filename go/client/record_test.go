@@ -0,0 +1,118 @@
+package client_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/digest"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	regrpc "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bsgrpc "google.golang.org/genproto/googleapis/bytestream"
+)
+
+// casSession is a fixed sequence of CAS operations, returning the blobs read and the error
+// of each operation, for comparing a recorded session with its replay.
+func casSession(ctx context.Context, c *client.Client) (blobs [][]byte, errs []codes.Code) {
+	present, missing := []byte("present"), []byte("missing")
+	record := func(blob []byte, err error) {
+		blobs = append(blobs, blob)
+		errs = append(errs, status.Code(err))
+	}
+	foo, bar := []byte("foo"), []byte("bar")
+	record(nil, c.WriteBlobs(ctx, map[digest.Key][]byte{
+		digest.ToKey(digest.FromBlob(foo)):     foo,
+		digest.ToKey(digest.FromBlob(bar)):     bar,
+		digest.ToKey(digest.FromBlob(present)): present,
+	}))
+	_, err := c.WriteBlob(ctx, []byte("single"))
+	record(nil, err)
+	record(c.ReadBlob(ctx, digest.FromBlob(present)))
+	record(c.ReadBlob(ctx, digest.FromBlob(missing)))
+	record(nil, func() error {
+		_, err := c.MissingBlobs(ctx, []*repb.Digest{digest.FromBlob(foo), digest.FromBlob(missing)})
+		return err
+	}())
+	return blobs, errs
+}
+
+func TestRecordReplay(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	recFile := filepath.Join(dir, "recording")
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	present := []byte("present")
+	fake := &fakeCAS{blobs: map[digest.Key][]byte{digest.ToKey(digest.FromBlob(present)): present}}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+		RecordFile: recFile,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	wantBlobs, wantErrs := casSession(ctx, c)
+	c.Close()
+	if wantErrs[3] != codes.NotFound {
+		t.Fatalf("reading a missing blob from the fake gave %v, want %v", wantErrs[3], codes.NotFound)
+	}
+
+	replayer, err := client.NewReplayer(recFile)
+	if err != nil {
+		t.Fatalf("client.NewReplayer(%q) gave error %v, expected nil", recFile, err)
+	}
+	replayListener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer replayListener.Close()
+	replayServer := grpc.NewServer()
+	replayer.Register(replayServer)
+	go replayServer.Serve(replayListener)
+	defer replayServer.Stop()
+
+	c, err = client.Dial(ctx, instance, client.DialParams{
+		Service:    replayListener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+	gotBlobs, gotErrs := casSession(ctx, c)
+	if diff := cmp.Diff(wantBlobs, gotBlobs); diff != "" {
+		t.Errorf("replayed session read different blobs (-recorded +replayed):\n%s", diff)
+	}
+	if diff := cmp.Diff(wantErrs, gotErrs); diff != "" {
+		t.Errorf("replayed session gave different errors (-recorded +replayed):\n%s", diff)
+	}
+
+	// The recording is used up, so further calls fail.
+	if _, err := c.ReadBlob(ctx, digest.FromBlob(present)); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("c.ReadBlob(ctx, ...) after replaying the whole recording gave error %v, want code %v", err, codes.FailedPrecondition)
+	}
+}
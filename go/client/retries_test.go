@@ -1,15 +1,20 @@
 package client_test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/bazelbuild/remote-apis-sdks/go/client"
 	"github.com/bazelbuild/remote-apis-sdks/go/digest"
+	"github.com/bazelbuild/remote-apis-sdks/go/retry"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -24,6 +29,7 @@ import (
 	bspb "google.golang.org/genproto/googleapis/bytestream"
 	opgrpc "google.golang.org/genproto/googleapis/longrunning"
 	oppb "google.golang.org/genproto/googleapis/longrunning"
+	errdetails "google.golang.org/genproto/googleapis/rpc/errdetails"
 	spb "google.golang.org/genproto/googleapis/rpc/status"
 )
 
@@ -60,7 +66,14 @@ func (f *flakyServer) Write(stream bsgrpc.ByteStream_WriteServer) error {
 	if numCalls < 5 {
 		return status.Error(codes.Internal, "another transient error!")
 	}
-	return stream.SendAndClose(&bspb.WriteResponse{CommittedSize: 4})
+	committed := int64(len(req.Data))
+	for !req.FinishWrite {
+		if req, err = stream.Recv(); err != nil {
+			return err
+		}
+		committed += int64(len(req.Data))
+	}
+	return stream.SendAndClose(&bspb.WriteResponse{CommittedSize: committed})
 }
 
 func (f *flakyServer) Read(req *bspb.ReadRequest, stream bsgrpc.ByteStream_ReadServer) error {
@@ -214,10 +227,11 @@ func setup(t *testing.T) *flakyFixture {
 	regrpc.RegisterExecutionServer(f.server, f.fake)
 	opgrpc.RegisterOperationsServer(f.server, f.fake)
 	go f.server.Serve(f.listener)
+	// Writes of the smallest chunks let the fake fail them partway through.
 	f.client, err = client.Dial(f.ctx, instance, client.DialParams{
 		Service:    f.listener.Addr().String(),
 		NoSecurity: true,
-	}, client.ChunkMaxSize(2), client.RetryTransient(), client.RPCTimeout(time.Second))
+	}, client.ChunkMaxSize(client.MinWriteChunkSize), client.RetryTransient(), client.RPCTimeout(time.Second))
 	if err != nil {
 		t.Fatalf("Error connecting to server: %v", err)
 	}
@@ -234,7 +248,8 @@ func TestWriteRetries(t *testing.T) {
 	f := setup(t)
 	defer f.shutDown()
 
-	blob := []byte("blob")
+	// The blob is written in two chunks.
+	blob := bytes.Repeat([]byte("blob"), client.MinWriteChunkSize/2)
 	gotDg, err := f.client.WriteBlob(f.ctx, blob)
 	if err != nil {
 		t.Errorf("client.WriteBlob(ctx, blob) gave error %s, wanted nil", err)
@@ -258,6 +273,464 @@ func TestReadRetries(t *testing.T) {
 	}
 }
 
+// truncatingReader serves a blob over ByteStream. The first read ends successfully halfway through
+// the requested data, as if the stream had been truncated; later reads are served in full.
+type truncatingReader struct {
+	bsgrpc.ByteStreamServer
+	blob     []byte
+	mu       sync.Mutex
+	numCalls int
+}
+
+func (f *truncatingReader) Read(req *bspb.ReadRequest, stream bsgrpc.ByteStream_ReadServer) error {
+	f.mu.Lock()
+	f.numCalls++
+	numCalls := f.numCalls
+	f.mu.Unlock()
+	data := f.blob[req.ReadOffset:]
+	if numCalls == 1 {
+		data = data[:len(data)/2]
+	}
+	return stream.Send(&bspb.ReadResponse{Data: data})
+}
+
+func TestReadShortReadRetries(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	blob := []byte("some blob that gets truncated")
+	dg := digest.FromBlob(blob)
+	fake := &truncatingReader{blob: blob}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	dir, err := ioutil.TempDir("", "short_read")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fpath := filepath.Join(dir, "blob")
+
+	reads := []struct {
+		name string
+		read func(c *client.Client) ([]byte, error)
+	}{
+		{
+			name: "ReadBlob",
+			read: func(c *client.Client) ([]byte, error) { return c.ReadBlob(ctx, dg) },
+		},
+		{
+			name: "ReadBlobToFile",
+			read: func(c *client.Client) ([]byte, error) {
+				if _, err := c.ReadBlobToFile(ctx, dg, fpath); err != nil {
+					return nil, err
+				}
+				return ioutil.ReadFile(fpath)
+			},
+		},
+	}
+	for _, retry := range []bool{true, false} {
+		var opts []client.Opt
+		if retry {
+			opts = append(opts, client.RetryTransient())
+		}
+		c, err := client.Dial(ctx, instance, client.DialParams{
+			Service:    listener.Addr().String(),
+			NoSecurity: true,
+		}, opts...)
+		if err != nil {
+			t.Fatalf("Error connecting to server: %v", err)
+		}
+		defer c.Close()
+		for _, r := range reads {
+			t.Run(fmt.Sprintf("%s, retry=%t", r.name, retry), func(t *testing.T) {
+				fake.numCalls = 0
+				got, err := r.read(c)
+				if !retry {
+					if status.Code(err) != codes.Unavailable {
+						t.Errorf("%s of a truncated stream without retries gave error %v, want code %v", r.name, err, codes.Unavailable)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("%s gave error %v, want nil", r.name, err)
+				}
+				if !bytes.Equal(got, blob) {
+					t.Errorf("%s read %q, want %q", r.name, got, blob)
+				}
+				if fake.numCalls != 2 {
+					t.Errorf("%s made %d Read calls, want 2", r.name, fake.numCalls)
+				}
+			})
+		}
+	}
+}
+
+// interruptedReader serves a blob over ByteStream. Its first Read stream fails with UNAVAILABLE
+// halfway through the blob; later ones are served in full. It records the offset of each read.
+type interruptedReader struct {
+	bsgrpc.ByteStreamServer
+	blob    []byte
+	mu      sync.Mutex
+	offsets []int64
+}
+
+func (f *interruptedReader) Read(req *bspb.ReadRequest, stream bsgrpc.ByteStream_ReadServer) error {
+	f.mu.Lock()
+	f.offsets = append(f.offsets, req.ReadOffset)
+	first := len(f.offsets) == 1
+	f.mu.Unlock()
+	data := f.blob[req.ReadOffset:]
+	if !first {
+		return stream.Send(&bspb.ReadResponse{Data: data})
+	}
+	if err := stream.Send(&bspb.ReadResponse{Data: data[:len(data)/2]}); err != nil {
+		return err
+	}
+	return status.Error(codes.Unavailable, "connection lost")
+}
+
+func TestReadBlobToFileResume(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	blob := []byte("some blob whose download gets interrupted")
+	dg := digest.FromBlob(blob)
+	half := int64(len(blob) / 2)
+	fake := &interruptedReader{blob: blob}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	dir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fpath := filepath.Join(dir, "blob")
+
+	tests := []struct {
+		name string
+		opts []client.Opt
+		// overwrite, if set, replaces the partial download with other data of the same size.
+		overwrite bool
+		// wantOffsets is the offsets of the reads made by the download that follows the interrupted one.
+		wantOffsets []int64
+	}{
+		{
+			name:        "not resumed",
+			wantOffsets: []int64{0},
+		},
+		{
+			name:        "resumed",
+			opts:        []client.Opt{client.ResumeDownloads(true)},
+			wantOffsets: []int64{half},
+		},
+		{
+			name:        "other data in the file",
+			opts:        []client.Opt{client.ResumeDownloads(true)},
+			overwrite:   true,
+			wantOffsets: []int64{half, 0},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := client.Dial(ctx, instance, client.DialParams{
+				Service:    listener.Addr().String(),
+				NoSecurity: true,
+			}, tc.opts...)
+			if err != nil {
+				t.Fatalf("Error connecting to server: %v", err)
+			}
+			defer c.Close()
+			fake.offsets = nil
+			os.Remove(fpath)
+
+			// Without retries, the interrupted download fails, leaving the start of the blob in the file.
+			if _, err := c.ReadBlobToFile(ctx, dg, fpath); status.Code(err) != codes.Unavailable {
+				t.Fatalf("c.ReadBlobToFile(ctx, dg, fpath) of an interrupted stream gave error %v, want code %v", err, codes.Unavailable)
+			}
+			partial, err := ioutil.ReadFile(fpath)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", fpath, err)
+			}
+			if !bytes.Equal(partial, blob[:half]) {
+				t.Fatalf("interrupted download left %q in the file, want %q", partial, blob[:half])
+			}
+			if tc.overwrite {
+				if err := ioutil.WriteFile(fpath, bytes.Repeat([]byte("x"), int(half)), 0644); err != nil {
+					t.Fatalf("failed to write %s: %v", fpath, err)
+				}
+			}
+
+			n, err := c.ReadBlobToFile(ctx, dg, fpath)
+			if err != nil {
+				t.Fatalf("c.ReadBlobToFile(ctx, dg, fpath) gave error %v, want nil", err)
+			}
+			if n != dg.SizeBytes {
+				t.Errorf("c.ReadBlobToFile(ctx, dg, fpath) = %d, want %d", n, dg.SizeBytes)
+			}
+			got, err := ioutil.ReadFile(fpath)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", fpath, err)
+			}
+			if !bytes.Equal(got, blob) {
+				t.Errorf("c.ReadBlobToFile(ctx, dg, fpath) wrote %q, want %q", got, blob)
+			}
+			if diff := cmp.Diff(tc.wantOffsets, fake.offsets[1:]); diff != "" {
+				t.Errorf("c.ReadBlobToFile(ctx, dg, fpath) read at offsets diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// redirectingReader serves a blob over ByteStream. A Read of a resource in redirects sends part of
+// the remaining data and then fails with an error redirecting it to the mapped resource; Reads of
+// other resources are served in full. It records the resource and offset of each read.
+type redirectingReader struct {
+	bsgrpc.ByteStreamServer
+	blob      []byte
+	redirects map[string]string
+	mu        sync.Mutex
+	reads     []string
+}
+
+func (f *redirectingReader) Read(req *bspb.ReadRequest, stream bsgrpc.ByteStream_ReadServer) error {
+	f.mu.Lock()
+	f.reads = append(f.reads, fmt.Sprintf("%s@%d", req.ResourceName, req.ReadOffset))
+	f.mu.Unlock()
+	data := f.blob[req.ReadOffset:]
+	target, ok := f.redirects[req.ResourceName]
+	if !ok {
+		return stream.Send(&bspb.ReadResponse{Data: data})
+	}
+	if err := stream.Send(&bspb.ReadResponse{Data: data[:len(data)/4]}); err != nil {
+		return err
+	}
+	st, err := status.New(codes.FailedPrecondition, "blob moved").WithDetails(&errdetails.ResourceInfo{
+		ResourceType: client.ReadRedirectType,
+		ResourceName: target,
+	})
+	if err != nil {
+		return err
+	}
+	return st.Err()
+}
+
+func TestReadBlobRedirect(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	blob := []byte("a blob stored by some other shard of the CAS")
+	dg := digest.FromBlob(blob)
+	fake := &redirectingReader{blob: blob}
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.RetryTransient())
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+	name := fmt.Sprintf("%s/blobs/%s/%d", instance, dg.Hash, dg.SizeBytes)
+
+	tests := []struct {
+		name      string
+		redirects map[string]string
+		wantErr   bool
+		wantReads []string
+	}{
+		{
+			name:      "not redirected",
+			wantReads: []string{name + "@0"},
+		},
+		{
+			name:      "redirected",
+			redirects: map[string]string{name: "shard/" + name},
+			// The second read resumes after the quarter of the blob sent by the first.
+			wantReads: []string{name + "@0", fmt.Sprintf("shard/%s@%d", name, len(blob)/4)},
+		},
+		{
+			name:      "redirect loop",
+			redirects: map[string]string{name: "shard/" + name, "shard/" + name: name},
+			wantErr:   true,
+			// The first read and each of the redirects it follows, each sending a quarter of the rest.
+			wantReads: []string{name + "@0", "shard/" + name + "@11", name + "@19", "shard/" + name + "@25", name + "@29", "shard/" + name + "@32"},
+		},
+		{
+			name:      "redirected to another blob",
+			redirects: map[string]string{name: fmt.Sprintf("shard/blobs/%s/%d", digest.Empty.Hash, 0)},
+			wantErr:   true,
+			wantReads: []string{name + "@0"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.redirects = tc.redirects
+			fake.reads = nil
+			got, err := c.ReadBlob(ctx, dg)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("c.ReadBlob(ctx, dg) gave no error, want error")
+				}
+				if diff := cmp.Diff(tc.wantReads, fake.reads); diff != "" {
+					t.Errorf("c.ReadBlob(ctx, dg) made reads diff (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("c.ReadBlob(ctx, dg) gave error %v, want nil", err)
+			}
+			if !bytes.Equal(got, blob) {
+				t.Errorf("c.ReadBlob(ctx, dg) = %q, want %q", got, blob)
+			}
+			if diff := cmp.Diff(tc.wantReads, fake.reads); diff != "" {
+				t.Errorf("c.ReadBlob(ctx, dg) made reads diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// droppingWriter is a ByteStream server for a single upload. It commits the data it receives as it
+// arrives, and its first Write stream fails with a retriable error once dropAfter bytes are
+// committed. If queryable, QueryWriteStatus reports the committed size, so that the client can
+// resume; otherwise, it is unimplemented and the client must restart the upload.
+type droppingWriter struct {
+	bsgrpc.ByteStreamServer
+	dropAfter int64
+	queryable bool
+
+	mu        sync.Mutex
+	committed []byte
+	complete  bool
+	numWrites int
+	received  int64 // The number of bytes received, over all streams.
+}
+
+func (f *droppingWriter) Write(stream bsgrpc.ByteStream_WriteServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.numWrites++
+	for first := true; ; first = false {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if first && req.ResourceName == "" {
+			return status.Error(codes.InvalidArgument, "the first request of a stream has no resource name")
+		}
+		if req.WriteOffset == 0 {
+			f.committed = nil
+		}
+		if req.WriteOffset != int64(len(f.committed)) {
+			return status.Errorf(codes.InvalidArgument, "request had offset %d, expected %d", req.WriteOffset, len(f.committed))
+		}
+		f.committed = append(f.committed, req.Data...)
+		f.received += int64(len(req.Data))
+		if req.FinishWrite {
+			f.complete = true
+			return stream.SendAndClose(&bspb.WriteResponse{CommittedSize: int64(len(f.committed))})
+		}
+		if f.numWrites == 1 && int64(len(f.committed)) >= f.dropAfter {
+			return status.Error(codes.Unavailable, "connection dropped")
+		}
+	}
+}
+
+func (f *droppingWriter) QueryWriteStatus(ctx context.Context, req *bspb.QueryWriteStatusRequest) (*bspb.QueryWriteStatusResponse, error) {
+	if !f.queryable {
+		return nil, status.Error(codes.Unimplemented, "test fake does not implement method")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &bspb.QueryWriteStatusResponse{CommittedSize: int64(len(f.committed)), Complete: f.complete}, nil
+}
+
+func TestWriteResumesAfterDroppedStream(t *testing.T) {
+	ctx := context.Background()
+	blob := bytes.Repeat([]byte("a blob that is uploaded in several chunks"), client.MinWriteChunkSize/10)
+	// The first stream is dropped after two chunks.
+	const dropAfter = 2 * client.MinWriteChunkSize
+	tests := []struct {
+		name         string
+		queryable    bool
+		wantReceived int64
+	}{
+		{name: "resumed", queryable: true, wantReceived: int64(len(blob))},
+		{name: "restarted", queryable: false, wantReceived: int64(len(blob)) + dropAfter},
+	}
+	uploads := []struct {
+		name  string
+		write func(c *client.Client) error
+	}{
+		{
+			name: "WriteBlob",
+			write: func(c *client.Client) error {
+				_, err := c.WriteBlob(ctx, blob)
+				return err
+			},
+		},
+		{
+			name: "WriteBlobReader",
+			write: func(c *client.Client) error {
+				return c.WriteBlobReader(ctx, digest.FromBlob(blob), bytes.NewReader(blob))
+			},
+		},
+	}
+	for _, tc := range tests {
+		for _, up := range uploads {
+			up := up
+			t.Run(up.name+"/"+tc.name, func(t *testing.T) {
+				listener, err := net.Listen("tcp", ":0")
+				if err != nil {
+					t.Fatalf("Cannot listen: %v", err)
+				}
+				defer listener.Close()
+				server := grpc.NewServer()
+				fake := &droppingWriter{dropAfter: dropAfter, queryable: tc.queryable}
+				bsgrpc.RegisterByteStreamServer(server, fake)
+				go server.Serve(listener)
+				defer server.Stop()
+				c, err := client.Dial(ctx, instance, client.DialParams{
+					Service:    listener.Addr().String(),
+					NoSecurity: true,
+				}, client.ChunkMaxSize(client.MinWriteChunkSize), client.RetryTransient())
+				if err != nil {
+					t.Fatalf("Error connecting to server: %v", err)
+				}
+				defer c.Close()
+
+				if err := up.write(c); err != nil {
+					t.Fatalf("c.%s(ctx, blob) gave error %v, want nil", up.name, err)
+				}
+				if !bytes.Equal(fake.committed, blob) || !fake.complete {
+					t.Errorf("server committed %d bytes (complete: %t), want the %d bytes of the blob", len(fake.committed), fake.complete, len(blob))
+				}
+				if fake.numWrites != 2 {
+					t.Errorf("%d Write streams were opened, want 2", fake.numWrites)
+				}
+				if fake.received != tc.wantReceived {
+					t.Errorf("server received %d bytes, want %d", fake.received, tc.wantReceived)
+				}
+			})
+		}
+	}
+}
+
 func assertCanceledErr(t *testing.T, err error, method string) {
 	t.Helper()
 	if err == nil {
@@ -347,6 +820,80 @@ func TestBatchWriteBlobsRpcRetries(t *testing.T) {
 	assertUnimplementedErr(t, err, "client.BatchWriteBlobs")
 }
 
+// failingBatchCAS is a fakeCAS whose BatchUpdateBlobs RPCs fail with a retriable error a given
+// number of times before they start succeeding.
+type failingBatchCAS struct {
+	*fakeCAS
+	failures int
+}
+
+func (f *failingBatchCAS) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
+	f.mu.Lock()
+	if f.failures > 0 {
+		f.failures--
+		f.mu.Unlock()
+		return nil, status.Error(codes.Unavailable, "transient error!")
+	}
+	f.mu.Unlock()
+	return f.fakeCAS.BatchUpdateBlobs(ctx, req)
+}
+
+func TestWriteBlobsRetryWholeOperation(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &failingBatchCAS{fakeCAS: &fakeCAS{}}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	blobs := map[digest.Key][]byte{
+		digest.ToKey(digest.FromBlob([]byte("foo"))): []byte("foo"),
+		digest.ToKey(digest.FromBlob([]byte("bar"))): []byte("bar"),
+	}
+	// Each BatchUpdateBlobs call is attempted twice, but the first three attempts fail.
+	retrier := &client.Retrier{
+		Backoff:     retry.ExponentialBackoff(time.Millisecond, time.Millisecond, retry.Attempts(2)),
+		ShouldRetry: retry.Always,
+	}
+	for _, whole := range []client.RetryWholeOperation{false, true} {
+		t.Run(fmt.Sprintf("RetryWholeOperation=%t", whole), func(t *testing.T) {
+			c, err := client.Dial(ctx, instance, client.DialParams{
+				Service:    listener.Addr().String(),
+				NoSecurity: true,
+			}, retrier, whole)
+			if err != nil {
+				t.Fatalf("Error connecting to server: %v", err)
+			}
+			defer c.Close()
+			fake.blobs = make(map[digest.Key][]byte)
+			fake.findMissingReqs = 0
+			fake.failures = 3
+
+			err = c.WriteBlobs(ctx, blobs)
+			if !whole {
+				if err == nil {
+					t.Errorf("c.WriteBlobs(ctx, blobs) gave nil error, want error after the batch retries run out")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("c.WriteBlobs(ctx, blobs) gave error %v, want nil", err)
+			}
+			if diff := cmp.Diff(blobs, fake.blobs); diff != "" {
+				t.Errorf("c.WriteBlobs(ctx, blobs) stored different blobs (-want +got):\n%s", diff)
+			}
+			if fake.findMissingReqs != 2 {
+				t.Errorf("%d FindMissingBlobs requests received, want 2", fake.findMissingReqs)
+			}
+		})
+	}
+}
+
 // Verify for one arbitrary method that when retries are exhausted, we get the retriable error code
 // back.
 func TestBatchWriteBlobsRpcRetriesExhausted(t *testing.T) {
@@ -362,6 +909,71 @@ func TestBatchWriteBlobsRpcRetriesExhausted(t *testing.T) {
 	assertCanceledErr(t, err, "client.BatchWriteBlobs")
 }
 
+func TestRetryBudgetExhaustedError(t *testing.T) {
+	f := setup(t)
+	f.fake.retriableForever = true
+	defer f.shutDown()
+
+	blobs := map[digest.Key][]byte{
+		digest.ToKey(digest.TestNew("a", 1)): []byte{1},
+		digest.ToKey(digest.TestNew("b", 1)): []byte{2},
+	}
+	err := f.client.BatchWriteBlobs(f.ctx, blobs)
+	exhausted, ok := err.(*client.RetryBudgetExhaustedError)
+	if !ok {
+		t.Fatalf("client.BatchWriteBlobs(ctx, blobs) = %v; expected a RetryBudgetExhaustedError", err)
+	}
+	if exhausted.Attempts != 6 {
+		t.Errorf("client.BatchWriteBlobs(ctx, blobs) made %d attempts, want 6", exhausted.Attempts)
+	}
+	if got := status.Code(exhausted.Unwrap()); got != codes.Canceled {
+		t.Errorf("client.BatchWriteBlobs(ctx, blobs) last attempt gave code %v, want %v", got, codes.Canceled)
+	}
+
+	// Non-retriable errors are returned as they are.
+	f.fake.retriableForever = false
+	err = f.client.BatchWriteBlobs(f.ctx, blobs)
+	assertUnimplementedErr(t, err, "client.BatchWriteBlobs")
+	if _, ok := err.(*client.RetryBudgetExhaustedError); ok {
+		t.Errorf("client.BatchWriteBlobs(ctx, blobs) = %v; expected no RetryBudgetExhaustedError", err)
+	}
+}
+
+func TestOperationTimeout(t *testing.T) {
+	f := setup(t)
+	f.fake.retriableForever = true
+	defer f.shutDown()
+	timeout := 200 * time.Millisecond
+	client.OperationTimeout(timeout).Apply(f.client)
+
+	// The first FindMissingBlobs call stalls for longer than the operation timeout.
+	dgs := []*repb.Digest{digest.TestNew("a", 1)}
+	_, err := f.client.MissingBlobs(f.ctx, dgs)
+	opErr, ok := err.(*client.OperationTimeoutError)
+	if !ok {
+		t.Fatalf("client.MissingBlobs(ctx, digests) = %v; expected an OperationTimeoutError", err)
+	}
+	if opErr.Op != "MissingBlobs" || opErr.Timeout != timeout {
+		t.Errorf("client.MissingBlobs(ctx, digests) gave error for op %q with timeout %v, want op %q with timeout %v", opErr.Op, opErr.Timeout, "MissingBlobs", timeout)
+	}
+	if opErr.Unwrap() == nil {
+		t.Errorf("client.MissingBlobs(ctx, digests) gave OperationTimeoutError with no underlying error")
+	}
+
+	// A deadline of the caller's context is not reported as an operation timeout.
+	ctx, cancel := context.WithTimeout(f.ctx, timeout/2)
+	defer cancel()
+	client.OperationTimeout(time.Minute).Apply(f.client)
+	f.fake.mu.Lock()
+	f.fake.numCalls["FindMissingBlobs"] = 0
+	f.fake.mu.Unlock()
+	if _, err := f.client.MissingBlobs(ctx, dgs); err == nil {
+		t.Errorf("client.MissingBlobs(ctx, digests) = nil; expected an error")
+	} else if _, ok := err.(*client.OperationTimeoutError); ok {
+		t.Errorf("client.MissingBlobs(ctx, digests) = %v; expected no OperationTimeoutError", err)
+	}
+}
+
 type flakyBatchUpdateServer struct {
 	numErrors int // A counter of errors the server has returned thus far.
 	requests  []*repb.BatchUpdateBlobsRequest
@@ -431,7 +1043,7 @@ func TestBatchUpdateBlobsIndividualRequestRetries(t *testing.T) {
 	regrpc.RegisterContentAddressableStorageServer(server, fake)
 	go server.Serve(listener)
 	ctx := context.Background()
-	client, err := client.Dial(ctx, instance, client.DialParams{
+	c, err := client.Dial(ctx, instance, client.DialParams{
 		Service:    listener.Addr().String(),
 		NoSecurity: true,
 	}, client.RetryTransient())
@@ -440,7 +1052,7 @@ func TestBatchUpdateBlobsIndividualRequestRetries(t *testing.T) {
 	}
 	defer server.Stop()
 	defer listener.Close()
-	defer client.Close()
+	defer c.Close()
 
 	blobs := map[digest.Key][]byte{
 		digest.ToKey(digest.TestNew("a", 1)): []byte{1},
@@ -448,12 +1060,28 @@ func TestBatchUpdateBlobsIndividualRequestRetries(t *testing.T) {
 		digest.ToKey(digest.TestNew("c", 1)): []byte{3},
 		digest.ToKey(digest.TestNew("d", 1)): []byte{4},
 	}
-	err = client.BatchWriteBlobs(ctx, blobs)
+	err = c.BatchWriteBlobs(ctx, blobs)
 	if err == nil {
 		t.Errorf("client.BatchWriteBlobs(ctx, blobs) = nil; expected PermissionDenied error got nil")
 	} else if s, ok := status.FromError(err); ok && s.Code() != codes.PermissionDenied {
 		t.Errorf("client.BatchWriteBlobs(ctx, blobs) = %v; expected PermissionDenied error, got %v", err, s.Code())
 	}
+	// Both failures of the last attempt are reported, not only the last one.
+	if bErr, ok := err.(*client.BatchWriteBlobsError); !ok {
+		t.Errorf("client.BatchWriteBlobs(ctx, blobs) = %v; expected a *BatchWriteBlobsError", err)
+	} else {
+		wantCodes := map[digest.Key]codes.Code{
+			digest.ToKey(digest.TestNew("c", 1)): codes.Internal,
+			digest.ToKey(digest.TestNew("d", 1)): codes.PermissionDenied,
+		}
+		gotCodes := make(map[digest.Key]codes.Code)
+		for k, e := range bErr.Errors {
+			gotCodes[k] = status.Code(e)
+		}
+		if diff := cmp.Diff(wantCodes, gotCodes); diff != "" {
+			t.Errorf("client.BatchWriteBlobs(ctx, blobs) gave error codes diff (-want +got):\n%s", diff)
+		}
+	}
 	wantRequests := []*repb.BatchUpdateBlobsRequest{
 		{
 			Requests: []*repb.BatchUpdateBlobsRequest_Request{
@@ -492,6 +1120,106 @@ func TestBatchUpdateBlobsIndividualRequestRetries(t *testing.T) {
 	}
 }
 
+// flakyBatchReadServer is a CAS server whose BatchReadBlobs responses give each blob the statuses
+// in codes in turn, and then OK.
+type flakyBatchReadServer struct {
+	flakyBatchUpdateServer
+	blobs    map[digest.Key][]byte
+	codes    map[digest.Key][]codes.Code
+	requests [][]string
+}
+
+func (f *flakyBatchReadServer) BatchReadBlobs(ctx context.Context, req *repb.BatchReadBlobsRequest) (*repb.BatchReadBlobsResponse, error) {
+	f.requests = append(f.requests, digestStrings(req.Digests))
+	resp := &repb.BatchReadBlobsResponse{}
+	for _, dg := range req.Digests {
+		k := digest.ToKey(dg)
+		code := codes.OK
+		if cs := f.codes[k]; len(cs) > 0 {
+			code, f.codes[k] = cs[0], cs[1:]
+		}
+		r := &repb.BatchReadBlobsResponse_Response{Digest: dg, Status: &spb.Status{Code: int32(code)}}
+		if code == codes.OK {
+			r.Data = f.blobs[k]
+		}
+		resp.Responses = append(resp.Responses, r)
+	}
+	return resp, nil
+}
+
+func TestBatchReadBlobsIndividualRequestRetries(t *testing.T) {
+	a, b, c := []byte("a"), []byte("b"), []byte("c")
+	aDg, bDg, cDg := digest.FromBlob(a), digest.FromBlob(b), digest.FromBlob(c)
+	tests := []struct {
+		desc         string
+		codes        map[digest.Key][]codes.Code
+		wantErr      bool
+		wantRequests [][]*repb.Digest
+	}{
+		{
+			desc: "retriable errors",
+			codes: map[digest.Key][]codes.Code{
+				digest.ToKey(bDg): {codes.Unavailable},
+				digest.ToKey(cDg): {codes.Aborted, codes.Unavailable},
+			},
+			wantRequests: [][]*repb.Digest{{aDg, bDg, cDg}, {bDg, cDg}, {cDg}},
+		},
+		{
+			desc: "non-retriable error",
+			codes: map[digest.Key][]codes.Code{
+				digest.ToKey(bDg): {codes.Unavailable},
+				digest.ToKey(cDg): {codes.NotFound},
+			},
+			wantErr:      true,
+			wantRequests: [][]*repb.Digest{{aDg, bDg, cDg}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			listener, err := net.Listen("tcp", ":0")
+			if err != nil {
+				t.Fatalf("Cannot listen: %v", err)
+			}
+			defer listener.Close()
+			server := grpc.NewServer()
+			fake := &flakyBatchReadServer{
+				blobs: map[digest.Key][]byte{digest.ToKey(aDg): a, digest.ToKey(bDg): b, digest.ToKey(cDg): c},
+				codes: tc.codes,
+			}
+			regrpc.RegisterContentAddressableStorageServer(server, fake)
+			go server.Serve(listener)
+			defer server.Stop()
+			ctx := context.Background()
+			c, err := client.Dial(ctx, instance, client.DialParams{
+				Service:    listener.Addr().String(),
+				NoSecurity: true,
+			}, client.RetryTransient())
+			if err != nil {
+				t.Fatalf("Error connecting to server: %v", err)
+			}
+			defer c.Close()
+
+			got, err := c.BatchDownloadBlobs(ctx, []*repb.Digest{aDg, bDg, cDg})
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("c.BatchDownloadBlobs(ctx, digests) gave no error, want error")
+				}
+			} else if err != nil {
+				t.Errorf("c.BatchDownloadBlobs(ctx, digests) gave error %v, want nil", err)
+			} else if diff := cmp.Diff(fake.blobs, got); diff != "" {
+				t.Errorf("c.BatchDownloadBlobs(ctx, digests) gave diff (-want +got):\n%s", diff)
+			}
+			var want [][]string
+			for _, dgs := range tc.wantRequests {
+				want = append(want, digestStrings(dgs))
+			}
+			if diff := cmp.Diff(want, fake.requests, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+				t.Errorf("BatchReadBlobs requests gave diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestGetTreeRetries(t *testing.T) {
 	f := setup(t)
 	defer f.shutDown()
@@ -506,6 +1234,266 @@ func TestGetTreeRetries(t *testing.T) {
 	}
 }
 
+// stallingTreeServer serves a three-page tree, pausing before each page. On its first call, it stalls
+// indefinitely before sending the last page.
+type stallingTreeServer struct {
+	mu       sync.Mutex
+	numCalls int
+}
+
+func (f *stallingTreeServer) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (f *stallingTreeServer) BatchReadBlobs(ctx context.Context, req *repb.BatchReadBlobsRequest) (*repb.BatchReadBlobsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (f *stallingTreeServer) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (f *stallingTreeServer) GetTree(req *repb.GetTreeRequest, stream regrpc.ContentAddressableStorage_GetTreeServer) error {
+	f.mu.Lock()
+	f.numCalls++
+	numCalls := f.numCalls
+	f.mu.Unlock()
+
+	pages := []string{"", "page2", "page3"}
+	start := -1
+	for i, tok := range pages {
+		if tok == req.PageToken {
+			start = i
+		}
+	}
+	if start < 0 {
+		return status.Errorf(codes.InvalidArgument, "unknown page token %q", req.PageToken)
+	}
+	for i := start; i < len(pages); i++ {
+		time.Sleep(100 * time.Millisecond)
+		if numCalls == 1 && i == len(pages)-1 {
+			select {
+			case <-stream.Context().Done():
+				return stream.Context().Err()
+			case <-time.After(10 * time.Second):
+				return status.Error(codes.Internal, "test fake was not cancelled")
+			}
+		}
+		resp := &repb.GetTreeResponse{Directories: []*repb.Directory{{Files: []*repb.FileNode{{Name: fmt.Sprintf("file%d", i)}}}}}
+		if i+1 < len(pages) {
+			resp.NextPageToken = pages[i+1]
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestGetTreeStalledPage(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	server := grpc.NewServer()
+	fake := &stallingTreeServer{}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	ctx := context.Background()
+	// The timeout is longer than each page takes, but shorter than the whole walk.
+	client, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.RetryTransient(), client.RPCTimeout(250*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer server.Stop()
+	defer listener.Close()
+	defer client.Close()
+
+	got, err := client.GetDirectoryTree(ctx, digest.TestNew("a", 1))
+	if err != nil {
+		t.Fatalf("client.GetDirectoryTree(ctx, digest) gave err %s, want nil", err)
+	}
+	if len(got) != 3 {
+		t.Errorf("client.GetDirectoryTree(ctx, digest) gave %d directories, want 3", len(got))
+	}
+	if fake.numCalls != 2 {
+		t.Errorf("GetTree was called %d times, want 2", fake.numCalls)
+	}
+}
+
+func TestWalkDirectoryTree(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	server := grpc.NewServer()
+	fake := &stallingTreeServer{}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	ctx := context.Background()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.RetryTransient())
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer server.Stop()
+	defer listener.Close()
+	defer c.Close()
+
+	// The walk is stopped before the page on which the fake stalls.
+	var pages int
+	got, err := c.WalkDirectoryTree(ctx, digest.TestNew("a", 1), func(dirs []*repb.Directory) error {
+		pages++
+		if pages == 2 {
+			return client.ErrStopWalk
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("client.WalkDirectoryTree(ctx, digest, fn) gave err %s, want nil", err)
+	}
+	if len(got) != 2 {
+		t.Errorf("client.WalkDirectoryTree(ctx, digest, fn) gave %d directories, want 2", len(got))
+	}
+	if fake.numCalls != 1 {
+		t.Errorf("GetTree was called %d times, want 1", fake.numCalls)
+	}
+
+	// Other errors of the callback are returned, and not retried.
+	fnErr := fmt.Errorf("callback error")
+	got, err = c.WalkDirectoryTree(ctx, digest.TestNew("a", 1), func(dirs []*repb.Directory) error {
+		return fnErr
+	})
+	if err != fnErr {
+		t.Errorf("client.WalkDirectoryTree(ctx, digest, fn) gave err %v, want %v", err, fnErr)
+	}
+	if got != nil {
+		t.Errorf("client.WalkDirectoryTree(ctx, digest, fn) gave %d directories, want none", len(got))
+	}
+	if fake.numCalls != 2 {
+		t.Errorf("GetTree was called %d times, want 2", fake.numCalls)
+	}
+}
+
+// forgetfulTreeServer serves a three-page tree. Each stream that starts from the first page fails
+// with a transient error after sending it, and page tokens are rejected as invalid, as by a server
+// that was restarted, the first forget times that they are sent.
+type forgetfulTreeServer struct {
+	regrpc.ContentAddressableStorageServer
+	forget int
+	mu     sync.Mutex
+	tokens []string
+}
+
+func (f *forgetfulTreeServer) GetTree(req *repb.GetTreeRequest, stream regrpc.ContentAddressableStorage_GetTreeServer) error {
+	f.mu.Lock()
+	f.tokens = append(f.tokens, req.PageToken)
+	forgot := false
+	if req.PageToken != "" && f.forget > 0 {
+		f.forget--
+		forgot = true
+	}
+	f.mu.Unlock()
+
+	pages := []string{"", "page2", "page3"}
+	start := -1
+	for i, tok := range pages {
+		if tok == req.PageToken {
+			start = i
+		}
+	}
+	if start < 0 || forgot {
+		return status.Errorf(codes.InvalidArgument, "unknown page token %q", req.PageToken)
+	}
+	for i := start; i < len(pages); i++ {
+		resp := &repb.GetTreeResponse{Directories: []*repb.Directory{{Files: []*repb.FileNode{{Name: fmt.Sprintf("file%d", i)}}}}}
+		if i+1 < len(pages) {
+			resp.NextPageToken = pages[i+1]
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+		if i == 0 {
+			return status.Error(codes.Unavailable, "server restarting")
+		}
+	}
+	return nil
+}
+
+func TestGetTreeExpiredPageToken(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &forgetfulTreeServer{}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	ctx := context.Background()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	}, client.RetryTransient())
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	tests := []struct {
+		name       string
+		forget     int
+		wantErr    bool
+		wantTokens []string
+	}{
+		{
+			name:       "token kept",
+			wantTokens: []string{"", "page2"},
+		},
+		{
+			name:       "token forgotten once",
+			forget:     1,
+			wantTokens: []string{"", "page2", "", "page2"},
+		},
+		{
+			name:    "token always forgotten",
+			forget:  100,
+			wantErr: true,
+			// The first walk and the maximum of 3 restarts.
+			wantTokens: []string{"", "page2", "", "page2", "", "page2", "", "page2"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.forget = tc.forget
+			fake.tokens = nil
+			got, err := c.GetDirectoryTree(ctx, digest.TestNew("a", 1))
+			if tc.wantErr {
+				if status.Code(err) != codes.InvalidArgument {
+					t.Errorf("client.GetDirectoryTree(ctx, digest) gave err %v, want code %v", err, codes.InvalidArgument)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("client.GetDirectoryTree(ctx, digest) gave err %v, want nil", err)
+				}
+				// The pages received before the restart are not duplicated.
+				if len(got) != 3 {
+					t.Errorf("client.GetDirectoryTree(ctx, digest) gave %d directories, want 3", len(got))
+				}
+			}
+			if diff := cmp.Diff(tc.wantTokens, fake.tokens); diff != "" {
+				t.Errorf("GetTree was called with page tokens diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestGetOperationRetries(t *testing.T) {
 	f := setup(t)
 	defer f.shutDown()
@@ -1,11 +1,18 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/bazelbuild/remote-apis-sdks/go/digest"
 	"github.com/golang/protobuf/proto"
@@ -101,6 +108,314 @@ func PackageTree(t *FileTree) (root *repb.Digest, blobs map[digest.Key][]byte, e
 	return dg, blobs, nil
 }
 
+// TreeOpts controls how a Merkle tree is built from a local directory.
+type TreeOpts struct {
+	// FollowSymlinks, if true, replaces symlinks by the files or directories they point to. By
+	// default, symlinks are kept in the tree as symlinks, with their targets unchanged. Building the
+	// tree fails if symlinks point to each other in a cycle, or a symlink points to a directory
+	// that contains it.
+	FollowSymlinks bool
+	// Excludes are regular expressions matched against the slash-separated path, relative to the
+	// root, of every file, directory and symlink. Matching entries, and everything under matching
+	// directories, are left out of the tree.
+	Excludes []*regexp.Regexp
+	// DigestCache, if set, is used to look up and store the digests of files, so that unchanged
+	// files are not hashed again.
+	DigestCache *digest.FileCache
+	// OnChange is how files that change while they are being hashed are handled. By default, such
+	// changes are not detected.
+	OnChange ChangePolicy
+	// DigestFunction is the digest function that files and directories are hashed with, SHA256 if
+	// nil. UploadTree ignores it and uses the client's digest function.
+	DigestFunction *digest.Function
+}
+
+// ChangePolicy is how building a tree from a local directory handles files that are modified while
+// they are being hashed, whose digests may then not match their contents when they are uploaded.
+// Changes are detected by comparing the size and modification time of the file before and after
+// hashing it.
+type ChangePolicy int
+
+const (
+	// ChangeIgnore uses the digest computed for a file, without checking whether it changed.
+	ChangeIgnore ChangePolicy = iota
+	// ChangeError fails building the tree if a file changed while it was hashed.
+	ChangeError
+	// ChangeRetry hashes a file that changed while it was hashed again, up to maxChangeRetries
+	// times, and fails building the tree if it keeps changing.
+	ChangeRetry
+)
+
+// maxChangeRetries is the number of times a file is hashed again under ChangeRetry.
+const maxChangeRetries = 3
+
+// afterHash, if set, is called with the path of each file hashed under ChangeError or ChangeRetry,
+// between hashing it and checking whether it changed. Tests use it to change files at that point.
+var afterHash func(path string)
+
+// localTree is the Merkle tree of a local directory: the encoded Directory protos, and the files, by
+// digest. File contents are not held in memory.
+type localTree struct {
+	root  *repb.Digest
+	dirs  map[digest.Key][]byte
+	files map[digest.Key]*localFile
+	// walking maps the real paths of the directories being walked, from the root down to the
+	// current one, to their paths relative to the root. It is only used with FollowSymlinks.
+	walking map[string]string
+}
+
+// localFile is a file of a localTree, with the size and modification time it had when it was hashed.
+type localFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// open opens the file for reading, failing if its size or modification time changed since it was
+// hashed, as its contents would then likely not match its digest.
+func (f *localFile) open() (*os.File, error) {
+	r, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := r.Stat()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	if fi.Size() != f.size || !fi.ModTime().Equal(f.modTime) {
+		r.Close()
+		return nil, fmt.Errorf("%s changed since the tree was built", f.path)
+	}
+	return r, nil
+}
+
+// buildLocalTree builds the Merkle tree of the local directory root.
+func buildLocalTree(root string, opts *TreeOpts) (*localTree, error) {
+	t := &localTree{
+		dirs:    make(map[digest.Key][]byte),
+		files:   make(map[digest.Key]*localFile),
+		walking: make(map[string]string),
+	}
+	dg, err := t.addDir(root, "", opts)
+	if err != nil {
+		return nil, err
+	}
+	t.root = dg
+	return t, nil
+}
+
+func (opts *TreeOpts) excluded(relPath string) bool {
+	for _, re := range opts.Excludes {
+		if re.MatchString(relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileDigest computes the digest of the file at path, whose attributes before hashing are fi,
+// checking for changes according to the OnChange policy. It also returns the attributes of the file
+// that the digest is for.
+func (opts *TreeOpts) fileDigest(path string, fi os.FileInfo) (*repb.Digest, os.FileInfo, error) {
+	if opts.OnChange == ChangeIgnore {
+		dg, err := opts.DigestCache.FromFile(opts.DigestFunction, path)
+		return dg, fi, err
+	}
+	for attempt := 0; ; attempt++ {
+		before, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		dg, err := opts.DigestCache.FromFile(opts.DigestFunction, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if afterHash != nil {
+			afterHash(path)
+		}
+		after, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if dg.SizeBytes == after.Size() && before.Size() == after.Size() && before.ModTime().Equal(after.ModTime()) {
+			return dg, after, nil
+		}
+		if opts.OnChange == ChangeError || attempt >= maxChangeRetries {
+			return nil, nil, fmt.Errorf("%s changed while it was being hashed", path)
+		}
+	}
+}
+
+// addDir adds the directory at absPath, whose path relative to the tree root is relPath, to the tree
+// and returns its digest.
+func (t *localTree) addDir(absPath, relPath string, opts *TreeOpts) (*repb.Digest, error) {
+	if opts.FollowSymlinks {
+		// A directory reached through a symlink may be one that is already being walked, which would
+		// otherwise be walked again without end.
+		real, err := filepath.EvalSymlinks(absPath)
+		if err != nil {
+			return nil, err
+		}
+		if outer, ok := t.walking[real]; ok {
+			return nil, fmt.Errorf("symlinks form a cycle: %s leads back to the directory %s, which contains it", relPath, displayRelPath(outer))
+		}
+		t.walking[real] = relPath
+		defer delete(t.walking, real)
+	}
+	// ReadDir sorts the entries by name, as the Directory proto requires.
+	entries, err := ioutil.ReadDir(absPath)
+	if err != nil {
+		return nil, err
+	}
+	dir := &repb.Directory{}
+	for _, fi := range entries {
+		name := fi.Name()
+		rel := path.Join(relPath, name)
+		if opts.excluded(rel) {
+			continue
+		}
+		abs := filepath.Join(absPath, name)
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if !opts.FollowSymlinks {
+				target, err := os.Readlink(abs)
+				if err != nil {
+					return nil, err
+				}
+				dir.Symlinks = append(dir.Symlinks, &repb.SymlinkNode{Name: name, Target: target})
+				continue
+			}
+			if fi, err = os.Stat(abs); err != nil {
+				if cerr := symlinkCycle(abs); cerr != nil {
+					return nil, cerr
+				}
+				return nil, err
+			}
+		}
+		switch {
+		case fi.IsDir():
+			dg, err := t.addDir(abs, rel, opts)
+			if err != nil {
+				return nil, err
+			}
+			dir.Directories = append(dir.Directories, &repb.DirectoryNode{Name: name, Digest: dg})
+		case fi.Mode().IsRegular():
+			dg, hashed, err := opts.fileDigest(abs, fi)
+			if err != nil {
+				return nil, err
+			}
+			t.files[digest.ToKey(dg)] = &localFile{path: abs, size: hashed.Size(), modTime: hashed.ModTime()}
+			dir.Files = append(dir.Files, &repb.FileNode{Name: name, Digest: dg, IsExecutable: fi.Mode()&0100 != 0})
+		default:
+			return nil, fmt.Errorf("%s has unsupported file type %v", abs, fi.Mode()&os.ModeType)
+		}
+	}
+
+	encDir, err := proto.Marshal(dir)
+	if err != nil {
+		return nil, err
+	}
+	dg := opts.DigestFunction.FromBlob(encDir)
+	t.dirs[digest.ToKey(dg)] = encDir
+	return dg, nil
+}
+
+// maxSymlinkChain bounds the number of symlinks followed by symlinkCycle.
+const maxSymlinkChain = 40
+
+// symlinkCycle follows the chain of symlinks starting at the symlink p, and returns an error naming
+// the symlinks in it if they form a cycle or there are more than maxSymlinkChain of them. It returns
+// nil if the chain ends, in which case os.Stat gives a better description of any failure.
+func symlinkCycle(p string) error {
+	chain := []string{p}
+	seen := map[string]bool{p: true}
+	for len(chain) <= maxSymlinkChain {
+		target, err := os.Readlink(p)
+		if err != nil {
+			return nil
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(p), target)
+		}
+		p = filepath.Clean(target)
+		if fi, err := os.Lstat(p); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		chain = append(chain, p)
+		if seen[p] {
+			return fmt.Errorf("symlinks form a cycle: %s", strings.Join(chain, " -> "))
+		}
+		seen[p] = true
+	}
+	return fmt.Errorf("more than %d symlinks in a chain starting at %s", maxSymlinkChain, chain[0])
+}
+
+// displayRelPath returns a path relative to the tree root for use in messages.
+func displayRelPath(relPath string) string {
+	if relPath == "" {
+		return "."
+	}
+	return relPath
+}
+
+// DirTreeDigest computes the digest of the Merkle tree of a local directory, without any network
+// calls. It identifies the contents of the directory, and can be used as a cache key that is stable
+// across machines.
+func DirTreeDigest(root string, opts TreeOpts) (*repb.Digest, error) {
+	t, err := buildLocalTree(root, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return t.root, nil
+}
+
+// UploadTree uploads the Merkle tree of a local directory to the CAS, as the input root of an
+// action, and returns the digest of its root Directory, which is the one DirTreeDigest computes with
+// the client's digest function, and the statistics of the upload. The tree holds the files,
+// subdirectories and symlinks of the directory according to opts, e.g. with its Excludes leaving out
+// version control directories. The Directory messages and the files are uploaded like
+// WriteBlobsFunc does, so only the blobs missing from the CAS are sent, and files are read as they
+// are uploaded rather than all held in memory; files too large for a batch are streamed with
+// ByteStream writes. A file whose size or modification
+// time changed since the tree was built fails the upload, as its contents no longer match the tree.
+func (c *Client) UploadTree(ctx context.Context, root string, opts TreeOpts) (*repb.Digest, *Stats, error) {
+	opts.DigestFunction = c.digestFn
+	t, err := buildLocalTree(root, &opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	dgs := make([]*repb.Digest, 0, len(t.dirs)+len(t.files))
+	for k := range t.dirs {
+		dgs = append(dgs, digest.FromKey(k))
+	}
+	for k := range t.files {
+		dgs = append(dgs, digest.FromKey(k))
+	}
+	stats, err := c.writeBlobsFunc(ctx, "UploadTree", dgs, blobSource{
+		fetch: func(k digest.Key) ([]byte, error) {
+			if blob, ok := t.dirs[k]; ok {
+				return blob, nil
+			}
+			f, err := t.files[k].open()
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			return ioutil.ReadAll(f)
+		},
+		open: func(k digest.Key) (io.ReadCloser, error) {
+			if _, ok := t.dirs[k]; ok {
+				return nil, nil
+			}
+			return t.files[k].open()
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return t.root, stats, nil
+}
+
 // Output represents a leaf output node in a nested directory structure (either a file or a
 // symlink).
 type Output struct {
@@ -115,20 +430,244 @@ type Output struct {
 // directories. Empty directories will be skipped, and directories containing only other directories
 // will be omitted as well.
 func FlattenTree(tree *repb.Tree, rootPath string) (map[string]*Output, error) {
-	root, err := digest.FromProto(tree.Root)
+	return flattenTreeMessage(digest.SHA256, tree, rootPath)
+}
+
+// flattenTreeMessage is FlattenTree, with the digests of the directories computed with fn.
+func flattenTreeMessage(fn *digest.Function, tree *repb.Tree, rootPath string) (map[string]*Output, error) {
+	root, err := fn.FromProto(tree.Root)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := treeDirs(fn, tree)
 	if err != nil {
 		return nil, err
 	}
-	dirs := make(map[digest.Key]*repb.Directory)
 	dirs[digest.ToKey(root)] = tree.Root
+	return flattenTree(root, rootPath, dirs)
+}
+
+// DirectoryDigests returns the digests of all the Directory messages in a Tree, root first and then
+// the children in order, for checking their presence in the CAS with MissingBlobs. Each distinct
+// directory is listed only once.
+func DirectoryDigests(tree *repb.Tree) ([]*repb.Digest, error) {
+	var dgs []*repb.Digest
+	seen := make(map[digest.Key]bool)
+	for _, dir := range append([]*repb.Directory{tree.Root}, tree.Children...) {
+		dg, err := digest.FromProto(dir)
+		if err != nil {
+			return nil, err
+		}
+		if seen[digest.ToKey(dg)] {
+			continue
+		}
+		seen[digest.ToKey(dg)] = true
+		dgs = append(dgs, dg)
+	}
+	return dgs, nil
+}
+
+// treeDirectories returns the paths of all the directories of a Tree, starting with its root at
+// rootPath, including empty directories. The digests of the directories are computed with fn.
+func treeDirectories(fn *digest.Function, tree *repb.Tree, rootPath string) ([]string, error) {
+	dirs, err := treeDirs(fn, tree)
+	if err != nil {
+		return nil, err
+	}
+	type queueElem struct {
+		dir  *repb.Directory
+		path string
+	}
+	paths := []string{rootPath}
+	queue := []queueElem{{dir: tree.Root, path: rootPath}}
+	for len(queue) > 0 {
+		elem := queue[0]
+		queue = queue[1:]
+		for _, sub := range elem.dir.Directories {
+			path := filepath.Join(elem.path, sub.Name)
+			dir, ok := dirs[digest.ToKey(sub.Digest)]
+			if !ok {
+				return nil, fmt.Errorf("couldn't find directory %s with digest %v", path, sub.Digest)
+			}
+			paths = append(paths, path)
+			queue = append(queue, queueElem{dir: dir, path: path})
+		}
+	}
+	return paths, nil
+}
+
+// MergeTrees merges two Tree messages into one, e.g. the inputs of an action and an overlay of the
+// files that changed since. The entries of overlay replace those of base at the same path, and
+// directories present in both trees are merged recursively, with their digests recomputed. A path
+// that is a directory in one tree and a file or symlink in the other is an error. It returns the
+// merged tree and the digest of its root Directory.
+func MergeTrees(base, overlay *repb.Tree) (*repb.Tree, *repb.Digest, error) {
+	if base == nil || overlay == nil {
+		return nil, nil, errors.New("nil Tree while merging trees")
+	}
+	if base.Root == nil || overlay.Root == nil {
+		return nil, nil, errors.New("nil root Directory of a Tree while merging trees")
+	}
+	m := &treeMerger{children: make(map[digest.Key]*repb.Directory)}
+	var err error
+	if m.base, err = treeDirs(digest.SHA256, base); err != nil {
+		return nil, nil, err
+	}
+	if m.overlay, err = treeDirs(digest.SHA256, overlay); err != nil {
+		return nil, nil, err
+	}
+	root, err := m.merge(base.Root, overlay.Root, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	dg, err := digest.FromProto(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	tree := &repb.Tree{Root: root}
+	for _, k := range m.order {
+		tree.Children = append(tree.Children, m.children[k])
+	}
+	return tree, dg, nil
+}
+
+// treeDirs returns the children of a Tree message, keyed by their digests computed with fn.
+func treeDirs(fn *digest.Function, tree *repb.Tree) (map[digest.Key]*repb.Directory, error) {
+	dirs := make(map[digest.Key]*repb.Directory)
 	for _, ch := range tree.Children {
-		dg, e := digest.FromProto(ch)
-		if e != nil {
-			return nil, e
+		dg, err := fn.FromProto(ch)
+		if err != nil {
+			return nil, err
 		}
 		dirs[digest.ToKey(dg)] = ch
 	}
-	return flattenTree(root, rootPath, dirs)
+	return dirs, nil
+}
+
+// treeMerger merges the directories of two trees, collecting the children of the merged tree.
+type treeMerger struct {
+	base, overlay map[digest.Key]*repb.Directory
+	children      map[digest.Key]*repb.Directory
+	// order is the order in which the children were added.
+	order []digest.Key
+}
+
+// merge returns the merge of a directory b of the base tree and a directory o of the overlay, both
+// at path p, adding the directories it refers to to the children of the merged tree.
+func (m *treeMerger) merge(b, o *repb.Directory, p string) (*repb.Directory, error) {
+	res := &repb.Directory{}
+	leaves := make(map[string]bool)
+	for _, f := range o.Files {
+		leaves[f.Name] = true
+		res.Files = append(res.Files, f)
+	}
+	for _, sm := range o.Symlinks {
+		leaves[sm.Name] = true
+		res.Symlinks = append(res.Symlinks, sm)
+	}
+	oDirs := make(map[string]*repb.DirectoryNode)
+	for _, d := range o.Directories {
+		oDirs[d.Name] = d
+	}
+
+	for _, f := range b.Files {
+		if _, ok := oDirs[f.Name]; ok {
+			return nil, fmt.Errorf("%s is a file in the base tree but a directory in the overlay", path.Join(p, f.Name))
+		}
+		if !leaves[f.Name] {
+			res.Files = append(res.Files, f)
+		}
+	}
+	for _, sm := range b.Symlinks {
+		if _, ok := oDirs[sm.Name]; ok {
+			return nil, fmt.Errorf("%s is a symlink in the base tree but a directory in the overlay", path.Join(p, sm.Name))
+		}
+		if !leaves[sm.Name] {
+			res.Symlinks = append(res.Symlinks, sm)
+		}
+	}
+	for _, d := range b.Directories {
+		dp := path.Join(p, d.Name)
+		if leaves[d.Name] {
+			return nil, fmt.Errorf("%s is a directory in the base tree but a file or symlink in the overlay", dp)
+		}
+		od, ok := oDirs[d.Name]
+		if !ok {
+			if err := m.add(m.base, d.Digest, dp); err != nil {
+				return nil, err
+			}
+			res.Directories = append(res.Directories, d)
+			continue
+		}
+		delete(oDirs, d.Name)
+		bDir, err := m.dir(m.base, d.Digest, dp)
+		if err != nil {
+			return nil, err
+		}
+		oDir, err := m.dir(m.overlay, od.Digest, dp)
+		if err != nil {
+			return nil, err
+		}
+		merged, err := m.merge(bDir, oDir, dp)
+		if err != nil {
+			return nil, err
+		}
+		dg, err := digest.FromProto(merged)
+		if err != nil {
+			return nil, err
+		}
+		m.addDir(digest.ToKey(dg), merged)
+		res.Directories = append(res.Directories, &repb.DirectoryNode{Name: d.Name, Digest: dg})
+	}
+	for _, d := range o.Directories {
+		if _, ok := oDirs[d.Name]; !ok {
+			continue // Merged with a base directory.
+		}
+		if err := m.add(m.overlay, d.Digest, path.Join(p, d.Name)); err != nil {
+			return nil, err
+		}
+		res.Directories = append(res.Directories, d)
+	}
+
+	sort.Slice(res.Files, func(i, j int) bool { return res.Files[i].Name < res.Files[j].Name })
+	sort.Slice(res.Symlinks, func(i, j int) bool { return res.Symlinks[i].Name < res.Symlinks[j].Name })
+	sort.Slice(res.Directories, func(i, j int) bool { return res.Directories[i].Name < res.Directories[j].Name })
+	return res, nil
+}
+
+// dir returns the directory with digest dg at path p of a tree with children dirs.
+func (m *treeMerger) dir(dirs map[digest.Key]*repb.Directory, dg *repb.Digest, p string) (*repb.Directory, error) {
+	dir, ok := dirs[digest.ToKey(dg)]
+	if !ok {
+		return nil, fmt.Errorf("couldn't find directory %s with digest %s", p, digest.ToString(dg))
+	}
+	return dir, nil
+}
+
+// add adds the directory with digest dg at path p of a tree with children dirs, and the directories
+// under it, to the children of the merged tree.
+func (m *treeMerger) add(dirs map[digest.Key]*repb.Directory, dg *repb.Digest, p string) error {
+	if _, ok := m.children[digest.ToKey(dg)]; ok {
+		return nil
+	}
+	dir, err := m.dir(dirs, dg, p)
+	if err != nil {
+		return err
+	}
+	m.addDir(digest.ToKey(dg), dir)
+	for _, d := range dir.Directories {
+		if err := m.add(dirs, d.Digest, path.Join(p, d.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *treeMerger) addDir(k digest.Key, dir *repb.Directory) {
+	if _, ok := m.children[k]; !ok {
+		m.children[k] = dir
+		m.order = append(m.order, k)
+	}
 }
 
 func flattenTree(root *repb.Digest, rootPath string, dirs map[digest.Key]*repb.Directory) (map[string]*Output, error) {
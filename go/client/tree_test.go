@@ -1,15 +1,27 @@
 package client_test
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/bazelbuild/remote-apis-sdks/go/client"
 	"github.com/bazelbuild/remote-apis-sdks/go/digest"
 	"github.com/golang/protobuf/proto"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/kylelemons/godebug/pretty"
+	"google.golang.org/grpc"
 
+	regrpc "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bsgrpc "google.golang.org/genproto/googleapis/bytestream"
 )
 
 func TestBuildTree(t *testing.T) {
@@ -435,3 +447,587 @@ func TestFlattenTreeRepeated(t *testing.T) {
 		}
 	}
 }
+
+func TestDirectoryDigests(t *testing.T) {
+	t.Parallel()
+	fooDigest := digest.TestNew("1001", 1)
+	dirB := &repb.Directory{Files: []*repb.FileNode{{Name: "foo", Digest: fooDigest}}}
+	bDigest := digest.TestFromProto(dirB)
+	dirA := &repb.Directory{Directories: []*repb.DirectoryNode{{Name: "b", Digest: bDigest}}}
+	aDigest := digest.TestFromProto(dirA)
+	root := &repb.Directory{
+		Directories: []*repb.DirectoryNode{
+			{Name: "a", Digest: aDigest},
+			{Name: "b", Digest: bDigest},
+		},
+	}
+	tests := []struct {
+		desc string
+		tree *repb.Tree
+		want []*repb.Digest
+	}{
+		{
+			desc: "root only",
+			tree: &repb.Tree{Root: dirB},
+			want: []*repb.Digest{bDigest},
+		},
+		{
+			desc: "nested",
+			tree: &repb.Tree{Root: root, Children: []*repb.Directory{dirA, dirB}},
+			want: []*repb.Digest{digest.TestFromProto(root), aDigest, bDigest},
+		},
+		{
+			desc: "repeated children",
+			tree: &repb.Tree{Root: root, Children: []*repb.Directory{dirA, dirB, dirB}},
+			want: []*repb.Digest{digest.TestFromProto(root), aDigest, bDigest},
+		},
+	}
+	for _, tc := range tests {
+		got, err := client.DirectoryDigests(tc.tree)
+		if err != nil {
+			t.Errorf("DirectoryDigests(%v) gave error %v", tc.desc, err)
+			continue
+		}
+		// The digests are compared as strings, as marshalling the directories fills in the cached
+		// sizes of the wanted ones.
+		var wantStrs, gotStrs []string
+		for _, dg := range tc.want {
+			wantStrs = append(wantStrs, digest.ToString(dg))
+		}
+		for _, dg := range got {
+			gotStrs = append(gotStrs, digest.ToString(dg))
+		}
+		if diff := cmp.Diff(wantStrs, gotStrs); diff != "" {
+			t.Errorf("DirectoryDigests(%v) gave result diff (-want +got):\n%s", tc.desc, diff)
+		}
+	}
+}
+
+// packageTreeMessage packages a tree of files, as PackageTree does, into a Tree message.
+func packageTreeMessage(t *testing.T, files map[string][]byte) (*repb.Tree, *repb.Digest) {
+	t.Helper()
+	root, blobs, err := client.PackageTree(client.BuildTree(files))
+	if err != nil {
+		t.Fatalf("PackageTree(%v) gave error %v", files, err)
+	}
+	tree := &repb.Tree{}
+	var decode func(dg *repb.Digest) *repb.Directory
+	decode = func(dg *repb.Digest) *repb.Directory {
+		dir := &repb.Directory{}
+		if err := proto.Unmarshal(blobs[digest.ToKey(dg)], dir); err != nil {
+			t.Fatalf("failed to decode directory %s: %v", digest.ToString(dg), err)
+		}
+		for _, d := range dir.Directories {
+			tree.Children = append(tree.Children, decode(d.Digest))
+		}
+		return dir
+	}
+	tree.Root = decode(root)
+	return tree, root
+}
+
+func TestMergeTrees(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		desc    string
+		base    map[string][]byte
+		overlay map[string][]byte
+		want    map[string][]byte
+	}{
+		{
+			desc:    "overlay replaces and adds files",
+			base:    map[string][]byte{"a/b": []byte("1"), "a/c": []byte("2"), "d": []byte("3")},
+			overlay: map[string][]byte{"a/b": []byte("x"), "a/e/f": []byte("4")},
+			want:    map[string][]byte{"a/b": []byte("x"), "a/c": []byte("2"), "a/e/f": []byte("4"), "d": []byte("3")},
+		},
+		{
+			desc:    "disjoint trees",
+			base:    map[string][]byte{"a/b/c": []byte("1")},
+			overlay: map[string][]byte{"d/e": []byte("2")},
+			want:    map[string][]byte{"a/b/c": []byte("1"), "d/e": []byte("2")},
+		},
+		{
+			desc:    "empty overlay",
+			base:    map[string][]byte{"a/b": []byte("1"), "c": []byte("2")},
+			overlay: map[string][]byte{},
+			want:    map[string][]byte{"a/b": []byte("1"), "c": []byte("2")},
+		},
+		{
+			desc:    "shared subtree",
+			base:    map[string][]byte{"a/x": []byte("1"), "b/x": []byte("1")},
+			overlay: map[string][]byte{"a/y": []byte("2")},
+			want:    map[string][]byte{"a/x": []byte("1"), "a/y": []byte("2"), "b/x": []byte("1")},
+		},
+	}
+	for _, tc := range tests {
+		base, _ := packageTreeMessage(t, tc.base)
+		overlay, _ := packageTreeMessage(t, tc.overlay)
+		want, wantDg := packageTreeMessage(t, tc.want)
+		got, gotDg, err := client.MergeTrees(base, overlay)
+		if err != nil {
+			t.Errorf("MergeTrees(%v) gave error %v", tc.desc, err)
+			continue
+		}
+		if !proto.Equal(wantDg, gotDg) {
+			t.Errorf("MergeTrees(%v) gave root digest %v, want %v", tc.desc, gotDg, wantDg)
+		}
+		wantDirs, err := client.DirectoryDigests(want)
+		if err != nil {
+			t.Fatalf("DirectoryDigests(%v) gave error %v", tc.desc, err)
+		}
+		gotDirs, err := client.DirectoryDigests(got)
+		if err != nil {
+			t.Fatalf("DirectoryDigests(%v) gave error %v", tc.desc, err)
+		}
+		sortDigests := cmpopts.SortSlices(func(a, b *repb.Digest) bool { return a.Hash < b.Hash })
+		if diff := cmp.Diff(wantDirs, gotDirs, sortDigests); diff != "" {
+			t.Errorf("MergeTrees(%v) gave directories diff (-want +got):\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestMergeTreesConflict(t *testing.T) {
+	t.Parallel()
+	dirA, _ := packageTreeMessage(t, map[string][]byte{"a/b": []byte("1")})
+	fileA, _ := packageTreeMessage(t, map[string][]byte{"a": []byte("2")})
+	for _, tc := range []struct {
+		desc          string
+		base, overlay *repb.Tree
+	}{
+		{desc: "directory replaced by file", base: dirA, overlay: fileA},
+		{desc: "file replaced by directory", base: fileA, overlay: dirA},
+	} {
+		if _, _, err := client.MergeTrees(tc.base, tc.overlay); err == nil {
+			t.Errorf("MergeTrees(%v) gave nil error, want an error for the conflict at a", tc.desc)
+		}
+	}
+}
+
+func TestMergeTreesInvalid(t *testing.T) {
+	t.Parallel()
+	tree, _ := packageTreeMessage(t, map[string][]byte{"a": []byte("1")})
+	for _, tc := range []struct {
+		desc          string
+		base, overlay *repb.Tree
+	}{
+		{desc: "nil base", overlay: tree},
+		{desc: "nil overlay", base: tree},
+		{desc: "base without root", base: &repb.Tree{}, overlay: tree},
+		{desc: "overlay without root", base: tree, overlay: &repb.Tree{}},
+		{desc: "trees without roots", base: &repb.Tree{}, overlay: &repb.Tree{}},
+	} {
+		if _, _, err := client.MergeTrees(tc.base, tc.overlay); err == nil {
+			t.Errorf("MergeTrees(%v) gave nil error, want an error", tc.desc)
+		}
+	}
+}
+
+func TestDirTreeDigest(t *testing.T) {
+	t.Parallel()
+	root, err := ioutil.TempDir("", "dir_tree_digest")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	// Directory structure:
+	// <root>
+	//  +-foo        (rw)
+	//  +-large      (rw, too large for a batch)
+	//  +-link -> foo
+	//  +-bin
+	//    +-run      (rwx)
+	//  +-skip
+	//    +-bar      (rw)
+	foo, run, bar := []byte("foo"), []byte("run"), []byte("bar")
+	files := []struct {
+		path string
+		blob []byte
+		mode os.FileMode
+	}{
+		{"foo", foo, 0644},
+		{"bin/run", run, 0755},
+		{"skip/bar", bar, 0644},
+	}
+	for _, f := range files {
+		p := filepath.Join(root, f.path)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("failed to make dir: %v", err)
+		}
+		if err := ioutil.WriteFile(p, f.blob, f.mode); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	if err := os.Symlink("foo", filepath.Join(root, "link")); err != nil {
+		t.Fatalf("failed to make symlink: %v", err)
+	}
+
+	fooNode := &repb.FileNode{Name: "foo", Digest: digest.FromBlob(foo)}
+	binDir := &repb.Directory{Files: []*repb.FileNode{{Name: "run", Digest: digest.FromBlob(run), IsExecutable: true}}}
+	binNode := &repb.DirectoryNode{Name: "bin", Digest: digest.TestFromProto(binDir)}
+	skipDir := &repb.Directory{Files: []*repb.FileNode{{Name: "bar", Digest: digest.FromBlob(bar)}}}
+	skipNode := &repb.DirectoryNode{Name: "skip", Digest: digest.TestFromProto(skipDir)}
+	tests := []struct {
+		desc string
+		opts client.TreeOpts
+		want *repb.Directory
+	}{
+		{
+			desc: "default",
+			want: &repb.Directory{
+				Files:       []*repb.FileNode{fooNode},
+				Directories: []*repb.DirectoryNode{binNode, skipNode},
+				Symlinks:    []*repb.SymlinkNode{{Name: "link", Target: "foo"}},
+			},
+		},
+		{
+			desc: "follow symlinks",
+			opts: client.TreeOpts{FollowSymlinks: true},
+			want: &repb.Directory{
+				Files:       []*repb.FileNode{fooNode, {Name: "link", Digest: digest.FromBlob(foo)}},
+				Directories: []*repb.DirectoryNode{binNode, skipNode},
+			},
+		},
+		{
+			desc: "excludes",
+			opts: client.TreeOpts{Excludes: []*regexp.Regexp{regexp.MustCompile("^skip$"), regexp.MustCompile("^link$")}},
+			want: &repb.Directory{
+				Files:       []*repb.FileNode{fooNode},
+				Directories: []*repb.DirectoryNode{binNode},
+			},
+		},
+		{
+			desc: "digest cache",
+			opts: client.TreeOpts{DigestCache: digest.NewFileCache()},
+			want: &repb.Directory{
+				Files:       []*repb.FileNode{fooNode},
+				Directories: []*repb.DirectoryNode{binNode, skipNode},
+				Symlinks:    []*repb.SymlinkNode{{Name: "link", Target: "foo"}},
+			},
+		},
+	}
+	for _, tc := range tests {
+		got, err := client.DirTreeDigest(root, tc.opts)
+		if err != nil {
+			t.Errorf("DirTreeDigest(root, %v) gave error %v", tc.desc, err)
+			continue
+		}
+		if want := digest.TestFromProto(tc.want); !digest.Equal(got, want) {
+			t.Errorf("DirTreeDigest(root, %v) = %v, want %v", tc.desc, got, want)
+		}
+	}
+
+	// With another digest function, every digest in the tree is computed with it.
+	sha1Bin := &repb.Directory{Files: []*repb.FileNode{{Name: "run", Digest: digest.SHA1.FromBlob(run), IsExecutable: true}}}
+	sha1Root := &repb.Directory{
+		Files:       []*repb.FileNode{{Name: "foo", Digest: digest.SHA1.FromBlob(foo)}},
+		Directories: []*repb.DirectoryNode{{Name: "bin", Digest: mustFromProto(t, digest.SHA1, sha1Bin)}},
+		Symlinks:    []*repb.SymlinkNode{{Name: "link", Target: "foo"}},
+	}
+	opts := client.TreeOpts{Excludes: []*regexp.Regexp{regexp.MustCompile("^skip$")}, DigestFunction: digest.SHA1}
+	got, err := client.DirTreeDigest(root, opts)
+	if err != nil {
+		t.Fatalf("DirTreeDigest(root, SHA1) gave error %v", err)
+	}
+	if want := mustFromProto(t, digest.SHA1, sha1Root); !digest.Equal(got, want) {
+		t.Errorf("DirTreeDigest(root, SHA1) = %v, want %v", got, want)
+	}
+}
+
+// mustFromProto returns the digest of a message computed with fn.
+func mustFromProto(t *testing.T, fn *digest.Function, msg proto.Message) *repb.Digest {
+	t.Helper()
+	dg, err := fn.FromProto(msg)
+	if err != nil {
+		t.Fatalf("failed to compute the digest of %v: %v", msg, err)
+	}
+	return dg
+}
+
+func TestUploadTree(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	server := grpc.NewServer()
+	fake := &fakeCAS{blobs: make(map[digest.Key][]byte)}
+	regrpc.RegisterContentAddressableStorageServer(server, fake)
+	bsgrpc.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	c, err := client.Dial(ctx, instance, client.DialParams{
+		Service:    listener.Addr().String(),
+		NoSecurity: true,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer c.Close()
+
+	root, err := ioutil.TempDir("", "upload_tree")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	// Directory structure:
+	// <root>
+	//  +-foo        (rw)
+	//  +-large      (rw, too large for a batch)
+	//  +-link -> foo
+	//  +-bin
+	//    +-run      (rwx)
+	//    +-foo      (rw)
+	//  +-.git
+	//    +-config   (rw)
+	foo, run, config := []byte("foo"), []byte("run"), []byte("config")
+	large := bytes.Repeat([]byte("l"), client.MaxBatchSz+1)
+	files := []struct {
+		path string
+		blob []byte
+		mode os.FileMode
+	}{
+		{"foo", foo, 0644},
+		{"large", large, 0644},
+		{"bin/run", run, 0755},
+		{"bin/foo", foo, 0644},
+		{".git/config", config, 0644},
+	}
+	for _, f := range files {
+		p := filepath.Join(root, f.path)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("failed to make dir: %v", err)
+		}
+		if err := ioutil.WriteFile(p, f.blob, f.mode); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	if err := os.Symlink("foo", filepath.Join(root, "link")); err != nil {
+		t.Fatalf("failed to make symlink: %v", err)
+	}
+
+	binDir := &repb.Directory{Files: []*repb.FileNode{
+		{Name: "foo", Digest: digest.FromBlob(foo)},
+		{Name: "run", Digest: digest.FromBlob(run), IsExecutable: true},
+	}}
+	rootDir := &repb.Directory{
+		Files: []*repb.FileNode{
+			{Name: "foo", Digest: digest.FromBlob(foo)},
+			{Name: "large", Digest: digest.FromBlob(large)},
+		},
+		Directories: []*repb.DirectoryNode{{Name: "bin", Digest: digest.TestFromProto(binDir)}},
+		Symlinks:    []*repb.SymlinkNode{{Name: "link", Target: "foo"}},
+	}
+	opts := client.TreeOpts{Excludes: []*regexp.Regexp{regexp.MustCompile(`^\.git$`)}}
+	got, stats, err := c.UploadTree(ctx, root, opts)
+	if err != nil {
+		t.Fatalf("c.UploadTree(ctx, root, opts) gave error %v, want nil", err)
+	}
+	if want := digest.TestFromProto(rootDir); !digest.Equal(got, want) {
+		t.Errorf("c.UploadTree(ctx, root, opts) = %v, want %v", got, want)
+	}
+	for _, dir := range []*repb.Directory{rootDir, binDir} {
+		blob, err := proto.Marshal(dir)
+		if err != nil {
+			t.Fatalf("failed marshalling Directory: %v", err)
+		}
+		if _, ok := fake.blobs[digest.ToKey(digest.FromBlob(blob))]; !ok {
+			t.Errorf("Directory %v was not uploaded", dir)
+		}
+	}
+	for _, blob := range [][]byte{foo, run, large} {
+		if got := fake.blobs[digest.ToKey(digest.FromBlob(blob))]; !bytes.Equal(got, blob) {
+			t.Errorf("file with digest %v was not uploaded", digest.FromBlob(blob))
+		}
+	}
+	if fake.writeReqs != 1 {
+		t.Errorf("c.UploadTree(ctx, root, opts) made %d ByteStream writes, want 1 for the large file", fake.writeReqs)
+	}
+	if _, ok := fake.blobs[digest.ToKey(digest.FromBlob(config))]; ok {
+		t.Errorf("excluded file .git/config was uploaded")
+	}
+	if stats.Blobs != 5 {
+		t.Errorf("c.UploadTree(ctx, root, opts) uploaded %d blobs, want 5", stats.Blobs)
+	}
+
+	// Blobs already in the CAS are not uploaded again.
+	if _, stats, err = c.UploadTree(ctx, root, opts); err != nil {
+		t.Fatalf("c.UploadTree(ctx, root, opts) gave error %v, want nil", err)
+	}
+	if stats.Blobs != 0 || stats.CacheHits != 5 {
+		t.Errorf("c.UploadTree(ctx, root, opts) of an uploaded tree uploaded %d blobs with %d cache hits, want 0 and 5", stats.Blobs, stats.CacheHits)
+	}
+}
+
+func TestUploadTreeChangedFile(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		desc string
+		size int
+	}{
+		{desc: "batched", size: 10},
+		{desc: "streamed", size: client.MaxBatchSz + 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "upload_tree")
+			if err != nil {
+				t.Fatalf("failed to make temp dir: %v", err)
+			}
+			defer os.RemoveAll(root)
+			path := filepath.Join(root, "file")
+			if err := ioutil.WriteFile(path, bytes.Repeat([]byte("a"), tc.size), 0644); err != nil {
+				t.Fatalf("failed to write file: %v", err)
+			}
+			listener, err := net.Listen("tcp", ":0")
+			if err != nil {
+				t.Fatalf("Cannot listen: %v", err)
+			}
+			defer listener.Close()
+			server := grpc.NewServer()
+			// The file changes after the tree is built, when the client checks which blobs are missing.
+			fake := &changingCAS{fakeCAS: &fakeCAS{blobs: make(map[digest.Key][]byte)}, change: func() {
+				ioutil.WriteFile(path, bytes.Repeat([]byte("b"), tc.size+1), 0644)
+			}}
+			regrpc.RegisterContentAddressableStorageServer(server, fake)
+			bsgrpc.RegisterByteStreamServer(server, fake)
+			go server.Serve(listener)
+			defer server.Stop()
+			c, err := client.Dial(ctx, instance, client.DialParams{
+				Service:    listener.Addr().String(),
+				NoSecurity: true,
+			})
+			if err != nil {
+				t.Fatalf("Error connecting to server: %v", err)
+			}
+			defer c.Close()
+
+			_, _, err = c.UploadTree(ctx, root, client.TreeOpts{})
+			if err == nil || !strings.Contains(err.Error(), "changed since the tree was built") {
+				t.Errorf("c.UploadTree(ctx, root, opts) of a changed file gave error %v, want a changed file error", err)
+			}
+			if fake.writeReqs != 0 {
+				t.Errorf("c.UploadTree(ctx, root, opts) of a changed file made %d ByteStream writes, want 0", fake.writeReqs)
+			}
+		})
+	}
+}
+
+func TestDirTreeDigestSymlinkCycles(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		desc     string
+		dirs     []string
+		symlinks map[string]string
+		wantErr  []string
+	}{
+		{
+			desc:     "two-link cycle",
+			symlinks: map[string]string{"a": "b", "b": "a"},
+			wantErr:  []string{"/a -> ", "/b -> "},
+		},
+		{
+			desc:     "link to parent",
+			dirs:     []string{"sub"},
+			symlinks: map[string]string{"sub/up": ".."},
+			wantErr:  []string{"sub/up"},
+		},
+		{
+			desc:     "links between sibling dirs",
+			dirs:     []string{"x", "y"},
+			symlinks: map[string]string{"x/toy": "../y", "y/tox": "../x"},
+			wantErr:  []string{"x/toy/tox"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "dir_tree_digest_cycle")
+			if err != nil {
+				t.Fatalf("failed to make temp dir: %v", err)
+			}
+			defer os.RemoveAll(root)
+			for _, d := range tc.dirs {
+				if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+					t.Fatalf("failed to make dir: %v", err)
+				}
+			}
+			for link, target := range tc.symlinks {
+				if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+					t.Fatalf("failed to make symlink: %v", err)
+				}
+			}
+
+			if _, err := client.DirTreeDigest(root, client.TreeOpts{}); err != nil {
+				t.Errorf("DirTreeDigest(root, {}) gave error %v, want nil", err)
+			}
+			_, err = client.DirTreeDigest(root, client.TreeOpts{FollowSymlinks: true})
+			if err == nil {
+				t.Fatalf("DirTreeDigest(root, {FollowSymlinks: true}) gave no error, want error")
+			}
+			if !strings.Contains(err.Error(), "cycle") {
+				t.Errorf("DirTreeDigest(root, {FollowSymlinks: true}) gave error %v, want a cycle error", err)
+			}
+			for _, p := range tc.wantErr {
+				if !strings.Contains(err.Error(), p) {
+					t.Errorf("DirTreeDigest(root, {FollowSymlinks: true}) gave error %v, want it to name %s", err, p)
+				}
+			}
+		})
+	}
+}
+
+func TestDirTreeDigestChangingFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "dir_tree_digest_change")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	p := filepath.Join(root, "growing")
+	if err := ioutil.WriteFile(p, []byte("contents"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	// appendByte makes the file grow, as if it was written to while it was being hashed.
+	appendByte := func() {
+		f, err := os.OpenFile(p, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatalf("failed to open file: %v", err)
+		}
+		defer f.Close()
+		if _, err := f.Write([]byte{1}); err != nil {
+			t.Fatalf("failed to append to file: %v", err)
+		}
+	}
+
+	tests := []struct {
+		desc    string
+		policy  client.ChangePolicy
+		changes int // The number of hashes of the file during which it changes.
+		wantErr bool
+		// wantHashes is the number of times the file is hashed while checking for changes.
+		wantHashes int
+	}{
+		{desc: "ignored change", policy: client.ChangeIgnore, changes: 1, wantErr: false, wantHashes: 0},
+		{desc: "unchanged", policy: client.ChangeError, changes: 0, wantErr: false, wantHashes: 1},
+		{desc: "change error", policy: client.ChangeError, changes: 1, wantErr: true, wantHashes: 1},
+		{desc: "retried change", policy: client.ChangeRetry, changes: 1, wantErr: false, wantHashes: 2},
+		{desc: "retried until failure", policy: client.ChangeRetry, changes: 100, wantErr: true, wantHashes: 4},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			hashes := 0
+			defer client.SetAfterHashHook(func(string) {
+				hashes++
+				if hashes <= tc.changes {
+					appendByte()
+				}
+			})()
+			_, err := client.DirTreeDigest(root, client.TreeOpts{OnChange: tc.policy})
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("DirTreeDigest(root, {OnChange: %v}) gave error %v, want error: %t", tc.policy, err, tc.wantErr)
+			}
+			if hashes != tc.wantHashes {
+				t.Errorf("DirTreeDigest(root, {OnChange: %v}) hashed the file %d times while checking for changes, want %d", tc.policy, hashes, tc.wantHashes)
+			}
+		})
+	}
+}
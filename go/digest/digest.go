@@ -2,12 +2,17 @@
 package digest
 
 import (
+	"crypto/md5"
+	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
+	"io"
+	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -20,70 +25,194 @@ var (
 	// hexStringRegex doesn't contain the size because that's checked separately.
 	hexStringRegex = regexp.MustCompile("^[a-f0-9]+$")
 
-	// Empty is the SHA256 digest of the empty blob.
-	Empty = FromBlob([]byte{})
+	// SHA256 is the SHA256 digest function. It is the default, and the one that the functions of
+	// this package use.
+	SHA256 = newFunction(repb.DigestFunction_SHA256, sha256.New)
+	// SHA1 is the SHA1 digest function.
+	SHA1 = newFunction(repb.DigestFunction_SHA1, sha1.New)
+	// MD5 is the MD5 digest function.
+	MD5 = newFunction(repb.DigestFunction_MD5, md5.New)
+
+	// Empty is the SHA256 digest of the empty blob. Use Function.Empty for the digest of the empty
+	// blob computed with another digest function.
+	Empty = SHA256.Empty()
 )
 
-// IsEmpty returns true iff digest is of an empty blob.
-func IsEmpty(dg *repb.Digest) bool {
+// Function is a digest function that hashes can be computed with, such as SHA256 for most servers
+// or SHA1 for a CAS that uses it. Its methods compute and validate digests like the functions of
+// this package, with the function instead of SHA256. Since the hashes of the supported functions
+// have distinct lengths, the function is not included in ByteStream resource names.
+//
+// A nil *Function is SHA256.
+type Function struct {
+	value     repb.DigestFunction
+	new       func() hash.Hash
+	size      int
+	emptyHash string
+}
+
+func newFunction(value repb.DigestFunction, new func() hash.Hash) *Function {
+	h := new()
+	return &Function{value: value, new: new, size: h.Size(), emptyHash: hex.EncodeToString(h.Sum(nil))}
+}
+
+// functions are the supported digest functions.
+var functions = map[repb.DigestFunction]*Function{
+	repb.DigestFunction_SHA256: SHA256,
+	repb.DigestFunction_SHA1:   SHA1,
+	repb.DigestFunction_MD5:    MD5,
+}
+
+// FunctionFor returns the Function for a digest function of the API, or an error if it is not
+// supported.
+func FunctionFor(f repb.DigestFunction) (*Function, error) {
+	fn, ok := functions[f]
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest function %v", f)
+	}
+	return fn, nil
+}
+
+// get returns f, or SHA256 if f is nil.
+func (f *Function) get() *Function {
+	if f == nil {
+		return SHA256
+	}
+	return f
+}
+
+// Value returns the digest function of the API that f is.
+func (f *Function) Value() repb.DigestFunction {
+	return f.get().value
+}
+
+// String returns the name of the digest function.
+func (f *Function) String() string {
+	return f.Value().String()
+}
+
+// NewHash returns a hash.Hash computing hashes with f.
+func (f *Function) NewHash() hash.Hash {
+	return f.get().new()
+}
+
+// Empty returns the digest of the empty blob, computed with f.
+func (f *Function) Empty() *repb.Digest {
+	return &repb.Digest{Hash: f.get().emptyHash, SizeBytes: 0}
+}
+
+// IsEmpty returns true iff digest is of an empty blob, computed with f.
+func (f *Function) IsEmpty(dg *repb.Digest) bool {
 	if dg == nil {
 		return false
 	}
-	return dg.SizeBytes == 0 && dg.Hash == Empty.Hash
+	return dg.SizeBytes == 0 && dg.Hash == f.get().emptyHash
 }
 
-func validateHashLength(hash string) (bool, error) {
+// IsEmpty returns true iff digest is of an empty blob.
+func IsEmpty(dg *repb.Digest) bool {
+	return SHA256.IsEmpty(dg)
+}
+
+// hashFunctions names the digest functions whose hex hashes have a given length, to describe hashes
+// that were likely computed with another function than the expected one.
+var hashFunctions = map[int]string{
+	32:  "MD5",
+	40:  "SHA1",
+	64:  "SHA256",
+	96:  "SHA384",
+	128: "SHA512",
+}
+
+func (f *Function) validateHashLength(hash string) (bool, error) {
+	f = f.get()
 	length := len(hash)
-	if length == sha256.Size*2 {
+	if length == f.size*2 {
 		return true, nil
 	}
-	return false, fmt.Errorf("valid hash length is %d, got length %d (%s)", sha256.Size*2, length, hash)
+	if other, ok := hashFunctions[length]; ok {
+		return false, fmt.Errorf("hash %s has length %d, as computed by %s, but %v hashes have length %d", hash, length, other, f.value, f.size*2)
+	}
+	return false, fmt.Errorf("valid hash length is %d, got length %d (%s)", f.size*2, length, hash)
 }
 
-// Validate returns nil if a digest appears to be valid, or a descriptive error
-// if it is not. All functions accepting digests directly from clients should
-// call this function, whether it's via an RPC call or by reading a serialized
-// proto message that contains digests that was uploaded directly from the
-// client.
-func Validate(digest *repb.Digest) error {
+// ValidateHash returns nil if a hash appears to be a valid hash of f, or a descriptive error if it
+// is not, naming the digest function that the hash was likely computed by if its length is that of
+// another function's hashes.
+func (f *Function) ValidateHash(hash string) error {
+	if ok, err := f.validateHashLength(hash); !ok {
+		return err
+	}
+	if !hexStringRegex.MatchString(hash) {
+		return fmt.Errorf("hash is not a lowercase hex string (%s)", hash)
+	}
+	return nil
+}
+
+// ValidateHash returns nil if a hash appears to be a valid SHA256 hash, or a descriptive error if
+// it is not, see Function.ValidateHash.
+func ValidateHash(hash string) error {
+	return SHA256.ValidateHash(hash)
+}
+
+// Validate returns nil if a digest appears to be a valid digest of f, or a descriptive error if it
+// is not, see the Validate function.
+func (f *Function) Validate(digest *repb.Digest) error {
 	if digest == nil {
 		return errors.New("nil digest")
 	}
-	if ok, err := validateHashLength(digest.Hash); !ok {
+	if err := f.ValidateHash(digest.Hash); err != nil {
 		return err
 	}
-	if !hexStringRegex.MatchString(digest.Hash) {
-		return fmt.Errorf("hash is not a lowercase hex string (%s)", digest.Hash)
-	}
 	if digest.SizeBytes < 0 {
 		return fmt.Errorf("expected non-negative size, got %d", digest.SizeBytes)
 	}
 	return nil
 }
 
-// New creates a new digest from a string and size. It does some basic
-// validation, which makes it marginally superior to constructing a Digest
-// yourself. It returns an error if there are any problems.
-func New(hash string, size int64) (*repb.Digest, error) {
+// Validate returns nil if a digest appears to be valid, or a descriptive error
+// if it is not. All functions accepting digests directly from clients should
+// call this function, whether it's via an RPC call or by reading a serialized
+// proto message that contains digests that was uploaded directly from the
+// client.
+func Validate(digest *repb.Digest) error {
+	return SHA256.Validate(digest)
+}
+
+// New creates a new digest of f from a string and size, like the New function.
+func (f *Function) New(hash string, size int64) (*repb.Digest, error) {
 	digest := &repb.Digest{Hash: hash, SizeBytes: size}
-	if err := Validate(digest); err != nil {
+	if err := f.Validate(digest); err != nil {
 		return nil, err
 	}
 	return digest, nil
 }
 
+// New creates a new digest from a string and size. It does some basic
+// validation, which makes it marginally superior to constructing a Digest
+// yourself. It returns an error if there are any problems.
+func New(hash string, size int64) (*repb.Digest, error) {
+	return SHA256.New(hash, size)
+}
+
+// NewFromHash is a variant of New that accepts a hash.Hash object, computed with f, instead of a
+// string.
+func (f *Function) NewFromHash(h hash.Hash, size int64) (*repb.Digest, error) {
+	format := fmt.Sprintf("%%0%dx", h.Size()*2)
+	return f.New(fmt.Sprintf(format, h.Sum(nil)), size)
+}
+
 // NewFromHash is a variant of New that accepts a hash.Hash object instead of a
 // string.
 func NewFromHash(h hash.Hash, size int64) (*repb.Digest, error) {
-	format := fmt.Sprintf("%%0%dx", h.Size()*2)
-	return New(fmt.Sprintf(format, h.Sum(nil)), size)
+	return SHA256.NewFromHash(h, size)
 }
 
 // TestNew is like New but also pads your hash with zeros if it is shorter than the required length,
 // and panics on error rather than returning the error.
 // ONLY USE FOR TESTS.
 func TestNew(hash string, size int64) *repb.Digest {
-	return mustNew(padHashSHA256(hash), size)
+	return mustNew(padHash(hash), size)
 }
 
 // TestFromProto is only suitable for testing and panics on error.
@@ -96,21 +225,77 @@ func TestFromProto(msg proto.Message) *repb.Digest {
 	return FromBlob(blob)
 }
 
+// FromBlob returns the digest of a blob, computed with f.
+func (f *Function) FromBlob(blob []byte) *repb.Digest {
+	h := f.NewHash()
+	h.Write(blob)
+	return &repb.Digest{Hash: hex.EncodeToString(h.Sum(nil)), SizeBytes: int64(len(blob))}
+}
+
 // FromBlob takes a blob (in the form of a byte array) and returns the
 // Digest proto for that blob. Changing this function will lead to cache
 // invalidations (execution cache and potentially others).
 func FromBlob(blob []byte) *repb.Digest {
-	sha256Arr := sha256.Sum256(blob)
-	return mustNew(hex.EncodeToString(sha256Arr[:]), int64(len(blob)))
+	return SHA256.FromBlob(blob)
 }
 
-// FromProto calculates the digest of a protobuf in SHA-256 mode.
-func FromProto(msg proto.Message) (*repb.Digest, error) {
+// FromFile computes the digest of the contents of a file with f, reading it in a streaming fashion.
+func (f *Function) FromFile(path string) (*repb.Digest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	h := f.NewHash()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return nil, err
+	}
+	return f.NewFromHash(h, size)
+}
+
+// FromFile computes the digest of the contents of a file, reading it in a streaming fashion.
+func FromFile(path string) (*repb.Digest, error) {
+	return SHA256.FromFile(path)
+}
+
+// FromDigests calculates a single digest identifying a set of digests with f, like the FromDigests
+// function.
+func (f *Function) FromDigests(digests []*repb.Digest) *repb.Digest {
+	sorted := FilterDuplicates(digests)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Hash != sorted[j].Hash {
+			return sorted[i].Hash < sorted[j].Hash
+		}
+		return sorted[i].SizeBytes < sorted[j].SizeBytes
+	})
+	var b strings.Builder
+	for _, dg := range sorted {
+		b.WriteString(ToString(dg))
+		b.WriteByte('\n')
+	}
+	return f.FromBlob([]byte(b.String()))
+}
+
+// FromDigests calculates a single digest identifying a set of digests, regardless of their order
+// and of duplicates. It is the digest of the canonical hash/size strings of the distinct digests,
+// sorted by hash and then size, each followed by a newline.
+func FromDigests(digests []*repb.Digest) *repb.Digest {
+	return SHA256.FromDigests(digests)
+}
+
+// FromProto calculates the digest of a protobuf with f.
+func (f *Function) FromProto(msg proto.Message) (*repb.Digest, error) {
 	blob, err := proto.Marshal(msg)
 	if err != nil {
 		return nil, err
 	}
-	return FromBlob(blob), nil
+	return f.FromBlob(blob), nil
+}
+
+// FromProto calculates the digest of a protobuf in SHA-256 mode.
+func FromProto(msg proto.Message) (*repb.Digest, error) {
+	return SHA256.FromProto(msg)
 }
 
 // ToDebugString returns a verbose string suitable for displaying to users.
@@ -126,8 +311,8 @@ func ToString(digest *repb.Digest) string {
 	return fmt.Sprintf("%s/%d", digest.Hash, digest.SizeBytes)
 }
 
-// FromString returns a digest from a canonical string
-func FromString(s string) (*repb.Digest, error) {
+// FromString returns a digest of f from a canonical string, like the FromString function.
+func (f *Function) FromString(s string) (*repb.Digest, error) {
 	pair := strings.Split(s, "/")
 	if len(pair) != 2 {
 		return nil, fmt.Errorf("expected digest in the form hash/size, got %s", s)
@@ -136,7 +321,12 @@ func FromString(s string) (*repb.Digest, error) {
 	if err != nil || size < 0 {
 		return nil, fmt.Errorf("invalid size in digest %s: %s", s, err)
 	}
-	return New(pair[0], size)
+	return f.New(pair[0], size)
+}
+
+// FromString returns a digest from a canonical string
+func FromString(s string) (*repb.Digest, error) {
+	return SHA256.FromString(s)
 }
 
 // Equal compares two digests for equality
@@ -187,8 +377,8 @@ func mustNew(hash string, size int64) *repb.Digest {
 	return digest
 }
 
-func padHashSHA256(hash string) string {
-	hashLen := sha256.Size * 2
+func padHash(hash string) string {
+	hashLen := SHA256.size * 2
 	if len(hash) < hashLen {
 		return strings.Repeat("0", hashLen-len(hash)) + hash
 	}
@@ -3,6 +3,8 @@ package digest
 import (
 	"crypto/sha256"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
@@ -62,6 +64,34 @@ func TestValidateDigests_Errors(t *testing.T) {
 	}
 }
 
+func TestValidateHash(t *testing.T) {
+	t.Parallel()
+	testcases := []struct {
+		desc string
+		hash string
+		// wantErr is a substring of the wanted error, or empty if no error is wanted.
+		wantErr string
+	}{
+		{"SHA256", strings.Repeat("a", 64), ""},
+		{"SHA1", strings.Repeat("a", 40), "as computed by SHA1, but SHA256 hashes have length 64"},
+		{"MD5", strings.Repeat("a", 32), "as computed by MD5"},
+		{"other length", strings.Repeat("a", 25), "valid hash length is 64, got length 25"},
+		{"not hex", strings.Repeat("g", 64), "not a lowercase hex string"},
+	}
+	for _, tc := range testcases {
+		err := ValidateHash(tc.hash)
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: ValidateHash(%q) = %v, want nil", tc.desc, tc.hash, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: ValidateHash(%q) = %v, want error containing %q", tc.desc, tc.hash, err, tc.wantErr)
+		}
+	}
+}
+
 func Test_New(t *testing.T) {
 	t.Parallel()
 	testcases := []struct {
@@ -120,6 +150,29 @@ func TestFromBlob(t *testing.T) {
 	}
 }
 
+func TestFromFile(t *testing.T) {
+	t.Parallel()
+	f, err := ioutil.TempFile("", "digest")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	blob := []byte("some file contents")
+	if _, err := f.Write(blob); err != nil {
+		t.Fatalf("failed to write temp file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close temp file: %v", err)
+	}
+	dGot, err := FromFile(f.Name())
+	if err != nil {
+		t.Fatalf("FromFile(%q) = (_, %v), want (_, nil)", f.Name(), err)
+	}
+	if dWant := FromBlob(blob); !Equal(dGot, dWant) {
+		t.Errorf("FromFile(%q) = %v, want %v", f.Name(), dGot, dWant)
+	}
+}
+
 func Test_FromProto(t *testing.T) {
 	t.Parallel()
 
@@ -234,6 +287,26 @@ func TestFilterDuplicateDigests(t *testing.T) {
 	}
 }
 
+func TestFromDigests(t *testing.T) {
+	t.Parallel()
+	d1 := TestNew("10", 1)
+	d2 := TestNew("20", 2)
+	d3 := TestNew("20", 3)
+	want := FromBlob([]byte(ToString(d1) + "\n" + ToString(d2) + "\n" + ToString(d3) + "\n"))
+	for _, dgs := range [][]*repb.Digest{
+		{d1, d2, d3},
+		{d3, d2, d1},
+		{d2, d1, d3, d1, d2},
+	} {
+		if got := FromDigests(dgs); !Equal(got, want) {
+			t.Errorf("FromDigests(%v) = %v, want %v", dgs, got, want)
+		}
+	}
+	if got := FromDigests(nil); !Equal(got, Empty) {
+		t.Errorf("FromDigests(nil) = %v, want %v", got, Empty)
+	}
+}
+
 func TestToFromKey(t *testing.T) {
 	t.Parallel()
 	digests := []*repb.Digest{
@@ -257,3 +330,48 @@ func TestToFromKey(t *testing.T) {
 		}
 	}
 }
+
+func TestFunction(t *testing.T) {
+	t.Parallel()
+	if _, err := FunctionFor(repb.DigestFunction_UNKNOWN); err == nil {
+		t.Errorf("FunctionFor(UNKNOWN) = (_, nil), want error")
+	}
+	f, err := FunctionFor(repb.DigestFunction_SHA1)
+	if err != nil {
+		t.Fatalf("FunctionFor(SHA1) = (_, %v), want (_, nil)", err)
+	}
+	if f != SHA1 || f.Value() != repb.DigestFunction_SHA1 {
+		t.Errorf("FunctionFor(SHA1) = %v, want SHA1", f)
+	}
+	const abcSHA1 = "a9993e364706816aba3e25717850c26c9cd0d89d"
+	if got, want := f.FromBlob([]byte("abc")), (&repb.Digest{Hash: abcSHA1, SizeBytes: 3}); !Equal(got, want) {
+		t.Errorf("SHA1.FromBlob(\"abc\") = %v, want %v", got, want)
+	}
+	if got, want := f.Empty().Hash, "da39a3ee5e6b4b0d3255bfef95601890afd80709"; got != want {
+		t.Errorf("SHA1.Empty().Hash = %s, want %s", got, want)
+	}
+	if !f.IsEmpty(f.Empty()) || f.IsEmpty(Empty) {
+		t.Errorf("SHA1.IsEmpty(SHA1.Empty()) = %v, SHA1.IsEmpty(Empty) = %v, want true, false", f.IsEmpty(f.Empty()), f.IsEmpty(Empty))
+	}
+	if got := f.NewHash().Size(); got != 20 {
+		t.Errorf("SHA1.NewHash().Size() = %d, want 20", got)
+	}
+	if err := f.ValidateHash(abcSHA1); err != nil {
+		t.Errorf("SHA1.ValidateHash(%q) = %v, want nil", abcSHA1, err)
+	}
+	if err := f.ValidateHash(strings.Repeat("a", 64)); err == nil || !strings.Contains(err.Error(), "as computed by SHA256, but SHA1 hashes have length 40") {
+		t.Errorf("SHA1.ValidateHash(SHA256 hash) = %v, want error naming SHA256", err)
+	}
+	if err := ValidateHash(abcSHA1); err == nil {
+		t.Errorf("ValidateHash(%q) = nil, want error, as the package functions use SHA256", abcSHA1)
+	}
+
+	// A nil Function is SHA256.
+	var nilFn *Function
+	if got := nilFn.Value(); got != repb.DigestFunction_SHA256 {
+		t.Errorf("nil Function Value() = %v, want SHA256", got)
+	}
+	if got, want := nilFn.FromBlob([]byte("abc")), FromBlob([]byte("abc")); !Equal(got, want) {
+		t.Errorf("nil Function FromBlob(\"abc\") = %v, want %v", got, want)
+	}
+}
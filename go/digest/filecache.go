@@ -0,0 +1,129 @@
+package digest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// FileCache caches the digests of local files, so that files that haven't changed are not hashed
+// again. Entries are keyed by absolute path, and an entry is only used while the file's size and
+// modification time are the same as when it was hashed, and only for the digest function it was
+// hashed with. Files modified shortly before they are hashed are not cached, since a change in the
+// same tick of the filesystem's clock would leave their modification time unchanged, like git's
+// "racily clean" entries. Changes made by tools that preserve modification times aren't detected. A
+// FileCache can be saved and loaded to reuse digests between runs. It is safe for concurrent use.
+//
+// A nil *FileCache is valid and caches nothing. The zero FileCache is an empty cache.
+type FileCache struct {
+	mu      sync.Mutex
+	entries map[string]fileCacheEntry
+}
+
+// modTimeGranularity is the coarsest granularity of file modification times among common
+// filesystems, that of FAT. A file modified less than this long before it is hashed may be modified
+// again without its modification time changing.
+const modTimeGranularity = 2 * time.Second
+
+// fileCacheEntry is the cached digest of a file, along with the file attributes and the digest
+// function it is valid for.
+type fileCacheEntry struct {
+	ModTime  time.Time
+	Size     int64
+	Hash     string
+	Function repb.DigestFunction
+}
+
+// NewFileCache returns an empty FileCache.
+func NewFileCache() *FileCache {
+	return &FileCache{entries: make(map[string]fileCacheEntry)}
+}
+
+// LoadFileCache loads a FileCache previously written with Save. If the file does not exist, it
+// returns an empty cache.
+func LoadFileCache(path string) (*FileCache, error) {
+	c := NewFileCache()
+	blob, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(blob, &c.entries); err != nil {
+		return nil, err
+	}
+	// A file containing null unmarshals to a nil map.
+	if c.entries == nil {
+		c.entries = make(map[string]fileCacheEntry)
+	}
+	return c, nil
+}
+
+// Save writes the cache to a file, replacing it atomically, so that it can be loaded with
+// LoadFileCache by a later run.
+func (c *FileCache) Save(path string) error {
+	c.mu.Lock()
+	blob, err := json.Marshal(c.entries)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(blob); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// FromFile returns the digest of a file computed with f, like Function.FromFile. If the cache has a
+// digest for the file computed with f, and the file's size and modification time haven't changed
+// since it was computed, the cached digest is returned without reading the file.
+func (c *FileCache) FromFile(f *Function, path string) (*repb.Digest, error) {
+	if c == nil {
+		return f.FromFile(path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	e, ok := c.entries[abs]
+	c.mu.Unlock()
+	if ok && e.Size == fi.Size() && e.ModTime.Equal(fi.ModTime()) && e.Function == f.Value() {
+		return &repb.Digest{Hash: e.Hash, SizeBytes: e.Size}, nil
+	}
+	dg, err := f.FromFile(abs)
+	if err != nil {
+		return nil, err
+	}
+	// If the file changed size while it was being hashed, the digest may not match the attributes.
+	// If it was modified too recently, a later change may not update its modification time.
+	if dg.SizeBytes == fi.Size() && fi.ModTime().Add(modTimeGranularity).Before(start) {
+		c.mu.Lock()
+		if c.entries == nil {
+			c.entries = make(map[string]fileCacheEntry)
+		}
+		c.entries[abs] = fileCacheEntry{ModTime: fi.ModTime(), Size: dg.SizeBytes, Hash: dg.Hash, Function: f.Value()}
+		c.mu.Unlock()
+	}
+	return dg, nil
+}
@@ -0,0 +1,189 @@
+package digest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileCache(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "filecache")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	mtime := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	// write sets the contents and the modification time of the file.
+	write := func(contents string, mtime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("failed to set the times of %s: %v", path, err)
+		}
+	}
+	check := func(c *FileCache, want string) {
+		t.Helper()
+		dg, err := c.FromFile(SHA256, path)
+		if err != nil {
+			t.Fatalf("c.FromFile(%q) = (_, %v), want (_, nil)", path, err)
+		}
+		if dWant := FromBlob([]byte(want)); !Equal(dg, dWant) {
+			t.Errorf("c.FromFile(%q) = %v, want %v", path, dg, dWant)
+		}
+	}
+
+	c := NewFileCache()
+	write("foo", mtime)
+	check(c, "foo")
+	// With the same size and modification time, the file isn't hashed again.
+	write("bar", mtime)
+	check(c, "foo")
+	// A new modification time invalidates the entry.
+	write("bar", mtime.Add(time.Second))
+	check(c, "bar")
+	// So does a new size.
+	write("bazqux", mtime.Add(time.Second))
+	check(c, "bazqux")
+
+	cachePath := filepath.Join(dir, "cache")
+	if err := c.Save(cachePath); err != nil {
+		t.Fatalf("c.Save(%q) = %v, want nil", cachePath, err)
+	}
+	loaded, err := LoadFileCache(cachePath)
+	if err != nil {
+		t.Fatalf("LoadFileCache(%q) = (_, %v), want (_, nil)", cachePath, err)
+	}
+	// The loaded cache has the entry, so it also doesn't hash the file again.
+	write("quxbaz", mtime.Add(time.Second))
+	check(loaded, "bazqux")
+
+	empty, err := LoadFileCache(filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatalf("LoadFileCache of a missing file = (_, %v), want (_, nil)", err)
+	}
+	check(empty, "quxbaz")
+
+	var nilCache *FileCache
+	check(nilCache, "quxbaz")
+}
+
+func TestFileCacheEmpty(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "filecache")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("foo"), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	// Files modified too recently aren't cached.
+	mtime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("failed to set the times of %s: %v", path, err)
+	}
+	cachePath := filepath.Join(dir, "cache")
+	if err := ioutil.WriteFile(cachePath, []byte("null"), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", cachePath, err)
+	}
+	loaded, err := LoadFileCache(cachePath)
+	if err != nil {
+		t.Fatalf("LoadFileCache(%q) = (_, %v), want (_, nil)", cachePath, err)
+	}
+
+	want := FromBlob([]byte("foo"))
+	for name, c := range map[string]*FileCache{"zero cache": {}, "cache loaded from null": loaded} {
+		// The second call reads the entry stored by the first.
+		for i := 0; i < 2; i++ {
+			dg, err := c.FromFile(SHA256, path)
+			if err != nil {
+				t.Fatalf("%s: c.FromFile(%q) = (_, %v), want (_, nil)", name, path, err)
+			}
+			if !Equal(dg, want) {
+				t.Errorf("%s: c.FromFile(%q) = %v, want %v", name, path, dg, want)
+			}
+		}
+	}
+}
+
+func TestFileCacheFunction(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "filecache")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("foo"), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	// Files modified too recently aren't cached.
+	mtime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("failed to set the times of %s: %v", path, err)
+	}
+
+	c := NewFileCache()
+	if _, err := c.FromFile(SHA256, path); err != nil {
+		t.Fatalf("c.FromFile(%q) = (_, %v), want (_, nil)", path, err)
+	}
+	cachePath := filepath.Join(dir, "cache")
+	if err := c.Save(cachePath); err != nil {
+		t.Fatalf("c.Save(%q) = %v, want nil", cachePath, err)
+	}
+	loaded, err := LoadFileCache(cachePath)
+	if err != nil {
+		t.Fatalf("LoadFileCache(%q) = (_, %v), want (_, nil)", cachePath, err)
+	}
+	// The cached SHA256 digests are not used for SHA1.
+	want := SHA1.FromBlob([]byte("foo"))
+	for name, c := range map[string]*FileCache{"cache": c, "loaded cache": loaded} {
+		dg, err := c.FromFile(SHA1, path)
+		if err != nil {
+			t.Fatalf("%s: c.FromFile(%q) = (_, %v), want (_, nil)", name, path, err)
+		}
+		if !Equal(dg, want) {
+			t.Errorf("%s: c.FromFile(%q) = %v, want %v", name, path, dg, want)
+		}
+	}
+}
+
+func TestFileCacheRacilyClean(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "filecache")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	// The file is rewritten with contents of the same size, keeping its modification time, as a
+	// change in the same tick of the filesystem's clock would.
+	mtime := time.Now()
+	c := NewFileCache()
+	for _, contents := range []string{"foo", "bar"} {
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("failed to set the times of %s: %v", path, err)
+		}
+		// The file was modified too recently for its digest to be cached, so the new contents are
+		// hashed.
+		dg, err := c.FromFile(SHA256, path)
+		if err != nil {
+			t.Fatalf("c.FromFile(%q) = (_, %v), want (_, nil)", path, err)
+		}
+		if want := FromBlob([]byte(contents)); !Equal(dg, want) {
+			t.Errorf("c.FromFile(%q) of a file containing %q = %v, want %v", path, contents, dg, want)
+		}
+		if len(c.entries) != 0 {
+			t.Errorf("c.FromFile(%q) of a file modified at %v cached its digest, want no entry", path, mtime)
+		}
+	}
+}